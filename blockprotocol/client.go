@@ -0,0 +1,364 @@
+package blockprotocol
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"sync"
+)
+
+var ErrClosed = errors.New("Block protocol connection is closed")
+
+/*
+Client makes requests to a Server over a single connection.
+It is safe to use from multiple goroutines, and requests are pipelined: each one is sent
+as soon as it is made, without waiting for the responses to earlier ones.
+*/
+type Client struct {
+	conn io.ReadWriteCloser
+
+	writeMutex sync.Mutex
+	writer     *bufio.Writer
+
+	mutex         sync.Mutex
+	nextRequestID uint32
+	pending       map[uint32]chan frame
+	err           error
+}
+
+// NewClient starts a connection with a server over conn, which is closed by Close
+func NewClient(conn io.ReadWriteCloser) (*Client, error) {
+	c := &Client{
+		conn:    conn,
+		writer:  bufio.NewWriter(conn),
+		pending: make(map[uint32]chan frame),
+	}
+
+	reader := bufio.NewReader(conn)
+
+	err := writeHandshake(c.writer)
+
+	if err == nil {
+		err = c.writer.Flush()
+	}
+
+	if err == nil {
+		err = readHandshake(reader)
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	go c.readLoop(reader)
+	return c, nil
+}
+
+// Dial connects to a server over TCP, using TLS if config is not nil
+func Dial(address string, config *tls.Config) (*Client, error) {
+	var conn net.Conn
+	var err error
+
+	if config != nil {
+		conn, err = tls.Dial("tcp", address, config)
+	} else {
+		conn, err = net.Dial("tcp", address)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return NewClient(conn)
+}
+
+/*
+Command starts cmd and talks to a server on its stdin and stdout, such as
+exec.Command("ssh", "host", "gosync", "serve", "--stdio", "/srv/files").
+Closing the client closes the command's stdin and waits for it to exit.
+*/
+func Command(cmd *exec.Cmd) (*Client, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return NewClient(&commandConn{cmd: cmd, stdin: stdin, stdout: stdout})
+}
+
+type commandConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.Reader
+}
+
+func (c *commandConn) Read(b []byte) (int, error) {
+	return c.stdout.Read(b)
+}
+
+func (c *commandConn) Write(b []byte) (int, error) {
+	return c.stdin.Write(b)
+}
+
+func (c *commandConn) Close() error {
+	c.stdin.Close()
+	return c.cmd.Wait()
+}
+
+// Close closes the connection, failing any outstanding requests
+func (c *Client) Close() error {
+	c.fail(ErrClosed)
+	return c.conn.Close()
+}
+
+// delivers responses to the requests that are waiting for them
+func (c *Client) readLoop(r io.Reader) {
+	for {
+		f, err := readFrame(r)
+		if err != nil {
+			if err == io.EOF {
+				err = ErrClosed
+			}
+			c.fail(err)
+			return
+		}
+
+		c.mutex.Lock()
+		response, ok := c.pending[f.RequestID]
+		delete(c.pending, f.RequestID)
+		c.mutex.Unlock()
+
+		if ok {
+			response <- f
+		} else if f.Type == frameError {
+			// an error about the connection rather than a request
+			if _, remote, err := decodeError(f); err != nil {
+				c.fail(err)
+			} else {
+				c.fail(remote)
+			}
+			return
+		}
+	}
+}
+
+// fails every outstanding and future request with err
+func (c *Client) fail(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.err == nil {
+		c.err = err
+	}
+
+	for id, response := range c.pending {
+		close(response)
+		delete(c.pending, id)
+	}
+}
+
+// sends a request and waits for its response
+func (c *Client) request(frameType uint8, parts ...[]byte) (frame, error) {
+	response := make(chan frame, 1)
+
+	c.mutex.Lock()
+	if c.err != nil {
+		c.mutex.Unlock()
+		return frame{}, c.err
+	}
+
+	c.nextRequestID++
+	id := c.nextRequestID
+	c.pending[id] = response
+	c.mutex.Unlock()
+
+	if err := c.send(frameType, id, parts...); err != nil {
+		c.fail(err)
+		return frame{}, err
+	}
+
+	f, ok := <-response
+	if !ok {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		return frame{}, c.err
+	}
+
+	if f.Type == frameError {
+		_, err, decodeErr := decodeError(f)
+		if decodeErr != nil {
+			return frame{}, decodeErr
+		}
+		return frame{}, err
+	}
+
+	return f, nil
+}
+
+func (c *Client) send(frameType uint8, requestID uint32, parts ...[]byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	if err := writeFrame(c.writer, frameType, requestID, parts...); err != nil {
+		return err
+	}
+
+	return c.writer.Flush()
+}
+
+func decodeError(f frame) (code uint16, err *ErrRemote, decodeErr error) {
+	message, decodeErr := decode(f.payload, &code)
+	if decodeErr != nil {
+		return 0, nil, decodeErr
+	}
+
+	return code, &ErrRemote{Code: code, Message: string(message)}, nil
+}
+
+/*
+Open opens a file on the server, to be read in blocks of blockSize.
+The server keeps reading the version of the file that was opened until the File is closed.
+*/
+func (c *Client) Open(path string, blockSize uint) (*File, error) {
+	if blockSize == 0 {
+		return nil, errors.New("The block size cannot be 0")
+	}
+
+	f, err := c.request(frameOpen, encode(uint32(blockSize)), []byte(path))
+	if err != nil {
+		return nil, err
+	}
+
+	file := &File{
+		client:    c,
+		blockSize: int64(blockSize),
+	}
+
+	if _, err := decode(f.payload, &file.handle, &file.size); err != nil || f.Type != frameOpened {
+		return nil, ErrProtocol
+	}
+
+	return file, nil
+}
+
+// File is a file opened on a server. It satisfies blocksources.BlockSourceRequester.
+type File struct {
+	client    *Client
+	handle    uint32
+	size      int64
+	blockSize int64
+}
+
+// Size is the size of the file when it was opened
+func (f *File) Size() int64 {
+	return f.size
+}
+
+// ReadBlocks reads the blocks from start to end (inclusive), checking them against the server's hashes
+func (f *File) ReadBlocks(start, end uint) ([]byte, error) {
+	// the server leaves out blocks past the end of the file
+	blockCount := (f.size + f.blockSize - 1) / f.blockSize
+	if int64(start) >= blockCount || end < start {
+		return nil, fmt.Errorf("Blocks %v-%v are not in the file", start, end)
+	}
+
+	if int64(end) >= blockCount {
+		end = uint(blockCount - 1)
+	}
+
+	response, err := f.client.request(frameRead, encode(f.handle, uint64(start), uint64(end)))
+	if err != nil {
+		return nil, err
+	}
+
+	var hashSize uint16
+	payload, err := decode(response.payload, &hashSize)
+
+	if err != nil || response.Type != frameBlocks || hashSize != md5.Size {
+		return nil, ErrProtocol
+	}
+
+	count := int(end - start + 1)
+	dataLength := int64(end+1)*f.blockSize - int64(start)*f.blockSize
+	if last := f.size - int64(start)*f.blockSize; dataLength > last {
+		dataLength = last
+	}
+
+	if int64(len(payload)) != int64(count*md5.Size)+dataLength {
+		return nil, ErrProtocol
+	}
+
+	hashes, data := payload[:count*md5.Size], payload[count*md5.Size:]
+
+	for i := 0; i < count; i++ {
+		blockStart := int64(i) * f.blockSize
+		blockEnd := blockStart + f.blockSize
+
+		if blockEnd > int64(len(data)) {
+			blockEnd = int64(len(data))
+		}
+
+		sum := md5.Sum(data[blockStart:blockEnd])
+		if !bytes.Equal(sum[:], hashes[i*md5.Size:(i+1)*md5.Size]) {
+			return nil, fmt.Errorf("Block %v did not match the hash sent by the server", start+uint(i))
+		}
+	}
+
+	return data, nil
+}
+
+// DoRequest reads the blocks covering a range of offsets, which must start on a block boundary
+func (f *File) DoRequest(startOffset int64, endOffset int64) (data []byte, err error) {
+	if startOffset%f.blockSize != 0 {
+		return nil, fmt.Errorf(
+			"Offset %v is not at the start of a block of %v bytes",
+			startOffset,
+			f.blockSize,
+		)
+	}
+
+	if endOffset > f.size {
+		endOffset = f.size
+	}
+
+	if endOffset <= startOffset {
+		return []byte{}, nil
+	}
+
+	data, err = f.ReadBlocks(
+		uint(startOffset/f.blockSize),
+		uint((endOffset-1)/f.blockSize),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// Every error is fatal: errors reported by the server are not going to go away by trying again
+func (f *File) IsFatal(err error) bool {
+	return true
+}
+
+// Close tells the server that the file is no longer needed
+func (f *File) Close() error {
+	return f.client.send(frameClose, 0, encode(f.handle))
+}
@@ -0,0 +1,177 @@
+/*
+Package blockprotocol is a compact binary protocol for fetching ranges of blocks from a server,
+as an alternative to HTTP range requests. It runs over any reliable stream, such as a TCP or TLS
+connection, or the stdin and stdout of a child process (for instance "ssh host gosync serve --stdio").
+
+Many requests can be outstanding on a connection at once, and the server may answer them in any order.
+Each response carries a hash of every block, computed by the server from the file it read, so that
+the client can detect corruption before the data is used.
+
+The client starts by sending the magic "GSYNCBP" and a uint8 version, and the server replies with
+the same if it supports the version. Everything after that is a frame
+(all integers little endian):
+
+	frame header: uint8 type, uint32 request ID, uint32 payload length
+
+	client to server:
+	OPEN:   uint32 block size, path of the file (the rest of the payload)
+	READ:   uint32 file handle, uint64 first block, uint64 last block (inclusive)
+	CLOSE:  uint32 file handle, and there is no response
+
+	server to client, with the request ID of the request:
+	OPENED: uint32 file handle, int64 file size
+	BLOCKS: uint16 hash length, the MD5 hash of each block, then the data of the blocks
+	ERROR:  uint16 error code, message (the rest of the payload)
+
+The last block of a file may be short, and blocks past the end of the file are not returned.
+*/
+package blockprotocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	magic   = "GSYNCBP"
+	version = uint8(1)
+)
+
+// Frame types
+const (
+	frameOpen  = uint8(1)
+	frameRead  = uint8(2)
+	frameClose = uint8(3)
+
+	frameOpened = uint8(0x81)
+	frameBlocks = uint8(0x82)
+	frameError  = uint8(0xFF)
+)
+
+// Error codes sent in ERROR frames
+const (
+	CodeBadRequest   = uint16(1)
+	CodeNotFound     = uint16(2)
+	CodeForbidden    = uint16(3)
+	CodeReadFailed   = uint16(4)
+	CodeTooLarge     = uint16(5)
+	CodeTooManyFiles = uint16(6)
+)
+
+// The largest payload that will be read, to protect against corrupt frames
+const maxPayload = 256 * 1024 * 1024
+
+var ErrProtocol = errors.New("Invalid block protocol data")
+
+// ErrRemote is an error reported by the other end of the connection in an ERROR frame
+type ErrRemote struct {
+	Code    uint16
+	Message string
+}
+
+func (e *ErrRemote) Error() string {
+	return fmt.Sprintf("Block server error %v: %v", e.Code, e.Message)
+}
+
+type frameHeader struct {
+	Type      uint8
+	RequestID uint32
+	Length    uint32
+}
+
+type frame struct {
+	frameHeader
+	payload []byte
+}
+
+func writeHandshake(w io.Writer) error {
+	_, err := w.Write(append([]byte(magic), version))
+	return err
+}
+
+func readHandshake(r io.Reader) error {
+	b := make([]byte, len(magic)+1)
+
+	if _, err := io.ReadFull(r, b); err != nil {
+		return fmt.Errorf("Error reading the block protocol handshake: %v", err)
+	}
+
+	if string(b[:len(magic)]) != magic {
+		return ErrProtocol
+	}
+
+	if v := b[len(magic)]; v != version {
+		return fmt.Errorf("Unsupported block protocol version: %v", v)
+	}
+
+	return nil
+}
+
+// writes a frame whose payload is the concatenation of parts
+func writeFrame(w io.Writer, frameType uint8, requestID uint32, parts ...[]byte) error {
+	length := 0
+	for _, p := range parts {
+		length += len(p)
+	}
+
+	err := binary.Write(w, binary.LittleEndian, frameHeader{
+		Type:      frameType,
+		RequestID: requestID,
+		Length:    uint32(length),
+	})
+
+	for _, p := range parts {
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(p)
+	}
+
+	return err
+}
+
+func readFrame(r io.Reader) (f frame, err error) {
+	if err = binary.Read(r, binary.LittleEndian, &f.frameHeader); err != nil {
+		return
+	}
+
+	if f.Length > maxPayload {
+		return f, ErrProtocol
+	}
+
+	f.payload = make([]byte, f.Length)
+	if _, err = io.ReadFull(r, f.payload); err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return
+}
+
+// encodes the fixed size values as a payload
+func encode(values ...interface{}) []byte {
+	b := bytes.NewBuffer(nil)
+	for _, v := range values {
+		binary.Write(b, binary.LittleEndian, v)
+	}
+	return b.Bytes()
+}
+
+// decodes the fixed size start of a payload into values, returning the rest
+func decode(payload []byte, values ...interface{}) ([]byte, error) {
+	r := bytes.NewReader(payload)
+
+	for _, v := range values {
+		if err := binary.Read(r, binary.LittleEndian, v); err != nil {
+			return nil, ErrProtocol
+		}
+	}
+
+	return payload[len(payload)-r.Len():], nil
+}
+
+func errorPayload(code uint16, message string) []byte {
+	return append(encode(code), message...)
+}
@@ -0,0 +1,370 @@
+package blockprotocol
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"io/ioutil"
+	"math/big"
+	mathrand "math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+const BLOCK_SIZE = 16
+
+func randomData(seed int64, size int) []byte {
+	b := make([]byte, size)
+	mathrand.New(mathrand.NewSource(seed)).Read(b)
+	return b
+}
+
+func makeRoot(t *testing.T, files map[string][]byte) string {
+	dir, err := ioutil.TempDir("", "gosync")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+// connects a client to a server for dir over an in-memory connection,
+// with wrap applied to the server's end
+func connect(t *testing.T, server *Server, wrap func(net.Conn) net.Conn) *Client {
+	clientConn, serverConn := net.Pipe()
+
+	go func() {
+		defer serverConn.Close()
+
+		if wrap != nil {
+			serverConn = wrap(serverConn)
+		}
+		server.ServeConn(serverConn)
+	}()
+
+	client, err := NewClient(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client
+}
+
+func TestReadBlocks(t *testing.T) {
+	content := randomData(1, 1000)
+	dir := makeRoot(t, map[string][]byte{"file": content})
+	defer os.RemoveAll(dir)
+
+	client := connect(t, &Server{Root: dir}, nil)
+	defer client.Close()
+
+	file, err := client.Open("/file", BLOCK_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if file.Size() != 1000 {
+		t.Errorf("Unexpected size: %v", file.Size())
+	}
+
+	for _, r := range [][2]int64{{0, 1000}, {16, 48}, {992, 1000}, {0, 16}, {512, 2000}} {
+		data, err := file.DoRequest(r[0], r[1])
+		if err != nil {
+			t.Fatalf("Error reading %v: %v", r, err)
+		}
+
+		end := r[1]
+		if end > 1000 {
+			end = 1000
+		}
+
+		if !bytes.Equal(data, content[r[0]:end]) {
+			t.Errorf("Unexpected content for %v", r)
+		}
+	}
+
+	if _, err := file.DoRequest(5, 16); err == nil {
+		t.Error("Expected an error reading from the middle of a block")
+	}
+}
+
+func TestPipelinedRequests(t *testing.T) {
+	content := randomData(2, 100000)
+	dir := makeRoot(t, map[string][]byte{"file": content})
+	defer os.RemoveAll(dir)
+
+	client := connect(t, &Server{Root: dir, Concurrency: 4}, nil)
+	defer client.Close()
+
+	file, err := client.Open("file", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg := sync.WaitGroup{}
+	errors := make(chan error, 100)
+
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+
+		go func(block int64) {
+			defer wg.Done()
+
+			data, err := file.DoRequest(block*1000, (block+1)*1000)
+			if err == nil && !bytes.Equal(data, content[block*1000:(block+1)*1000]) {
+				t.Errorf("Unexpected content for block %v", block)
+			}
+
+			errors <- err
+		}(int64(i))
+	}
+
+	wg.Wait()
+	close(errors)
+
+	for err := range errors {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestErrorFrames(t *testing.T) {
+	dir := makeRoot(t, map[string][]byte{"file": randomData(3, 1000)})
+	defer os.RemoveAll(dir)
+
+	client := connect(t, &Server{Root: dir, MaxReadSize: 100}, nil)
+	defer client.Close()
+
+	for _, name := range []string{"missing", "/"} {
+		_, err := client.Open(name, BLOCK_SIZE)
+
+		if remote, ok := err.(*ErrRemote); !ok || remote.Code != CodeNotFound {
+			t.Errorf("Expected %v to be not found, got: %v", name, err)
+		}
+	}
+
+	file, err := client.Open("file", BLOCK_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := file.DoRequest(0, 1000); err == nil {
+		t.Error("Expected a read larger than MaxReadSize to fail")
+	} else if remote, ok := err.(*ErrRemote); !ok || remote.Code != CodeTooLarge {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// the connection is still usable after an error
+	if _, err := file.DoRequest(0, 96); err != nil {
+		t.Error(err)
+	}
+}
+
+// corrupts the last byte of large writes, which are the data of BLOCKS frames
+type corruptingConn struct {
+	net.Conn
+}
+
+func (c *corruptingConn) Write(b []byte) (int, error) {
+	if len(b) > 500 {
+		b = append([]byte{}, b...)
+		b[len(b)-1] ^= 0xFF
+	}
+	return c.Conn.Write(b)
+}
+
+func TestCorruptBlocksAreDetected(t *testing.T) {
+	dir := makeRoot(t, map[string][]byte{"file": randomData(4, 1000)})
+	defer os.RemoveAll(dir)
+
+	client := connect(t, &Server{Root: dir}, func(c net.Conn) net.Conn {
+		return &corruptingConn{c}
+	})
+	defer client.Close()
+
+	file, err := client.Open("file", BLOCK_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := file.DoRequest(0, 1000); err == nil {
+		t.Error("Expected corrupted data to be detected")
+	}
+}
+
+func TestClosedConnectionFailsRequests(t *testing.T) {
+	dir := makeRoot(t, map[string][]byte{"file": randomData(5, 1000)})
+	defer os.RemoveAll(dir)
+
+	client := connect(t, &Server{Root: dir}, nil)
+
+	file, err := client.Open("file", BLOCK_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.Close()
+
+	if _, err := file.DoRequest(0, 16); err != ErrClosed {
+		t.Errorf("Expected ErrClosed, got: %v", err)
+	}
+}
+
+func makeCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestTLS(t *testing.T) {
+	content := randomData(6, 1000)
+	dir := makeRoot(t, map[string][]byte{"file": content})
+	defer os.RemoveAll(dir)
+
+	certificate, pool := makeCertificate(t)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{certificate}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go (&Server{Root: dir}).Serve(listener)
+
+	client, err := Dial(listener.Addr().String(), &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	file, err := client.Open("file", BLOCK_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := file.DoRequest(0, 1000); err != nil || !bytes.Equal(data, content) {
+		t.Errorf("Unexpected result: %v", err)
+	}
+}
+
+// TestHelperProcess is not a real test: it is the server started by TestCommand
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("GOSYNC_BLOCK_SERVER") == "" {
+		return
+	}
+
+	(&Server{Root: os.Getenv("GOSYNC_BLOCK_SERVER")}).ServeConn(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout})
+
+	os.Exit(0)
+}
+
+func TestCommand(t *testing.T) {
+	content := randomData(7, 1000)
+	dir := makeRoot(t, map[string][]byte{"file": content})
+	defer os.RemoveAll(dir)
+
+	cmd := exec.Command(os.Args[0], "-test.run=TestHelperProcess")
+	cmd.Env = append(os.Environ(), "GOSYNC_BLOCK_SERVER="+dir)
+
+	client, err := Command(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := client.Open("file", BLOCK_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := file.DoRequest(0, 1000); err != nil || !bytes.Equal(data, content) {
+		t.Errorf("Unexpected result: %v", err)
+	}
+
+	if err := client.Close(); err != nil {
+		t.Errorf("Server process did not exit cleanly: %v", err)
+	}
+}
+
+func TestOpenFilesAreLimited(t *testing.T) {
+	dir := makeRoot(t, map[string][]byte{"file": randomData(9, 100)})
+	defer os.RemoveAll(dir)
+
+	client := connect(t, &Server{Root: dir, MaxOpenFiles: 2}, nil)
+	defer client.Close()
+
+	var files []*File
+	for i := 0; i < 2; i++ {
+		file, err := client.Open("file", BLOCK_SIZE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+
+	_, err := client.Open("file", BLOCK_SIZE)
+	if remote, ok := err.(*ErrRemote); !ok || remote.Code != CodeTooManyFiles {
+		t.Fatalf("Expected too many files, got: %v", err)
+	}
+
+	// the files that are open can still be read
+	if _, err := files[0].DoRequest(0, BLOCK_SIZE); err != nil {
+		t.Error(err)
+	}
+
+	// and closing one allows another to be opened
+	if err := files[1].Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Open("file", BLOCK_SIZE); err != nil {
+		t.Errorf("Could not open a file after closing one: %v", err)
+	}
+}
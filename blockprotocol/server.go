@@ -0,0 +1,351 @@
+package blockprotocol
+
+import (
+	"bufio"
+	"crypto/md5"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+)
+
+// DefaultMaxReadSize is the largest READ that a server answers, when MaxReadSize is not set
+const DefaultMaxReadSize = 16 * 1024 * 1024
+
+// DefaultMaxOpenFiles is the number of files a connection may have open, when MaxOpenFiles is not set
+const DefaultMaxOpenFiles = 64
+
+// DefaultConcurrency is the number of requests a server reads at once on a connection, when Concurrency is not set
+const DefaultConcurrency = 8
+
+/*
+Server serves the blocks of the files under Root.
+
+A file stays open from OPEN until CLOSE or the end of the connection, so every block read
+through a handle comes from the same version of the file, even if it is replaced by renaming
+another file over it.
+*/
+type Server struct {
+	Root string
+
+	// The largest number of bytes that a single READ may ask for
+	MaxReadSize int64
+
+	// The number of requests read from files at once on each connection
+	Concurrency int
+
+	// The number of files that each connection may have open at once.
+	// Further OPEN requests get a CodeTooManyFiles error until a file is closed.
+	MaxOpenFiles int
+}
+
+// Serve accepts connections from l and serves each of them, until l fails
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			defer conn.Close()
+			s.ServeConn(conn)
+		}()
+	}
+}
+
+/*
+ServeConn serves requests from conn until it is closed or there is a protocol error.
+A connection that is closed between frames is not an error.
+*/
+func (s *Server) ServeConn(conn io.ReadWriter) error {
+	c := &serverConn{
+		server:  s,
+		reader:  bufio.NewReader(conn),
+		writer:  bufio.NewWriter(conn),
+		files:   make(map[uint32]*openFile),
+		limiter: make(chan struct{}, s.concurrency()),
+	}
+
+	defer c.close()
+
+	// the client sends its handshake first
+	if err := readHandshake(c.reader); err != nil {
+		return err
+	}
+
+	if err := writeHandshake(c.writer); err != nil {
+		return err
+	}
+
+	if err := c.writer.Flush(); err != nil {
+		return err
+	}
+
+	for {
+		f, err := readFrame(c.reader)
+
+		if err == io.EOF {
+			return nil
+		} else if err == ErrProtocol {
+			c.sendError(f.RequestID, CodeTooLarge, "Frame is too large")
+			return err
+		} else if err != nil {
+			return err
+		}
+
+		switch f.Type {
+		case frameOpen:
+			c.open(f)
+		case frameRead:
+			c.limiter <- struct{}{}
+			c.pending.Add(1)
+
+			go func() {
+				defer func() {
+					<-c.limiter
+					c.pending.Done()
+				}()
+				c.read(f)
+			}()
+		case frameClose:
+			c.closeFile(f)
+		default:
+			c.sendError(f.RequestID, CodeBadRequest, "Unknown frame type")
+		}
+
+		if c.writeErr() != nil {
+			return c.writeErr()
+		}
+	}
+}
+
+func (s *Server) maxReadSize() int64 {
+	if s.MaxReadSize > 0 {
+		return s.MaxReadSize
+	}
+	return DefaultMaxReadSize
+}
+
+func (s *Server) maxOpenFiles() int {
+	if s.MaxOpenFiles > 0 {
+		return s.MaxOpenFiles
+	}
+	return DefaultMaxOpenFiles
+}
+
+func (s *Server) concurrency() int {
+	if s.Concurrency > 0 {
+		return s.Concurrency
+	}
+	return DefaultConcurrency
+}
+
+type openFile struct {
+	file      *os.File
+	size      int64
+	blockSize int64
+
+	// reads in progress, which must finish before the file is closed
+	reads sync.WaitGroup
+}
+
+type serverConn struct {
+	server  *Server
+	reader  *bufio.Reader
+	limiter chan struct{}
+	pending sync.WaitGroup
+
+	filesMutex sync.Mutex
+	files      map[uint32]*openFile
+	nextHandle uint32
+
+	writeMutex sync.Mutex
+	writer     *bufio.Writer
+	err        error
+}
+
+func (c *serverConn) close() {
+	c.pending.Wait()
+
+	c.filesMutex.Lock()
+	defer c.filesMutex.Unlock()
+
+	for _, f := range c.files {
+		f.file.Close()
+	}
+}
+
+// sends a frame, recording the first error
+func (c *serverConn) send(frameType uint8, requestID uint32, parts ...[]byte) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	if c.err != nil {
+		return
+	}
+
+	if c.err = writeFrame(c.writer, frameType, requestID, parts...); c.err == nil {
+		c.err = c.writer.Flush()
+	}
+}
+
+func (c *serverConn) sendError(requestID uint32, code uint16, message string) {
+	c.send(frameError, requestID, errorPayload(code, message))
+}
+
+func (c *serverConn) writeErr() error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return c.err
+}
+
+func (c *serverConn) open(f frame) {
+	var blockSize uint32
+
+	name, err := decode(f.payload, &blockSize)
+	if err != nil || blockSize == 0 {
+		c.sendError(f.RequestID, CodeBadRequest, "Invalid OPEN request")
+		return
+	}
+
+	c.filesMutex.Lock()
+	openCount := len(c.files)
+	c.filesMutex.Unlock()
+
+	// OPEN is handled in the order frames are read, so nothing is opened between checking and opening
+	if openCount >= c.server.maxOpenFiles() {
+		c.sendError(f.RequestID, CodeTooManyFiles, "Too many open files")
+		return
+	}
+
+	// cleaning a rooted path removes any ".." elements
+	cleaned := path.Clean("/" + string(name))
+	file, err := os.Open(filepath.Join(c.server.Root, filepath.FromSlash(cleaned)))
+
+	var info os.FileInfo
+	if err == nil {
+		if info, err = file.Stat(); err == nil && !info.Mode().IsRegular() {
+			err = os.ErrNotExist
+		}
+
+		if err != nil {
+			file.Close()
+		}
+	}
+
+	switch {
+	case os.IsNotExist(err):
+		c.sendError(f.RequestID, CodeNotFound, "Not found: "+cleaned)
+		return
+	case os.IsPermission(err):
+		c.sendError(f.RequestID, CodeForbidden, "Forbidden: "+cleaned)
+		return
+	case err != nil:
+		c.sendError(f.RequestID, CodeReadFailed, "Could not open "+cleaned)
+		return
+	}
+
+	c.filesMutex.Lock()
+	c.nextHandle++
+	handle := c.nextHandle
+	c.files[handle] = &openFile{
+		file:      file,
+		size:      info.Size(),
+		blockSize: int64(blockSize),
+	}
+	c.filesMutex.Unlock()
+
+	c.send(frameOpened, f.RequestID, encode(handle, info.Size()))
+}
+
+// gets an open file to read from, which must be released with file.reads.Done()
+func (c *serverConn) getFile(handle uint32) *openFile {
+	c.filesMutex.Lock()
+	defer c.filesMutex.Unlock()
+
+	file := c.files[handle]
+	if file != nil {
+		file.reads.Add(1)
+	}
+	return file
+}
+
+func (c *serverConn) closeFile(f frame) {
+	var handle uint32
+	if _, err := decode(f.payload, &handle); err != nil {
+		c.sendError(f.RequestID, CodeBadRequest, "Invalid CLOSE request")
+		return
+	}
+
+	c.filesMutex.Lock()
+	file := c.files[handle]
+	delete(c.files, handle)
+	c.filesMutex.Unlock()
+
+	if file != nil {
+		go func() {
+			file.reads.Wait()
+			file.file.Close()
+		}()
+	}
+}
+
+func (c *serverConn) read(f frame) {
+	var handle uint32
+	var start, end uint64
+
+	if _, err := decode(f.payload, &handle, &start, &end); err != nil || end < start {
+		c.sendError(f.RequestID, CodeBadRequest, "Invalid READ request")
+		return
+	}
+
+	file := c.getFile(handle)
+	if file == nil {
+		c.sendError(f.RequestID, CodeBadRequest, "Unknown file handle")
+		return
+	}
+	defer file.reads.Done()
+
+	blockCount := (file.size + file.blockSize - 1) / file.blockSize
+	if start >= uint64(blockCount) {
+		c.sendError(f.RequestID, CodeBadRequest, "Blocks are past the end of the file")
+		return
+	}
+
+	if end >= uint64(blockCount) {
+		end = uint64(blockCount - 1)
+	}
+
+	startOffset := int64(start) * file.blockSize
+	endOffset := int64(end+1) * file.blockSize
+	if endOffset > file.size {
+		endOffset = file.size
+	}
+
+	if endOffset-startOffset > c.server.maxReadSize() {
+		c.sendError(f.RequestID, CodeTooLarge, "READ is larger than the server allows")
+		return
+	}
+
+	data := make([]byte, endOffset-startOffset)
+	if _, err := file.file.ReadAt(data, startOffset); err != nil {
+		c.sendError(f.RequestID, CodeReadFailed, "Could not read the file: "+err.Error())
+		return
+	}
+
+	hashes := make([]byte, 0, int(end-start+1)*md5.Size)
+	for i := int64(0); i < int64(len(data)); i += file.blockSize {
+		blockEnd := i + file.blockSize
+		if blockEnd > int64(len(data)) {
+			blockEnd = int64(len(data))
+		}
+
+		sum := md5.Sum(data[i:blockEnd])
+		hashes = append(hashes, sum[:]...)
+	}
+
+	c.send(frameBlocks, f.RequestID, encode(uint16(md5.Size)), hashes, data)
+}
@@ -78,6 +78,12 @@ type BlockSourceBase struct {
 	// (requested + pending delivery)
 	ConcurrentBytes int64
 
+	// If set, responses are verified on the goroutine that made the request
+	// rather than the one delivering responses, so that hashing large
+	// spans does not hold up delivery. The Verifier must then support
+	// concurrent calls. Set this before requesting any blocks.
+	ConcurrentVerification bool
+
 	hasQuit         bool
 	exitChannel     chan bool
 	errorChannel    chan error
@@ -161,6 +167,8 @@ func (s *BlockSourceBase) loop() {
 
 			requestOrdering = append(requestOrdering, nextRequest.StartBlockID)
 			sort.Sort(sort.Reverse(requestOrdering))
+			verifyInRequest := s.ConcurrentVerification && s.Verifier != nil
+
 			go func() {
 				resolver := s.BlockSourceResolver
 
@@ -177,11 +185,20 @@ func (s *BlockSourceBase) loop() {
 					endOffset,
 				)
 
+				if err == nil && verifyInRequest {
+					err = s.verify(
+						nextRequest.StartBlockID,
+						nextRequest.EndBlockID,
+						result,
+					)
+				}
+
 				resultChan <- asyncResult{
 					startBlockID: nextRequest.StartBlockID,
 					endBlockID:   nextRequest.EndBlockID,
 					data:         result,
 					err:          err,
+					verified:     verifyInRequest,
 				}
 			}()
 
@@ -213,16 +230,13 @@ func (s *BlockSourceBase) loop() {
 
 			s.bytesRequested += int64(len(result.data))
 
-			if s.Verifier != nil && !s.Verifier.VerifyBlockRange(result.startBlockID, result.data) {
-				pendingErrors.setError(
-					fmt.Errorf(
-						"The returned block range (%v-%v) did not match the expected checksum for the blocks",
-						result.startBlockID, result.endBlockID,
-					),
-				)
-				pendingResponse.clear()
-				state = STATE_EXITING
-				break
+			if !result.verified {
+				if err := s.verify(result.startBlockID, result.endBlockID, result.data); err != nil {
+					pendingErrors.setError(err)
+					pendingResponse.clear()
+					state = STATE_EXITING
+					break
+				}
 			}
 
 			responseOrdering = append(responseOrdering,
@@ -269,3 +283,15 @@ func (s *BlockSourceBase) loop() {
 		}
 	}
 }
+
+// verify checks the data for a block range, if there is a Verifier
+func (s *BlockSourceBase) verify(startBlockID, endBlockID uint, data []byte) error {
+	if s.Verifier == nil || s.Verifier.VerifyBlockRange(startBlockID, data) {
+		return nil
+	}
+
+	return fmt.Errorf(
+		"The returned block range (%v-%v) did not match the expected checksum for the blocks",
+		startBlockID, endBlockID,
+	)
+}
@@ -301,3 +301,50 @@ func TestRequestCountLimiting(t *testing.T) {
 		t.Errorf("Total number of requests is not expected: %v", call_counter)
 	}
 }
+
+//-----------------------------------------------------------------------------
+type FunctionVerifier func(startBlockID uint, data []byte) bool
+
+func (f FunctionVerifier) VerifyBlockRange(startBlockID uint, data []byte) bool {
+	return f(startBlockID, data)
+}
+
+func TestConcurrentVerificationError(t *testing.T) {
+	b := NewBlockSourceBase(
+		FunctionRequester(func(start, end int64) (data []byte, err error) {
+			return []byte("test"), nil
+		}),
+		MakeNullFixedSizeResolver(4),
+		FunctionVerifier(func(startBlockID uint, data []byte) bool {
+			return startBlockID != 1
+		}),
+		2,
+		1024,
+	)
+	b.ConcurrentVerification = true
+	defer b.Close()
+
+	b.RequestBlocks(patcher.MissingBlockSpan{
+		BlockSize:  4,
+		StartBlock: 0,
+		EndBlock:   0,
+	})
+
+	b.RequestBlocks(patcher.MissingBlockSpan{
+		BlockSize:  4,
+		StartBlock: 1,
+		EndBlock:   1,
+	})
+
+	if r := <-b.GetResultChannel(); r.StartBlock != 0 {
+		t.Errorf("Wrong start block: %v", r.StartBlock)
+	}
+
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for verification error")
+	case r := <-b.GetResultChannel():
+		t.Fatalf("Unverified block was delivered: %v", r.StartBlock)
+	case <-b.EncounteredError():
+	}
+}
@@ -0,0 +1,186 @@
+package blocksources
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/Redundancy/go-sync/delta"
+)
+
+/*
+DeltaRequester gets the blocks of a reference from a server that creates deltas (such as
+server.DeltaHandler), rather than by requesting ranges of the reference.
+
+On the first request, the signature of the local file is posted to the URL of the reference,
+and the data of the delta in the response is written to a temporary file in tempDir
+(the default temporary directory if empty). Every block is then read from the local file
+or the delta data, so the only transfer is the signature and the data missing from the local file.
+
+The delta is checked as it is read, so a server cannot make it hold more data than
+the size of the reference that it declares. Close removes the temporary file.
+*/
+type DeltaRequester struct {
+	url       string
+	options   HttpOptions
+	local     io.ReaderAt
+	localSize int64
+	blockSize uint
+	tempDir   string
+
+	once   sync.Once
+	patch  *delta.Patch
+	reader io.ReaderAt
+	err    error
+}
+
+// NewDeltaRequester requests a delta from url against the local file of localSize bytes,
+// using a signature with blocks of blockSize. The delta data is kept in a temporary file in tempDir.
+func NewDeltaRequester(
+	url string,
+	local io.ReaderAt,
+	localSize int64,
+	blockSize uint,
+	tempDir string,
+	options HttpOptions,
+) *DeltaRequester {
+	return &DeltaRequester{
+		url:       url,
+		options:   options,
+		local:     local,
+		localSize: localSize,
+		blockSize: blockSize,
+		tempDir:   tempDir,
+	}
+}
+
+/*
+NewDeltaBlockSource creates a BlockSource for the reference at url, whose blocks of blockSize
+are built from the local file and a delta from the server.
+
+Since the blocks come from a delta, the local file must not change until patching is done.
+The requester must be closed once the source is no longer used.
+*/
+func NewDeltaBlockSource(
+	url string,
+	local io.ReaderAt,
+	localSize int64,
+	blockSize uint,
+	tempDir string,
+	options HttpOptions,
+) (*BlockSourceBase, *DeltaRequester) {
+	requester := NewDeltaRequester(url, local, localSize, blockSize, tempDir, options)
+
+	source := NewBlockSourceBase(
+		requester,
+		&FixedSizeBlockResolver{BlockSize: uint64(blockSize)},
+		nil,
+		1,
+		8*MB,
+	)
+
+	return source, requester
+}
+
+// Patch gets the delta from the server, if it has not already been fetched
+func (r *DeltaRequester) Patch() (*delta.Patch, error) {
+	r.once.Do(func() {
+		r.patch, r.err = r.fetch()
+
+		if r.err == nil {
+			r.reader = r.patch.Reader(r.local)
+		}
+	})
+
+	return r.patch, r.err
+}
+
+func (r *DeltaRequester) fetch() (*delta.Patch, error) {
+	signature := bytes.NewBuffer(nil)
+
+	err := delta.WriteSignature(
+		signature,
+		io.NewSectionReader(r.local, 0, r.localSize),
+		r.localSize,
+		r.blockSize,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("Could not create the signature of the local file: %v", err)
+	}
+
+	request, err := http.NewRequest(http.MethodPost, r.url, bytes.NewReader(signature.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Set("Content-Type", "application/octet-stream")
+
+	response, err := r.options.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, URLNotFoundError(r.url)
+	default:
+		return nil, fmt.Errorf("Error requesting a delta from %v: %v", r.url, response.Status)
+	}
+
+	if etag := r.options.ExpectedETag; etag != "" && response.Header.Get("ETag") != etag {
+		return nil, &ErrReferenceChanged{
+			URL:      r.url,
+			Expected: etag,
+			Received: response.Header.Get("ETag"),
+		}
+	}
+
+	return delta.Decode(response.Body, r.tempDir)
+}
+
+// Close removes the delta data, if the delta was fetched
+func (r *DeltaRequester) Close() error {
+	// makes sure that a later fetch cannot leave a file behind
+	r.once.Do(func() {
+		r.err = errors.New("The delta requester is closed")
+	})
+
+	if r.patch == nil {
+		return nil
+	}
+
+	return r.patch.Close()
+}
+
+func (r *DeltaRequester) DoRequest(startOffset int64, endOffset int64) (data []byte, err error) {
+	patch, err := r.Patch()
+	if err != nil {
+		return nil, err
+	}
+
+	if endOffset > patch.FileSize {
+		endOffset = patch.FileSize
+	}
+
+	if startOffset > endOffset {
+		startOffset = endOffset
+	}
+
+	data = make([]byte, endOffset-startOffset)
+	if _, err = r.reader.ReadAt(data, startOffset); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// Every error is fatal, since the delta is only requested once
+func (r *DeltaRequester) IsFatal(err error) bool {
+	return true
+}
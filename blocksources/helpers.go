@@ -89,6 +89,8 @@ type asyncResult struct {
 	endBlockID   uint
 	data         []byte
 	err          error
+	// already checked by the verifier
+	verified bool
 }
 
 type QueuedRequest struct {
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"sync"
 )
 
 const MB = 1024 * 1024
@@ -23,15 +24,33 @@ func NewHttpBlockSource(
 	resolver BlockSourceOffsetResolver,
 	verifier BlockVerifier,
 ) *BlockSourceBase {
-	return NewBlockSourceBase(
-		&HttpRequester{
-			url:    url,
-			client: http.DefaultClient,
-		},
+	return NewHttpBlockSourceWithOptions(
+		url,
+		concurrentRequests,
 		resolver,
 		verifier,
-		concurrentRequests,
-		4*MB,
+		HttpOptions{},
+	)
+}
+
+/*
+ErrReferenceChanged is returned when a response shows that the reference file is not the
+version that earlier responses came from, so that blocks from different versions are never mixed.
+*/
+type ErrReferenceChanged struct {
+	URL string
+	// The ETag or Last-Modified value of the first response
+	Expected string
+	// The value of the response that did not match, which may be empty
+	Received string
+}
+
+func (e *ErrReferenceChanged) Error() string {
+	return fmt.Sprintf(
+		"The reference file %v changed while it was being read (expected version %v, got %v)",
+		e.URL,
+		e.Expected,
+		e.Received,
 	)
 }
 
@@ -44,9 +63,87 @@ func (url URLNotFoundError) Error() string {
 // This class provides the implementation of BlockSourceRequester for BlockSourceBase
 // this simplifies creating new BlockSources that satisfy the requirements down to
 // writing a request function
+//
+// The ETag and Last-Modified headers of the first response are recorded, and later requests
+// are made conditional on them, so that a reference file that changes between requests
+// results in an ErrReferenceChanged rather than a mix of versions.
 type HttpRequester struct {
-	client *http.Client
-	url    string
+	client  *http.Client
+	url     string
+	options HttpOptions
+
+	mutex        sync.Mutex
+	etag         string
+	lastModified string
+}
+
+// the recorded validators, if there has been a response
+func (r *HttpRequester) validators() (etag, lastModified string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.etag, r.lastModified
+}
+
+// sets the conditional headers for the version of the file seen so far
+func (r *HttpRequester) setConditions(request *http.Request) (conditional bool) {
+	etag, lastModified := r.validators()
+
+	switch {
+	case isStrongETag(etag):
+		// If-Match fails with a 412 if the file changed, and If-Range makes
+		// servers that ignore If-Match send the whole file rather than the range
+		request.Header.Set("If-Match", etag)
+		request.Header.Set("If-Range", etag)
+	case lastModified != "":
+		// weak ETags cannot be used with If-Range, so fall back on the date
+		request.Header.Set("If-Range", lastModified)
+	default:
+		return false
+	}
+
+	return true
+}
+
+// records the validators of the first response, and checks that later responses match them
+func (r *HttpRequester) checkVersion(response *http.Response) error {
+	etag := response.Header.Get("ETag")
+	lastModified := response.Header.Get("Last-Modified")
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.etag == "" && r.lastModified == "" {
+		r.etag = etag
+		r.lastModified = lastModified
+		return nil
+	}
+
+	if r.etag != "" && etag != r.etag {
+		return &ErrReferenceChanged{URL: r.url, Expected: r.etag, Received: etag}
+	}
+
+	if r.etag == "" && lastModified != r.lastModified {
+		return &ErrReferenceChanged{URL: r.url, Expected: r.lastModified, Received: lastModified}
+	}
+
+	return nil
+}
+
+// the error for a response to a conditional request that failed
+func (r *HttpRequester) changed(response *http.Response) error {
+	expected, lastModified := r.validators()
+	received := response.Header.Get("ETag")
+
+	if !isStrongETag(expected) {
+		expected = lastModified
+		received = response.Header.Get("Last-Modified")
+	}
+
+	return &ErrReferenceChanged{URL: r.url, Expected: expected, Received: received}
+}
+
+func isStrongETag(etag string) bool {
+	return etag != "" && !strings.HasPrefix(etag, "W/")
 }
 
 func (r *HttpRequester) DoRequest(startOffset int64, endOffset int64) (data []byte, err error) {
@@ -60,7 +157,8 @@ func (r *HttpRequester) DoRequest(startOffset int64, endOffset int64) (data []by
 	rangedRequest.ProtoAtLeast(1, 1)
 	rangedRequest.Header.Add("Range", rangeSpecifier)
 	rangedRequest.Header.Add("Accept-Encoding", "identity")
-	rangedResponse, err := r.client.Do(rangedRequest)
+	conditional := r.setConditions(rangedRequest)
+	rangedResponse, err := r.options.doWithClient(r.client, rangedRequest)
 
 	if err != nil {
 		return nil, fmt.Errorf("Error executing request for \"%v\": %v", r.url, err)
@@ -70,6 +168,10 @@ func (r *HttpRequester) DoRequest(startOffset int64, endOffset int64) (data []by
 
 	if rangedResponse.StatusCode == 404 {
 		return nil, URLNotFoundError(r.url)
+	} else if conditional && (rangedResponse.StatusCode == http.StatusPreconditionFailed ||
+		rangedResponse.StatusCode == http.StatusOK) {
+		// If-Match fails, or If-Range gives the whole file, when the file has changed
+		return nil, r.changed(rangedResponse)
 	} else if rangedResponse.StatusCode != 206 {
 		return nil, RangedRequestNotSupportedError
 	} else if strings.Contains(
@@ -77,6 +179,8 @@ func (r *HttpRequester) DoRequest(startOffset int64, endOffset int64) (data []by
 		"gzip",
 	) {
 		return nil, ResponseFromServerWasGZiped
+	} else if err = r.checkVersion(rangedResponse); err != nil {
+		return nil, err
 	} else {
 		buf := bytes.NewBuffer(make([]byte, 0, endOffset-startOffset))
 		_, err = buf.ReadFrom(rangedResponse.Body)
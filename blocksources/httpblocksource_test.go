@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -19,22 +20,25 @@ var TEST_CONTENT = []byte("This is test content used for evaluation of the unit
 var content = bytes.NewReader(TEST_CONTENT)
 var LOCAL_URL = ""
 
+// the content does not change while the tests run
+var CONTENT_MOD_TIME = time.Now()
+
 func handler(w http.ResponseWriter, req *http.Request) {
-	http.ServeContent(w, req, "", time.Now(), content)
+	http.ServeContent(w, req, "", CONTENT_MOD_TIME, content)
 }
 
 var PARTIAL_CONTENT = []byte("abcdef")
 var partialContent = bytes.NewReader(PARTIAL_CONTENT)
 
 func partialContentHandler(w http.ResponseWriter, req *http.Request) {
-	http.ServeContent(w, req, "", time.Now(), partialContent)
+	http.ServeContent(w, req, "", CONTENT_MOD_TIME, partialContent)
 }
 
 var CORRUPT_CONTENT = []byte("sfdfsfhhrtertert sffsfsdfsdfsdf")
 var corruptContent = bytes.NewReader(CORRUPT_CONTENT)
 
 func corruptContentHandler(w http.ResponseWriter, req *http.Request) {
-	http.ServeContent(w, req, "", time.Now(), corruptContent)
+	http.ServeContent(w, req, "", CONTENT_MOD_TIME, corruptContent)
 }
 
 // set up a http server locally that will respond predictably to ranged requests
@@ -249,3 +253,96 @@ func TestHttpBlockSourceVerification(t *testing.T) {
 		t.Fatalf("Timeout waiting for result")
 	}
 }
+
+// serves one of two versions of a file, with the validators given
+type versionedHandler struct {
+	version      int
+	etags        []string
+	modTimes     []time.Time
+	ignoreChecks bool
+}
+
+func (h *versionedHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if h.etags != nil {
+		w.Header().Set("ETag", h.etags[h.version])
+	}
+
+	if h.ignoreChecks {
+		req.Header.Del("If-Match")
+		req.Header.Del("If-Range")
+	}
+
+	content := []byte(fmt.Sprintf("%v: %s", h.version, TEST_CONTENT))
+	http.ServeContent(w, req, "", h.modTimes[h.version], bytes.NewReader(content))
+}
+
+func requestTwoVersions(t *testing.T, h *versionedHandler) error {
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	r := &HttpRequester{url: server.URL, client: http.DefaultClient}
+
+	if _, err := r.DoRequest(0, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.DoRequest(4, 8); err != nil {
+		t.Fatalf("Unchanged file returned an error: %v", err)
+	}
+
+	h.version = 1
+	_, err := r.DoRequest(8, 12)
+	return err
+}
+
+func TestChangedETagIsDetected(t *testing.T) {
+	now := time.Now()
+
+	err := requestTwoVersions(t, &versionedHandler{
+		etags:    []string{`"a"`, `"b"`},
+		modTimes: []time.Time{now, now},
+	})
+
+	if e, ok := err.(*ErrReferenceChanged); !ok || e.Expected != `"a"` {
+		t.Errorf("Expected the reference to have changed, got: %v", err)
+	}
+}
+
+func TestChangedETagIsDetectedWhenServerIgnoresConditions(t *testing.T) {
+	now := time.Now()
+
+	err := requestTwoVersions(t, &versionedHandler{
+		etags:        []string{`"a"`, `"b"`},
+		modTimes:     []time.Time{now, now},
+		ignoreChecks: true,
+	})
+
+	if e, ok := err.(*ErrReferenceChanged); !ok || e.Received != `"b"` {
+		t.Errorf("Expected the reference to have changed, got: %v", err)
+	}
+}
+
+func TestChangedModificationTimeIsDetected(t *testing.T) {
+	now := time.Now()
+
+	err := requestTwoVersions(t, &versionedHandler{
+		modTimes: []time.Time{now, now.Add(time.Hour)},
+	})
+
+	if _, ok := err.(*ErrReferenceChanged); !ok {
+		t.Errorf("Expected the reference to have changed, got: %v", err)
+	}
+}
+
+func TestWeakETagFallsBackOnModificationTime(t *testing.T) {
+	now := time.Now()
+
+	err := requestTwoVersions(t, &versionedHandler{
+		etags:    []string{`W/"a"`, `W/"a"`},
+		modTimes: []time.Time{now, now.Add(time.Hour)},
+	})
+
+	if _, ok := err.(*ErrReferenceChanged); !ok {
+		t.Errorf("Expected the reference to have changed, got: %v", err)
+	}
+}
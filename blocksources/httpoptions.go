@@ -0,0 +1,107 @@
+package blocksources
+
+import (
+	"net/http"
+	"net/url"
+)
+
+/*
+HttpOptions configures the requests made by an HttpRequester.
+The zero value uses http.DefaultClient with no extra headers.
+*/
+type HttpOptions struct {
+	// The client to make requests with. If set, Transport and Proxy are ignored.
+	Client *http.Client
+
+	// Used to make requests when there is no Client, for example to set up TLS
+	// with a custom CA bundle or client certificates
+	Transport http.RoundTripper
+
+	// Chooses the proxy for each request when there is no Client or Transport,
+	// such as http.ProxyURL. If nil, the environment is used as http.DefaultTransport does.
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// Headers added to every request
+	Header http.Header
+
+	// Called before every request to get headers that may change, such as
+	// a bearer token that has to be refreshed. The result replaces any headers of the same name.
+	HeaderFunc func() (http.Header, error)
+
+	// Sent as the User-Agent header, if set
+	UserAgent string
+
+	// The ETag that the reference is expected to have. If set, it is used to check
+	// the very first response, rather than taking the ETag from it.
+	ExpectedETag string
+}
+
+func (o *HttpOptions) client() *http.Client {
+	switch {
+	case o.Client != nil:
+		return o.Client
+	case o.Transport != nil:
+		return &http.Client{Transport: o.Transport}
+	case o.Proxy != nil:
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Proxy = o.Proxy
+		return &http.Client{Transport: transport}
+	default:
+		return http.DefaultClient
+	}
+}
+
+// Do sends a request with the configured client and headers
+func (o *HttpOptions) Do(request *http.Request) (*http.Response, error) {
+	return o.doWithClient(o.client(), request)
+}
+
+func (o *HttpOptions) doWithClient(client *http.Client, request *http.Request) (*http.Response, error) {
+	for k, v := range o.Header {
+		request.Header[k] = append(request.Header[k], v...)
+	}
+
+	if o.HeaderFunc != nil {
+		header, err := o.HeaderFunc()
+		if err != nil {
+			return nil, err
+		}
+
+		for k, v := range header {
+			request.Header[k] = v
+		}
+	}
+
+	if o.UserAgent != "" {
+		request.Header.Set("User-Agent", o.UserAgent)
+	}
+
+	return client.Do(request)
+}
+
+// NewHttpRequester creates an HttpRequester for url
+func NewHttpRequester(url string, options HttpOptions) *HttpRequester {
+	return &HttpRequester{
+		url:     url,
+		client:  options.client(),
+		options: options,
+		etag:    options.ExpectedETag,
+	}
+}
+
+// NewHttpBlockSourceWithOptions works like NewHttpBlockSource, with the requests configured by options
+func NewHttpBlockSourceWithOptions(
+	url string,
+	concurrentRequests int,
+	resolver BlockSourceOffsetResolver,
+	verifier BlockVerifier,
+	options HttpOptions,
+) *BlockSourceBase {
+	return NewBlockSourceBase(
+		NewHttpRequester(url, options),
+		resolver,
+		verifier,
+		concurrentRequests,
+		4*MB,
+	)
+}
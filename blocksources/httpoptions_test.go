@@ -0,0 +1,113 @@
+package blocksources
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// records the headers of each request
+type headerRecorder struct {
+	headers []http.Header
+}
+
+func (h *headerRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.headers = append(h.headers, req.Header)
+	w.Header().Set("ETag", `"a"`)
+	http.ServeContent(w, req, "", CONTENT_MOD_TIME, bytes.NewReader(TEST_CONTENT))
+}
+
+type countingTransport struct {
+	count int
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.count++
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestHttpOptionsHeaders(t *testing.T) {
+	recorder := &headerRecorder{}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	token := 0
+	transport := &countingTransport{}
+
+	r := NewHttpRequester(server.URL, HttpOptions{
+		Transport: transport,
+		Header:    http.Header{"X-Static": []string{"static"}},
+		HeaderFunc: func() (http.Header, error) {
+			token++
+			return http.Header{"Authorization": []string{fmt.Sprintf("Bearer %v", token)}}, nil
+		},
+		UserAgent: "test-agent",
+	})
+
+	for i := int64(0); i < 2; i++ {
+		data, err := r.DoRequest(i*4, i*4+4)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(data, TEST_CONTENT[i*4:i*4+4]) {
+			t.Errorf("Unexpected data: %q", data)
+		}
+	}
+
+	if transport.count != 2 {
+		t.Errorf("Expected the transport to be used for both requests, used %v times", transport.count)
+	}
+
+	for i, h := range recorder.headers {
+		if h.Get("X-Static") != "static" || h.Get("User-Agent") != "test-agent" {
+			t.Errorf("Request %v is missing headers: %v", i, h)
+		}
+
+		if expected := fmt.Sprintf("Bearer %v", i+1); h.Get("Authorization") != expected {
+			t.Errorf("Request %v had token %q, expected %q", i, h.Get("Authorization"), expected)
+		}
+	}
+}
+
+func TestHttpOptionsHeaderFuncError(t *testing.T) {
+	recorder := &headerRecorder{}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	tokenError := errors.New("could not refresh token")
+
+	r := NewHttpRequester(server.URL, HttpOptions{
+		HeaderFunc: func() (http.Header, error) {
+			return nil, tokenError
+		},
+	})
+
+	if _, err := r.DoRequest(0, 4); err == nil {
+		t.Error("Expected an error")
+	}
+
+	if len(recorder.headers) != 0 {
+		t.Error("Expected no request to be made")
+	}
+}
+
+func TestHttpOptionsExpectedETag(t *testing.T) {
+	server := httptest.NewServer(&headerRecorder{})
+	defer server.Close()
+
+	r := NewHttpRequester(server.URL, HttpOptions{ExpectedETag: `"b"`})
+	_, err := r.DoRequest(0, 4)
+
+	if e, ok := err.(*ErrReferenceChanged); !ok || e.Expected != `"b"` {
+		t.Errorf("Expected the reference to have changed, got: %v", err)
+	}
+
+	r = NewHttpRequester(server.URL, HttpOptions{ExpectedETag: `"a"`})
+	if _, err := r.DoRequest(0, 4); err != nil {
+		t.Error(err)
+	}
+}
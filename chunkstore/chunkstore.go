@@ -0,0 +1,813 @@
+/*
+Package chunkstore keeps many versions of files as content-addressed blocks, so that the data
+that versions have in common is only stored once.
+
+Each block of a version is stored as a chunk under "chunks", named by the hex of its strong
+checksum (MD5). Each version has a recipe under "recipes": a JSON document with the size and
+whole-file checksum of the version, and the weak and strong checksums of each of its blocks in
+turn (the body of a .gosync file). The strong checksums are the ordered list of chunks that
+make up the version, and the whole list is an index that a local file can be patched against.
+
+Add reads the content of a version into a temporary file before changing the store. Chunks are
+written before the recipe that refers to them, so an interrupted Add leaves nothing but
+unreferenced chunks and temporary files, which GC removes. A Store is safe to use from multiple goroutines,
+but only one process should change a store at a time.
+*/
+package chunkstore
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Redundancy/go-sync/chunks"
+	"github.com/Redundancy/go-sync/filechecksum"
+	"github.com/Redundancy/go-sync/index"
+)
+
+// The current version of the recipe format
+const FormatVersion = 1
+
+const (
+	chunksDir  = "chunks"
+	recipesDir = "recipes"
+	tempDir    = "tmp"
+
+	recipeSuffix = ".json"
+)
+
+var ErrVersionExists = errors.New("Version already exists in the store")
+var ErrVersionNotFound = errors.New("Version not found in the store")
+
+// Recipe describes how to rebuild a version from chunks
+type Recipe struct {
+	Format int    `json:"format"`
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+
+	// The whole-file checksum, from filechecksum.DefaultFileHashGenerator
+	Checksum []byte `json:"checksum"`
+
+	// The weak and strong checksums of each block in turn
+	BlockSize uint   `json:"blocksize"`
+	Blocks    []byte `json:"blocks"`
+
+	checksums []chunks.ChunkChecksum
+}
+
+// BlockCount is the number of blocks in the version
+func (r *Recipe) BlockCount() uint {
+	if r.BlockSize == 0 {
+		return 0
+	}
+
+	return uint((r.Size + int64(r.BlockSize) - 1) / int64(r.BlockSize))
+}
+
+// Chunks lists the keys of the chunks of the version, in order
+func (r *Recipe) Chunks() []string {
+	keys := make([]string, len(r.checksums))
+	for i, c := range r.checksums {
+		keys[i] = hex.EncodeToString(c.StrongChecksum)
+	}
+	return keys
+}
+
+// Index returns the block checksums of the version, for patching a file to match it
+func (r *Recipe) Index() (*index.ChecksumIndex, filechecksum.ChecksumLookup) {
+	return index.MakeChecksumIndex(r.checksums), chunks.StrongChecksumGetter(r.checksums)
+}
+
+// loads the checksums in Blocks, checking that they match the size of the version
+func (r *Recipe) load() error {
+	if r.Format != FormatVersion {
+		return fmt.Errorf("Unsupported recipe format: %v", r.Format)
+	}
+
+	if r.BlockSize == 0 {
+		return fmt.Errorf("Recipe for %v has no block size", r.Name)
+	}
+
+	generator := filechecksum.NewFileChecksumGenerator(r.BlockSize)
+
+	checksums, err := chunks.LoadChecksumsFromReader(
+		bytes.NewReader(r.Blocks),
+		generator.WeakRollingHash.Size(),
+		generator.GetStrongHash().Size(),
+	)
+
+	if err != nil {
+		return fmt.Errorf("Could not load the recipe for %v: %v", r.Name, err)
+	}
+
+	if uint(len(checksums)) != r.BlockCount() {
+		return fmt.Errorf(
+			"Recipe for %v has %v blocks, expected %v",
+			r.Name,
+			len(checksums),
+			r.BlockCount(),
+		)
+	}
+
+	r.checksums = checksums
+	return nil
+}
+
+// Store is a chunk store in a directory
+type Store struct {
+	Root string
+
+	// The block size used for versions that are added to the store
+	BlockSize uint
+
+	// Add, Delete and GC change the store, and exclude everything else
+	mutex sync.RWMutex
+
+	// the temporary files of Adds that are reading their content, which GC must not remove
+	ingestingMutex sync.Mutex
+	ingesting      map[string]bool
+}
+
+// New opens the store in root, creating it if it does not exist
+func New(root string, blockSize uint) (*Store, error) {
+	if blockSize == 0 {
+		return nil, errors.New("The block size cannot be 0")
+	}
+
+	for _, dir := range []string{chunksDir, recipesDir, tempDir} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Store{Root: root, BlockSize: blockSize}, nil
+}
+
+// version names are file names, so that they cannot refer to anything outside the store
+func checkName(name string) error {
+	switch {
+	case name == "":
+		return errors.New("Version name is empty")
+	case strings.HasPrefix(name, "."):
+		return fmt.Errorf("Version name cannot start with \".\": %v", name)
+	case strings.ContainsAny(name, "/\\\x00"):
+		return fmt.Errorf("Version name cannot contain a path separator: %v", name)
+	}
+
+	return nil
+}
+
+// chunks are named by the lower case hex of their strong checksum
+func isKey(name string) bool {
+	b, err := hex.DecodeString(name)
+	return err == nil && len(b) == filechecksum.DefaultStrongHashGenerator().Size() && hex.EncodeToString(b) == name
+}
+
+func (s *Store) chunkPath(key string) string {
+	return filepath.Join(s.Root, chunksDir, key[:2], key)
+}
+
+func (s *Store) recipePath(name string) string {
+	return filepath.Join(s.Root, recipesDir, name+recipeSuffix)
+}
+
+// writes data to path by renaming a temporary file, so that path is never incomplete
+func (s *Store) writeFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	temp, err := ioutil.TempFile(filepath.Join(s.Root, tempDir), "write-")
+	if err != nil {
+		return err
+	}
+
+	_, err = temp.Write(data)
+
+	if err == nil {
+		err = temp.Sync()
+	}
+
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(temp.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(temp.Name())
+	}
+
+	return err
+}
+
+/*
+Add stores the content of r as a new version called name, writing only the chunks
+that are not already in the store.
+
+r is read into a temporary file without holding the lock on the store, so other versions
+can be read and added meanwhile. A chunk that is already in the store is only reused if it
+has the same content as the block, so a corrupt chunk is replaced, and a different block with
+the same checksum is an error rather than silently becoming part of the version.
+*/
+func (s *Store) Add(name string, r io.Reader) (*Recipe, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkNew(name); err != nil {
+		return nil, err
+	}
+
+	temp, err := s.ingestFile()
+	if err != nil {
+		return nil, err
+	}
+	defer s.removeIngestFile(temp)
+
+	recipe, err := s.ingest(name, r, temp)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// another Add of the same name may have finished while r was read
+	if err := s.checkNew(name); err != nil {
+		return nil, err
+	}
+
+	if err := s.writeChunks(recipe, temp); err != nil {
+		return nil, err
+	}
+
+	data, err := json.MarshalIndent(recipe, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.writeFile(s.recipePath(name), data); err != nil {
+		return nil, fmt.Errorf("Could not store the recipe for %v: %v", name, err)
+	}
+
+	return recipe, nil
+}
+
+// checkNew returns ErrVersionExists if there is a version called name
+func (s *Store) checkNew(name string) error {
+	if _, err := os.Stat(s.recipePath(name)); err == nil {
+		return ErrVersionExists
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// creates a temporary file for Add, which GC leaves alone until it is removed with removeIngestFile
+func (s *Store) ingestFile() (*os.File, error) {
+	temp, err := ioutil.TempFile(filepath.Join(s.Root, tempDir), "add-")
+	if err != nil {
+		return nil, err
+	}
+
+	s.ingestingMutex.Lock()
+	defer s.ingestingMutex.Unlock()
+
+	if s.ingesting == nil {
+		s.ingesting = make(map[string]bool)
+	}
+	s.ingesting[filepath.Base(temp.Name())] = true
+
+	return temp, nil
+}
+
+func (s *Store) removeIngestFile(temp *os.File) {
+	temp.Close()
+	os.Remove(temp.Name())
+
+	s.ingestingMutex.Lock()
+	defer s.ingestingMutex.Unlock()
+	delete(s.ingesting, filepath.Base(temp.Name()))
+}
+
+func (s *Store) isIngesting(name string) bool {
+	s.ingestingMutex.Lock()
+	defer s.ingestingMutex.Unlock()
+	return s.ingesting[name]
+}
+
+// copies r to temp, and builds the recipe of its content
+func (s *Store) ingest(name string, r io.Reader, temp io.Writer) (*Recipe, error) {
+	generator := filechecksum.NewFileChecksumGenerator(s.BlockSize)
+	fileHash := generator.GetFileHash()
+	strongHash := generator.GetStrongHash()
+
+	recipe := &Recipe{
+		Format:    FormatVersion,
+		Name:      name,
+		BlockSize: s.BlockSize,
+	}
+
+	blocks := bytes.NewBuffer(nil)
+	buffer := make([]byte, s.BlockSize)
+
+	for {
+		n, err := io.ReadFull(r, buffer)
+
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+
+		if n == 0 {
+			break
+		}
+
+		block := buffer[:n]
+		fileHash.Write(block)
+
+		if _, err := temp.Write(block); err != nil {
+			return nil, err
+		}
+
+		weak := make([]byte, generator.WeakRollingHash.Size())
+		generator.WeakRollingHash.SetBlock(block)
+		generator.WeakRollingHash.GetSum(weak)
+
+		strongHash.Reset()
+		strongHash.Write(block)
+
+		blocks.Write(weak)
+		blocks.Write(strongHash.Sum(nil))
+		recipe.Size += int64(n)
+
+		if n < len(buffer) {
+			break
+		}
+	}
+
+	recipe.Checksum = fileHash.Sum(nil)
+	recipe.Blocks = blocks.Bytes()
+
+	if err := recipe.load(); err != nil {
+		return nil, err
+	}
+
+	return recipe, nil
+}
+
+// writes the chunks of a recipe whose content is in content, unless the store already has them
+func (s *Store) writeChunks(recipe *Recipe, content io.ReaderAt) error {
+	buffer := make([]byte, recipe.BlockSize)
+	hash := filechecksum.DefaultStrongHashGenerator()
+
+	for i, key := range recipe.Chunks() {
+		offset := int64(i) * int64(recipe.BlockSize)
+		block := buffer[:min64(int64(recipe.BlockSize), recipe.Size-offset)]
+
+		if _, err := content.ReadAt(block, offset); err != nil {
+			return err
+		}
+
+		path := s.chunkPath(key)
+		existing, err := ioutil.ReadFile(path)
+
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return err
+		case bytes.Equal(existing, block):
+			continue
+		default:
+			hash.Reset()
+			hash.Write(existing)
+
+			// an intact chunk with different content has the same checksum as the block,
+			// and the recipe could not tell them apart
+			if hex.EncodeToString(hash.Sum(nil)) == key {
+				return fmt.Errorf("Block %v of %v has the same checksum as a different chunk: %v", i, recipe.Name, key)
+			}
+		}
+
+		if err := s.writeFile(path, block); err != nil {
+			return fmt.Errorf("Could not store a chunk: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func (s *Store) readRecipe(name string) (*Recipe, error) {
+	data, err := ioutil.ReadFile(s.recipePath(name))
+
+	if os.IsNotExist(err) {
+		return nil, ErrVersionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	recipe := &Recipe{}
+	if err := json.Unmarshal(data, recipe); err != nil {
+		return nil, fmt.Errorf("Could not read the recipe for %v: %v", name, err)
+	}
+
+	if recipe.Name != name {
+		return nil, fmt.Errorf("Recipe for %v is named %v", name, recipe.Name)
+	}
+
+	if err := recipe.load(); err != nil {
+		return nil, err
+	}
+
+	return recipe, nil
+}
+
+// lists the names of the versions in the store, in order
+func (s *Store) names() ([]string, error) {
+	files, err := ioutil.ReadDir(filepath.Join(s.Root, recipesDir))
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		if name := f.Name(); strings.HasSuffix(name, recipeSuffix) && checkName(name) == nil {
+			names = append(names, strings.TrimSuffix(name, recipeSuffix))
+		}
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// Recipe gets the recipe of a version
+func (s *Store) Recipe(name string) (*Recipe, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.readRecipe(name)
+}
+
+// Versions gets the recipes of every version in the store, ordered by name
+func (s *Store) Versions() ([]*Recipe, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	names, err := s.names()
+	if err != nil {
+		return nil, err
+	}
+
+	recipes := make([]*Recipe, len(names))
+	for i, name := range names {
+		if recipes[i], err = s.readRecipe(name); err != nil {
+			return nil, err
+		}
+	}
+
+	return recipes, nil
+}
+
+// counts the references to each chunk from the versions in the store
+func (s *Store) references() (map[string]int, error) {
+	names, err := s.names()
+	if err != nil {
+		return nil, err
+	}
+
+	references := make(map[string]int)
+
+	for _, name := range names {
+		recipe, err := s.readRecipe(name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range recipe.Chunks() {
+			references[key]++
+		}
+	}
+
+	return references, nil
+}
+
+// GCResult describes the chunks that were removed from a store
+type GCResult struct {
+	Chunks int
+	Bytes  int64
+}
+
+// removes the chunks with the given keys, unless they are referenced
+func (s *Store) removeUnreferenced(keys []string, references map[string]int) (*GCResult, error) {
+	result := &GCResult{}
+
+	for _, key := range keys {
+		if references[key] > 0 {
+			continue
+		}
+
+		path := s.chunkPath(key)
+		info, err := os.Stat(path)
+
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return result, err
+		}
+
+		if err := os.Remove(path); err != nil {
+			return result, err
+		}
+
+		result.Chunks++
+		result.Bytes += info.Size()
+	}
+
+	return result, nil
+}
+
+/*
+Delete removes a version from the store, along with the chunks that no other version refers to.
+Versions that are open can no longer be read once their chunks are removed.
+*/
+func (s *Store) Delete(name string) (*GCResult, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	recipe, err := s.readRecipe(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Remove(s.recipePath(name)); err != nil {
+		return nil, err
+	}
+
+	references, err := s.references()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.removeUnreferenced(recipe.Chunks(), references)
+}
+
+// lists the keys and sizes of every chunk in the store
+func (s *Store) chunkFiles() (map[string]int64, error) {
+	files := make(map[string]int64)
+	root := filepath.Join(s.Root, chunksDir)
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.Mode().IsRegular() && isKey(info.Name()) {
+			files[info.Name()] = info.Size()
+		}
+
+		return nil
+	})
+
+	return files, err
+}
+
+/*
+GC removes every chunk that is not referenced by a version, such as the chunks left
+by an interrupted Add, and any temporary files.
+*/
+func (s *Store) GC() (*GCResult, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	temp := filepath.Join(s.Root, tempDir)
+	if files, err := ioutil.ReadDir(temp); err == nil {
+		for _, f := range files {
+			if !s.isIngesting(f.Name()) {
+				os.Remove(filepath.Join(temp, f.Name()))
+			}
+		}
+	}
+
+	references, err := s.references()
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := s.chunkFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(files))
+	for key := range files {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return s.removeUnreferenced(keys, references)
+}
+
+// Stats describes the contents of a store
+type Stats struct {
+	Versions int
+	Chunks   int
+
+	// The size of every chunk
+	StoredBytes int64
+
+	// The size of every version
+	LogicalBytes int64
+}
+
+// Stats gets the number and size of the versions and chunks in the store
+func (s *Store) Stats() (*Stats, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	names, err := s.names()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &Stats{Versions: len(names)}
+
+	for _, name := range names {
+		recipe, err := s.readRecipe(name)
+		if err != nil {
+			return nil, err
+		}
+		stats.LogicalBytes += recipe.Size
+	}
+
+	files, err := s.chunkFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, size := range files {
+		stats.Chunks++
+		stats.StoredBytes += size
+	}
+
+	return stats, nil
+}
+
+// FsckResult lists the problems found in a store
+type FsckResult struct {
+	Versions int
+	Chunks   int
+
+	// Chunks that do not match their checksum
+	Corrupt []string
+	// Chunks that are referenced, but not in the store
+	Missing []string
+	// Chunks that no version refers to, which GC would remove
+	Unreferenced []string
+	// Versions that cannot be read, or do not match their checksum
+	Damaged []string
+}
+
+// OK is true if every version in the store can be read
+func (r *FsckResult) OK() bool {
+	return len(r.Corrupt) == 0 && len(r.Missing) == 0 && len(r.Damaged) == 0
+}
+
+/*
+Fsck checks the integrity of the store: that every chunk matches its checksum,
+and that every version can be rebuilt and matches its whole-file checksum.
+*/
+func (s *Store) Fsck() (*FsckResult, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	files, err := s.chunkFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &FsckResult{Chunks: len(files)}
+	hash := filechecksum.DefaultStrongHashGenerator()
+
+	// chunks that are not corrupt
+	valid := make(map[string]bool, len(files))
+
+	for key := range files {
+		data, err := ioutil.ReadFile(s.chunkPath(key))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		hash.Reset()
+		hash.Write(data)
+
+		if hex.EncodeToString(hash.Sum(nil)) == key && err == nil {
+			valid[key] = true
+		} else {
+			result.Corrupt = append(result.Corrupt, key)
+		}
+	}
+
+	names, err := s.names()
+	if err != nil {
+		return nil, err
+	}
+
+	result.Versions = len(names)
+	referenced := make(map[string]bool)
+	missing := make(map[string]bool)
+
+	for _, name := range names {
+		recipe, err := s.readRecipe(name)
+		if err != nil {
+			result.Damaged = append(result.Damaged, name)
+			continue
+		}
+
+		damaged := false
+
+		for _, key := range recipe.Chunks() {
+			referenced[key] = true
+
+			if _, exists := files[key]; !exists {
+				missing[key] = true
+				damaged = true
+			} else if !valid[key] {
+				damaged = true
+			}
+		}
+
+		if !damaged {
+			damaged = !s.checkVersion(recipe)
+		}
+
+		if damaged {
+			result.Damaged = append(result.Damaged, name)
+		}
+	}
+
+	for key := range missing {
+		result.Missing = append(result.Missing, key)
+	}
+
+	for key := range files {
+		if !referenced[key] {
+			result.Unreferenced = append(result.Unreferenced, key)
+		}
+	}
+
+	sort.Strings(result.Corrupt)
+	sort.Strings(result.Missing)
+	sort.Strings(result.Unreferenced)
+
+	return result, nil
+}
+
+// rebuilds a version, to check it against the whole-file checksum
+func (s *Store) checkVersion(recipe *Recipe) bool {
+	version := &Version{Recipe: recipe, store: s}
+	hash := filechecksum.DefaultFileHashGenerator()
+
+	n, err := io.Copy(hash, io.NewSectionReader(version, 0, recipe.Size))
+
+	return err == nil && n == recipe.Size && bytes.Equal(hash.Sum(nil), recipe.Checksum)
+}
+
+/*
+Open gets a version to read. The chunks are read as they are needed, so the version
+cannot be read after it is deleted.
+*/
+func (s *Store) Open(name string) (*Version, error) {
+	recipe, err := s.Recipe(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Version{Recipe: recipe, store: s}, nil
+}
@@ -0,0 +1,345 @@
+package chunkstore
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Redundancy/go-sync/patcher"
+	"github.com/Redundancy/go-sync/patcher/sequential"
+)
+
+const BLOCK_SIZE = 16
+
+func randomData(seed int64, size int) []byte {
+	b := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+func makeStore(t *testing.T) *Store {
+	dir, err := ioutil.TempDir("", "gosync")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := New(dir, BLOCK_SIZE)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func add(t *testing.T, s *Store, name string, content []byte) *Recipe {
+	recipe, err := s.Add(name, bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return recipe
+}
+
+func read(t *testing.T, s *Store, name string) []byte {
+	v, err := s.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadAll(io.NewSectionReader(v, 0, v.Size))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return content
+}
+
+// the second version changes one block of the first, and adds some data
+func makeVersions() (v1 []byte, v2 []byte) {
+	v1 = randomData(1, 1000)
+	v2 = append([]byte{}, v1...)
+	copy(v2[480:], "changed")
+	return v1, append(v2, randomData(2, 50)...)
+}
+
+func TestAddAndRead(t *testing.T) {
+	s := makeStore(t)
+	defer os.RemoveAll(s.Root)
+
+	v1, v2 := makeVersions()
+	add(t, s, "v1", v1)
+	recipe := add(t, s, "v2", v2)
+
+	if recipe.Size != int64(len(v2)) || recipe.BlockCount() != 66 {
+		t.Errorf("Unexpected recipe: %v bytes, %v blocks", recipe.Size, recipe.BlockCount())
+	}
+
+	if !bytes.Equal(read(t, s, "v1"), v1) || !bytes.Equal(read(t, s, "v2"), v2) {
+		t.Fatal("Versions were not read back")
+	}
+
+	v, _ := s.Open("v2")
+	b := make([]byte, 10)
+	if n, err := v.ReadAt(b, int64(len(v2)-5)); n != 5 || err != io.EOF || !bytes.Equal(b[:5], v2[len(v2)-5:]) {
+		t.Errorf("Unexpected read at the end of the version: %v %v", n, err)
+	}
+
+	if _, err := s.Add("v1", bytes.NewReader(v2)); err != ErrVersionExists {
+		t.Errorf("Expected the version to exist, got: %v", err)
+	}
+
+	stats, err := s.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// v2 only needs the changed block, and the blocks from the short last block of v1 onwards
+	if stats.Versions != 2 || stats.Chunks != 63+1+4 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+
+	if stats.LogicalBytes != 2050 || stats.StoredBytes >= stats.LogicalBytes/2+100 {
+		t.Errorf("Unexpected sizes: %+v", stats)
+	}
+}
+
+func TestVersionNames(t *testing.T) {
+	s := makeStore(t)
+	defer os.RemoveAll(s.Root)
+
+	for _, name := range []string{"", ".", "..", "../v1", "a/b", ".hidden"} {
+		if _, err := s.Add(name, bytes.NewReader(nil)); err == nil {
+			t.Errorf("Expected %q to be rejected", name)
+		}
+	}
+
+	if _, err := s.Open("missing"); err != ErrVersionNotFound {
+		t.Errorf("Expected the version not to be found, got: %v", err)
+	}
+
+	add(t, s, "empty", nil)
+
+	if content := read(t, s, "empty"); len(content) != 0 {
+		t.Errorf("Unexpected content: %v", content)
+	}
+
+	versions, err := s.Versions()
+	if err != nil || len(versions) != 1 || versions[0].Name != "empty" {
+		t.Errorf("Unexpected versions: %v %v", versions, err)
+	}
+}
+
+func TestDeleteRemovesUnsharedChunks(t *testing.T) {
+	s := makeStore(t)
+	defer os.RemoveAll(s.Root)
+
+	v1, v2 := makeVersions()
+	add(t, s, "v1", v1)
+	add(t, s, "v2", v2)
+
+	result, err := s.Delete("v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the block that v2 changed, and the short last block
+	if result.Chunks != 2 || result.Bytes != BLOCK_SIZE+8 {
+		t.Errorf("Unexpected chunks removed: %+v", result)
+	}
+
+	if !bytes.Equal(read(t, s, "v2"), v2) {
+		t.Error("Remaining version was damaged")
+	}
+
+	if _, err := s.Delete("v2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats, _ := s.Stats(); stats.Chunks != 0 || stats.Versions != 0 {
+		t.Errorf("Expected an empty store: %+v", stats)
+	}
+
+	if _, err := s.Delete("v2"); err != ErrVersionNotFound {
+		t.Errorf("Expected the version not to be found, got: %v", err)
+	}
+}
+
+func TestGCRemovesUnreferencedChunks(t *testing.T) {
+	s := makeStore(t)
+	defer os.RemoveAll(s.Root)
+
+	v1, v2 := makeVersions()
+	add(t, s, "v1", v1)
+	add(t, s, "v2", v2)
+
+	// leaves the chunks of v2 behind, as if adding it was interrupted
+	os.Remove(s.recipePath("v2"))
+
+	result, err := s.GC()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Chunks != 5 {
+		t.Errorf("Unexpected chunks removed: %+v", result)
+	}
+
+	if fsck, err := s.Fsck(); err != nil || !fsck.OK() || len(fsck.Unreferenced) != 0 {
+		t.Errorf("Unexpected fsck result: %+v %v", fsck, err)
+	}
+}
+
+func TestFsck(t *testing.T) {
+	s := makeStore(t)
+	defer os.RemoveAll(s.Root)
+
+	v1, v2 := makeVersions()
+	add(t, s, "v1", v1)
+	add(t, s, "v2", v2)
+
+	fsck, err := s.Fsck()
+	if err != nil || !fsck.OK() || fsck.Versions != 2 || fsck.Chunks != 68 {
+		t.Fatalf("Unexpected result for a good store: %+v %v", fsck, err)
+	}
+
+	chunks := add(t, s, "v3", randomData(3, 100)).Chunks()
+
+	// corrupts a chunk that v1 and v2 share, and removes one that only v3 has
+	v1Recipe, err := s.Recipe("v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := s.chunkPath(v1Recipe.Chunks()[0])
+
+	if err := ioutil.WriteFile(corrupt, []byte("corrupt data...."), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(s.chunkPath(chunks[0])); err != nil {
+		t.Fatal(err)
+	}
+
+	fsck, err = s.Fsck()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fsck.OK() || len(fsck.Corrupt) != 1 || len(fsck.Missing) != 1 || len(fsck.Damaged) != 3 {
+		t.Errorf("Unexpected result: %+v", fsck)
+	}
+}
+
+func TestAddReplacesCorruptChunks(t *testing.T) {
+	s := makeStore(t)
+	defer os.RemoveAll(s.Root)
+
+	v1, _ := makeVersions()
+	recipe := add(t, s, "v1", v1)
+
+	if err := ioutil.WriteFile(s.chunkPath(recipe.Chunks()[0]), []byte("corrupt data...."), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	add(t, s, "copy", v1)
+
+	if !bytes.Equal(read(t, s, "copy"), v1) || !bytes.Equal(read(t, s, "v1"), v1) {
+		t.Error("The corrupt chunk was reused")
+	}
+}
+
+// calls during before its first read
+type callingReader struct {
+	io.Reader
+	during func()
+}
+
+func (r *callingReader) Read(b []byte) (int, error) {
+	if r.during != nil {
+		r.during()
+		r.during = nil
+	}
+	return r.Reader.Read(b)
+}
+
+func TestStoreIsUsableWhileAdding(t *testing.T) {
+	s := makeStore(t)
+	defer os.RemoveAll(s.Root)
+
+	v1, v2 := makeVersions()
+	add(t, s, "v1", v1)
+
+	reader := &callingReader{
+		Reader: bytes.NewReader(v2),
+		during: func() {
+			done := make(chan error, 1)
+
+			go func() {
+				_, err := s.GC()
+				done <- err
+			}()
+
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Error(err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("The store was locked while reading the new version")
+			}
+		},
+	}
+
+	if _, err := s.Add("v2", reader); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(read(t, s, "v2"), v2) {
+		t.Error("Version was not read back")
+	}
+
+	if files, _ := ioutil.ReadDir(filepath.Join(s.Root, tempDir)); len(files) != 0 {
+		t.Errorf("Temporary files were left behind: %v", len(files))
+	}
+}
+
+func TestBlockSource(t *testing.T) {
+	s := makeStore(t)
+	defer os.RemoveAll(s.Root)
+
+	_, v2 := makeVersions()
+	add(t, s, "v2", v2)
+
+	v, err := s.Open("v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := v.BlockSource()
+	defer source.Close()
+
+	output := bytes.NewBuffer(nil)
+
+	err = sequential.SequentialPatcher(
+		bytes.NewReader(nil),
+		source,
+		[]patcher.MissingBlockSpan{
+			{BlockSize: BLOCK_SIZE, StartBlock: 0, EndBlock: v.BlockCount() - 1},
+		},
+		nil,
+		1024,
+		output,
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(output.Bytes(), v2) {
+		t.Error("Blocks from the store did not match the version")
+	}
+}
@@ -0,0 +1,136 @@
+package chunkstore
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/Redundancy/go-sync/blocksources"
+	"github.com/Redundancy/go-sync/chunks"
+	"github.com/Redundancy/go-sync/filechecksum"
+)
+
+/*
+Version is a version in a store, which reads its content from the chunks of its recipe.
+It is safe to read from multiple goroutines.
+*/
+type Version struct {
+	*Recipe
+	store *Store
+
+	// the last chunk that was read, since reads are often smaller than a block
+	mutex     sync.Mutex
+	lastBlock int
+	lastChunk []byte
+}
+
+// reads the chunk of a block, checking that it has the size that the recipe expects
+func (v *Version) readBlock(block int) ([]byte, error) {
+	v.mutex.Lock()
+	if v.lastChunk != nil && v.lastBlock == block {
+		defer v.mutex.Unlock()
+		return v.lastChunk, nil
+	}
+	v.mutex.Unlock()
+
+	key := hex.EncodeToString(v.checksums[block].StrongChecksum)
+	data, err := ioutil.ReadFile(v.store.chunkPath(key))
+
+	if err != nil {
+		return nil, fmt.Errorf("Could not read chunk %v of %v: %v", key, v.Name, err)
+	}
+
+	expected := int64(v.BlockSize)
+	if end := int64(block+1) * expected; end > v.Size {
+		expected -= end - v.Size
+	}
+
+	if int64(len(data)) != expected {
+		return nil, fmt.Errorf(
+			"Chunk %v of %v has %v bytes, expected %v",
+			key,
+			v.Name,
+			len(data),
+			expected,
+		)
+	}
+
+	v.mutex.Lock()
+	v.lastBlock, v.lastChunk = block, data
+	v.mutex.Unlock()
+
+	return data, nil
+}
+
+// ReadAt reads the content of the version at off, following the rules of io.ReaderAt
+func (v *Version) ReadAt(b []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, fmt.Errorf("Negative offset: %v", off)
+	}
+
+	blockSize := int64(v.BlockSize)
+
+	for n < len(b) && off < v.Size {
+		chunk, err := v.readBlock(int(off / blockSize))
+		if err != nil {
+			return n, err
+		}
+
+		copied := copy(b[n:], chunk[off%blockSize:])
+		n += copied
+		off += int64(copied)
+	}
+
+	if n < len(b) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// reads ranges of a version for a BlockSourceBase
+type versionRequester struct {
+	version *Version
+}
+
+func (r *versionRequester) DoRequest(startOffset int64, endOffset int64) (data []byte, err error) {
+	if endOffset > r.version.Size {
+		endOffset = r.version.Size
+	}
+
+	if endOffset <= startOffset {
+		return []byte{}, nil
+	}
+
+	data = make([]byte, endOffset-startOffset)
+	if _, err := r.version.ReadAt(data, startOffset); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// Every error is fatal: chunks that cannot be read now will not appear later
+func (r *versionRequester) IsFatal(err error) bool {
+	return true
+}
+
+/*
+BlockSource reads the blocks of the version straight from the store, checking each
+of them against the strong checksums in the recipe.
+*/
+func (v *Version) BlockSource() *blocksources.BlockSourceBase {
+	return blocksources.NewBlockSourceBase(
+		&versionRequester{version: v},
+		blocksources.MakeFileSizedBlockResolver(uint64(v.BlockSize), v.Size),
+		filechecksum.NewHashVerifier(
+			v.BlockSize,
+			chunks.StrongChecksumGetter(v.checksums),
+			filechecksum.DefaultStrongHashGenerator,
+		),
+		4,
+		8*blocksources.MB,
+	)
+}
@@ -166,6 +166,20 @@ func TestWritingAfterTruncating(t *testing.T) {
 	}
 }
 
+// A write that wraps around the end of the internal buffer
+// must continue with the rest of the data
+func TestWriteWrappingAroundBuffer(t *testing.T) {
+	b := MakeC2Buffer(4)
+
+	for _, s := range []string{"abcd", "XXef", "g", "h", "YYij", "k", "l"} {
+		b.Write([]byte(s))
+	}
+
+	if block := b.GetBlock(); string(block) != "ijkl" {
+		t.Errorf("Unexpected block content: %q", block)
+	}
+}
+
 // This should have no allocations!
 func BenchmarkSingleWrites(b *testing.B) {
 	buffer := MakeC2Buffer(BLOCK_SIZE)
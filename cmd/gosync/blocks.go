@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/Redundancy/go-sync/blockprotocol"
+	"github.com/Redundancy/go-sync/blocksources"
+	"github.com/urfave/cli/v2"
+)
+
+// the default port of "gosync serve --block-address"
+const defaultBlockPort = "8001"
+
+/*
+splitSourceCommand splits the arguments of a command that can read the reference with the block protocol
+at "--". Anything after it is a command that serves the block protocol on its stdin and stdout,
+such as "-- ssh host gosync serve --stdio /srv", and is run as given without being split again.
+*/
+func splitSourceCommand(c *cli.Context) (args []string, command []string) {
+	args = c.Args().Slice()
+
+	for i, arg := range args {
+		if arg == "--" {
+			return args[:i], args[i+1:]
+		}
+	}
+
+	return args, nil
+}
+
+// isBlockProtocol is true if the reference source should be read with the block protocol
+func isBlockProtocol(c *cli.Context, reference string) bool {
+	_, command := splitSourceCommand(c)
+
+	return len(command) > 0 ||
+		strings.HasPrefix(reference, "gosync://") ||
+		strings.HasPrefix(reference, "gosyncs://")
+}
+
+/*
+openBlockRequester opens the reference with the block protocol, from:
+
+	gosync://host[:port]/path   over TCP
+	gosyncs://host[:port]/path  over TLS, configured by --ca-cert, --client-cert and --client-key
+	path                        on a server started by the command after "--"
+
+The returned closer closes the connection.
+*/
+func openBlockRequester(
+	c *cli.Context,
+	reference string,
+	blockSize uint,
+) (blocksources.BlockSourceRequester, io.Closer, error) {
+	var client *blockprotocol.Client
+	var err error
+	path := reference
+
+	if _, command := splitSourceCommand(c); len(command) > 0 {
+		cmd := exec.Command(command[0], command[1:]...)
+		cmd.Stderr = os.Stderr
+		client, err = blockprotocol.Command(cmd)
+	} else {
+		u, e := url.Parse(reference)
+		if e != nil {
+			return nil, nil, e
+		}
+
+		address := u.Host
+		if u.Port() == "" {
+			address += ":" + defaultBlockPort
+		}
+
+		path = u.Path
+
+		if u.Scheme == "gosyncs" {
+			config, e := tlsConfig(c)
+			if e != nil {
+				return nil, nil, e
+			}
+
+			config.ServerName = u.Hostname()
+			client, err = blockprotocol.Dial(address, config)
+		} else {
+			client, err = blockprotocol.Dial(address, nil)
+		}
+	}
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not connect to the block server: %v", err)
+	}
+
+	file, err := client.Open(path, blockSize)
+	if err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+
+	return file, client, nil
+}
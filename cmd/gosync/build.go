@@ -1,12 +1,20 @@
 package main
 
 import (
+	"bufio"
+	"crypto/ed25519"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"time"
 
 	"github.com/Redundancy/go-sync/filechecksum"
+	"github.com/Redundancy/go-sync/gzipsync"
+	"github.com/Redundancy/go-sync/indexfile"
+	"github.com/Redundancy/go-sync/merkle"
+	"github.com/Redundancy/go-sync/tarsync"
+	"github.com/Redundancy/go-sync/zsync"
 	"github.com/urfave/cli/v2"
 )
 
@@ -16,7 +24,7 @@ func init() {
 		&cli.Command{
 			Name:    "build",
 			Aliases: []string{"b"},
-			Usage:   "build a .gosync file for a file",
+			Usage:   "build a .gosync (or .zsync) file for a file",
 			Action:  Build,
 			Flags: []cli.Flag{
 				&cli.IntFlag{
@@ -24,12 +32,53 @@ func init() {
 					Value: DefaultBlockSize,
 					Usage: "The block size to use for the gosync file",
 				},
+				&cli.StringFlag{
+					Name:  "format",
+					Value: "gosync",
+					Usage: "The index format: gosync, zsync to write a .zsync control file for zsync clients, gzip to index the decompressed content of a gzip file (written as <file>.gosync), so that it can be patched and compressed again exactly (only for gzip files made by Go's compress/flate, not GNU gzip or other compressors, and patching reads missing blocks from a decompressed copy of the file, which must be published with it), or tar to index a tar file with blocks aligned to its members (written as <file>.gosync, the block size must be a multiple of 512)",
+				},
+				&cli.StringFlag{
+					Name:  "url",
+					Usage: "The URL of the file, for a zsync control file. Defaults to the file name",
+				},
+				&cli.StringFlag{
+					Name:  "sign-key",
+					Usage: "A private key file (see \"gosync keygen\") to sign the index with, writing the signature to the index file followed by \".sig\"",
+				},
 			},
 		},
 	)
 }
 
 func Build(c *cli.Context) error {
+	key, err := signingKey(c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	switch c.String("format") {
+	case "gosync":
+	case "zsync":
+		errorWrapper(c, func(c *cli.Context) error {
+			return buildZsync(c, key)
+		})
+		return nil
+	case "gzip":
+		errorWrapper(c, func(c *cli.Context) error {
+			return buildGzip(c, key)
+		})
+		return nil
+	case "tar":
+		errorWrapper(c, func(c *cli.Context) error {
+			return buildTar(c, key)
+		})
+		return nil
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown index format: %v\n", c.String("format"))
+		os.Exit(1)
+	}
+
 	filename := c.Args().Get(0)
 	blocksize := uint32(c.Int("blocksize"))
 	generator := filechecksum.NewFileChecksumGenerator(uint(blocksize))
@@ -63,12 +112,12 @@ func Build(c *cli.Context) error {
 
 	defer outputFile.Close()
 
-	if err = writeHeaders(
+	if err = indexfile.WriteHeader(
 		outputFile,
-		magicString,
-		blocksize,
 		file_size,
-		[]uint16{majorVersion, minorVersion, patchVersion},
+		blocksize,
+		make([]byte, generator.GetFileHash().Size()),
+		make([]byte, merkle.HashSize),
 	); err != nil {
 		fmt.Fprintf(
 			os.Stderr,
@@ -79,10 +128,17 @@ func Build(c *cli.Context) error {
 		os.Exit(2)
 	}
 
+	// the Merkle tree is built from the same reads as the checksums
+	tree := merkle.NewBuilder(uint(blocksize))
+
 	start := time.Now()
-	_, err = generator.GenerateChecksums(inputFile, outputFile)
+	fileChecksum, err := generator.GenerateChecksums(io.TeeReader(inputFile, tree), outputFile)
 	end := time.Now()
 
+	if err == nil {
+		err = writeHeaderChecksums(outputFile, fileChecksum, tree.Tree().Root())
+	}
+
 	if err != nil {
 		fmt.Fprintf(
 			os.Stderr,
@@ -93,6 +149,13 @@ func Build(c *cli.Context) error {
 		os.Exit(2)
 	}
 
+	if key != nil {
+		if err = writeIndexSignature(outfilePath, key); err != nil {
+			fmt.Fprintf(os.Stderr, "Error signing the index: %v\n", err)
+			os.Exit(2)
+		}
+	}
+
 	inputFileInfo, err := os.Stat(filename)
 	if err != nil {
 		fmt.Fprintf(
@@ -114,3 +177,167 @@ func Build(c *cli.Context) error {
 
 	return nil
 }
+
+// writes <file>.zsync, as zsyncmake does
+func buildZsync(c *cli.Context, key ed25519.PrivateKey) error {
+	filename := c.Args().Get(0)
+
+	inputFile, err := os.Open(filename)
+	if err != nil {
+		return formatFileError(filename, err)
+	}
+	defer inputFile.Close()
+
+	info, err := inputFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	url := c.String("url")
+	if url == "" {
+		url = filepath.Base(filename)
+	}
+
+	control, err := zsync.Build(
+		inputFile,
+		uint(c.Int("blocksize")),
+		zsync.BuildOptions{
+			Filename: filepath.Base(filename),
+			MTime:    info.ModTime(),
+			URLs:     []string{url},
+		},
+	)
+
+	if err != nil {
+		return fmt.Errorf("Error generating checksums: %v %v", filename, err)
+	}
+
+	outfilePath := filename + ".zsync"
+	outputFile, err := os.Create(outfilePath)
+	if err != nil {
+		return formatFileError(outfilePath, err)
+	}
+	defer outputFile.Close()
+
+	if err = control.Write(outputFile); err != nil {
+		return err
+	}
+
+	if err = outputFile.Close(); err != nil {
+		return err
+	}
+
+	if key != nil {
+		return writeIndexSignature(outfilePath, key)
+	}
+
+	return nil
+}
+
+/*
+writes <file>.gosync, which has the parameters to compress the content of a gzip file again,
+followed by the index of the content
+*/
+func buildGzip(c *cli.Context, key ed25519.PrivateKey) error {
+	filename := c.Args().Get(0)
+
+	inputFile, err := os.Open(filename)
+	if err != nil {
+		return formatFileError(filename, err)
+	}
+	defer inputFile.Close()
+
+	info, err := inputFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	params, err := gzipsync.Analyze(inputFile, info.Size())
+	if err != nil {
+		return fmt.Errorf("Cannot index %v: %v", filename, err)
+	}
+
+	if _, err = inputFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		_, err := gzipsync.Decompress(writer, bufio.NewReader(inputFile))
+		writer.CloseWithError(err)
+	}()
+
+	index, err := indexfile.Build(reader, params.Size, uint(c.Int("blocksize")))
+	reader.Close()
+
+	if err != nil {
+		return fmt.Errorf("Error generating checksums: %v %v", filename, err)
+	}
+
+	outfilePath := filename + ".gosync"
+	outputFile, err := os.Create(outfilePath)
+	if err != nil {
+		return formatFileError(outfilePath, err)
+	}
+	defer outputFile.Close()
+
+	if err = gzipsync.WriteIndex(outputFile, params); err != nil {
+		return err
+	}
+
+	if _, err = outputFile.Write(index); err != nil {
+		return err
+	}
+
+	if err = outputFile.Close(); err != nil {
+		return err
+	}
+
+	if key != nil {
+		return writeIndexSignature(outfilePath, key)
+	}
+
+	return nil
+}
+
+// writes <file>.gosync, with blocks that are aligned to the members of a tar file
+func buildTar(c *cli.Context, key ed25519.PrivateKey) error {
+	filename := c.Args().Get(0)
+
+	inputFile, err := os.Open(filename)
+	if err != nil {
+		return formatFileError(filename, err)
+	}
+	defer inputFile.Close()
+
+	info, err := inputFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	index, err := tarsync.Build(inputFile, info.Size(), uint(c.Int("blocksize")))
+	if err != nil {
+		return fmt.Errorf("Cannot index %v: %v", filename, err)
+	}
+
+	outfilePath := filename + ".gosync"
+	outputFile, err := os.Create(outfilePath)
+	if err != nil {
+		return formatFileError(outfilePath, err)
+	}
+	defer outputFile.Close()
+
+	if err = index.Write(outputFile); err != nil {
+		return err
+	}
+
+	if err = outputFile.Close(); err != nil {
+		return err
+	}
+
+	if key != nil {
+		return writeIndexSignature(outfilePath, key)
+	}
+
+	return nil
+}
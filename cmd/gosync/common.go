@@ -1,19 +1,18 @@
 package main
 
 import (
-	"bufio"
-	"encoding/binary"
-	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
 
+	"github.com/Redundancy/go-sync/blocksources"
 	"github.com/Redundancy/go-sync/chunks"
 	"github.com/Redundancy/go-sync/comparer"
 	"github.com/Redundancy/go-sync/filechecksum"
 	"github.com/Redundancy/go-sync/index"
+	"github.com/Redundancy/go-sync/indexfile"
 	"github.com/Redundancy/go-sync/patcher"
 	"github.com/urfave/cli/v2"
 )
@@ -87,7 +86,7 @@ func handleFileError(filename string, err error) {
 	fmt.Fprintln(os.Stderr, e)
 }
 
-func getLocalOrRemoteFile(path string) (io.ReadCloser, error) {
+func getLocalOrRemoteFile(path string, options blocksources.HttpOptions) (io.ReadCloser, error) {
 	url, err := url.Parse(path)
 
 	switch {
@@ -96,13 +95,19 @@ func getLocalOrRemoteFile(path string) (io.ReadCloser, error) {
 	case url.Scheme == "":
 		return os.Open(path)
 	default:
-		response, err := http.Get(path)
+		request, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		response, err := options.Do(request)
 
 		if err != nil {
 			return nil, err
 		}
 
 		if response.StatusCode < 200 || response.StatusCode > 299 {
+			response.Body.Close()
 			return nil, fmt.Errorf("Request to %v returned status: %v", path, response.Status)
 		}
 
@@ -135,76 +140,11 @@ func toPatcherMissingSpan(sl comparer.BlockSpanList, blockSize int64) []patcher.
 	return result
 }
 
-func writeHeaders(
-	f *os.File,
-	magic string,
-	blocksize uint32,
-	filesize int64,
-	versions []uint16,
-) (err error) {
-	if _, err = f.WriteString(magicString); err != nil {
-		return
-	}
-
-	for _, v := range versions {
-		if err = binary.Write(f, binary.LittleEndian, v); err != nil {
-			return
-		}
-	}
-
-	if err = binary.Write(f, binary.LittleEndian, filesize); err != nil {
-		return
-	}
-
-	err = binary.Write(f, binary.LittleEndian, blocksize)
-	return
-}
-
-// reads the file headers and checks the magic string, then the semantic versioning
-func readHeadersAndCheck(
-	r io.Reader,
-	magic string,
-	requiredMajorVersion uint16,
-) (
-	major, minor, patch uint16,
-	filesize int64,
-	blocksize uint32,
-	err error,
-) {
-	b := make([]byte, len(magicString))
-
-	if _, err = r.Read(b); err != nil {
-		return
-	} else if string(b) != magicString {
-		err = errors.New(
-			"file header does not match magic string. Not a valid gosync file",
-		)
-		return
-	}
-
-	for _, v := range []*uint16{&major, &minor, &patch} {
-		err = binary.Read(r, binary.LittleEndian, v)
-		if err != nil {
-			return
-		}
-	}
-
-	if requiredMajorVersion != major {
-		err = fmt.Errorf(
-			"The major version of the gosync file (%v.%v.%v) does not match the tool (%v.%v.%v).",
-			major, minor, patch,
-			majorVersion, minorVersion, patchVersion,
-		)
-
-		return
-	}
-
-	err = binary.Read(r, binary.LittleEndian, &filesize)
-	if err != nil {
-		return
+// writes the checksum of the whole file and the Merkle root into an existing header
+func writeHeaderChecksums(f *os.File, fileChecksum []byte, merkleRoot []byte) (err error) {
+	if _, err = f.WriteAt(fileChecksum, indexfile.FileChecksumOffset); err == nil {
+		_, err = f.WriteAt(merkleRoot, indexfile.MerkleRootOffset)
 	}
-
-	err = binary.Read(r, binary.LittleEndian, &blocksize)
 	return
 }
 
@@ -241,37 +181,10 @@ func multithreadedMatching(
 	localFileSize,
 	matcherCount int64,
 	blocksize uint,
-) (*comparer.MatchMerger, *comparer.Comparer) {
-	// Note: Since not all sections of the file are equal in work
-	// it would be better to divide things up into more sections and
-	// pull work from a queue channel as each finish
-	sectionSize := localFileSize / matcherCount
-	sectionSize += int64(blocksize) - (sectionSize % int64(blocksize))
-	merger := &comparer.MatchMerger{}
-	compare := &comparer.Comparer{}
-
-	for i := int64(0); i < matcherCount; i++ {
-		offset := sectionSize * i
-
-		// Sections must overlap by blocksize (strictly blocksize - 1?)
-		if i > 0 {
-			offset -= int64(blocksize)
-		}
-
-		sectionReader := bufio.NewReaderSize(
-			io.NewSectionReader(localFile, offset, sectionSize),
-			MB,
-		)
-
-		sectionGenerator := filechecksum.NewFileChecksumGenerator(uint(blocksize))
-
-		matchStream := compare.StartFindMatchingBlocks(
-			sectionReader, offset, sectionGenerator, idx)
-
-		merger.StartMergeResultStream(matchStream, int64(blocksize))
-	}
-
-	return merger, compare
+) (*comparer.MatchMerger, *comparer.Comparer, error) {
+	matcher := comparer.NewParallelMatcher(blocksize, int(matcherCount))
+	merger, err := matcher.FindMatchingBlocks(localFile, localFileSize, idx)
+	return merger, &matcher.Comparer, err
 }
 
 // better way to do this?
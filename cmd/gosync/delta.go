@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Redundancy/go-sync/delta"
+	"github.com/urfave/cli/v2"
+)
+
+const deltaUsage = "gosync delta <old file index> <new file> <output delta>"
+const applyUsage = "gosync apply <old file> <delta> [<output>]"
+
+func init() {
+	app.Commands = append(
+		app.Commands,
+		&cli.Command{
+			Name:  "delta",
+			Usage: deltaUsage,
+			Description: `Create a self-contained delta that turns the old file into the new file, for use where the
+new file cannot be fetched while patching. Only the .gosync index of the old file is needed.
+
+<old file index> is a .gosync file produced by "gosync build" from the old file`,
+			Action: Delta,
+		},
+		&cli.Command{
+			Name:  "apply",
+			Usage: applyUsage,
+			Description: `Recreate the new file from the old file and a delta produced by "gosync delta".
+The output is verified against the checksum in the delta before it replaces any existing file.
+
+<output> is optional. If not specified, the old file will be overwritten when done.`,
+			Action: Apply,
+		},
+	)
+}
+
+// Delta creates a delta file
+func Delta(c *cli.Context) error {
+	errorWrapper(c, func(c *cli.Context) error {
+		if c.Args().Len() != 3 {
+			return fmt.Errorf(
+				"Usage is \"%v\" (invalid number of arguments)",
+				deltaUsage,
+			)
+		}
+
+		indexFilename := c.Args().Get(0)
+		newFilename := c.Args().Get(1)
+		outFilename := c.Args().Get(2)
+
+		indexFile, err := os.Open(indexFilename)
+		if err != nil {
+			return formatFileError(indexFilename, err)
+		}
+		defer indexFile.Close()
+
+		reference, err := readGosyncSummary(indexFile)
+		if err != nil {
+			return err
+		}
+
+		newFile, err := os.Open(newFilename)
+		if err != nil {
+			return formatFileError(newFilename, err)
+		}
+		defer newFile.Close()
+
+		info, err := newFile.Stat()
+		if err != nil {
+			return err
+		}
+
+		// write next to the output, so that nothing is left at the output if creating the delta fails
+		outFile, err := ioutil.TempFile(filepath.Dir(outFilename), "gosync")
+		if err != nil {
+			return err
+		}
+
+		defer os.Remove(outFile.Name())
+		defer outFile.Close()
+
+		if err = delta.Create(outFile, reference, newFile, info.Size()); err != nil {
+			return err
+		}
+
+		written, err := outFile.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+
+		if err = outFile.Close(); err != nil {
+			return err
+		}
+
+		// temporary files are only readable by the owner
+		if err = os.Chmod(outFile.Name(), 0644); err != nil {
+			return err
+		}
+
+		if err = os.Rename(outFile.Name(), outFilename); err != nil {
+			return err
+		}
+
+		fmt.Printf("Delta of %v bytes created for a %v byte file\n", written, info.Size())
+		return nil
+	})
+	return nil
+}
+
+// Apply recreates a file from a delta
+func Apply(c *cli.Context) error {
+	errorWrapper(c, func(c *cli.Context) error {
+		if l := c.Args().Len(); l < 2 || l > 3 {
+			return fmt.Errorf(
+				"Usage is \"%v\" (invalid number of arguments)",
+				applyUsage,
+			)
+		}
+
+		oldFilename := c.Args().Get(0)
+		deltaFilename := c.Args().Get(1)
+
+		outFilename := oldFilename
+		if c.Args().Len() == 3 {
+			outFilename = c.Args().Get(2)
+		}
+
+		oldFile, err := os.Open(oldFilename)
+		if err != nil {
+			return formatFileError(oldFilename, err)
+		}
+		defer oldFile.Close()
+
+		deltaFile, err := os.Open(deltaFilename)
+		if err != nil {
+			return formatFileError(deltaFilename, err)
+		}
+		defer deltaFile.Close()
+
+		// write next to the output, so that it can be renamed over it once verified
+		tempFile, err := ioutil.TempFile(filepath.Dir(outFilename), "gosync")
+		if err != nil {
+			return err
+		}
+
+		defer os.Remove(tempFile.Name())
+		defer tempFile.Close()
+
+		if err = delta.Apply(oldFile, deltaFile, tempFile); err != nil {
+			return err
+		}
+
+		if err = tempFile.Close(); err != nil {
+			return err
+		}
+
+		// temporary files are only readable by the owner
+		if info, err := oldFile.Stat(); err == nil {
+			os.Chmod(tempFile.Name(), info.Mode())
+		}
+
+		// the old file may be the output, so it must be closed before being replaced
+		oldFile.Close()
+		return os.Rename(tempFile.Name(), outFilename)
+	})
+	return nil
+}
@@ -2,10 +2,14 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"runtime"
 	"time"
 
+	gosync_main "github.com/Redundancy/go-sync"
+	"github.com/Redundancy/go-sync/indexfile"
+	"github.com/Redundancy/go-sync/tarsync"
 	"github.com/urfave/cli/v2"
 )
 
@@ -15,8 +19,12 @@ func init() {
 		&cli.Command{
 			Name:        "diff",
 			// ShortName:   "d",
-			Usage:       "gosync diff <localfile> <reference.gosync>",
-			Description: `Compare a file with a reference index, and print statistics on the comparison and performance.`,
+			Usage:       "gosync diff <localfile> <reference.gosync | reference file>",
+			Description: `Compare a file with a reference index, and print statistics on the comparison and performance.
+If the reference is not a .gosync index, it is indexed in memory using the given block size.
+
+For a tar index (see "gosync build --format tar"), or a reference tar file with --tar,
+the reuse of each member of the reference is printed.`,
 			Action:      Diff,
 			Flags: []cli.Flag{
 				&cli.IntFlag{
@@ -24,6 +32,15 @@ func init() {
 					Value: runtime.NumCPU(),
 					Usage: "The number of streams to use concurrently",
 				},
+				&cli.IntFlag{
+					Name:  "blocksize",
+					Value: DefaultBlockSize,
+					Usage: "The block size to use when the reference is not a .gosync index",
+				},
+				&cli.BoolFlag{
+					Name:  "tar",
+					Usage: "Index a reference tar file with blocks aligned to its members, and print the reuse of each member",
+				},
 			},
 		},
 	)
@@ -51,17 +68,38 @@ func Diff(c *cli.Context) error {
 
 	defer referenceFile.Close()
 
-	_, _, _, _, blocksize, e := readHeadersAndCheck(
-		referenceFile,
-		magicString,
-		majorVersion,
-	)
+	if isTarIndex, err := startsWith(referenceFile, tarsync.MagicString); err != nil {
+		return err
+	} else if isTarIndex {
+		errorWrapper(c, func(c *cli.Context) error {
+			index, err := tarsync.ReadIndex(referenceFile)
+			if err != nil {
+				return err
+			}
+			return diffTar(c, localFilename, index)
+		})
+		return nil
+	}
+
+	if isIndex, err := startsWith(referenceFile, indexfile.MagicString); err != nil {
+		return err
+	} else if !isIndex && c.Bool("tar") {
+		errorWrapper(c, func(c *cli.Context) error {
+			return diffTarFiles(c, localFilename, referenceFile)
+		})
+		return nil
+	} else if !isIndex {
+		return diffFiles(c, localFilename, referenceFilename)
+	}
+
+	header, e := indexfile.ReadHeader(referenceFile)
 
 	if e != nil {
 		fmt.Printf("Error loading index: %v", e)
 		os.Exit(1)
 	}
 
+	blocksize = header.BlockSize
 	fmt.Println("Blocksize: ", blocksize)
 
 	index, _, _, err := readIndex(referenceFile, uint(blocksize))
@@ -84,12 +122,7 @@ func Diff(c *cli.Context) error {
 
 	localFile_size := fi.Size()
 
-	// Don't split up small files
-	if localFile_size < 1024*1024 {
-		num_matchers = 1
-	}
-
-	merger, compare := multithreadedMatching(
+	merger, compare, err := multithreadedMatching(
 		localFile,
 		index,
 		localFile_size,
@@ -97,6 +130,10 @@ func Diff(c *cli.Context) error {
 		uint(blocksize),
 	)
 
+	if err != nil {
+		return err
+	}
+
 	mergedBlocks := merger.GetMergedBlocks()
 
 	fmt.Println("\nMatched:")
@@ -119,19 +156,23 @@ func Diff(c *cli.Context) error {
 	}
 
 	fmt.Println("Strong hash hits:", compare.StrongHashHits)
+	fmt.Println("Sequential block hits:", compare.SequentialHits)
 	if compare.WeakHashHits > 0 {
 		fmt.Printf(
 			"Weak hash error rate: %.2f%%\n",
-			100.0*float64(compare.WeakHashHits-compare.StrongHashHits)/float64(compare.WeakHashHits),
+			// sequential hits do not go through the weak lookup
+			100.0*float64(compare.WeakHashHits-compare.StrongHashHits+compare.SequentialHits)/float64(compare.WeakHashHits),
 		)
 	}
 
 	fmt.Println("Total matched bytes:", totalMatchingSize)
 	fmt.Println("Total matched blocks:", matchedBlockCountAfterMerging)
 
-	// TODO: GetMissingBlocks uses the highest index, not the count, this can be pretty confusing
-	// Should clean up this interface to avoid that
-	missing := mergedBlocks.GetMissingBlocks(uint(index.BlockCount) - 1)
+	literals := merger.GetLiteralSpans(localFile_size)
+	fmt.Println("Unmatched local bytes:", literals.TotalSize())
+	fmt.Println("Unmatched local regions:", len(literals))
+
+	missing := mergedBlocks.MissingBlocks(uint(index.BlockCount))
 	fmt.Println("Index blocks:", index.BlockCount)
 
 	totalMissingSize := uint64(0)
@@ -144,3 +185,63 @@ func Diff(c *cli.Context) error {
 	fmt.Println("Time taken:", time.Now().Sub(startTime))
 	return nil
 }
+
+// checks if the file starts with a magic string, and returns to the start
+func startsWith(f *os.File, magic string) (bool, error) {
+	b := make([]byte, len(magic))
+	n, err := io.ReadFull(f, b)
+
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	return string(b[:n]) == magic, nil
+}
+
+// compares two plain files, without a pre-built index
+func diffFiles(c *cli.Context, localFilename, referenceFilename string) error {
+	startTime := time.Now()
+
+	result, err := gosync_main.Diff(
+		localFilename,
+		referenceFilename,
+		gosync_main.DiffOptions{
+			BlockSize:   uint(c.Int("blocksize")),
+			Concurrency: c.Int("p"),
+		},
+	)
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Blocksize: ", result.BlockSize)
+	fmt.Println("Matched spans:", len(result.Matched))
+	fmt.Println("Total matched bytes:", result.MatchedBytes)
+	fmt.Println("Missing spans:", len(result.Missing))
+	fmt.Println("Total missing bytes:", result.MissingBytes)
+	fmt.Println("Unmatched local bytes:", result.LiteralBytes)
+	fmt.Println("Unmatched local regions:", len(result.Literals))
+	fmt.Printf("Reuse: %.2f%%\n", result.Reuse)
+	fmt.Println("Time taken:", time.Now().Sub(startTime))
+	return nil
+}
+
+// compares a file to a reference tar file, indexed in memory
+func diffTarFiles(c *cli.Context, localFilename string, referenceFile *os.File) error {
+	info, err := referenceFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	index, err := tarsync.Build(referenceFile, info.Size(), uint(c.Int("blocksize")))
+	if err != nil {
+		return fmt.Errorf("Cannot index %v: %v", referenceFile.Name(), err)
+	}
+
+	return diffTar(c, localFilename, index)
+}
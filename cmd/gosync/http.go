@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Redundancy/go-sync/blocksources"
+	"github.com/urfave/cli/v2"
+)
+
+// flags for commands that make HTTP requests, read by httpOptions
+var httpFlags = []cli.Flag{
+	&cli.StringSliceFlag{
+		Name:  "header",
+		Usage: "A header to send with every request, as \"Name: value\", may be repeated",
+	},
+	&cli.StringFlag{
+		Name:  "token-file",
+		Usage: "A file containing a bearer token, read before every request so that it can be refreshed",
+	},
+	&cli.StringFlag{
+		Name:  "user-agent",
+		Usage: "The User-Agent header to send",
+	},
+	&cli.StringFlag{
+		Name:  "proxy",
+		Usage: "The URL of a proxy to use, rather than one from the environment",
+	},
+	&cli.StringFlag{
+		Name:  "ca-cert",
+		Usage: "A PEM file of CA certificates to trust, rather than the system ones",
+	},
+	&cli.StringFlag{
+		Name:  "client-cert",
+		Usage: "A PEM client certificate to use for TLS, requires --client-key",
+	},
+	&cli.StringFlag{
+		Name:  "client-key",
+		Usage: "The PEM private key of --client-cert",
+	},
+}
+
+// creates the options for HTTP requests from httpFlags
+func httpOptions(c *cli.Context) (options blocksources.HttpOptions, err error) {
+	options.UserAgent = c.String("user-agent")
+
+	if headers := c.StringSlice("header"); len(headers) > 0 {
+		options.Header = make(http.Header)
+
+		for _, h := range headers {
+			parts := strings.SplitN(h, ":", 2)
+
+			if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+				return options, fmt.Errorf("Invalid header %q, expected \"Name: value\"", h)
+			}
+
+			options.Header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+		}
+	}
+
+	if tokenFile := c.String("token-file"); tokenFile != "" {
+		options.HeaderFunc = func() (http.Header, error) {
+			token, err := ioutil.ReadFile(tokenFile)
+			if err != nil {
+				return nil, formatFileError(tokenFile, err)
+			}
+
+			return http.Header{
+				"Authorization": []string{"Bearer " + strings.TrimSpace(string(token))},
+			}, nil
+		}
+	}
+
+	proxy := c.String("proxy")
+
+	if proxy == "" && c.String("ca-cert") == "" && c.String("client-cert") == "" && c.String("client-key") == "" {
+		return options, nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if transport.TLSClientConfig, err = tlsConfig(c); err != nil {
+		return options, err
+	}
+
+	if proxy != "" {
+		proxyURL, err := url.Parse(proxy)
+		if err != nil {
+			return options, fmt.Errorf("Invalid proxy URL %v: %v", proxy, err)
+		}
+
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	options.Transport = transport
+	return options, nil
+}
+
+// creates the client TLS configuration from the --ca-cert, --client-cert and --client-key flags
+func tlsConfig(c *cli.Context) (*tls.Config, error) {
+	config := &tls.Config{}
+	caCert := c.String("ca-cert")
+	clientCert := c.String("client-cert")
+	clientKey := c.String("client-key")
+
+	if caCert != "" {
+		pem, err := ioutil.ReadFile(caCert)
+		if err != nil {
+			return nil, formatFileError(caCert, err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %v", caCert)
+		}
+
+		config.RootCAs = pool
+	}
+
+	if clientCert != "" || clientKey != "" {
+		if clientCert == "" || clientKey == "" {
+			return nil, fmt.Errorf("--client-cert and --client-key must be used together")
+		}
+
+		certificate, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load the client certificate: %v", err)
+		}
+
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
@@ -12,15 +12,12 @@ import (
 	"os"
 	"runtime"
 
+	"github.com/Redundancy/go-sync/indexfile"
 	"github.com/urfave/cli/v2"
 )
 
 const (
 	DefaultBlockSize = 8192
-	magicString      = "G0S9NC" // just to confirm the file type is used correctly
-	majorVersion     = uint16(0)
-	minorVersion     = uint16(2)
-	patchVersion     = uint16(1)
 )
 
 var app = cli.NewApp()
@@ -42,9 +39,9 @@ func main() {
 
 	app.Version = fmt.Sprintf(
 		"%v.%v.%v",
-		majorVersion,
-		minorVersion,
-		patchVersion,
+		indexfile.MajorVersion,
+		indexfile.MinorVersion,
+		indexfile.PatchVersion,
 	)
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+const runMainEnv = "GOSYNC_TEST_RUN_MAIN"
+
+// the commands exit the process on errors, so the tests run them in a copy of the test binary
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) == "1" {
+		main()
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
+func gosyncCommand(args ...string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), runMainEnv+"=1")
+	return cmd
+}
+
+func runGosync(t *testing.T, args ...string) string {
+	output, err := gosyncCommand(args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("gosync %v failed: %v\n%s", args, err, output)
+	}
+
+	return string(output)
+}
+
+// references that are empty or smaller than one block, and local files to sync them from
+var smallFileCases = []struct {
+	name      string
+	local     []byte
+	reference []byte
+}{
+	{"both empty", nil, nil},
+	{"empty reference", []byte("some local content"), nil},
+	{"empty local file", nil, []byte("short")},
+	{"same short file", []byte("short"), []byte("short")},
+	{"different short file", []byte("other"), []byte("short")},
+}
+
+func writeSmallFiles(t *testing.T, local, reference []byte) (dir, localFile, referenceFile string) {
+	dir, err := ioutil.TempDir("", "gosync-cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	localFile = filepath.Join(dir, "local")
+	referenceFile = filepath.Join(dir, "reference")
+
+	if err := ioutil.WriteFile(localFile, local, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(referenceFile, reference, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return dir, localFile, referenceFile
+}
+
+func TestDiffSmallFiles(t *testing.T) {
+	for _, c := range smallFileCases {
+		t.Run(c.name, func(t *testing.T) {
+			dir, localFile, referenceFile := writeSmallFiles(t, c.local, c.reference)
+			defer os.RemoveAll(dir)
+
+			runGosync(t, "diff", "--blocksize", "16", localFile, referenceFile)
+
+			runGosync(t, "build", "--blocksize", "16", referenceFile)
+			output := runGosync(t, "diff", localFile, referenceFile+".gosync")
+
+			if !bytes.Contains([]byte(output), []byte("Approximate missing bytes:")) {
+				t.Errorf("Diff did not complete:\n%s", output)
+			}
+		})
+	}
+}
+
+func TestPatchSmallFiles(t *testing.T) {
+	for _, c := range smallFileCases {
+		t.Run(c.name, func(t *testing.T) {
+			dir, localFile, referenceFile := writeSmallFiles(t, c.local, c.reference)
+			defer os.RemoveAll(dir)
+
+			// blocks of the reference are requested over http
+			server := httptest.NewServer(http.FileServer(http.Dir(dir)))
+			defer server.Close()
+
+			outFile := filepath.Join(dir, "out")
+
+			runGosync(t, "build", "--blocksize", "16", referenceFile)
+			runGosync(t, "patch", localFile, referenceFile+".gosync", server.URL+"/reference", outFile)
+
+			result, err := ioutil.ReadFile(outFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(result, c.reference) {
+				t.Errorf("Patched file is %q, expected %q", result, c.reference)
+			}
+		})
+	}
+}
+
+func TestFailedDeltaLeavesNoOutput(t *testing.T) {
+	dir, oldFile, _ := writeSmallFiles(t, []byte("The quick brown fox"), nil)
+	defer os.RemoveAll(dir)
+
+	runGosync(t, "build", "--blocksize", "16", oldFile)
+
+	// reading a directory as the new file fails after the output would have been created
+	outFile := filepath.Join(dir, "out.delta")
+	if err := gosyncCommand("delta", oldFile+".gosync", dir, outFile).Run(); err == nil {
+		t.Fatal("Expected the delta to fail")
+	}
+
+	if _, err := os.Stat(outFile); !os.IsNotExist(err) {
+		t.Errorf("Expected no output from a failed delta: %v", err)
+	}
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 3 {
+		t.Errorf("Expected the temporary file to be removed, found %v files", len(files))
+	}
+}
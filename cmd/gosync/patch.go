@@ -1,15 +1,24 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"runtime"
+	"strings"
 
 	gosync_main "github.com/Redundancy/go-sync"
+	"github.com/Redundancy/go-sync/blocksources"
+	"github.com/Redundancy/go-sync/gzipsync"
+	"github.com/Redundancy/go-sync/indexfile"
+	"github.com/Redundancy/go-sync/merkle"
+	"github.com/Redundancy/go-sync/tarsync"
+	"github.com/Redundancy/go-sync/zsync"
 	"github.com/urfave/cli/v2"
 )
 
-const usage = "gosync patch <localfile> <reference index> <reference source> [<output>]"
+const usage = "gosync patch <localfile> <reference index> <reference source> [<output>] [-- <source command>...]"
 
 func init() {
 	app.Commands = append(
@@ -21,17 +30,57 @@ func init() {
 			Description: `Recreate the reference source file, using an index and a local file that is believed to be similar.
 The index should be produced by "gosync build".
 
-<reference index> is a .gosync file and may be a local, unc network path or http/https url
+<reference index> is a .gosync or .zsync file and may be a local, unc network path or http/https url
 <reference source> is corresponding target and may be a local, unc network path or http/https url
-<output> is optional. If not specified, the local file will be overwritten when done.`,
+<output> is optional. If not specified, the local file will be overwritten when done.
+
+Additional local files that may share content with the reference (such as other versions) can be
+given with --seed, and blocks are taken from whichever local file has them.
+
+Requests for the index and the reference can be configured with headers, a bearer token,
+a proxy, a CA bundle and a client certificate.
+
+The reference can also be read with the block protocol of "gosync serve", from a
+gosync://host:port/path (or gosyncs:// for TLS) URL, or from a server started by the command after "--",
+such as "-- ssh host gosync serve --stdio /srv" with the path of the reference on that host.
+
+With --verify-merkle, every block from the reference is also checked against the root of the Merkle
+tree in the index (SHA-256 of the block data), with a proof for each request from the server of
+the reference, such as "gosync serve". This needs an index built with Merkle roots (gosync 0.4 or later)
+and an http or https reference.
+
+With --trusted-key, the index must have a signature (see "gosync build --sign-key") by one of the
+trusted keys, which is checked before anything is written.
+
+If the index was built for a gzip file (with "gosync build --format gzip"), the local file and seeds
+are decompressed, <reference source> must be the decompressed content of the reference, and the
+patched content is compressed again to recreate the reference gzip file exactly. This ONLY works for
+gzip files made by Go's compress/flate (not GNU gzip, pigz, zlib or other compressors), and fails
+without writing anything if the result differs. compress/flate may change between Go versions, so
+gosync should be built with the Go version recorded in the index (see "gosync build --format gzip").
+
+If the index was built for a tar file (with "gosync build --format tar"), the local file and seeds
+are compared a member at a time, so that members are found wherever they have moved to.`,
 			Action: Patch,
-			Flags: []cli.Flag{
+			Flags: append([]cli.Flag{
 				&cli.IntFlag{
 					Name:  "p",
 					Value: runtime.NumCPU(),
 					Usage: "The number of streams to use concurrently",
 				},
-			},
+				&cli.StringSliceFlag{
+					Name:  "seed",
+					Usage: "Another local file to take blocks from, may be repeated",
+				},
+				&cli.BoolFlag{
+					Name:  "weak-filter",
+					Usage: "Filter weak checksums before looking them up, which is faster when the local file is mostly different",
+				},
+				&cli.BoolFlag{
+					Name:  "verify-merkle",
+					Usage: "Check blocks against the Merkle root in the index, with proofs from the reference server",
+				},
+			}, append(httpFlags, trustFlags...)...),
 		},
 	)
 }
@@ -42,52 +91,94 @@ func Patch(c *cli.Context) error {
 
 		fmt.Fprintln(os.Stderr, "Starting patching process")
 
-		if l := c.Args().Len(); l < 3 || l > 4 {
+		args, _ := splitSourceCommand(c)
+
+		if l := len(args); l < 3 || l > 4 {
 			return fmt.Errorf(
 				"Usage is \"%v\" (invalid number of arguments)",
 				usage,
 			)
 		}
 
-		localFilename := c.Args().Get(0)
-		summaryFile := c.Args().Get(1)
-		referencePath := c.Args().Get(2)
+		localFilename := args[0]
+		summaryFile := args[1]
+		referencePath := args[2]
 
 		outFilename := localFilename
-		if c.Args().Len() == 4 {
-			outFilename = c.Args().Get(3)
+		if len(args) == 4 {
+			outFilename = args[3]
+		}
+
+		options, e := httpOptions(c)
+		if e != nil {
+			return e
 		}
 
-		indexReader, e := os.Open(summaryFile)
+		indexReader, e := getLocalOrRemoteFile(summaryFile, options)
 		if e != nil {
 			return e
 		}
 		defer indexReader.Close()
 
-		_, _, _, filesize, blocksize, e := readHeadersAndCheck(
-			indexReader,
-			magicString,
-			majorVersion,
-		)
+		trustedIndex, err := readTrustedIndex(c, indexReader, summaryFile, options)
+		if err != nil {
+			return err
+		}
 
-		index, checksumLookup, blockCount, err := readIndex(
-			indexReader,
-			uint(blocksize),
-		)
+		rsyncOptions := gosync_main.RSyncOptions{
+			SeedFiles:  c.StringSlice("seed"),
+			HTTP:       options,
+			WeakFilter: c.Bool("weak-filter"),
+		}
+
+		indexData := bufio.NewReader(trustedIndex)
+
+		if start, _ := indexData.Peek(len(tarsync.MagicString)); string(start) == tarsync.MagicString {
+			if c.Bool("verify-merkle") {
+				return fmt.Errorf("Tar indexes have no Merkle root for --verify-merkle")
+			}
+
+			return patchTar(c, indexData, localFilename, referencePath, outFilename, rsyncOptions)
+		}
+
+		fs, gzipParams, err := readSummary(indexData)
+		if err != nil {
+			return err
+		}
+
+		if c.Bool("verify-merkle") {
+			if rsyncOptions.Verifier, err = merkleVerifier(fs, referencePath, options); err != nil {
+				return err
+			}
+		}
+
+		if isBlockProtocol(c, referencePath) {
+			requester, connection, err := openBlockRequester(c, referencePath, fs.GetBlockSize())
+			if err != nil {
+				return err
+			}
+			defer connection.Close()
 
-		fs := &gosync_main.BasicSummary{
-			ChecksumIndex:  index,
-			ChecksumLookup: checksumLookup,
-			BlockCount:     blockCount,
-			BlockSize:      uint(blocksize),
-			FileSize:       filesize,
+			rsyncOptions.Requester = requester
 		}
 
-		rsync, err := gosync_main.MakeRSync(
+		if gzipParams != nil {
+			return gosync_main.PatchGzip(
+				localFilename,
+				referencePath,
+				outFilename,
+				fs,
+				gzipParams,
+				rsyncOptions,
+			)
+		}
+
+		rsync, err := gosync_main.MakeRSyncWithOptions(
 			localFilename,
 			referencePath,
 			outFilename,
 			fs,
+			rsyncOptions,
 		)
 
 		if err != nil {
@@ -104,3 +195,97 @@ func Patch(c *cli.Context) error {
 	})
 	return nil
 }
+
+/*
+reads a .gosync index, or a zsync control file.
+For the index of a gzip file, the parameters to compress the patched content again are also returned.
+*/
+func readSummary(r io.Reader) (gosync_main.FileSummary, *gzipsync.Params, error) {
+	reader := bufio.NewReader(r)
+
+	if start, _ := reader.Peek(len(zsync.MagicString)); string(start) == zsync.MagicString {
+		control, err := zsync.Read(reader)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return control.Summary(), nil, nil
+	}
+
+	if start, _ := reader.Peek(len(gzipsync.MagicString)); string(start) == gzipsync.MagicString {
+		params, err := gzipsync.ReadIndex(reader)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		summary, err := readGosyncSummary(reader)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if summary.GetFileSize() != params.Size {
+			return nil, nil, fmt.Errorf(
+				"The index of the gzip content is for %v bytes, but the content is %v bytes",
+				summary.GetFileSize(),
+				params.Size,
+			)
+		}
+
+		return summary, params, nil
+	}
+
+	summary, err := readGosyncSummary(reader)
+	return summary, nil, err
+}
+
+// reads a .gosync index
+func readGosyncSummary(reader io.Reader) (gosync_main.FileSummary, error) {
+	header, err := indexfile.ReadHeader(reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	index, checksumLookup, blockCount, err := readIndex(
+		reader,
+		uint(header.BlockSize),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &gosync_main.BasicSummary{
+		ChecksumIndex:  index,
+		ChecksumLookup: checksumLookup,
+		BlockCount:     blockCount,
+		BlockSize:      uint(header.BlockSize),
+		FileSize:       header.FileSize,
+		FileChecksum:   header.FileChecksum,
+		MerkleRoot:     header.MerkleRoot,
+	}, nil
+}
+
+// checks blocks against the Merkle root in the index, with proofs from the server of the reference
+func merkleVerifier(
+	summary gosync_main.FileSummary,
+	referenceURL string,
+	options blocksources.HttpOptions,
+) (*merkle.Verifier, error) {
+	basic, ok := summary.(*gosync_main.BasicSummary)
+	if !ok || basic.MerkleRoot == nil {
+		return nil, fmt.Errorf("The index has no Merkle root for --verify-merkle, it must be built again")
+	}
+
+	if !strings.HasPrefix(referenceURL, "http://") && !strings.HasPrefix(referenceURL, "https://") {
+		return nil, fmt.Errorf("--verify-merkle gets proofs from the server, so the reference must be an http or https URL")
+	}
+
+	index := &merkle.Index{
+		FileSize:  basic.FileSize,
+		BlockSize: basic.BlockSize,
+		Root:      basic.MerkleRoot,
+	}
+
+	return merkle.NewVerifier(index, &merkle.HTTPProofs{URL: referenceURL, Options: options}), nil
+}
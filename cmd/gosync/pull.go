@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+
+	gosync_main "github.com/Redundancy/go-sync"
+	"github.com/urfave/cli/v2"
+)
+
+const pullUsage = "gosync pull [--blocksize <size>] <localfile> <reference url> [<output>]"
+
+func init() {
+	app.Commands = append(
+		app.Commands,
+		&cli.Command{
+			Name:  "pull",
+			Usage: pullUsage,
+			Description: `Recreate the reference file from a server that creates deltas, such as "gosync serve --allow-pull".
+The signature of the local file is sent to the server, which replies with only the data that the
+local file is missing. No index of the reference is needed, which is better than "gosync patch"
+when the local file is much smaller than the reference.
+
+<output> is optional. If not specified, the local file will be overwritten when done.`,
+			Action: Pull,
+			Flags: append([]cli.Flag{
+				&cli.IntFlag{
+					Name:  "blocksize",
+					Value: DefaultBlockSize,
+					Usage: "The block size of the local file's signature",
+				},
+			}, httpFlags...),
+		},
+	)
+}
+
+// Pull patches a file with a delta from the server
+func Pull(c *cli.Context) error {
+	errorWrapper(c, func(c *cli.Context) error {
+		if l := c.Args().Len(); l < 2 || l > 3 {
+			return fmt.Errorf(
+				"Usage is \"%v\" (invalid number of arguments)",
+				pullUsage,
+			)
+		}
+
+		localFilename := c.Args().Get(0)
+		referenceURL := c.Args().Get(1)
+
+		outFilename := localFilename
+		if c.Args().Len() == 3 {
+			outFilename = c.Args().Get(2)
+		}
+
+		blocksize := c.Int("blocksize")
+		if blocksize <= 0 {
+			return fmt.Errorf("Invalid block size: %v", blocksize)
+		}
+
+		options, err := httpOptions(c)
+		if err != nil {
+			return err
+		}
+
+		patch, err := gosync_main.PatchFromServerDelta(
+			localFilename,
+			referenceURL,
+			outFilename,
+			uint(blocksize),
+			options,
+		)
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf(
+			"Patched a %v byte file, reusing %v bytes of the local file\n",
+			patch.FileSize,
+			patch.CopiedBytes(),
+		)
+
+		return nil
+	})
+	return nil
+}
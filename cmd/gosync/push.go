@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+
+	gosync_main "github.com/Redundancy/go-sync"
+	"github.com/urfave/cli/v2"
+)
+
+const pushUsage = "gosync push <localfile> <destination url>"
+
+func init() {
+	app.Commands = append(
+		app.Commands,
+		&cli.Command{
+			Name:  "push",
+			Usage: pushUsage,
+			Description: `Upload a file to a server that has a previous version of it, such as "gosync serve --allow-upload",
+sending only the data that the server does not already have.
+
+The index of the server's copy is fetched from "<destination url>?index". The server checks the result
+against the checksum of the local file before replacing its copy, and the upload fails if the server's
+copy changed after the index was fetched.
+
+"gosync serve" requires the upload token, which is sent with --token-file.`,
+			Action: Push,
+			Flags:  httpFlags,
+		},
+	)
+}
+
+// Push uploads a file
+func Push(c *cli.Context) error {
+	errorWrapper(c, func(c *cli.Context) error {
+		if c.Args().Len() != 2 {
+			return fmt.Errorf(
+				"Usage is \"%v\" (invalid number of arguments)",
+				pushUsage,
+			)
+		}
+
+		options, err := httpOptions(c)
+		if err != nil {
+			return err
+		}
+
+		result, err := gosync_main.Push(c.Args().Get(0), c.Args().Get(1), options)
+		if err != nil {
+			return err
+		}
+
+		if result.Created {
+			fmt.Printf("Created a %v byte file, sending %v bytes\n", result.FileSize, result.Sent)
+		} else {
+			fmt.Printf("Updated a %v byte file, sending %v bytes\n", result.FileSize, result.Sent)
+		}
+
+		return nil
+	})
+	return nil
+}
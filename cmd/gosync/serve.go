@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/Redundancy/go-sync/blockprotocol"
+	"github.com/Redundancy/go-sync/server"
+	"github.com/urfave/cli/v2"
+)
+
+const serveUsage = "gosync serve [--address <host:port>] [--block-address <host:port>] [--stdio] <directory>"
+
+func init() {
+	app.Commands = append(
+		app.Commands,
+		&cli.Command{
+			Name:  "serve",
+			Usage: serveUsage,
+			Description: `Serve the files in a directory over HTTP, with support for ranged requests.
+
+The .gosync index of any file can be fetched from "<file>?index" or "<file>.gosync", and is
+generated on demand and cached until the file changes (up to --index-cache megabytes of indexes).
+Proofs for ranges of blocks against the Merkle root in the index are served from
+"<file>?proof=<first block>-<last block>", for "gosync patch --verify-merkle".
+
+With --allow-pull, a POST of the signature of a local file to the path of a file returns a delta
+against it, for "gosync pull". Each request reads the whole file and holds the signature in memory,
+so signatures over --max-signature-size megabytes are rejected, and --pull-token-file can require
+a bearer token (pulled with "gosync pull --token-file").
+
+With --allow-upload, new versions of files can be uploaded with "gosync push". Uploads can replace
+any file in the directory, so they require the bearer token in --upload-token-file
+(pushed with "gosync push --token-file"), and deltas over --max-upload-size megabytes are rejected.
+
+With --block-address, blocks can also be read with the block protocol, which has much less overhead
+per request than HTTP, from gosync://host:port/path URLs. With --stdio, only the block protocol is served,
+on stdin and stdout, so that clients can start the server over ssh
+(for instance "gosync patch <local> <index> <path> -- ssh host gosync serve --stdio <directory>").
+
+With --tls-cert and --tls-key, both HTTP and the block protocol are served over TLS
+(use https:// and gosyncs:// URLs).`,
+			Action: Serve,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "address",
+					Value: ":8000",
+					Usage: "The address to listen on",
+				},
+				&cli.IntFlag{
+					Name:  "blocksize",
+					Value: DefaultBlockSize,
+					Usage: "The block size to use for generated indexes",
+				},
+				&cli.IntFlag{
+					Name:  "index-cache",
+					Value: server.DefaultIndexCacheSize / (1024 * 1024),
+					Usage: "The approximate memory to use for cached indexes, in megabytes",
+				},
+				&cli.BoolFlag{
+					Name:  "allow-pull",
+					Usage: "Serve deltas against the signatures posted by \"gosync pull\"",
+				},
+				&cli.IntFlag{
+					Name:  "max-signature-size",
+					Value: server.DefaultMaxSignatureSize / (1024 * 1024),
+					Usage: "The largest signature to accept from \"gosync pull\", in megabytes",
+				},
+				&cli.StringFlag{
+					Name:  "pull-token-file",
+					Usage: "A file containing the bearer token that \"gosync pull\" requests must have",
+				},
+				&cli.BoolFlag{
+					Name:  "allow-upload",
+					Usage: "Allow files to be replaced by uploads from \"gosync push\", requires --upload-token-file",
+				},
+				&cli.StringFlag{
+					Name:  "upload-token-file",
+					Usage: "A file containing the bearer token that uploads must have",
+				},
+				&cli.IntFlag{
+					Name:  "max-upload-size",
+					Value: server.DefaultMaxDeltaSize / (1024 * 1024),
+					Usage: "The largest upload to accept, in megabytes",
+				},
+				&cli.StringFlag{
+					Name:  "block-address",
+					Usage: "An address to also serve the block protocol on",
+				},
+				&cli.BoolFlag{
+					Name:  "stdio",
+					Usage: "Serve the block protocol on stdin and stdout, rather than serving HTTP",
+				},
+				&cli.StringFlag{
+					Name:  "tls-cert",
+					Usage: "A PEM certificate to serve TLS with, requires --tls-key",
+				},
+				&cli.StringFlag{
+					Name:  "tls-key",
+					Usage: "The PEM private key of --tls-cert",
+				},
+			},
+		},
+	)
+}
+
+// Serve serves a directory over HTTP
+func Serve(c *cli.Context) error {
+	errorWrapper(c, func(c *cli.Context) error {
+		if c.Args().Len() != 1 {
+			return fmt.Errorf(
+				"Usage is \"%v\" (invalid number of arguments)",
+				serveUsage,
+			)
+		}
+
+		blocksize := c.Int("blocksize")
+		if blocksize <= 0 {
+			return fmt.Errorf("Invalid block size: %v", blocksize)
+		}
+
+		indexCache := c.Int("index-cache")
+		if indexCache <= 0 {
+			return fmt.Errorf("Invalid index cache size: %v", indexCache)
+		}
+
+		root := c.Args().Get(0)
+		blockServer := &blockprotocol.Server{Root: root}
+
+		if c.Bool("stdio") {
+			// stdout carries the protocol, so nothing else can be written to it
+			return blockServer.ServeConn(struct {
+				io.Reader
+				io.Writer
+			}{os.Stdin, os.Stdout})
+		}
+
+		var config *tls.Config
+
+		if certFile, keyFile := c.String("tls-cert"), c.String("tls-key"); certFile != "" || keyFile != "" {
+			if certFile == "" || keyFile == "" {
+				return fmt.Errorf("--tls-cert and --tls-key must be used together")
+			}
+
+			certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return fmt.Errorf("Could not load the TLS certificate: %v", err)
+			}
+
+			config = &tls.Config{Certificates: []tls.Certificate{certificate}}
+		}
+
+		listen := func(address string) (net.Listener, error) {
+			if config != nil {
+				return tls.Listen("tcp", address, config)
+			}
+			return net.Listen("tcp", address)
+		}
+
+		if blockAddress := c.String("block-address"); blockAddress != "" {
+			listener, err := listen(blockAddress)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("Serving the block protocol for %v on %v\n", root, blockAddress)
+			go blockServer.Serve(listener)
+		}
+
+		address := c.String("address")
+		listener, err := listen(address)
+		if err != nil {
+			return err
+		}
+
+		fileServer := server.NewFileServer(root, uint(blocksize))
+		fileServer.IndexCacheSize = int64(indexCache) * 1024 * 1024
+
+		if c.Bool("allow-pull") {
+			deltas, err := deltaHandler(c, root)
+			if err != nil {
+				return err
+			}
+
+			fileServer.Deltas = deltas
+		}
+
+		if c.Bool("allow-upload") {
+			uploads, err := uploadHandler(c, root)
+			if err != nil {
+				return err
+			}
+
+			fileServer.Uploads = uploads
+		}
+
+		fmt.Printf("Serving %v on %v\n", root, address)
+		return http.Serve(listener, fileServer)
+	})
+	return nil
+}
+
+func uploadHandler(c *cli.Context, root string) (*server.UploadHandler, error) {
+	maxSize := c.Int("max-upload-size")
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("Invalid upload size limit: %v", maxSize)
+	}
+
+	tokenFile := c.String("upload-token-file")
+	if tokenFile == "" {
+		return nil, fmt.Errorf("--allow-upload requires --upload-token-file")
+	}
+
+	token, err := readServeToken(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &server.UploadHandler{
+		Root:         root,
+		MaxDeltaSize: int64(maxSize) * 1024 * 1024,
+		Token:        token,
+	}, nil
+}
+
+func deltaHandler(c *cli.Context, root string) (*server.DeltaHandler, error) {
+	maxSize := c.Int("max-signature-size")
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("Invalid signature size limit: %v", maxSize)
+	}
+
+	handler := &server.DeltaHandler{
+		Root:             root,
+		MaxSignatureSize: int64(maxSize) * 1024 * 1024,
+	}
+
+	if tokenFile := c.String("pull-token-file"); tokenFile != "" {
+		token, err := readServeToken(tokenFile)
+		if err != nil {
+			return nil, err
+		}
+
+		handler.Token = token
+	}
+
+	return handler, nil
+}
+
+// reads a bearer token that requests must have
+func readServeToken(tokenFile string) (string, error) {
+	token, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("Could not read the token: %v", err)
+	}
+
+	if len(bytes.TrimSpace(token)) == 0 {
+		return "", fmt.Errorf("The token in %v is empty", tokenFile)
+	}
+
+	return string(bytes.TrimSpace(token)), nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+
+	"github.com/Redundancy/go-sync/blocksources"
+	"github.com/Redundancy/go-sync/signing"
+	"github.com/urfave/cli/v2"
+)
+
+const keygenUsage = "gosync keygen <private key file> <public key file>"
+
+var trustFlags = []cli.Flag{
+	&cli.StringSliceFlag{
+		Name:  "trusted-key",
+		Usage: "A public key file: the index must be signed by one of the trusted keys, may be repeated",
+	},
+	&cli.StringFlag{
+		Name:  "signature",
+		Usage: "The signature of the index, when there are trusted keys. Defaults to the index followed by \".sig\"",
+	},
+}
+
+func init() {
+	app.Commands = append(
+		app.Commands,
+		&cli.Command{
+			Name:  "keygen",
+			Usage: keygenUsage,
+			Description: `Create an ed25519 key pair for signing indexes with "gosync build --sign-key",
+whose public key can be given to "gosync patch --trusted-key".`,
+			Action: Keygen,
+		},
+	)
+}
+
+// Keygen creates a key pair for signing indexes
+func Keygen(c *cli.Context) error {
+	errorWrapper(c, func(c *cli.Context) error {
+		if c.Args().Len() != 2 {
+			return fmt.Errorf(
+				"Usage is \"%v\" (invalid number of arguments)",
+				keygenUsage,
+			)
+		}
+
+		key, err := signing.GenerateKey()
+		if err != nil {
+			return err
+		}
+
+		privateFilename := c.Args().Get(0)
+		private, err := os.OpenFile(privateFilename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return formatFileError(privateFilename, err)
+		}
+		defer private.Close()
+
+		if err := signing.WritePrivateKey(private, key); err != nil {
+			return err
+		}
+
+		if err := private.Close(); err != nil {
+			return err
+		}
+
+		publicFilename := c.Args().Get(1)
+		public, err := os.Create(publicFilename)
+		if err != nil {
+			return formatFileError(publicFilename, err)
+		}
+		defer public.Close()
+
+		if err := signing.WritePublicKey(public, key.Public().(ed25519.PublicKey)); err != nil {
+			return err
+		}
+
+		return public.Close()
+	})
+	return nil
+}
+
+// the default location of the signature of an index, which may be a URL
+func signatureLocation(indexPath string) string {
+	if u, err := url.Parse(indexPath); err == nil && u.Scheme != "" {
+		u.Path += ".sig"
+		return u.String()
+	}
+
+	return indexPath + ".sig"
+}
+
+// loads the key given by --sign-key, or nil if there is none
+func signingKey(c *cli.Context) (ed25519.PrivateKey, error) {
+	filename := c.String("sign-key")
+	if filename == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, formatFileError(filename, err)
+	}
+	defer f.Close()
+
+	key, err := signing.ReadPrivateKey(f)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read the signing key %v: %v", filename, err)
+	}
+
+	return key, nil
+}
+
+// signs the index that has been written to indexPath
+func writeIndexSignature(indexPath string, key ed25519.PrivateKey) error {
+	index, err := ioutil.ReadFile(indexPath)
+	if err != nil {
+		return err
+	}
+
+	sigPath := signatureLocation(indexPath)
+	if err := ioutil.WriteFile(sigPath, signing.Sign(key, index), 0644); err != nil {
+		return formatFileError(sigPath, err)
+	}
+
+	return nil
+}
+
+/*
+reads an index, and checks its signature if there are trusted keys.
+Nothing should be done with an index until it has been read by this.
+*/
+func readTrustedIndex(c *cli.Context, r io.Reader, indexPath string, options blocksources.HttpOptions) (io.Reader, error) {
+	keyFiles := c.StringSlice("trusted-key")
+	if len(keyFiles) == 0 {
+		return r, nil
+	}
+
+	trusted := make([]ed25519.PublicKey, len(keyFiles))
+
+	for i, filename := range keyFiles {
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, formatFileError(filename, err)
+		}
+
+		trusted[i], err = signing.ReadPublicKey(f)
+		f.Close()
+
+		if err != nil {
+			return nil, fmt.Errorf("Could not read the trusted key %v: %v", filename, err)
+		}
+	}
+
+	index, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	sigPath := c.String("signature")
+	if sigPath == "" {
+		sigPath = signatureLocation(indexPath)
+	}
+
+	sigReader, err := getLocalOrRemoteFile(sigPath, options)
+	if err != nil {
+		return nil, fmt.Errorf("The index is not signed, and there are trusted keys (%v)", err)
+	}
+	defer sigReader.Close()
+
+	signature, err := ioutil.ReadAll(io.LimitReader(sigReader, int64(signing.SignatureSize)+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := signing.Verify(trusted, index, signature); err != nil {
+		return nil, fmt.Errorf("Refusing to use the index %v: %v", indexPath, err)
+	}
+
+	return bytes.NewReader(index), nil
+}
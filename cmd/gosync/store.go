@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Redundancy/go-sync/chunkstore"
+	"github.com/urfave/cli/v2"
+)
+
+const storeAddUsage = "gosync store add <store> <version> <file>"
+const storeGetUsage = "gosync store get <store> <version> <output file>"
+const storeListUsage = "gosync store list <store>"
+const storeDeleteUsage = "gosync store delete <store> <version>"
+const storeGCUsage = "gosync store gc <store>"
+const storeFsckUsage = "gosync store fsck <store>"
+const storeStatsUsage = "gosync store stats <store>"
+
+func init() {
+	app.Commands = append(
+		app.Commands,
+		&cli.Command{
+			Name:  "store",
+			Usage: "Keep many versions of files in a chunk store",
+			Description: `A chunk store is a directory that keeps versions of files as blocks named by their checksum,
+so that the blocks that versions have in common are only stored once.`,
+			Subcommands: []*cli.Command{
+				{
+					Name:   "add",
+					Usage:  storeAddUsage,
+					Action: StoreAdd,
+					Flags: []cli.Flag{
+						&cli.IntFlag{
+							Name:  "blocksize",
+							Value: DefaultBlockSize,
+							Usage: "The block size to split the file into",
+						},
+					},
+				},
+				{
+					Name:   "get",
+					Usage:  storeGetUsage,
+					Action: StoreGet,
+				},
+				{
+					Name:   "list",
+					Usage:  storeListUsage,
+					Action: StoreList,
+				},
+				{
+					Name:        "delete",
+					Usage:       storeDeleteUsage,
+					Description: `Delete a version, and the blocks that no other version uses.`,
+					Action:      StoreDelete,
+				},
+				{
+					Name:        "gc",
+					Usage:       storeGCUsage,
+					Description: `Delete the blocks that no version uses, such as those left by an interrupted add.`,
+					Action:      StoreGC,
+				},
+				{
+					Name:  "fsck",
+					Usage: storeFsckUsage,
+					Description: `Check that every block matches its checksum, and that every version can be rebuilt.
+Exits with an error if any version is damaged.`,
+					Action: StoreFsck,
+				},
+				{
+					Name:   "stats",
+					Usage:  storeStatsUsage,
+					Action: StoreStats,
+				},
+			},
+		},
+	)
+}
+
+// opens the store in the first argument, checking the number of arguments.
+// Only adding a version creates a store that does not exist.
+func openStore(c *cli.Context, args int, usage string, create bool) (*chunkstore.Store, error) {
+	if c.Args().Len() != args {
+		return nil, fmt.Errorf(
+			"Usage is \"%v\" (invalid number of arguments)",
+			usage,
+		)
+	}
+
+	root := c.Args().Get(0)
+	if _, err := os.Stat(root); err != nil && !(create && os.IsNotExist(err)) {
+		return nil, formatFileError(root, err)
+	}
+
+	blocksize := DefaultBlockSize
+	if c.IsSet("blocksize") {
+		blocksize = c.Int("blocksize")
+	}
+
+	if blocksize <= 0 {
+		return nil, fmt.Errorf("Invalid block size: %v", blocksize)
+	}
+
+	return chunkstore.New(root, uint(blocksize))
+}
+
+// StoreAdd adds a version to a store
+func StoreAdd(c *cli.Context) error {
+	errorWrapper(c, func(c *cli.Context) error {
+		store, err := openStore(c, 3, storeAddUsage, true)
+		if err != nil {
+			return err
+		}
+
+		filename := c.Args().Get(2)
+		file, err := os.Open(filename)
+		if err != nil {
+			return formatFileError(filename, err)
+		}
+		defer file.Close()
+
+		recipe, err := store.Add(c.Args().Get(1), file)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Added %v (%v bytes, %v blocks)\n", recipe.Name, recipe.Size, recipe.BlockCount())
+		return nil
+	})
+	return nil
+}
+
+// StoreGet writes a version from a store to a file
+func StoreGet(c *cli.Context) error {
+	errorWrapper(c, func(c *cli.Context) error {
+		store, err := openStore(c, 3, storeGetUsage, false)
+		if err != nil {
+			return err
+		}
+
+		version, err := store.Open(c.Args().Get(1))
+		if err != nil {
+			return err
+		}
+
+		outFilename := c.Args().Get(2)
+		outFile, err := os.Create(outFilename)
+		if err != nil {
+			return formatFileError(outFilename, err)
+		}
+
+		_, err = io.Copy(outFile, io.NewSectionReader(version, 0, version.Size))
+
+		if closeErr := outFile.Close(); err == nil {
+			err = closeErr
+		}
+
+		if err != nil {
+			os.Remove(outFilename)
+		}
+
+		return err
+	})
+	return nil
+}
+
+// StoreList lists the versions in a store
+func StoreList(c *cli.Context) error {
+	errorWrapper(c, func(c *cli.Context) error {
+		store, err := openStore(c, 1, storeListUsage, false)
+		if err != nil {
+			return err
+		}
+
+		versions, err := store.Versions()
+		if err != nil {
+			return err
+		}
+
+		for _, v := range versions {
+			fmt.Printf("%v\t%v\t%x\n", v.Name, v.Size, v.Checksum)
+		}
+
+		return nil
+	})
+	return nil
+}
+
+// StoreDelete deletes a version from a store
+func StoreDelete(c *cli.Context) error {
+	errorWrapper(c, func(c *cli.Context) error {
+		store, err := openStore(c, 2, storeDeleteUsage, false)
+		if err != nil {
+			return err
+		}
+
+		result, err := store.Delete(c.Args().Get(1))
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Deleted %v, freeing %v blocks (%v bytes)\n", c.Args().Get(1), result.Chunks, result.Bytes)
+		return nil
+	})
+	return nil
+}
+
+// StoreGC removes the unused blocks of a store
+func StoreGC(c *cli.Context) error {
+	errorWrapper(c, func(c *cli.Context) error {
+		store, err := openStore(c, 1, storeGCUsage, false)
+		if err != nil {
+			return err
+		}
+
+		result, err := store.GC()
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Removed %v unused blocks (%v bytes)\n", result.Chunks, result.Bytes)
+		return nil
+	})
+	return nil
+}
+
+// StoreFsck checks the integrity of a store
+func StoreFsck(c *cli.Context) error {
+	errorWrapper(c, func(c *cli.Context) error {
+		store, err := openStore(c, 1, storeFsckUsage, false)
+		if err != nil {
+			return err
+		}
+
+		result, err := store.Fsck()
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Checked %v versions and %v blocks\n", result.Versions, result.Chunks)
+
+		for _, key := range result.Corrupt {
+			fmt.Printf("Corrupt block: %v\n", key)
+		}
+
+		for _, key := range result.Missing {
+			fmt.Printf("Missing block: %v\n", key)
+		}
+
+		for _, name := range result.Damaged {
+			fmt.Printf("Damaged version: %v\n", name)
+		}
+
+		if len(result.Unreferenced) > 0 {
+			fmt.Printf("%v blocks are not used by any version\n", len(result.Unreferenced))
+		}
+
+		if !result.OK() {
+			return fmt.Errorf("%v versions are damaged", len(result.Damaged))
+		}
+
+		return nil
+	})
+	return nil
+}
+
+// StoreStats shows the size of a store
+func StoreStats(c *cli.Context) error {
+	errorWrapper(c, func(c *cli.Context) error {
+		store, err := openStore(c, 1, storeStatsUsage, false)
+		if err != nil {
+			return err
+		}
+
+		stats, err := store.Stats()
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Versions: %v\n", stats.Versions)
+		fmt.Printf("Blocks: %v\n", stats.Chunks)
+		fmt.Printf("Stored bytes: %v\n", stats.StoredBytes)
+		fmt.Printf("Total size of versions: %v\n", stats.LogicalBytes)
+		return nil
+	})
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	gosync_main "github.com/Redundancy/go-sync"
+	"github.com/Redundancy/go-sync/tarsync"
+	"github.com/urfave/cli/v2"
+)
+
+// patches a file with a tar index, which is read from r
+func patchTar(
+	c *cli.Context,
+	r io.Reader,
+	localFilename,
+	referencePath,
+	outFilename string,
+	options gosync_main.RSyncOptions,
+) error {
+	index, err := tarsync.ReadIndex(r)
+	if err != nil {
+		return err
+	}
+
+	if isBlockProtocol(c, referencePath) {
+		// blocks of a tar index start on records, rather than multiples of the block size
+		requester, connection, err := openBlockRequester(c, referencePath, tarsync.RecordSize)
+		if err != nil {
+			return err
+		}
+		defer connection.Close()
+
+		options.Requester = requester
+	}
+
+	matches, err := gosync_main.PatchTar(localFilename, referencePath, outFilename, index, options)
+	if err != nil {
+		return err
+	}
+
+	size, reused := totalReuse(index.Reuse(matches...))
+	fmt.Fprintf(os.Stderr, "Reused %v of %v bytes of members\n", reused, size)
+	return nil
+}
+
+func totalReuse(members []tarsync.MemberReuse) (size int64, reused int64) {
+	for _, m := range members {
+		size += m.Size
+		reused += m.Reused
+	}
+	return
+}
+
+// prints how much of each member of a tar index was found in the local file
+func diffTar(c *cli.Context, localFilename string, index *tarsync.Index) error {
+	localFile, err := os.Open(localFilename)
+	if err != nil {
+		return formatFileError(localFilename, err)
+	}
+	defer localFile.Close()
+
+	info, err := localFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	layout := tarsync.LocalLayout(localFile, info.Size())
+	matcher := tarsync.NewMatcher(index)
+
+	matches, err := matcher.FindMatches(localFile, layout)
+	if err != nil {
+		return err
+	}
+
+	members := index.Reuse(matches)
+
+	fmt.Println("Blocksize: ", index.BlockSize)
+	fmt.Println("Index blocks:", index.BlockCount())
+	fmt.Println("Local segments:", len(layout.Segments))
+	fmt.Println("Comparisons:", matcher.Comparisons)
+	fmt.Println("Strong hash hits:", matcher.StrongHashHits)
+
+	fmt.Println("\nMembers:")
+	for _, m := range members {
+		fmt.Printf("%6.2f%% %12v / %-12v %v\n", percentage(m.Reused, m.Size), m.Reused, m.Size, m.Name)
+	}
+
+	size, reused := totalReuse(members)
+	fmt.Println("\nTotal member bytes:", size)
+	fmt.Println("Total reused bytes:", reused)
+	fmt.Printf("Reuse: %.2f%%\n", percentage(reused, size))
+	return nil
+}
+
+func percentage(part, total int64) float64 {
+	if total == 0 {
+		return 100
+	}
+	return 100 * float64(part) / float64(total)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	gosync_main "github.com/Redundancy/go-sync"
+	"github.com/Redundancy/go-sync/manifest"
+	"github.com/urfave/cli/v2"
+)
+
+const manifestUsage = "gosync manifest <directory> <output manifest>"
+const syncTreeUsage = "gosync synctree <manifest> <local directory> <reference url>"
+
+func init() {
+	app.Commands = append(
+		app.Commands,
+		&cli.Command{
+			Name:  "manifest",
+			Usage: manifestUsage,
+			Description: `Describe every file in a directory tree, with an inline index of each file,
+so that another copy of the tree can be synced with "gosync synctree".`,
+			Action: Manifest,
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:  "blocksize",
+					Value: DefaultBlockSize,
+					Usage: "The block size to use for the index of each file",
+				},
+			},
+		},
+		&cli.Command{
+			Name:  "synctree",
+			Usage: syncTreeUsage,
+			Description: `Make a local directory match a manifest. Files that already match are skipped,
+renamed files are copied, and other files are patched from local files and the reference.
+Local files that are not in the manifest are deleted.
+
+<reference url> is the URL of the root of the tree, each file is fetched from the URL
+followed by its path in the manifest.`,
+			Action: SyncTree,
+			Flags:  httpFlags,
+		},
+	)
+}
+
+// Manifest builds a manifest of a directory
+func Manifest(c *cli.Context) error {
+	errorWrapper(c, func(c *cli.Context) error {
+		if c.Args().Len() != 2 {
+			return fmt.Errorf(
+				"Usage is \"%v\" (invalid number of arguments)",
+				manifestUsage,
+			)
+		}
+
+		root := c.Args().Get(0)
+		outFilename := c.Args().Get(1)
+
+		blocksize := c.Int("blocksize")
+		if blocksize <= 0 {
+			return fmt.Errorf("Invalid block size: %v", blocksize)
+		}
+
+		m, err := manifest.Build(root, uint(blocksize))
+		if err != nil {
+			return err
+		}
+
+		outFile, err := os.Create(outFilename)
+		if err != nil {
+			return formatFileError(outFilename, err)
+		}
+		defer outFile.Close()
+
+		if err = m.Write(outFile); err != nil {
+			return err
+		}
+
+		fmt.Printf("Manifest of %v files written to %v\n", len(m.Files), outFilename)
+		return outFile.Close()
+	})
+	return nil
+}
+
+// SyncTree makes a directory match a manifest
+func SyncTree(c *cli.Context) error {
+	errorWrapper(c, func(c *cli.Context) error {
+		if c.Args().Len() != 3 {
+			return fmt.Errorf(
+				"Usage is \"%v\" (invalid number of arguments)",
+				syncTreeUsage,
+			)
+		}
+
+		manifestFilename := c.Args().Get(0)
+		localDir := c.Args().Get(1)
+		referenceURL := c.Args().Get(2)
+
+		manifestFile, err := os.Open(manifestFilename)
+		if err != nil {
+			return formatFileError(manifestFilename, err)
+		}
+		defer manifestFile.Close()
+
+		m, err := manifest.Read(manifestFile)
+		if err != nil {
+			return err
+		}
+
+		options, err := httpOptions(c)
+		if err != nil {
+			return err
+		}
+
+		result, err := gosync_main.SyncTreeWithOptions(m, localDir, referenceURL, options)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf(
+			"Unchanged: %v, Copied: %v, Patched: %v, Deleted: %v\n",
+			len(result.Unchanged),
+			len(result.Copied),
+			len(result.Patched),
+			len(result.Deleted),
+		)
+		return nil
+	})
+	return nil
+}
@@ -5,6 +5,7 @@ to move through a file and compare it to the index, producing a FileDiffSummary
 package comparer
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"sync/atomic"
@@ -20,6 +21,10 @@ const (
 	READ_NONE
 )
 
+// DefaultBatchSize is the number of results sent together in a batch when
+// Comparer.BatchSize is not set
+const DefaultBatchSize = 256
+
 // If the weak Hash object satisfies this interface, then
 // StartFindMatchingBlocks will not allocate a circular buffer
 type BlockBuffer interface {
@@ -45,6 +50,16 @@ type Index interface {
 	FindStrongChecksum2(chk []byte, weak interface{}) []chunks.ChunkChecksum
 }
 
+// If the Index also satisfies SequentialIndex, then after a match the Comparer
+// checks if the next block in the comparison matches the next block in the reference
+// before doing a general lookup. For mostly unchanged files, this turns the comparison
+// into a sequential verification.
+type SequentialIndex interface {
+	Index
+	GetChunkByOffset(i uint) *chunks.ChunkChecksum
+	IsDuplicated(i uint) bool
+}
+
 /*
 Iterates though comparison looking for blocks that match ones from the index
 it emits each block to be read from the returned channel. Callers should check for
@@ -59,6 +74,56 @@ type Comparer struct {
 	Comparisons    int64
 	WeakHashHits   int64
 	StrongHashHits int64
+
+	// Strong hash hits on the block following a previous match
+	SequentialHits int64
+
+	// The maximum number of results in each batch sent by
+	// StartFindMatchingBlockBatches, defaults to DefaultBatchSize
+	BatchSize int
+}
+
+func (c *Comparer) batchSize() int {
+	if c.BatchSize <= 0 {
+		return DefaultBatchSize
+	}
+	return c.BatchSize
+}
+
+// resultBatcher collects results into slices, so that heavily duplicated
+// blocks do not cost a channel send per result
+type resultBatcher struct {
+	out   chan<- []BlockMatchResult
+	size  int
+	batch []BlockMatchResult
+}
+
+func newResultBatcher(out chan<- []BlockMatchResult, size int) *resultBatcher {
+	return &resultBatcher{
+		out:  out,
+		size: size,
+	}
+}
+
+func (b *resultBatcher) add(r BlockMatchResult) {
+	if b.batch == nil {
+		b.batch = make([]BlockMatchResult, 0, b.size)
+	}
+
+	b.batch = append(b.batch, r)
+
+	if len(b.batch) >= b.size {
+		b.flush()
+	}
+}
+
+// flush sends any results that have not been sent yet.
+// The receiver owns each batch, so a new one is allocated for the next results
+func (b *resultBatcher) flush() {
+	if len(b.batch) > 0 {
+		b.out <- b.batch
+		b.batch = nil
+	}
 }
 
 func (c *Comparer) StartFindMatchingBlocks(
@@ -69,6 +134,40 @@ func (c *Comparer) StartFindMatchingBlocks(
 ) <-chan BlockMatchResult {
 
 	resultStream := make(chan BlockMatchResult)
+	batches := c.StartFindMatchingBlockBatches(
+		comparison,
+		baseOffset,
+		generator,
+		referenceIndex,
+	)
+
+	go func() {
+		defer close(resultStream)
+
+		for batch := range batches {
+			for _, result := range batch {
+				resultStream <- result
+			}
+		}
+	}()
+
+	return resultStream
+}
+
+/*
+StartFindMatchingBlockBatches works like StartFindMatchingBlocks, but sends results in
+slices of up to BatchSize. A batch with a result where .Err != nil is the last one sent.
+
+The receiver owns each batch, and may keep or modify it.
+*/
+func (c *Comparer) StartFindMatchingBlockBatches(
+	comparison io.Reader,
+	baseOffset int64,
+	generator *filechecksum.FileChecksumGenerator,
+	referenceIndex Index,
+) <-chan []BlockMatchResult {
+
+	resultStream := make(chan []BlockMatchResult)
 
 	go c.startFindMatchingBlocks_int(
 		resultStream,
@@ -81,11 +180,8 @@ func (c *Comparer) StartFindMatchingBlocks(
 	return resultStream
 }
 
-/*
-TODO: When matching duplicated blocks, a channel of BlockMatchResult slices would be more efficient
-*/
 func (c *Comparer) startFindMatchingBlocks_int(
-	results chan<- BlockMatchResult,
+	results chan<- []BlockMatchResult,
 	comparison io.Reader,
 	baseOffset int64,
 	generator *filechecksum.FileChecksumGenerator,
@@ -93,78 +189,136 @@ func (c *Comparer) startFindMatchingBlocks_int(
 ) {
 	defer close(results)
 
-	block := make([]byte, generator.BlockSize)
-	var err error
+	batcher := newResultBatcher(results, c.batchSize())
+	err := c.findMatchingBlocks(batcher, comparison, baseOffset, generator, reference, true)
+	batcher.flush()
 
-	ReportErr := func(err error) {
-		results <- BlockMatchResult{
-			Err: err,
+	if err != nil {
+		results <- []BlockMatchResult{
+			{Err: err},
 		}
 	}
+}
 
-	_, err = io.ReadFull(comparison, block)
+// findMatchingBlocks adds matches to results, and returns any error
+// rather than sending it, so that results can be shared between comparisons.
+// The caller must flush results.
+//
+// Only the end of a file can match a partial block, so if the comparison is a
+// section that ends before the end of the file, atEnd should be false.
+func (c *Comparer) findMatchingBlocks(
+	results *resultBatcher,
+	comparison io.Reader,
+	baseOffset int64,
+	generator *filechecksum.FileChecksumGenerator,
+	reference Index,
+	atEnd bool,
+) error {
+	block := make([]byte, generator.BlockSize)
+	next := READ_NEXT_BYTE
 
-	if err != nil {
-		ReportErr(
-			fmt.Errorf("Error reading first block in comparison: %v", err),
-		)
-		return
+	n, err := io.ReadFull(comparison, block)
+
+	switch {
+	case err == io.EOF:
+		// an empty comparison has nothing to match
+		return nil
+	case err == io.ErrUnexpectedEOF && !atEnd:
+		// there is no whole block, and partial blocks can only match at the end of the file
+		return nil
+	case err == io.ErrUnexpectedEOF:
+		// a comparison smaller than a block can still match the partial block at the end
+		// of the reference, so its ends are compared as they would be at the end of a file
+		err = io.EOF
+		next = READ_NONE
+	case err != nil:
+		return fmt.Errorf("Error reading first block in comparison: %v", err)
 	}
 
-	generator.WeakRollingHash.SetBlock(block)
+	generator.WeakRollingHash.SetBlock(block[:n])
 	singleByte := make([]byte, 1)
 	weaksum := make([]byte, generator.WeakRollingHash.Size())
 	strongSum := make([]byte, 0, generator.GetStrongHash().Size())
 
 	blockMemory := circularbuffer.MakeC2Buffer(int(generator.BlockSize))
-	blockMemory.Write(block)
+	blockMemory.Write(block[:n])
 
 	strong := generator.GetStrongHash()
 	// All the bytes
 	i := int64(0)
-	next := READ_NEXT_BYTE
+
+	sequential, _ := reference.(SequentialIndex)
+	// the reference block expected to follow the last match, if any
+	var expected *chunks.ChunkChecksum
+	expectedMatch := make([]chunks.ChunkChecksum, 1)
 
 	//ReadLoop:
 	for {
 
 		atomic.AddInt64(&c.Comparisons, 1)
 
-		// look for a weak match
+		var strongList []chunks.ChunkChecksum
 		generator.WeakRollingHash.GetSum(weaksum)
-		if weakMatchList := reference.FindWeakChecksum2(weaksum); weakMatchList != nil {
-			atomic.AddInt64(&c.WeakHashHits, 1)
-
-			block = blockMemory.GetBlock()
 
+		// check if the block following the last match continues it
+		if expected != nil && bytes.Equal(weaksum, expected.WeakChecksum) {
 			strong.Reset()
-			strong.Write(block)
-			strongSum = strong.Sum(strongSum)
-			strongList := reference.FindStrongChecksum2(strongSum, weakMatchList)
-
-			// clear the slice
-			strongSum = strongSum[:0]
-
-			// If there are many matches, it means that this block is
-			// duplicated in the reference.
-			// since we care about finding all the blocks in the reference,
-			// we must report all of them
-			off := i + baseOffset
-			for _, strongMatch := range strongList {
-				results <- BlockMatchResult{
-					ComparisonOffset: off,
-					BlockIdx:         strongMatch.ChunkOffset,
-				}
+			strong.Write(blockMemory.GetBlock())
+			strongSum = strong.Sum(strongSum[:0])
+
+			if bytes.Equal(strongSum, expected.StrongChecksum) {
+				atomic.AddInt64(&c.SequentialHits, 1)
+				expectedMatch[0] = *expected
+				strongList = expectedMatch
+			}
+		}
+
+		// look for a weak match
+		if strongList == nil {
+			if weakMatchList := reference.FindWeakChecksum2(weaksum); weakMatchList != nil {
+				atomic.AddInt64(&c.WeakHashHits, 1)
+
+				// GetBlock returns the buffer's own storage, so it must
+				// not be read into
+				strong.Reset()
+				strong.Write(blockMemory.GetBlock())
+				strongSum = strong.Sum(strongSum[:0])
+				strongList = reference.FindStrongChecksum2(strongSum, weakMatchList)
+			}
+		}
+
+		expected = nil
+
+		// If there are many matches, it means that this block is
+		// duplicated in the reference.
+		// since we care about finding all the blocks in the reference,
+		// we must report all of them
+		off := i + baseOffset
+		for _, strongMatch := range strongList {
+			results.add(BlockMatchResult{
+				ComparisonOffset: off,
+				BlockIdx:         strongMatch.ChunkOffset,
+			})
+		}
+
+		if len(strongList) > 0 {
+			atomic.AddInt64(&c.StrongHashHits, 1)
+			if next == READ_NONE {
+				// found the match at the end, so exit
+				break
 			}
 
-			if len(strongList) > 0 {
-				atomic.AddInt64(&c.StrongHashHits, 1)
-				if next == READ_NONE {
-					// found the match at the end, so exit
-					break
+			// Duplicated blocks must go through a general lookup
+			// so that all of the matching blocks are reported
+			if sequential != nil && len(strongList) == 1 {
+				nextID := strongList[0].ChunkOffset + 1
+				if !sequential.IsDuplicated(nextID) {
+					expected = sequential.GetChunkByOffset(nextID)
 				}
-				// No point looking for a match that overlaps this block
-				next = READ_NEXT_BLOCK
 			}
+
+			// No point looking for a match that overlaps this block
+			next = READ_NEXT_BLOCK
 		}
 
 		var n int
@@ -178,6 +332,11 @@ func (c *Comparer) startFindMatchingBlocks_int(
 			n, err = io.ReadFull(comparison, block)
 			readBytes = block[:n]
 			next = READ_NEXT_BYTE
+
+			// a partial block does not follow on from the match
+			if uint(n) != generator.BlockSize {
+				expected = nil
+			}
 		}
 
 		if uint(n) == generator.BlockSize {
@@ -201,7 +360,8 @@ func (c *Comparer) startFindMatchingBlocks_int(
 		}
 
 		if next == READ_NONE {
-			if blockMemory.Empty() {
+			// the remaining windows are compared in full by the following section
+			if blockMemory.Empty() || !atEnd {
 				break
 			}
 
@@ -213,7 +373,8 @@ func (c *Comparer) startFindMatchingBlocks_int(
 	}
 
 	if err != io.EOF {
-		ReportErr(err)
-		return
+		return err
 	}
+
+	return nil
 }
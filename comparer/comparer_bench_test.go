@@ -1,9 +1,14 @@
 package comparer
 
 import (
+	"bytes"
 	"github.com/Redundancy/go-sync/chunks"
 	"github.com/Redundancy/go-sync/filechecksum"
+	"github.com/Redundancy/go-sync/index"
+	"github.com/Redundancy/go-sync/indexbuilder"
 	"github.com/Redundancy/go-sync/util/readers"
+	"io/ioutil"
+	"math/rand"
 	"testing"
 )
 
@@ -74,3 +79,168 @@ func BenchmarkStrongComparison(b *testing.B) {
 
 	b.StopTimer()
 }
+
+// Compare random data against a large index that it has nothing in common with
+// (as for an 8 GB reference with 8 KB blocks), so that nearly every byte offset
+// is a weak checksum miss
+func benchmarkRandomDataComparison(b *testing.B, filtered bool) {
+	b.ReportAllocs()
+
+	const BLOCK_SIZE = 8192
+	const REFERENCE_BLOCKS = 1024 * 1024
+	const COMPARISON_SIZE = 1024 * 1024
+
+	generator := filechecksum.NewFileChecksumGenerator(BLOCK_SIZE)
+	checksums := make([]chunks.ChunkChecksum, REFERENCE_BLOCKS)
+	random := rand.New(rand.NewSource(1))
+
+	for i := range checksums {
+		checksums[i].ChunkOffset = uint(i)
+		checksums[i].WeakChecksum = make([]byte, 4)
+		checksums[i].StrongChecksum = make([]byte, 16)
+		random.Read(checksums[i].WeakChecksum)
+		random.Read(checksums[i].StrongChecksum)
+	}
+
+	reference := index.MakeChecksumIndex(checksums)
+
+	if filtered {
+		reference.EnableWeakFilter()
+	}
+
+	comparison, err := ioutil.ReadAll(
+		readers.NewSizedNonRepeatingSequence(745656, COMPARISON_SIZE),
+	)
+
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(COMPARISON_SIZE)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		results := (&Comparer{}).StartFindMatchingBlocks(
+			bytes.NewReader(comparison),
+			0,
+			generator,
+			reference,
+		)
+
+		for range results {
+		}
+	}
+}
+
+func BenchmarkRandomDataComparison(b *testing.B) {
+	benchmarkRandomDataComparison(b, false)
+}
+
+func BenchmarkFilteredRandomDataComparison(b *testing.B) {
+	benchmarkRandomDataComparison(b, true)
+}
+
+// A file where the first half is unchanged, and the second is not,
+// so that the work is uneven across the file
+func benchmarkPartiallyChangedFile(b *testing.B, segmentSize int64) {
+	const BLOCK_SIZE = 4096
+	const SIZE = 8 * 1024 * 1024
+	const WORKERS = 4
+
+	random := rand.New(rand.NewSource(1))
+	reference := make([]byte, SIZE)
+	random.Read(reference)
+
+	local := make([]byte, SIZE)
+	copy(local, reference[:SIZE/2])
+	random.Read(local[SIZE/2:])
+
+	generator := filechecksum.NewFileChecksumGenerator(BLOCK_SIZE)
+	_, index, _, err := indexbuilder.BuildChecksumIndex(generator, bytes.NewReader(reference))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(SIZE)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		m := NewParallelMatcher(BLOCK_SIZE, WORKERS)
+		m.SegmentSize = segmentSize
+
+		merger, err := m.FindMatchingBlocks(bytes.NewReader(local), SIZE, index)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		merger.GetMergedBlocks()
+	}
+}
+
+// Equivalent to splitting the file into a fixed section per worker
+func BenchmarkFixedSectionMatching(b *testing.B) {
+	benchmarkPartiallyChangedFile(b, 8*1024*1024/4)
+}
+
+func BenchmarkWorkStealingMatching(b *testing.B) {
+	benchmarkPartiallyChangedFile(b, 256*1024)
+}
+
+// A reference made of the same block repeated, so that every match
+// in the comparison produces a result for every block of the reference
+func benchmarkDuplicatedFile(b *testing.B, batched bool) {
+	const BLOCK_SIZE = 64
+	const REFERENCE_BLOCKS = 1024
+	const COMPARISON_SIZE = 16 * 1024
+
+	generator := filechecksum.NewFileChecksumGenerator(BLOCK_SIZE)
+	_, reference, _, err := indexbuilder.BuildChecksumIndex(
+		generator,
+		bytes.NewReader(make([]byte, BLOCK_SIZE*REFERENCE_BLOCKS)),
+	)
+
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	comparison := make([]byte, COMPARISON_SIZE)
+
+	b.SetBytes(COMPARISON_SIZE)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		merger := &MatchMerger{}
+
+		if batched {
+			merger.StartMergeResultBatchStream(
+				(&Comparer{}).StartFindMatchingBlockBatches(
+					bytes.NewReader(comparison),
+					0,
+					generator,
+					reference,
+				),
+				BLOCK_SIZE,
+			)
+		} else {
+			merger.StartMergeResultStream(
+				(&Comparer{}).StartFindMatchingBlocks(
+					bytes.NewReader(comparison),
+					0,
+					generator,
+					reference,
+				),
+				BLOCK_SIZE,
+			)
+		}
+
+		merger.GetMergedBlocks()
+	}
+}
+
+func BenchmarkDuplicatedFileResults(b *testing.B) {
+	benchmarkDuplicatedFile(b, false)
+}
+
+func BenchmarkBatchedDuplicatedFileResults(b *testing.B) {
+	benchmarkDuplicatedFile(b, true)
+}
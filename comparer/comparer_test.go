@@ -7,7 +7,9 @@ import (
 	"reflect"
 	"testing"
 
+	"github.com/Redundancy/go-sync/chunks"
 	"github.com/Redundancy/go-sync/filechecksum"
+	"github.com/Redundancy/go-sync/index"
 	"github.com/Redundancy/go-sync/indexbuilder"
 )
 
@@ -443,3 +445,180 @@ func TestTwoComparisons(t *testing.T) {
 		}
 	}
 }
+
+func TestCompiledIndexComparison(t *testing.T) {
+	const BLOCK_SIZE = 4
+	const ORIGINAL_STRING = "The quick brown fox jumped over the lazy dog"
+	const MODIFIED_STRING = "The qwik brown fox jumped 0v3r the lazy"
+
+	generator := filechecksum.NewFileChecksumGenerator(BLOCK_SIZE)
+	checksums := bytes.NewBuffer(nil)
+
+	if _, err := generator.GenerateChecksums(bytes.NewBufferString(ORIGINAL_STRING), checksums); err != nil {
+		t.Fatal(err)
+	}
+
+	weakSize, strongSize := generator.GetChecksumSizes()
+	readChunks, err := chunks.LoadChecksumsFromReader(checksums, weakSize, strongSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compiled := bytes.NewBuffer(nil)
+	if err := index.WriteCompiledIndex(compiled, readChunks); err != nil {
+		t.Fatal(err)
+	}
+
+	reference, err := index.LoadCompiledIndex(compiled.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := (&Comparer{}).StartFindMatchingBlocks(
+		bytes.NewBufferString(MODIFIED_STRING),
+		0,
+		generator,
+		reference,
+	)
+
+	CheckResults(
+		t,
+		ORIGINAL_STRING,
+		MODIFIED_STRING,
+		results,
+		BLOCK_SIZE,
+		[]string{"The ", "k br", "own ", "fox ", "jump", "the ", "lazy"},
+	)
+}
+
+func TestUnchangedContentIsMatchedSequentially(t *testing.T) {
+	const BLOCK_SIZE = 4
+	const ORIGINAL_STRING = "abcdefghijklmnopqrst"
+
+	generator := filechecksum.NewFileChecksumGenerator(BLOCK_SIZE)
+	_, reference, _, err := indexbuilder.BuildIndexFromString(generator, ORIGINAL_STRING)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Comparer{}
+	results := c.StartFindMatchingBlocks(
+		bytes.NewBufferString(ORIGINAL_STRING),
+		0,
+		generator,
+		reference,
+	)
+
+	CheckResults(
+		t,
+		ORIGINAL_STRING,
+		ORIGINAL_STRING,
+		results,
+		BLOCK_SIZE,
+		split(4, ORIGINAL_STRING),
+	)
+
+	if c.SequentialHits != 4 {
+		t.Errorf("Expected all blocks after the first to match sequentially: %v", c.SequentialHits)
+	}
+
+	if c.WeakHashHits != 1 {
+		t.Errorf("Expected only one general lookup hit: %v", c.WeakHashHits)
+	}
+}
+
+func TestDuplicatedBlocksFollowingAMatchAreAllReported(t *testing.T) {
+	const BLOCK_SIZE = 4
+	const A = "abcd"
+	const B = "efgh"
+	const ORIGINAL_STRING = A + B + "ijkl" + B
+	const MODIFIED_STRING = A + B
+
+	results, err := compare(ORIGINAL_STRING, MODIFIED_STRING, BLOCK_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	CheckResults(
+		t,
+		ORIGINAL_STRING,
+		MODIFIED_STRING,
+		results,
+		BLOCK_SIZE,
+		[]string{A, B, B},
+	)
+}
+
+func TestBatchedResultsAreLimitedToBatchSize(t *testing.T) {
+	const BLOCK_SIZE = 4
+	generator := filechecksum.NewFileChecksumGenerator(BLOCK_SIZE)
+
+	// every block of the reference is the same, so one match produces four results
+	_, reference, _, err := indexbuilder.BuildChecksumIndex(
+		generator,
+		bytes.NewBufferString("abcdabcdabcdabcd"),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Comparer{BatchSize: 3}
+	batches := c.StartFindMatchingBlockBatches(
+		bytes.NewBufferString("abcd"),
+		0,
+		generator,
+		reference,
+	)
+
+	var sizes []int
+	seen := make(map[uint]bool)
+
+	for batch := range batches {
+		sizes = append(sizes, len(batch))
+
+		for _, result := range batch {
+			if result.Err != nil {
+				t.Fatal(result.Err)
+			}
+			seen[result.BlockIdx] = true
+		}
+	}
+
+	if !reflect.DeepEqual(sizes, []int{3, 1}) {
+		t.Errorf("Unexpected batch sizes: %v", sizes)
+	}
+
+	if len(seen) != 4 {
+		t.Errorf("Expected all 4 blocks to match, got %v", seen)
+	}
+}
+
+func TestEmptyAndSmallComparisons(t *testing.T) {
+	const BLOCK_SIZE = 4
+
+	for _, c := range []struct {
+		original, modified string
+		expected           []string
+	}{
+		{"abcdefg", "", nil},
+		{"", "", nil},
+		{"", "abcdefg", nil},
+		{"", "ab", nil},
+		// only the partial block at the end of the reference can match
+		{"abcdefg", "efg", []string{"efg"}},
+		{"abcdefg", "xefg", []string{"efg"}},
+		{"abcdefg", "fg", nil},
+		{"abcdefg", "abc", nil},
+		{"abc", "abc", []string{"abc"}},
+		{"abc", "ab", nil},
+		{"abcd", "abc", nil},
+	} {
+		results, err := compare(c.original, c.modified, BLOCK_SIZE)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		CheckResults(t, c.original, c.modified, results, BLOCK_SIZE, c.expected)
+	}
+}
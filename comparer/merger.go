@@ -19,6 +19,11 @@ type MatchMerger struct {
 	startEndBlockMap *llrb.LLRB
 
 	blockCount uint
+
+	// every comparison offset that matched a block, with the first block it matched
+	// used to find literals, and places where a block is repeated
+	matches   []BlockMatchResult
+	blockSize int64
 }
 
 // a span of multiple blocks, from start to end, which match the blocks
@@ -128,17 +133,7 @@ func (merger *MatchMerger) StartMergeResultStream(
 	resultStream <-chan BlockMatchResult,
 	blockSize int64,
 ) {
-	// Add should be called on the main goroutine
-	// to ensure that it has happened before wait is called
-	merger.wait.Add(1)
-
-	if merger.startEndBlockMap == nil {
-		merger.startEndBlockMap = llrb.New()
-	}
-
-	// used by the llrb iterator to signal that it found/didn't find
-	// an existing key on or spanning the given block
-	//foundExisting := make(chan bool)
+	merger.start(blockSize)
 
 	go func() {
 		defer merger.wait.Done()
@@ -149,83 +144,35 @@ func (merger *MatchMerger) StartMergeResultStream(
 			}
 
 			merger.Lock()
-			merger.blockCount += 1
-
-			blockID := result.BlockIdx
-			preceeding := merger.startEndBlockMap.Get(BlockSpanKey(blockID - 1))
-			following := merger.startEndBlockMap.Get(BlockSpanKey(blockID + 1))
-
-			asBlockSpan := toBlockSpan(result)
-
-			var foundExisting bool
-			// Exists, or within an existing span
-			merger.startEndBlockMap.AscendGreaterOrEqual(
-				BlockSpanKey(blockID),
-				// iterator
-				func(i llrb.Item) bool {
-					j, ok := i.(BlockSpanIndex)
-
-					if !ok {
-						foundExisting = true
-						return false
-					}
-
-					switch k := j.(type) {
-					case BlockSpanStart:
-						// it's only overlapping if its the same blockID
-						foundExisting = k.StartBlock == blockID
-						return false
-
-					case BlockSpanEnd:
-						// we didn't find a start, so there's an end that overlaps
-						foundExisting = true
-						return false
-					default:
-						foundExisting = true
-						return false
-					}
+			merger.mergeResult(result, blockSize)
+			merger.Unlock()
+		}
+	}()
+}
 
-				},
-			)
+// StartMergeResultBatchStream merges batches of results, such as from
+// Comparer.StartFindMatchingBlockBatches, taking the lock once per batch.
+// Like StartMergeResultStream, it can be used on multiple streams simultaneously
+// and should be called from the initiating goroutine.
+func (merger *MatchMerger) StartMergeResultBatchStream(
+	resultStream <-chan []BlockMatchResult,
+	blockSize int64,
+) {
+	merger.start(blockSize)
 
-			if foundExisting {
-				merger.Unlock()
-				continue
-			}
+	go func() {
+		defer merger.wait.Done()
 
-			merger.startEndBlockMap.ReplaceOrInsert(
-				BlockSpanStart(*toBlockSpan(result)),
-			)
+		for batch := range resultStream {
+			merger.Lock()
+
+			for _, result := range batch {
+				if result.Err != nil {
+					merger.Unlock()
+					return
+				}
 
-			if preceeding != nil && following != nil {
-				a := itemToBlockSpan(preceeding)
-				merger.merge(
-					asBlockSpan,
-					&a,
-					blockSize,
-				)
-
-				b := itemToBlockSpan(following)
-				merger.merge(
-					&a,
-					&b,
-					blockSize,
-				)
-
-			} else if preceeding != nil {
-				a := itemToBlockSpan(preceeding)
-				merger.merge(
-					asBlockSpan,
-					&a,
-					blockSize,
-				)
-			} else if following != nil {
-				b := itemToBlockSpan(following)
-				merger.merge(
-					asBlockSpan,
-					&b,
-					blockSize,
-				)
+				merger.mergeResult(result, blockSize)
 			}
 
 			merger.Unlock()
@@ -233,6 +180,107 @@ func (merger *MatchMerger) StartMergeResultStream(
 	}()
 }
 
+func (merger *MatchMerger) start(blockSize int64) {
+	merger.blockSize = blockSize
+
+	// Add should be called on the main goroutine
+	// to ensure that it has happened before wait is called
+	merger.wait.Add(1)
+
+	if merger.startEndBlockMap == nil {
+		merger.startEndBlockMap = llrb.New()
+	}
+}
+
+// adds a single result to the merged spans, the lock must be held
+func (merger *MatchMerger) mergeResult(result BlockMatchResult, blockSize int64) {
+	merger.blockCount += 1
+
+	// duplicated blocks produce many results for the same offset
+	if n := len(merger.matches); n == 0 || merger.matches[n-1].ComparisonOffset != result.ComparisonOffset {
+		merger.matches = append(merger.matches, BlockMatchResult{
+			ComparisonOffset: result.ComparisonOffset,
+			BlockIdx:         result.BlockIdx,
+		})
+	}
+
+	blockID := result.BlockIdx
+	preceeding := merger.startEndBlockMap.Get(BlockSpanKey(blockID - 1))
+	following := merger.startEndBlockMap.Get(BlockSpanKey(blockID + 1))
+
+	asBlockSpan := toBlockSpan(result)
+
+	var foundExisting bool
+	// Exists, or within an existing span
+	merger.startEndBlockMap.AscendGreaterOrEqual(
+		BlockSpanKey(blockID),
+		// iterator
+		func(i llrb.Item) bool {
+			j, ok := i.(BlockSpanIndex)
+
+			if !ok {
+				foundExisting = true
+				return false
+			}
+
+			switch k := j.(type) {
+			case BlockSpanStart:
+				// it's only overlapping if its the same blockID
+				foundExisting = k.StartBlock == blockID
+				return false
+
+			case BlockSpanEnd:
+				// we didn't find a start, so there's an end that overlaps
+				foundExisting = true
+				return false
+			default:
+				foundExisting = true
+				return false
+			}
+
+		},
+	)
+
+	if foundExisting {
+		return
+	}
+
+	merger.startEndBlockMap.ReplaceOrInsert(
+		BlockSpanStart(*toBlockSpan(result)),
+	)
+
+	if preceeding != nil && following != nil {
+		a := itemToBlockSpan(preceeding)
+		merger.merge(
+			asBlockSpan,
+			&a,
+			blockSize,
+		)
+
+		b := itemToBlockSpan(following)
+		merger.merge(
+			&a,
+			&b,
+			blockSize,
+		)
+
+	} else if preceeding != nil {
+		a := itemToBlockSpan(preceeding)
+		merger.merge(
+			asBlockSpan,
+			&a,
+			blockSize,
+		)
+	} else if following != nil {
+		b := itemToBlockSpan(following)
+		merger.merge(
+			asBlockSpan,
+			&b,
+			blockSize,
+		)
+	}
+}
+
 type BlockSpanList []BlockSpan
 
 func (l BlockSpanList) Len() int {
@@ -253,6 +301,11 @@ func (merger *MatchMerger) GetMergedBlocks() (sorted BlockSpanList) {
 	// var smallestKey uint = 0
 	m := merger.startEndBlockMap
 
+	// no result streams were merged
+	if m == nil {
+		return
+	}
+
 	m.AscendGreaterOrEqual(m.Min(), func(item llrb.Item) bool {
 		switch block := item.(type) {
 		case BlockSpanStart:
@@ -266,12 +319,27 @@ func (merger *MatchMerger) GetMergedBlocks() (sorted BlockSpanList) {
 	return
 }
 
-// Creates a list of spans that are missing.
-// note that maxBlock is blockCount-1
-func (l BlockSpanList) GetMissingBlocks(maxBlock uint) (sorted BlockSpanList) {
+// Creates a list of spans that are missing, up to and including maxBlock.
+// A maxBlock of GetBlockCount()-1 for a reference with no blocks wraps around to the
+// largest uint, which is taken as that empty reference, and gives no spans.
+//
+// Deprecated: use MissingBlocks, which takes the block count.
+func (l BlockSpanList) GetMissingBlocks(maxBlock uint) BlockSpanList {
+	// wraps to 0 blocks if maxBlock is 0-1
+	return l.MissingBlocks(maxBlock + 1)
+}
+
+// MissingBlocks creates a list of the spans of a reference of blockCount blocks that
+// are not in l, and is empty if the reference has no blocks
+func (l BlockSpanList) MissingBlocks(blockCount uint) (sorted BlockSpanList) {
 	// it's difficult to know how many spans we will need
 	sorted = make(BlockSpanList, 0)
 
+	if blockCount == 0 {
+		return sorted
+	}
+
+	maxBlock := blockCount - 1
 	lastBlockSpanIndex := -1
 	for _, blockSpan := range l {
 		if int(blockSpan.StartBlock) > lastBlockSpanIndex+1 {
@@ -307,3 +375,86 @@ func (l BlockSpanList) GetMissingBlocks(maxBlock uint) (sorted BlockSpanList) {
 
 	return sorted
 }
+
+// a range of bytes in the comparison that did not match any block,
+// from ComparisonStartOffset up to (but not including) ComparisonEndOffset
+type LiteralSpan struct {
+	ComparisonStartOffset int64
+	ComparisonEndOffset   int64
+}
+
+func (l LiteralSpan) Len() int64 {
+	return l.ComparisonEndOffset - l.ComparisonStartOffset
+}
+
+type LiteralSpanList []LiteralSpan
+
+// The total number of bytes in the literal spans
+func (l LiteralSpanList) TotalSize() (size int64) {
+	for _, span := range l {
+		size += span.Len()
+	}
+	return
+}
+
+/*
+GetLiteralSpans returns the sorted ranges of the first comparisonSize bytes of the comparison
+that are not covered by any matched block.
+
+Matches may overlap (from separate sections of a comparison, or where different reference blocks
+match overlapping data), so a byte is only a literal if no match covers it.
+*/
+func (merger *MatchMerger) GetLiteralSpans(comparisonSize int64) (literals LiteralSpanList) {
+	// everything before covered has been matched
+	covered := int64(0)
+
+	for _, match := range merger.GetMatches() {
+		offset := match.ComparisonOffset
+
+		if offset > covered {
+			literals = append(literals, LiteralSpan{
+				ComparisonStartOffset: covered,
+				ComparisonEndOffset:   offset,
+			})
+		}
+
+		if end := offset + merger.blockSize; end > covered {
+			covered = end
+		}
+	}
+
+	if covered < comparisonSize {
+		literals = append(literals, LiteralSpan{
+			ComparisonStartOffset: covered,
+			ComparisonEndOffset:   comparisonSize,
+		})
+	}
+
+	return
+}
+
+/*
+GetMatches returns every offset in the comparison that matched a block, sorted by offset.
+
+GetMergedBlocks has one location for each block of the reference, but a block may be found in
+many places in the comparison. If an offset matched several identical blocks, only one is returned.
+*/
+func (merger *MatchMerger) GetMatches() []BlockMatchResult {
+	merger.wait.Wait()
+
+	matches := make([]BlockMatchResult, len(merger.matches))
+	copy(matches, merger.matches)
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].ComparisonOffset < matches[j].ComparisonOffset
+	})
+
+	// separate streams can match the same offset
+	result := matches[:0]
+	for _, m := range matches {
+		if n := len(result); n == 0 || result[n-1].ComparisonOffset != m.ComparisonOffset {
+			result = append(result, m)
+		}
+	}
+
+	return result
+}
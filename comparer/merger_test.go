@@ -1,6 +1,7 @@
 package comparer
 
 import (
+	"reflect"
 	"testing"
 )
 
@@ -399,3 +400,125 @@ func TestRegression1Merger(t *testing.T) {
 		}
 	}
 }
+
+func TestMergeBatchStream(t *testing.T) {
+	const BLOCK_SIZE = 4
+
+	mergeChan := make(chan []BlockMatchResult)
+	merger := &MatchMerger{}
+	merger.StartMergeResultBatchStream(mergeChan, BLOCK_SIZE)
+
+	mergeChan <- []BlockMatchResult{
+		{ComparisonOffset: 0, BlockIdx: 0},
+		{ComparisonOffset: BLOCK_SIZE * 2, BlockIdx: 2},
+	}
+
+	mergeChan <- []BlockMatchResult{
+		{ComparisonOffset: BLOCK_SIZE, BlockIdx: 1},
+	}
+
+	close(mergeChan)
+
+	merged := merger.GetMergedBlocks()
+
+	if len(merged) != 1 {
+		t.Fatalf("Wrong number of blocks returned: %#v", merged)
+	}
+
+	if merged[0].StartBlock != 0 || merged[0].EndBlock != 2 {
+		t.Errorf("Wrong span, expected 0-2 got %#v", merged[0])
+	}
+}
+
+func TestLiteralSpans(t *testing.T) {
+	const BLOCK_SIZE = 4
+	const ORIGINAL_STRING = "abcdefghijkl"
+	const MODIFIED_STRING = "abcdXXefghYYijkl!"
+
+	results, err := compare(ORIGINAL_STRING, MODIFIED_STRING, BLOCK_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merger := &MatchMerger{}
+	merger.StartMergeResultStream(results, BLOCK_SIZE)
+
+	literals := merger.GetLiteralSpans(int64(len(MODIFIED_STRING)))
+
+	var found []string
+	for _, l := range literals {
+		found = append(found, MODIFIED_STRING[l.ComparisonStartOffset:l.ComparisonEndOffset])
+	}
+
+	expected := []string{"XX", "YY", "!"}
+
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("Expected literals %q, got %q", expected, found)
+	}
+
+	if literals.TotalSize() != 5 {
+		t.Errorf("Wrong total literal size: %v", literals.TotalSize())
+	}
+}
+
+func TestLiteralSpansWithOverlappingMatches(t *testing.T) {
+	const BLOCK_SIZE = 4
+
+	mergeChan := make(chan BlockMatchResult)
+	merger := &MatchMerger{}
+	merger.StartMergeResultStream(mergeChan, BLOCK_SIZE)
+
+	mergeChan <- BlockMatchResult{ComparisonOffset: 2, BlockIdx: 1}
+	mergeChan <- BlockMatchResult{ComparisonOffset: 0, BlockIdx: 0}
+	mergeChan <- BlockMatchResult{ComparisonOffset: 10, BlockIdx: 3}
+	close(mergeChan)
+
+	literals := merger.GetLiteralSpans(16)
+	expected := LiteralSpanList{
+		{ComparisonStartOffset: 6, ComparisonEndOffset: 10},
+		{ComparisonStartOffset: 14, ComparisonEndOffset: 16},
+	}
+
+	if !reflect.DeepEqual(literals, expected) {
+		t.Errorf("Unexpected literals: %v", literals)
+	}
+}
+
+func TestLiteralSpansWithNoMatches(t *testing.T) {
+	merger := &MatchMerger{}
+	literals := merger.GetLiteralSpans(10)
+
+	if len(literals) != 1 || literals[0].Len() != 10 {
+		t.Errorf("Expected the whole comparison to be a literal: %v", literals)
+	}
+}
+
+func TestMissingBlocksOfEmptyReference(t *testing.T) {
+	if missing := BlockSpanList(nil).MissingBlocks(0); len(missing) != 0 {
+		t.Errorf("Expected no missing blocks: %v", missing)
+	}
+
+	blockCount := uint(0)
+	if missing := BlockSpanList(nil).GetMissingBlocks(blockCount - 1); len(missing) != 0 {
+		t.Errorf("Expected no missing blocks from GetMissingBlocks: %v", missing)
+	}
+
+	missing := BlockSpanList{{StartBlock: 1, EndBlock: 1}}.MissingBlocks(3)
+	expected := BlockSpanList{{StartBlock: 0, EndBlock: 0}, {StartBlock: 2, EndBlock: 2}}
+
+	if !reflect.DeepEqual(missing, expected) {
+		t.Errorf("Unexpected missing blocks: %v", missing)
+	}
+}
+
+func TestLiteralSpansOfEmptyComparison(t *testing.T) {
+	merger := &MatchMerger{}
+
+	if literals := merger.GetLiteralSpans(0); len(literals) != 0 {
+		t.Errorf("Expected no literals: %v", literals)
+	}
+
+	if blocks := merger.GetMergedBlocks(); len(blocks) != 0 {
+		t.Errorf("Expected no blocks: %v", blocks)
+	}
+}
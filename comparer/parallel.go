@@ -0,0 +1,168 @@
+package comparer
+
+import (
+	"bufio"
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Redundancy/go-sync/filechecksum"
+)
+
+const (
+	// DefaultSegmentSize is the approximate amount of the comparison
+	// that a ParallelMatcher worker takes at a time
+	DefaultSegmentSize = 4 * 1024 * 1024
+
+	segmentBufferSize = 1024 * 1024
+)
+
+/*
+ParallelMatcher compares a file against an index using multiple goroutines.
+
+Work is not equal across a file: matched regions skip a whole block at a time, while unmatched
+regions are compared byte by byte. Rather than giving each goroutine a fixed section of the file,
+the file is split into many small segments, and each worker takes the next segment when it
+finishes the last. Segments overlap so that every block offset is compared, and the
+results are combined by a MatchMerger.
+*/
+type ParallelMatcher struct {
+	// Statistics for all of the workers
+	Comparer
+
+	// The number of goroutines to use, defaults to runtime.NumCPU()
+	Workers int
+
+	// The size of each segment, rounded up to a multiple of the block size
+	// defaults to DefaultSegmentSize
+	SegmentSize int64
+
+	// Creates the generator used by each worker, since generators hold state
+	NewGenerator func() *filechecksum.FileChecksumGenerator
+}
+
+// NewParallelMatcher creates a ParallelMatcher using the default checksums
+func NewParallelMatcher(blockSize uint, workers int) *ParallelMatcher {
+	return &ParallelMatcher{
+		Workers: workers,
+		NewGenerator: func() *filechecksum.FileChecksumGenerator {
+			return filechecksum.NewFileChecksumGenerator(blockSize)
+		},
+	}
+}
+
+type segment struct {
+	offset int64
+	length int64
+}
+
+// splits the comparison into segments that overlap by one byte less than a block,
+// so that every block-sized window starts in exactly one segment
+func (m *ParallelMatcher) segments(size int64, blockSize int64) []segment {
+	segmentSize := m.SegmentSize
+	if segmentSize <= 0 {
+		segmentSize = DefaultSegmentSize
+	}
+
+	if r := segmentSize % blockSize; r != 0 {
+		segmentSize += blockSize - r
+	}
+
+	result := make([]segment, 0, size/segmentSize+1)
+
+	for offset := int64(0); offset < size; offset += segmentSize {
+		// windows starting here were compared by the end of the last segment
+		if offset > 0 && size-offset < blockSize {
+			break
+		}
+
+		length := segmentSize + blockSize - 1
+		if offset+length > size {
+			length = size - offset
+		}
+
+		result = append(result, segment{offset: offset, length: length})
+	}
+
+	return result
+}
+
+// FindMatchingBlocks compares the first size bytes of comparison against the
+// reference, and returns a MatchMerger with the results.
+func (m *ParallelMatcher) FindMatchingBlocks(
+	comparison io.ReaderAt,
+	size int64,
+	reference Index,
+) (*MatchMerger, error) {
+	workers := m.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	merger := &MatchMerger{}
+	blockSize := int64(m.NewGenerator().BlockSize)
+
+	// An empty comparison has nothing to match, but one smaller than a block
+	// can still match the partial block at the end of the reference
+	if size == 0 {
+		return merger, nil
+	}
+
+	segments := m.segments(size, blockSize)
+	if workers > len(segments) {
+		workers = len(segments)
+	}
+
+	var (
+		nextSegment int64
+		firstErr    error
+		errOnce     sync.Once
+		failed      int32
+		wait        sync.WaitGroup
+	)
+
+	for w := 0; w < workers; w++ {
+		results := make(chan []BlockMatchResult)
+		merger.StartMergeResultBatchStream(results, blockSize)
+		wait.Add(1)
+
+		go func() {
+			defer wait.Done()
+			defer close(results)
+
+			batcher := newResultBatcher(results, m.Comparer.batchSize())
+			defer batcher.flush()
+
+			generator := m.NewGenerator()
+			buffer := bufio.NewReaderSize(nil, segmentBufferSize)
+
+			for atomic.LoadInt32(&failed) == 0 {
+				i := atomic.AddInt64(&nextSegment, 1) - 1
+				if i >= int64(len(segments)) {
+					return
+				}
+
+				s := segments[i]
+				buffer.Reset(io.NewSectionReader(comparison, s.offset, s.length))
+
+				err := m.Comparer.findMatchingBlocks(
+					batcher,
+					buffer,
+					s.offset,
+					generator,
+					reference,
+					s.offset+s.length == size,
+				)
+
+				if err != nil {
+					errOnce.Do(func() { firstErr = err })
+					atomic.StoreInt32(&failed, 1)
+				}
+			}
+		}()
+	}
+
+	wait.Wait()
+	return merger, firstErr
+}
@@ -0,0 +1,169 @@
+package comparer
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/Redundancy/go-sync/filechecksum"
+	"github.com/Redundancy/go-sync/indexbuilder"
+)
+
+func TestSegmentsCoverAllWindows(t *testing.T) {
+	const BLOCK_SIZE = 4
+	m := &ParallelMatcher{SegmentSize: 6}
+
+	segments := m.segments(18, BLOCK_SIZE)
+
+	// segment size is rounded up to 8, and overlaps by 3
+	expected := []segment{
+		{offset: 0, length: 11},
+		{offset: 8, length: 10},
+	}
+
+	if !reflect.DeepEqual(segments, expected) {
+		t.Errorf("Unexpected segments: %#v", segments)
+	}
+}
+
+func TestParallelMatchingMatchesSingleStream(t *testing.T) {
+	const BLOCK_SIZE = 16
+	const SIZE = 64 * 1024
+
+	reference := make([]byte, SIZE)
+	rand.New(rand.NewSource(1)).Read(reference)
+
+	// Move things around, and add some unmatched content
+	local := append([]byte{}, reference[SIZE/2:]...)
+	local = append(local, []byte("some new content that's not in the reference")...)
+	local = append(local, reference[:SIZE/4+7]...)
+
+	generator := filechecksum.NewFileChecksumGenerator(BLOCK_SIZE)
+	_, index, _, err := indexbuilder.BuildChecksumIndex(generator, bytes.NewReader(reference))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	single := &MatchMerger{}
+	single.StartMergeResultStream(
+		(&Comparer{}).StartFindMatchingBlocks(bytes.NewReader(local), 0, generator, index),
+		BLOCK_SIZE,
+	)
+	expected := single.GetMergedBlocks()
+
+	m := NewParallelMatcher(BLOCK_SIZE, 4)
+	m.SegmentSize = 1000
+
+	merger, err := m.FindMatchingBlocks(bytes.NewReader(local), int64(len(local)), index)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result := merger.GetMergedBlocks(); !reflect.DeepEqual(result, expected) {
+		t.Errorf("Parallel result differs:\n%v\n%v", result, expected)
+	}
+}
+
+func TestParallelLiteralsMatchSingleStream(t *testing.T) {
+	const BLOCK_SIZE = 16
+	const SIZE = 64 * 1024
+
+	reference := make([]byte, SIZE)
+	rand.New(rand.NewSource(2)).Read(reference)
+
+	local := append([]byte{}, reference[:SIZE/4]...)
+	local = append(local, []byte("some new content that's not in the reference")...)
+	local = append(local, reference[SIZE/2:SIZE/2+1003]...)
+
+	generator := filechecksum.NewFileChecksumGenerator(BLOCK_SIZE)
+	_, index, _, err := indexbuilder.BuildChecksumIndex(generator, bytes.NewReader(reference))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	single := &MatchMerger{}
+	single.StartMergeResultStream(
+		(&Comparer{}).StartFindMatchingBlocks(bytes.NewReader(local), 0, generator, index),
+		BLOCK_SIZE,
+	)
+	expected := single.GetLiteralSpans(int64(len(local)))
+
+	m := NewParallelMatcher(BLOCK_SIZE, 4)
+	m.SegmentSize = 1000
+
+	merger, err := m.FindMatchingBlocks(bytes.NewReader(local), int64(len(local)), index)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result := merger.GetLiteralSpans(int64(len(local))); !reflect.DeepEqual(result, expected) {
+		t.Errorf("Parallel literals differ:\n%v\n%v", result, expected)
+	}
+}
+
+// The end of a section that is not the end of the file must not match the
+// final partial block of the reference
+func TestSectionsDoNotMatchPartialBlocks(t *testing.T) {
+	const BLOCK_SIZE = 4
+	const REFERENCE = "abcdefg"
+	const LOCAL = "zzzzzzzzefgzzzzzzzzz"
+
+	generator := filechecksum.NewFileChecksumGenerator(BLOCK_SIZE)
+	_, index, _, err := indexbuilder.BuildChecksumIndex(generator, bytes.NewBufferString(REFERENCE))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewParallelMatcher(BLOCK_SIZE, 1)
+	m.SegmentSize = 8
+
+	merger, err := m.FindMatchingBlocks(bytes.NewReader([]byte(LOCAL)), int64(len(LOCAL)), index)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if blocks := merger.GetMergedBlocks(); len(blocks) != 0 {
+		t.Errorf("Unexpected matches: %v", blocks)
+	}
+
+	if literals := merger.GetLiteralSpans(int64(len(LOCAL))); literals.TotalSize() != int64(len(LOCAL)) {
+		t.Errorf("Expected the whole file to be a literal: %v", literals)
+	}
+}
+
+func TestParallelMatchingSmallComparisons(t *testing.T) {
+	const BLOCK_SIZE = 4
+	const REFERENCE = "abcdefg"
+
+	generator := filechecksum.NewFileChecksumGenerator(BLOCK_SIZE)
+	_, index, _, err := indexbuilder.BuildChecksumIndex(generator, bytes.NewBufferString(REFERENCE))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for local, expected := range map[string]BlockSpanList{
+		"":    nil,
+		"ab":  nil,
+		"efg": {{StartBlock: 1, EndBlock: 1, ComparisonStartOffset: 0}},
+	} {
+		merger, err := NewParallelMatcher(BLOCK_SIZE, 2).FindMatchingBlocks(
+			bytes.NewReader([]byte(local)),
+			int64(len(local)),
+			index,
+		)
+
+		if err != nil {
+			t.Fatalf("%q: %v", local, err)
+		}
+
+		if result := merger.GetMergedBlocks(); !reflect.DeepEqual(result, expected) {
+			t.Errorf("%q: unexpected matches: %v", local, result)
+		}
+
+		literals := merger.GetLiteralSpans(int64(len(local)))
+		if expected != nil && len(literals) != 0 || expected == nil && literals.TotalSize() != int64(len(local)) {
+			t.Errorf("%q: unexpected literals: %v", local, literals)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package delta
+
+import (
+	"bufio"
+	"io"
+	"sort"
+
+	"github.com/Redundancy/go-sync/comparer"
+	"github.com/Redundancy/go-sync/filechecksum"
+)
+
+// Reference is the index of the old file that a delta is created against.
+// gosync.BasicSummary satisfies it.
+type Reference interface {
+	comparer.Index
+	GetBlockSize() uint
+	GetFileSize() int64
+}
+
+// a range of the new file, either copied from the old file or not
+type instruction struct {
+	copy      bool
+	newOffset int64
+	oldOffset int64
+	length    int64
+}
+
+/*
+Create writes a delta to out, which turns the old file described by reference
+into newFile (of newSize bytes) when applied.
+
+Every byte of the new file that is not found in the old file is stored in the delta,
+so it is only small if the files are similar.
+*/
+func Create(out io.Writer, reference Reference, newFile io.ReaderAt, newSize int64) error {
+	checksum := filechecksum.DefaultFileHashGenerator()
+
+	if _, err := io.Copy(checksum, io.NewSectionReader(newFile, 0, newSize)); err != nil {
+		return err
+	}
+
+	matcher := comparer.NewParallelMatcher(reference.GetBlockSize(), 0)
+	merger, err := matcher.FindMatchingBlocks(newFile, newSize, reference)
+
+	if err != nil {
+		return err
+	}
+
+	// every place a block was found, rather than the merged spans, which only
+	// have one place for each block of the old file
+	var spans comparer.BlockSpanList
+	for _, match := range merger.GetMatches() {
+		spans = append(spans, comparer.BlockSpan{
+			StartBlock:            match.BlockIdx,
+			EndBlock:              match.BlockIdx,
+			ComparisonStartOffset: match.ComparisonOffset,
+		})
+	}
+
+	instructions := toInstructions(
+		spans,
+		int64(reference.GetBlockSize()),
+		reference.GetFileSize(),
+		newSize,
+	)
+
+	w := bufio.NewWriter(out)
+
+	err = writeHeader(w, header{
+		FileSize:     newSize,
+		FileChecksum: checksum.Sum(nil),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, in := range instructions {
+		if in.copy {
+			err = writeCopy(w, in.oldOffset, in.length)
+		} else {
+			err = writeData(w, io.NewSectionReader(newFile, in.newOffset, in.length), in.length)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = w.WriteByte(OpEnd); err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+// toInstructions covers the new file with copies of the matched spans, and data
+// for everything else. Matched spans can overlap in the new file, so each
+// one only copies what is not already covered. Copies of consecutive ranges
+// of the old file are joined into one.
+func toInstructions(
+	spans comparer.BlockSpanList,
+	blockSize int64,
+	oldSize int64,
+	newSize int64,
+) (result []instruction) {
+	sorted := make(comparer.BlockSpanList, len(spans))
+	copy(sorted, spans)
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].ComparisonStartOffset < sorted[j].ComparisonStartOffset
+	})
+
+	add := func(in instruction) {
+		if n := len(result); n > 0 && in.copy && result[n-1].copy &&
+			result[n-1].oldOffset+result[n-1].length == in.oldOffset {
+			result[n-1].length += in.length
+			return
+		}
+		result = append(result, in)
+	}
+
+	covered := int64(0)
+
+	for _, span := range sorted {
+		oldStart := int64(span.StartBlock) * blockSize
+		oldEnd := int64(span.EndBlock+1) * blockSize
+
+		// the last block of the old file may be short
+		if oldEnd > oldSize {
+			oldEnd = oldSize
+		}
+
+		newStart := span.ComparisonStartOffset
+		newEnd := newStart + oldEnd - oldStart
+
+		if newEnd > newSize {
+			newEnd = newSize
+		}
+
+		if newEnd <= covered {
+			continue
+		}
+
+		if newStart > covered {
+			add(instruction{
+				newOffset: covered,
+				length:    newStart - covered,
+			})
+			covered = newStart
+		}
+
+		add(instruction{
+			copy:      true,
+			newOffset: covered,
+			oldOffset: oldStart + covered - newStart,
+			length:    newEnd - covered,
+		})
+
+		covered = newEnd
+	}
+
+	if covered < newSize {
+		add(instruction{
+			newOffset: covered,
+			length:    newSize - covered,
+		})
+	}
+
+	return result
+}
@@ -0,0 +1,260 @@
+/*
+Package delta creates and applies self-contained patches, for when the reference
+cannot be reached while patching (for instance, on an air-gapped machine).
+
+A delta is created from the index of the old file and the new file, and contains instructions to
+either COPY a range of the old file, or to write DATA that was not found in the old file.
+Applying the delta to the old file recreates the new file, which is verified against the size
+and whole-file checksum embedded in the delta.
+
+When the new file is on a server, a client can send a signature of its old file (see WriteSignature)
+for the server to create a delta against, so that only the missing data is transferred.
+
+The format (all integers little endian) is:
+
+	header:       magic "GSYNCDLT", uint32 version, int64 new file size,
+	              uint16 checksum length, whole-file checksum of the new file
+	instructions: repeating uint8 opcode, followed by:
+	              COPY: int64 old file offset, int64 length
+	              DATA: int64 length, data
+	              END:  nothing, this must be the last instruction
+*/
+package delta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/Redundancy/go-sync/filechecksum"
+)
+
+const (
+	magic   = "GSYNCDLT"
+	version = uint32(1)
+)
+
+// Instruction opcodes
+const (
+	OpEnd = uint8(iota)
+	OpCopy
+	OpData
+)
+
+var ErrInvalidDelta = errors.New("Data is not a valid delta")
+
+// ErrTrailingData is returned when there is more data after the END instruction of a delta
+var ErrTrailingData = errors.New("Delta has data after its END instruction")
+
+// ErrOutputMismatch is returned by Apply when the output does not have
+// the size or whole-file checksum embedded in the delta
+type ErrOutputMismatch struct {
+	ExpectedSize     int64
+	ActualSize       int64
+	ExpectedChecksum []byte
+	ActualChecksum   []byte
+}
+
+func (e *ErrOutputMismatch) Error() string {
+	if e.ExpectedSize != e.ActualSize {
+		return fmt.Sprintf(
+			"Delta output was %v bytes, expected %v bytes",
+			e.ActualSize,
+			e.ExpectedSize,
+		)
+	}
+
+	return fmt.Sprintf(
+		"Delta output checksum %x did not match the expected checksum %x",
+		e.ActualChecksum,
+		e.ExpectedChecksum,
+	)
+}
+
+type header struct {
+	FileSize     int64
+	FileChecksum []byte
+}
+
+func writeHeader(w io.Writer, h header) error {
+	if _, err := io.WriteString(w, magic); err != nil {
+		return err
+	}
+
+	for _, v := range []interface{}{
+		version,
+		h.FileSize,
+		uint16(len(h.FileChecksum)),
+	} {
+		if err := binary.Write(w, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+
+	_, err := w.Write(h.FileChecksum)
+	return err
+}
+
+func readHeader(r io.Reader) (h header, err error) {
+	m := make([]byte, len(magic))
+
+	if _, err = io.ReadFull(r, m); err != nil || string(m) != magic {
+		return h, ErrInvalidDelta
+	}
+
+	var v uint32
+	if err = binary.Read(r, binary.LittleEndian, &v); err != nil {
+		return h, ErrInvalidDelta
+	} else if v != version {
+		return h, fmt.Errorf("Unsupported delta version: %v", v)
+	}
+
+	var checksumLength uint16
+
+	if err = binary.Read(r, binary.LittleEndian, &h.FileSize); err != nil {
+		return h, ErrInvalidDelta
+	}
+
+	if err = binary.Read(r, binary.LittleEndian, &checksumLength); err != nil {
+		return h, ErrInvalidDelta
+	}
+
+	h.FileChecksum = make([]byte, checksumLength)
+	if _, err = io.ReadFull(r, h.FileChecksum); err != nil {
+		return h, ErrInvalidDelta
+	}
+
+	return h, nil
+}
+
+func writeCopy(w io.Writer, offset, length int64) error {
+	return binary.Write(w, binary.LittleEndian, struct {
+		Op     uint8
+		Offset int64
+		Length int64
+	}{OpCopy, offset, length})
+}
+
+func writeData(w io.Writer, data io.Reader, length int64) error {
+	err := binary.Write(w, binary.LittleEndian, struct {
+		Op     uint8
+		Length int64
+	}{OpData, length})
+
+	if err != nil {
+		return err
+	}
+
+	n, err := io.CopyN(w, data, length)
+	if err == io.EOF && n < length {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readEnd checks that there is nothing after the END instruction
+func readEnd(r io.Reader) error {
+	switch _, err := io.ReadFull(r, make([]byte, 1)); err {
+	case io.EOF:
+		return nil
+	case nil:
+		return ErrTrailingData
+	default:
+		return fmt.Errorf("Error reading the end of the delta: %v", err)
+	}
+}
+
+/*
+Apply recreates the new file described by patch, copying ranges from old as instructed,
+and writing the result to out. The output is verified against the size and checksum
+in the delta, and an *ErrOutputMismatch is returned if they do not match.
+If there is anything in patch after the END instruction, ErrTrailingData is returned, and
+ErrInvalidDelta is returned before anything past the size of the new file would be written.
+
+Data has already been written to out when verification fails, so callers that
+need to leave existing files untouched should write to a temporary file.
+*/
+func Apply(old io.ReaderAt, patch io.Reader, out io.Writer) error {
+	h, err := readHeader(patch)
+	if err != nil {
+		return err
+	}
+
+	hash := filechecksum.DefaultFileHashGenerator()
+	output := io.MultiWriter(out, hash)
+	written := int64(0)
+
+	for {
+		var op uint8
+		if err := binary.Read(patch, binary.LittleEndian, &op); err != nil {
+			return fmt.Errorf("Error reading delta instruction: %v", err)
+		}
+
+		switch op {
+		case OpEnd:
+			actual := hash.Sum(nil)
+
+			if written != h.FileSize || !bytes.Equal(actual, h.FileChecksum) {
+				return &ErrOutputMismatch{
+					ExpectedSize:     h.FileSize,
+					ActualSize:       written,
+					ExpectedChecksum: h.FileChecksum,
+					ActualChecksum:   actual,
+				}
+			}
+
+			return readEnd(patch)
+
+		case OpCopy:
+			var c struct {
+				Offset int64
+				Length int64
+			}
+
+			if err := binary.Read(patch, binary.LittleEndian, &c); err != nil {
+				return fmt.Errorf("Error reading delta COPY instruction: %v", err)
+			}
+
+			// nothing is copied past the size of the new file
+			if c.Offset < 0 || c.Length < 0 || c.Length > h.FileSize-written {
+				return ErrInvalidDelta
+			}
+
+			n, err := io.Copy(output, io.NewSectionReader(old, c.Offset, c.Length))
+			written += n
+
+			if err != nil {
+				return fmt.Errorf("Error copying from the old file: %v", err)
+			} else if n != c.Length {
+				return fmt.Errorf(
+					"Old file is too short to copy %v bytes from offset %v",
+					c.Length,
+					c.Offset,
+				)
+			}
+
+		case OpData:
+			var length int64
+
+			if err := binary.Read(patch, binary.LittleEndian, &length); err != nil {
+				return fmt.Errorf("Error reading delta DATA instruction: %v", err)
+			}
+
+			if length < 0 || length > h.FileSize-written {
+				return ErrInvalidDelta
+			}
+
+			n, err := io.CopyN(output, patch, length)
+			written += n
+
+			if err != nil {
+				return fmt.Errorf("Error reading delta data: %v", err)
+			}
+
+		default:
+			return fmt.Errorf("Unknown delta instruction: %v", op)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package delta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/Redundancy/go-sync/comparer"
+	"github.com/Redundancy/go-sync/filechecksum"
+	"github.com/Redundancy/go-sync/index"
+	"github.com/Redundancy/go-sync/indexbuilder"
+)
+
+const BLOCK_SIZE = 16
+
+type testReference struct {
+	*index.ChecksumIndex
+	fileSize int64
+}
+
+func (r *testReference) GetBlockSize() uint {
+	return BLOCK_SIZE
+}
+
+func (r *testReference) GetFileSize() int64 {
+	return r.fileSize
+}
+
+func makeReference(t *testing.T, old []byte) *testReference {
+	generator := filechecksum.NewFileChecksumGenerator(BLOCK_SIZE)
+	_, idx, _, err := indexbuilder.BuildChecksumIndex(generator, bytes.NewReader(old))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testReference{
+		ChecksumIndex: idx,
+		fileSize:      int64(len(old)),
+	}
+}
+
+func roundTrip(t *testing.T, old, new []byte) (patch []byte) {
+	buffer := bytes.NewBuffer(nil)
+	err := Create(buffer, makeReference(t, old), bytes.NewReader(new), int64(len(new)))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patch = buffer.Bytes()
+	out := bytes.NewBuffer(nil)
+
+	if err := Apply(bytes.NewReader(old), bytes.NewReader(patch), out); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(out.Bytes(), new) {
+		t.Errorf("Applied delta did not recreate the new file")
+	}
+
+	return patch
+}
+
+func randomData(seed int64, size int) []byte {
+	b := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+func TestRoundTripModifiedFile(t *testing.T) {
+	old := randomData(1, 4000+7)
+
+	// move things around, insert, delete and append content
+	new := append([]byte{}, old[2000:3000]...)
+	new = append(new, []byte("inserted content")...)
+	new = append(new, old[:1500]...)
+	new = append(new, old[3500:]...)
+	new = append(new, []byte("appended")...)
+
+	patch := roundTrip(t, old, new)
+
+	if len(patch) > len(new)/4 {
+		t.Errorf("Delta was larger than expected: %v bytes", len(patch))
+	}
+}
+
+func TestRoundTripIdenticalFile(t *testing.T) {
+	old := randomData(2, 1000)
+	patch := roundTrip(t, old, old)
+
+	// header, one copy and the end
+	expectedSize := len(magic) + 4 + 8 + 2 + 16 + 17 + 1
+	if len(patch) != expectedSize {
+		t.Errorf("Expected a delta of %v bytes, got %v", expectedSize, len(patch))
+	}
+}
+
+func TestRoundTripUnrelatedFiles(t *testing.T) {
+	roundTrip(t, randomData(3, 1000), randomData(4, 900))
+}
+
+func TestRoundTripEmptyFiles(t *testing.T) {
+	roundTrip(t, randomData(5, 100), []byte{})
+	roundTrip(t, []byte{}, randomData(6, 100))
+}
+
+func TestRoundTripRepeatedBlocks(t *testing.T) {
+	old := randomData(7, 1000)
+
+	// the start of the old file appears several times in the new file
+	var new []byte
+	for i := 0; i < 4; i++ {
+		new = append(new, old[:500]...)
+		new = append(new, byte(i))
+	}
+
+	patch := roundTrip(t, old, new)
+
+	if len(patch) > 200 {
+		t.Errorf("Expected every repeat to be copied, the delta was %v bytes", len(patch))
+	}
+}
+
+func TestApplyWithTrailingDataFails(t *testing.T) {
+	old := randomData(8, 1000)
+	patch := roundTrip(t, old, old)
+	patch = append(patch, 0)
+
+	if err := Apply(bytes.NewReader(old), bytes.NewReader(patch), bytes.NewBuffer(nil)); err != ErrTrailingData {
+		t.Errorf("Expected data after the end of the delta to fail: %v", err)
+	}
+}
+
+func TestApplyToWrongFileFails(t *testing.T) {
+	old := randomData(7, 1000)
+	new := append(append([]byte{}, old[:500]...), 'x')
+
+	buffer := bytes.NewBuffer(nil)
+	err := Create(buffer, makeReference(t, old), bytes.NewReader(new), int64(len(new)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed := append([]byte{}, old...)
+	changed[10] ^= 0xFF
+
+	err = Apply(bytes.NewReader(changed), buffer, bytes.NewBuffer(nil))
+
+	if _, ok := err.(*ErrOutputMismatch); !ok {
+		t.Errorf("Expected an output mismatch, got: %v", err)
+	}
+}
+
+func TestApplyToShortFileFails(t *testing.T) {
+	old := randomData(8, 1000)
+
+	buffer := bytes.NewBuffer(nil)
+	err := Create(buffer, makeReference(t, old), bytes.NewReader(old), int64(len(old)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Apply(bytes.NewReader(old[:900]), buffer, bytes.NewBuffer(nil)); err == nil {
+		t.Error("Expected an error applying to a truncated file")
+	}
+}
+
+func TestApplyTruncatedDeltaFails(t *testing.T) {
+	old := randomData(9, 1000)
+	new := append([]byte("new"), old...)
+
+	buffer := bytes.NewBuffer(nil)
+	err := Create(buffer, makeReference(t, old), bytes.NewReader(new), int64(len(new)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patch := buffer.Bytes()
+	for _, size := range []int{0, 10, len(patch) - 1} {
+		err := Apply(bytes.NewReader(old), bytes.NewReader(patch[:size]), bytes.NewBuffer(nil))
+		if err == nil {
+			t.Errorf("Expected an error applying a delta truncated to %v bytes", size)
+		}
+	}
+}
+
+func TestInstructionsForOverlappingSpans(t *testing.T) {
+	spans := comparer.BlockSpanList{
+		{StartBlock: 0, EndBlock: 1, ComparisonStartOffset: 0},
+		// overlaps the end of the first span by 8 bytes
+		{StartBlock: 5, EndBlock: 5, ComparisonStartOffset: 24},
+		// entirely within the first span
+		{StartBlock: 4, EndBlock: 4, ComparisonStartOffset: 8},
+		{StartBlock: 3, EndBlock: 3, ComparisonStartOffset: 40},
+	}
+
+	result := toInstructions(spans, 16, 100, 60)
+	expected := []instruction{
+		{copy: true, newOffset: 0, oldOffset: 0, length: 32},
+		{copy: true, newOffset: 32, oldOffset: 88, length: 8},
+		{copy: true, newOffset: 40, oldOffset: 48, length: 16},
+		{copy: false, newOffset: 56, length: 4},
+	}
+
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Unexpected instructions:\n%v\n%v", result, expected)
+	}
+}
+
+func TestSignatureRoundTrip(t *testing.T) {
+	old := randomData(10, 1000)
+	new := append(append([]byte("prefix"), old[:600]...), old[700:]...)
+
+	signature := bytes.NewBuffer(nil)
+	if err := WriteSignature(signature, bytes.NewReader(old), int64(len(old)), BLOCK_SIZE); err != nil {
+		t.Fatal(err)
+	}
+
+	reference, err := ReadSignature(signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reference.GetFileSize() != int64(len(old)) || reference.GetBlockSize() != BLOCK_SIZE {
+		t.Errorf("Unexpected signature: %v bytes, blocks of %v", reference.FileSize, reference.BlockSize)
+	}
+
+	patch := bytes.NewBuffer(nil)
+	if err := Create(patch, reference, bytes.NewReader(new), int64(len(new))); err != nil {
+		t.Fatal(err)
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := Apply(bytes.NewReader(old), patch, out); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(out.Bytes(), new) {
+		t.Errorf("Applied delta did not recreate the new file")
+	}
+}
+
+func TestTruncatedSignatureFails(t *testing.T) {
+	old := randomData(11, 1000)
+
+	signature := bytes.NewBuffer(nil)
+	if err := WriteSignature(signature, bytes.NewReader(old), int64(len(old)), BLOCK_SIZE); err != nil {
+		t.Fatal(err)
+	}
+
+	b := signature.Bytes()
+	for _, size := range []int{0, 10, len(b) - 20, len(b) - 1} {
+		if _, err := ReadSignature(bytes.NewReader(b[:size])); err == nil {
+			t.Errorf("Expected an error reading a signature truncated to %v bytes", size)
+		}
+	}
+}
+
+func TestSignatureWithLargeBlocksFails(t *testing.T) {
+	signature := bytes.NewBuffer(nil)
+	if err := WriteSignature(signature, bytes.NewReader(nil), 0, MaxSignatureBlockSize+1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ReadSignature(signature); err == nil {
+		t.Error("Expected an error reading a signature with blocks over the limit")
+	}
+}
+
+func TestDecodedPatchReadsAnyRange(t *testing.T) {
+	old := randomData(12, 1000)
+	new := append([]byte{}, old[500:]...)
+	new = append(new, []byte("inserted content")...)
+	new = append(new, old[:400]...)
+
+	buffer := bytes.NewBuffer(nil)
+	err := Create(buffer, makeReference(t, old), bytes.NewReader(new), int64(len(new)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "gosync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	patch, err := Decode(buffer, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if patch.FileSize != int64(len(new)) {
+		t.Errorf("Unexpected file size: %v", patch.FileSize)
+	}
+
+	if patch.CopiedBytes() == 0 || patch.CopiedBytes() > int64(len(new)) {
+		t.Errorf("Unexpected number of copied bytes: %v", patch.CopiedBytes())
+	}
+
+	reader := patch.Reader(bytes.NewReader(old))
+
+	for _, r := range [][2]int{{0, len(new)}, {490, 530}, {7, 8}, {600, 900}, {len(new) - 3, len(new)}} {
+		b := make([]byte, r[1]-r[0])
+
+		if _, err := reader.ReadAt(b, int64(r[0])); err != nil {
+			t.Fatalf("Error reading %v: %v", r, err)
+		}
+
+		if !bytes.Equal(b, new[r[0]:r[1]]) {
+			t.Errorf("Range %v did not match the new file", r)
+		}
+	}
+
+	if n, err := reader.ReadAt(make([]byte, 10), int64(len(new)-5)); n != 5 || err != io.EOF {
+		t.Errorf("Expected 5 bytes and EOF reading past the end, got %v, %v", n, err)
+	}
+
+	if err := patch.Close(); err != nil {
+		t.Error(err)
+	}
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("The data of the delta was not removed: %v", len(files))
+	}
+}
+
+func TestDecodeRejectsDataLargerThanTheFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	buffer := bytes.NewBuffer(nil)
+	writeHeader(buffer, header{FileSize: 10, FileChecksum: make([]byte, 16)})
+	writeData(buffer, bytes.NewReader(make([]byte, 5)), 5)
+
+	// claims far more data than the file has, without sending it
+	binary.Write(buffer, binary.LittleEndian, OpData)
+	binary.Write(buffer, binary.LittleEndian, int64(1<<40))
+
+	if _, err := Decode(buffer, dir); err != ErrInvalidDelta {
+		t.Errorf("Expected an invalid delta, got: %v", err)
+	}
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("The data of the delta was not removed: %v", len(files))
+	}
+}
+
+func TestApplyRejectsCopiesLargerThanTheFile(t *testing.T) {
+	old := randomData(10, 1000)
+
+	buffer := bytes.NewBuffer(nil)
+	writeHeader(buffer, header{FileSize: int64(len(old)), FileChecksum: make([]byte, 16)})
+
+	for i := 0; i < 3; i++ {
+		writeCopy(buffer, 0, int64(len(old)))
+	}
+
+	out := bytes.NewBuffer(nil)
+
+	if err := Apply(bytes.NewReader(old), buffer, out); err != ErrInvalidDelta {
+		t.Errorf("Expected an invalid delta, got: %v", err)
+	}
+
+	if out.Len() > len(old) {
+		t.Errorf("Wrote %v bytes, more than the size of the file", out.Len())
+	}
+}
+
+func TestApplyRejectsDataLargerThanTheFile(t *testing.T) {
+	buffer := bytes.NewBuffer(nil)
+	writeHeader(buffer, header{FileSize: 10, FileChecksum: make([]byte, 16)})
+	writeData(buffer, bytes.NewReader(make([]byte, 20)), 20)
+
+	if err := Apply(bytes.NewReader(nil), buffer, bytes.NewBuffer(nil)); err != ErrInvalidDelta {
+		t.Errorf("Expected an invalid delta, got: %v", err)
+	}
+}
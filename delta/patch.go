@@ -0,0 +1,216 @@
+package delta
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+/*
+Patch is a delta read by Decode, so that any range of the new file can be read without
+applying the whole delta. The data for the ranges that were not found in the old file
+is kept in a temporary file, which is removed by Close.
+*/
+type Patch struct {
+	FileSize     int64
+	FileChecksum []byte
+
+	// sorted and contiguous over the new file
+	instructions []instruction
+	// the offset in data of the content of each DATA instruction
+	dataOffsets []int64
+	data        *os.File
+}
+
+/*
+Decode reads a whole delta, as written by Create, keeping the data of the delta in a
+temporary file in tempDir (or the default directory for temporary files, if it is "").
+
+No instruction may describe more than the size of the new file in the header of the delta,
+and ErrInvalidDelta is returned if one does.
+*/
+func Decode(r io.Reader, tempDir string) (result *Patch, err error) {
+	h, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.TempFile(tempDir, "gosync-delta-")
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Patch{
+		FileSize:     h.FileSize,
+		FileChecksum: h.FileChecksum,
+		data:         data,
+	}
+
+	defer func() {
+		if err != nil {
+			p.Close()
+		}
+	}()
+
+	newOffset := int64(0)
+	dataSize := int64(0)
+
+	for {
+		var op uint8
+		if err := binary.Read(r, binary.LittleEndian, &op); err != nil {
+			return nil, fmt.Errorf("Error reading delta instruction: %v", err)
+		}
+
+		in := instruction{newOffset: newOffset}
+		dataOffset := int64(-1)
+
+		switch op {
+		case OpEnd:
+			if newOffset != p.FileSize {
+				return nil, fmt.Errorf(
+					"Delta describes %v bytes, expected %v bytes",
+					newOffset,
+					p.FileSize,
+				)
+			}
+
+			if err := readEnd(r); err != nil {
+				return nil, err
+			}
+
+			return p, nil
+
+		case OpCopy:
+			var c struct {
+				Offset int64
+				Length int64
+			}
+
+			if err := binary.Read(r, binary.LittleEndian, &c); err != nil {
+				return nil, fmt.Errorf("Error reading delta COPY instruction: %v", err)
+			}
+
+			in.copy = true
+			in.oldOffset = c.Offset
+			in.length = c.Length
+
+		case OpData:
+			if err := binary.Read(r, binary.LittleEndian, &in.length); err != nil {
+				return nil, fmt.Errorf("Error reading delta DATA instruction: %v", err)
+			}
+
+			if in.length < 0 || in.length > p.FileSize-newOffset {
+				return nil, ErrInvalidDelta
+			}
+
+			n, err := io.CopyN(data, r, in.length)
+			if err != nil {
+				return nil, fmt.Errorf("Error reading delta data: %v", err)
+			}
+
+			dataOffset = dataSize
+			dataSize += n
+
+		default:
+			return nil, fmt.Errorf("Unknown delta instruction: %v", op)
+		}
+
+		if in.length < 0 || in.oldOffset < 0 || in.length > p.FileSize-newOffset {
+			return nil, ErrInvalidDelta
+		}
+
+		p.instructions = append(p.instructions, in)
+		p.dataOffsets = append(p.dataOffsets, dataOffset)
+		newOffset += in.length
+	}
+}
+
+// Close removes the data of the delta. The patch cannot be read once it has been closed.
+func (p *Patch) Close() error {
+	err := p.data.Close()
+
+	if e := os.Remove(p.data.Name()); err == nil {
+		err = e
+	}
+
+	return err
+}
+
+// CopiedBytes is the number of bytes of the new file that are copied from the old file
+func (p *Patch) CopiedBytes() (n int64) {
+	for _, in := range p.instructions {
+		if in.copy {
+			n += in.length
+		}
+	}
+	return n
+}
+
+// Reader reads the new file at any offset, by copying from old or the delta data as needed
+func (p *Patch) Reader(old io.ReaderAt) io.ReaderAt {
+	return &patchReader{patch: p, old: old}
+}
+
+type patchReader struct {
+	patch *Patch
+	old   io.ReaderAt
+}
+
+func (r *patchReader) ReadAt(b []byte, off int64) (n int, err error) {
+	p := r.patch
+
+	if off < 0 {
+		return 0, fmt.Errorf("Negative offset: %v", off)
+	}
+
+	// the first instruction that ends after the offset
+	i := sort.Search(len(p.instructions), func(i int) bool {
+		in := p.instructions[i]
+		return in.newOffset+in.length > off
+	})
+
+	for ; n < len(b) && i < len(p.instructions); i++ {
+		in := p.instructions[i]
+		start := off + int64(n) - in.newOffset
+		length := in.length - start
+
+		if length > int64(len(b)-n) {
+			length = int64(len(b) - n)
+		}
+
+		target := b[n : n+int(length)]
+
+		if !in.copy {
+			read, err := p.data.ReadAt(target, p.dataOffsets[i]+start)
+			n += read
+
+			if read < len(target) {
+				return n, fmt.Errorf("Error reading delta data: %v", err)
+			}
+			continue
+		}
+
+		read, err := r.old.ReadAt(target, in.oldOffset+start)
+		n += read
+
+		if read < len(target) {
+			if err == nil || err == io.EOF {
+				err = fmt.Errorf(
+					"Old file is too short to copy %v bytes from offset %v",
+					len(target),
+					in.oldOffset+start,
+				)
+			}
+			return n, err
+		}
+	}
+
+	if n < len(b) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
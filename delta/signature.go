@@ -0,0 +1,133 @@
+package delta
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/Redundancy/go-sync/chunks"
+	"github.com/Redundancy/go-sync/filechecksum"
+	"github.com/Redundancy/go-sync/index"
+)
+
+/*
+A signature describes the old file to whoever holds the new file, so that they can create
+a delta against it without the old file being transferred (the direction rsync works in).
+
+The format (all integers little endian) is:
+
+	header: magic "GSYNCSIG", uint32 version, int64 file size, uint32 block size
+	blocks: the weak and strong checksums of each block, as written by FileChecksumGenerator
+*/
+const (
+	signatureMagic   = "GSYNCSIG"
+	signatureVersion = uint32(1)
+)
+
+// MaxSignatureBlockSize is the largest block size that ReadSignature accepts
+const MaxSignatureBlockSize = 1024 * 1024
+
+var ErrInvalidSignature = errors.New("Data is not a valid signature")
+
+// Signature is the index of an old file read from a signature. It satisfies Reference.
+type Signature struct {
+	*index.ChecksumIndex
+	BlockSize uint
+	FileSize  int64
+}
+
+func (s *Signature) GetBlockSize() uint {
+	return s.BlockSize
+}
+
+func (s *Signature) GetFileSize() int64 {
+	return s.FileSize
+}
+
+// WriteSignature reads the old file of the given size from r, and writes its signature to w
+func WriteSignature(w io.Writer, r io.Reader, size int64, blockSize uint) error {
+	if blockSize == 0 {
+		return errors.New("The block size of a signature cannot be 0")
+	}
+
+	out := bufio.NewWriter(w)
+
+	if _, err := io.WriteString(out, signatureMagic); err != nil {
+		return err
+	}
+
+	for _, v := range []interface{}{
+		signatureVersion,
+		size,
+		uint32(blockSize),
+	} {
+		if err := binary.Write(out, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+
+	generator := filechecksum.NewFileChecksumGenerator(blockSize)
+	if _, err := generator.GenerateChecksums(io.LimitReader(r, size), out); err != nil {
+		return err
+	}
+
+	return out.Flush()
+}
+
+// ReadSignature reads a signature written by WriteSignature
+func ReadSignature(r io.Reader) (*Signature, error) {
+	m := make([]byte, len(signatureMagic))
+
+	if _, err := io.ReadFull(r, m); err != nil || string(m) != signatureMagic {
+		return nil, ErrInvalidSignature
+	}
+
+	var h struct {
+		Version   uint32
+		FileSize  int64
+		BlockSize uint32
+	}
+
+	if err := binary.Read(r, binary.LittleEndian, &h); err != nil {
+		return nil, ErrInvalidSignature
+	} else if h.Version != signatureVersion {
+		return nil, fmt.Errorf("Unsupported signature version: %v", h.Version)
+	} else if h.BlockSize == 0 || h.FileSize < 0 {
+		return nil, ErrInvalidSignature
+	} else if h.BlockSize > MaxSignatureBlockSize {
+		return nil, fmt.Errorf(
+			"The signature block size of %v is larger than the limit of %v",
+			h.BlockSize,
+			MaxSignatureBlockSize,
+		)
+	}
+
+	generator := filechecksum.NewFileChecksumGenerator(uint(h.BlockSize))
+	checksums, err := chunks.LoadChecksumsFromReader(
+		r,
+		generator.WeakRollingHash.Size(),
+		generator.StrongHash.Size(),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	blockCount := (h.FileSize + int64(h.BlockSize) - 1) / int64(h.BlockSize)
+	if int64(len(checksums)) != blockCount {
+		return nil, fmt.Errorf(
+			"Signature has %v blocks, expected %v for a %v byte file",
+			len(checksums),
+			blockCount,
+			h.FileSize,
+		)
+	}
+
+	return &Signature{
+		ChecksumIndex: index.MakeChecksumIndex(checksums),
+		BlockSize:     uint(h.BlockSize),
+		FileSize:      h.FileSize,
+	}, nil
+}
@@ -0,0 +1,147 @@
+package gosync
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Redundancy/go-sync/comparer"
+	"github.com/Redundancy/go-sync/filechecksum"
+	"github.com/Redundancy/go-sync/indexbuilder"
+	"github.com/Redundancy/go-sync/patcher"
+)
+
+// DefaultBlockSize is the block size used by Diff when none is given
+const DefaultBlockSize = 8192
+
+// DiffOptions configures Diff. The zero value uses the defaults.
+type DiffOptions struct {
+	// The block size of the index built from the new file, defaults to DefaultBlockSize
+	BlockSize uint
+
+	// The number of goroutines used to compare, defaults to DefaultConcurrency
+	Concurrency int
+
+	// Check weak checksums against a filter before looking them up in the index of the new file
+	// (see index.ChecksumIndex.EnableWeakFilter), which is faster when the files are mostly different
+	WeakFilter bool
+}
+
+/*
+DiffResult describes how the new file could be made by patching the old file,
+as RSync.Patch would do with the new file as the reference.
+*/
+type DiffResult struct {
+	BlockSize uint
+	OldSize   int64
+	NewSize   int64
+
+	// Blocks of the new file that were found in the old file
+	Matched []patcher.FoundBlockSpan
+	// Blocks of the new file that would have to be fetched
+	Missing []patcher.MissingBlockSpan
+	// Ranges of the old file that are not used in the new file
+	Literals comparer.LiteralSpanList
+
+	MatchedBytes int64
+	MissingBytes int64
+	LiteralBytes int64
+
+	// The percentage of the new file that can be reused from the old file
+	Reuse float64
+}
+
+/*
+Diff compares two files on disk, without needing a pre-built index.
+
+An index of the new file is built in memory, and the old file is compared against it.
+*/
+func Diff(oldPath, newPath string, opts DiffOptions) (*DiffResult, error) {
+	if opts.BlockSize == 0 {
+		opts.BlockSize = DefaultBlockSize
+	}
+
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DefaultConcurrency
+	}
+
+	newFile, err := os.Open(newPath)
+	if err != nil {
+		return nil, err
+	}
+	defer newFile.Close()
+
+	newInfo, err := newFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	generator := filechecksum.NewFileChecksumGenerator(opts.BlockSize)
+	_, reference, _, err := indexbuilder.BuildChecksumIndex(generator, newFile)
+
+	if err != nil {
+		return nil, fmt.Errorf("Could not build an index of %v: %v", newPath, err)
+	}
+
+	if opts.WeakFilter {
+		reference.EnableWeakFilter()
+	}
+
+	oldFile, err := os.Open(oldPath)
+	if err != nil {
+		return nil, err
+	}
+	defer oldFile.Close()
+
+	oldInfo, err := oldFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	matcher := comparer.NewParallelMatcher(opts.BlockSize, opts.Concurrency)
+	merger, err := matcher.FindMatchingBlocks(oldFile, oldInfo.Size(), reference)
+
+	if err != nil {
+		return nil, fmt.Errorf("Could not compare %v to %v: %v", oldPath, newPath, err)
+	}
+
+	blockSize := int64(opts.BlockSize)
+	matched := merger.GetMergedBlocks()
+
+	result := &DiffResult{
+		BlockSize: opts.BlockSize,
+		OldSize:   oldInfo.Size(),
+		NewSize:   newInfo.Size(),
+		Matched:   toPatcherFoundSpan(matched, blockSize),
+		Literals:  merger.GetLiteralSpans(oldInfo.Size()),
+		Missing: toPatcherMissingSpan(
+			matched.MissingBlocks(uint(reference.BlockCount)),
+			blockSize,
+		),
+		Reuse: 100,
+	}
+
+	for _, span := range matched {
+		result.MatchedBytes += spanSize(span.StartBlock, span.EndBlock, blockSize, result.NewSize)
+	}
+
+	for _, span := range result.Missing {
+		result.MissingBytes += spanSize(span.StartBlock, span.EndBlock, blockSize, result.NewSize)
+	}
+
+	result.LiteralBytes = result.Literals.TotalSize()
+
+	if result.NewSize > 0 {
+		result.Reuse = 100 * float64(result.MatchedBytes) / float64(result.NewSize)
+	}
+
+	return result, nil
+}
+
+// the number of bytes in a span of blocks, where the last block of the file may be short
+func spanSize(startBlock, endBlock uint, blockSize, fileSize int64) int64 {
+	end := int64(endBlock+1) * blockSize
+	if end > fileSize {
+		end = fileSize
+	}
+	return end - int64(startBlock)*blockSize
+}
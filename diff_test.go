@@ -0,0 +1,105 @@
+package gosync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeTestFiles(t *testing.T, contents ...string) (dir string, paths []string) {
+	dir, err := ioutil.TempDir("", "gosync")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, c := range contents {
+		path := filepath.Join(dir, string('a'+rune(i)))
+		if err := ioutil.WriteFile(path, []byte(c), 0666); err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	return
+}
+
+func TestDiff(t *testing.T) {
+	dir, paths := writeTestFiles(t, LOCAL_VERSION, REFERENCE)
+	defer os.RemoveAll(dir)
+
+	result, err := Diff(paths[0], paths[1], DiffOptions{BlockSize: BLOCK_SIZE})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// "quic", "ed over " and " dog" are missing
+	if result.MissingBytes != 16 || len(result.Missing) != 3 {
+		t.Errorf("Unexpected missing spans: %v (%v bytes)", result.Missing, result.MissingBytes)
+	}
+
+	if result.MatchedBytes != int64(len(REFERENCE))-16 {
+		t.Errorf("Unexpected matched bytes: %v", result.MatchedBytes)
+	}
+
+	var literals []string
+	for _, l := range result.Literals {
+		literals = append(literals, LOCAL_VERSION[l.ComparisonStartOffset:l.ComparisonEndOffset])
+	}
+
+	if !reflect.DeepEqual(literals, []string{"qwi", "ed 0v3r "}) {
+		t.Errorf("Unexpected unused parts of the old file: %q", literals)
+	}
+
+	if result.LiteralBytes != 11 {
+		t.Errorf("Unexpected literal bytes: %v", result.LiteralBytes)
+	}
+
+	if result.Reuse < 63 || result.Reuse > 64 {
+		t.Errorf("Unexpected reuse: %v", result.Reuse)
+	}
+}
+
+func TestDiffIdenticalFiles(t *testing.T) {
+	dir, paths := writeTestFiles(t, REFERENCE, REFERENCE)
+	defer os.RemoveAll(dir)
+
+	result, err := Diff(paths[0], paths[1], DiffOptions{BlockSize: BLOCK_SIZE})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Reuse != 100 || len(result.Missing) != 0 || len(result.Literals) != 0 {
+		t.Errorf("Expected complete reuse: %#v", result)
+	}
+}
+
+func TestDiffWithWeakFilter(t *testing.T) {
+	dir, paths := writeTestFiles(t, LOCAL_VERSION, REFERENCE)
+	defer os.RemoveAll(dir)
+
+	unfiltered, err := Diff(paths[0], paths[1], DiffOptions{BlockSize: BLOCK_SIZE})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filtered, err := Diff(paths[0], paths[1], DiffOptions{BlockSize: BLOCK_SIZE, WeakFilter: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(filtered, unfiltered) {
+		t.Errorf("The filter changed the result: %#v", filtered)
+	}
+}
+
+func TestDiffMissingFile(t *testing.T) {
+	dir, paths := writeTestFiles(t, REFERENCE)
+	defer os.RemoveAll(dir)
+
+	if _, err := Diff(paths[0], filepath.Join(dir, "missing"), DiffOptions{}); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
@@ -277,7 +277,7 @@ func TestInvalidReaderLength_Strong(t *testing.T) {
 	}
 }
 
-func ExampleFileChecksumGenerator_LoadChecksumsFromReader() {
+func ExampleFileChecksumGenerator_GetChecksumSizes() {
 	const BLOCKSIZE = 8096
 	checksum := NewFileChecksumGenerator(BLOCKSIZE)
 
@@ -3,19 +3,82 @@ package filechecksum
 import (
 	"bytes"
 	"hash"
+	"sync"
 )
 
 type ChecksumLookup interface {
 	GetStrongChecksumForBlock(blockID int) []byte
 }
 
+// HashVerifier checks blocks against the strong checksums of the reference.
+// It is safe to call VerifyBlockRange concurrently: each call takes a hash
+// from a pool, rather than sharing the state of a single one.
 type HashVerifier struct {
-	BlockSize           uint
-	Hash                hash.Hash
+	BlockSize uint
+
+	// Deprecated: use HashGenerator. If set, Hash is used for every block,
+	// and calls to VerifyBlockRange take turns using it.
+	Hash hash.Hash
+
 	BlockChecksumGetter ChecksumLookup
+
+	// Creates the hashes used to verify blocks
+	// defaults to DefaultStrongHashGenerator
+	HashGenerator func() hash.Hash
+
+	hashes sync.Pool
+
+	// guards Hash
+	hashLock sync.Mutex
+}
+
+// NewHashVerifier creates a HashVerifier that uses hashes from hashGenerator
+func NewHashVerifier(
+	blockSize uint,
+	checksums ChecksumLookup,
+	hashGenerator func() hash.Hash,
+) *HashVerifier {
+	return &HashVerifier{
+		BlockSize:           blockSize,
+		BlockChecksumGetter: checksums,
+		HashGenerator:       hashGenerator,
+	}
+}
+
+func (v *HashVerifier) getHash() hash.Hash {
+	if v.Hash != nil {
+		v.hashLock.Lock()
+		return v.Hash
+	}
+
+	if h, ok := v.hashes.Get().(hash.Hash); ok {
+		return h
+	}
+
+	if v.HashGenerator != nil {
+		return v.HashGenerator()
+	}
+
+	return DefaultStrongHashGenerator()
+}
+
+func (v *HashVerifier) putHash(h hash.Hash) {
+	h.Reset()
+
+	if v.Hash != nil {
+		v.hashLock.Unlock()
+		return
+	}
+
+	v.hashes.Put(h)
 }
 
 func (v *HashVerifier) VerifyBlockRange(startBlockID uint, data []byte) bool {
+	h := v.getHash()
+	defer v.putHash(h)
+
+	hashedData := make([]byte, 0, h.Size())
+
 	for i := 0; i*int(v.BlockSize) < len(data); i++ {
 		start := i * int(v.BlockSize)
 		end := start + int(v.BlockSize)
@@ -34,14 +97,14 @@ func (v *HashVerifier) VerifyBlockRange(startBlockID uint, data []byte) bool {
 			return true
 		}
 
-		v.Hash.Write(blockData)
-		hashedData := v.Hash.Sum(nil)
+		h.Write(blockData)
+		hashedData = h.Sum(hashedData[:0])
 
 		if bytes.Compare(expectedChecksum, hashedData) != 0 {
 			return false
 		}
 
-		v.Hash.Reset()
+		h.Reset()
 	}
 
 	return true
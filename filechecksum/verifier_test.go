@@ -2,6 +2,7 @@ package filechecksum
 
 import (
 	"crypto/md5"
+	"sync"
 	"testing"
 )
 
@@ -70,3 +71,74 @@ func TestPartialBlock(t *testing.T) {
 		t.Error("data did not verify")
 	}
 }
+
+func TestConcurrentVerification(t *testing.T) {
+	data := []byte("foooBaarbazzquux")
+	h := NewHashVerifier(4, FourByteBlockSource(data), md5.New)
+
+	failures := make(chan bool, 100)
+	wait := sync.WaitGroup{}
+
+	for i := 0; i < cap(failures); i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			block := uint(i % 4)
+			if !h.VerifyBlockRange(block, data[block*4:]) {
+				failures <- true
+			}
+		}(i)
+	}
+
+	wait.Wait()
+	close(failures)
+
+	if len(failures) != 0 {
+		t.Errorf("%v concurrent verifications failed", len(failures))
+	}
+}
+
+func TestVerificationFailsOnBadData(t *testing.T) {
+	data := []byte("foooBaar")
+	h := NewHashVerifier(4, FourByteBlockSource(data), nil)
+
+	if h.VerifyBlockRange(0, []byte("foooBaaz")) {
+		t.Error("bad data verified")
+	}
+
+	// ensure that the pooled hash was reset
+	if !h.VerifyBlockRange(0, data) {
+		t.Error("data did not verify")
+	}
+}
+
+func TestConcurrentVerificationWithSharedHash(t *testing.T) {
+	data := []byte("foooBaarbazzquux")
+
+	h := &HashVerifier{
+		Hash:                md5.New(),
+		BlockSize:           4,
+		BlockChecksumGetter: FourByteBlockSource(data),
+	}
+
+	failures := make(chan bool, 100)
+	wait := sync.WaitGroup{}
+
+	for i := 0; i < cap(failures); i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			block := uint(i % 4)
+			if !h.VerifyBlockRange(block, data[block*4:]) {
+				failures <- true
+			}
+		}(i)
+	}
+
+	wait.Wait()
+	close(failures)
+
+	if len(failures) != 0 {
+		t.Errorf("%v concurrent verifications failed", len(failures))
+	}
+}
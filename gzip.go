@@ -0,0 +1,169 @@
+package gosync
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/Redundancy/go-sync/gzipsync"
+)
+
+/*
+PatchGzip recreates the gzip file described by Params in OutFile, byte for byte.
+
+Summary describes the decompressed content of the gzip file, which is what is patched: InputFile
+and the SeedFiles in Options are decompressed into temporary files if they are gzip files, and
+blocks that are missing are requested from Source, which must be the decompressed content of the
+reference (blocks of decompressed content cannot be read from the middle of a gzip file).
+
+The patched content is then compressed again, and OutFile is only replaced if the result matches
+the size and checksum in Params. If it does not, a *gzipsync.NotReproducibleError is returned.
+*/
+func PatchGzip(
+	InputFile,
+	Source,
+	OutFile string,
+	Summary FileSummary,
+	Params *gzipsync.Params,
+	Options RSyncOptions,
+) (err error) {
+	dir := filepath.Dir(OutFile)
+
+	var temporary []string
+	defer func() {
+		for _, path := range temporary {
+			os.Remove(path)
+		}
+	}()
+
+	decompress := func(path string) (string, error) {
+		decompressed, isTemporary, err := decompressedCopy(path, dir)
+		if isTemporary {
+			temporary = append(temporary, decompressed)
+		}
+		return decompressed, err
+	}
+
+	input, err := decompress(InputFile)
+	if err != nil {
+		return err
+	}
+
+	seeds := make([]string, 0, len(Options.SeedFiles))
+	for _, path := range Options.SeedFiles {
+		seed, err := decompress(path)
+		if err != nil {
+			return err
+		}
+		seeds = append(seeds, seed)
+	}
+
+	Options.SeedFiles = seeds
+
+	content, contentFilename, err := getTempFile(dir)
+	if err != nil {
+		return err
+	}
+	content.Close()
+	temporary = append(temporary, contentFilename)
+
+	rsync, err := MakeRSyncWithOptions(input, Source, contentFilename, Summary, Options)
+	if err != nil {
+		return err
+	}
+
+	if err = rsync.Patch(); err != nil {
+		rsync.Close()
+		return err
+	}
+
+	if err = rsync.Close(); err != nil {
+		return err
+	}
+
+	return recompressInto(contentFilename, OutFile, Params)
+}
+
+// compresses the content in contentFilename into a temporary file, which replaces outFile if it is exact
+func recompressInto(contentFilename, outFile string, params *gzipsync.Params) (err error) {
+	content, err := os.Open(contentFilename)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	out, outFilename, err := getTempFile(filepath.Dir(outFile))
+	if err != nil {
+		return err
+	}
+
+	copier := &fileCopyCloser{
+		from: outFilename,
+		to:   outFile,
+	}
+
+	defer func() {
+		if err != nil {
+			out.Close()
+			copier.Abort()
+			copier.Close()
+		}
+	}()
+
+	buffered := bufio.NewWriterSize(out, megabyte)
+
+	if err = gzipsync.Recompress(buffered, bufio.NewReaderSize(content, megabyte), params); err != nil {
+		return err
+	}
+
+	if err = buffered.Flush(); err != nil {
+		return err
+	}
+
+	if err = out.Close(); err != nil {
+		return err
+	}
+
+	return copier.Close()
+}
+
+/*
+decompressedCopy returns the path of a file with the decompressed content of path,
+which is a new file in dir if path is a gzip file, and path itself if it is not.
+*/
+func decompressedCopy(path, dir string) (decompressed string, isTemporary bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReaderSize(f, megabyte)
+
+	if start, _ := reader.Peek(3); !gzipsync.IsGzip(start) {
+		return path, false, nil
+	}
+
+	out, outFilename, err := getTempFile(dir)
+	if err != nil {
+		return "", false, err
+	}
+
+	buffered := bufio.NewWriterSize(out, megabyte)
+	_, err = gzipsync.Decompress(buffered, reader)
+
+	if err == nil {
+		err = buffered.Flush()
+	}
+
+	if e := out.Close(); err == nil {
+		err = e
+	}
+
+	if err != nil {
+		return outFilename, true, fmt.Errorf("Could not decompress %v: %v", path, err)
+	}
+
+	return outFilename, true, nil
+}
@@ -0,0 +1,96 @@
+package gosync
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/Redundancy/go-sync/gzipsync"
+	"github.com/Redundancy/go-sync/server"
+)
+
+func gzipString(t *testing.T, content, name string) []byte {
+	b := bytes.NewBuffer(nil)
+	w := gzip.NewWriter(b)
+	w.Name = name
+
+	if _, err := w.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return b.Bytes()
+}
+
+func TestPatchGzip(t *testing.T) {
+	reference := randomString(7, 20000)
+	compressed := gzipString(t, reference, "reference")
+
+	params, err := gzipsync.Analyze(bytes.NewReader(compressed), int64(len(compressed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local := string(gzipString(t, reference[:8000]+"changed"+reference[9000:], "local"))
+
+	// the server has the decompressed content of the reference
+	dir, paths := writeTestFiles(t, reference, local)
+	defer os.RemoveAll(dir)
+
+	s := httptest.NewServer(server.NewFileServer(dir, 0))
+	defer s.Close()
+
+	summary := makeTestSummary(t, reference, 512)
+
+	if err := PatchGzip(paths[1], s.URL+"/a", paths[1], summary, params, RSyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if content, _ := ioutil.ReadFile(paths[1]); !bytes.Equal(content, compressed) {
+		t.Error("The gzip file was not recreated exactly")
+	}
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 2 {
+		t.Errorf("Temporary files were not removed: %v", len(files))
+	}
+}
+
+func TestPatchGzipNotReproducible(t *testing.T) {
+	reference := randomString(8, 5000)
+	compressed := gzipString(t, reference, "reference")
+
+	params, err := gzipsync.Analyze(bytes.NewReader(compressed), int64(len(compressed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// as if the index was made by a different version of compress/flate
+	params.CompressedChecksum = make([]byte, len(params.CompressedChecksum))
+
+	local := string(gzipString(t, reference, "local"))
+
+	dir, paths := writeTestFiles(t, reference, local)
+	defer os.RemoveAll(dir)
+
+	s := httptest.NewServer(server.NewFileServer(dir, 0))
+	defer s.Close()
+
+	err = PatchGzip(paths[1], s.URL+"/a", paths[1], makeTestSummary(t, reference, 512), params, RSyncOptions{})
+	if _, ok := err.(*gzipsync.NotReproducibleError); !ok {
+		t.Fatalf("Expected the patch not to be reproducible, got: %v", err)
+	}
+
+	if content, _ := ioutil.ReadFile(paths[1]); string(content) != local {
+		t.Error("The local file was modified")
+	}
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 2 {
+		t.Errorf("Temporary files were not removed: %v", len(files))
+	}
+}
@@ -0,0 +1,360 @@
+/*
+Package gzipsync makes it possible to sync gzip files by their decompressed content.
+
+A small change to the content of a gzip file changes most of the compressed stream after it,
+so the blocks of two versions rarely match. Instead, a gzip index describes the decompressed
+content, along with what is needed to compress it again into exactly the same file: the bytes of
+the gzip header (which hold the name, modification time and other fields), and the compress/flate
+level that reproduces the deflate stream.
+
+The deflate stream can only be reproduced if it was made by the same compressor: Go's
+compress/flate (as used by "gosync" and other Go programs). Files made by other compressors, such as
+GNU gzip, cannot be recreated byte for byte, and Analyze fails with a *NotReproducibleError.
+Files with more than one gzip member, or with data after the first one, are also not supported.
+
+The output of compress/flate is not guaranteed to be the same in every Go version, so the index
+records the version that reproduced the stream, and Recompress reports it if the result differs.
+
+Unlike zsync, which can read the blocks it is missing from the middle of the compressed file, the
+blocks of the decompressed content have to be fetched from a decompressed copy of the reference,
+so the server must publish that copy alongside the gzip file (see gosync.PatchGzip).
+*/
+package gzipsync
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"runtime"
+)
+
+const (
+	gzipID1     = 0x1f
+	gzipID2     = 0x8b
+	gzipDeflate = 8
+
+	flagText    = 1 << 0
+	flagHCRC    = 1 << 1
+	flagExtra   = 1 << 2
+	flagName    = 1 << 3
+	flagComment = 1 << 4
+)
+
+// the levels to try, most likely first
+var levels = []int{
+	flate.DefaultCompression,
+	flate.BestCompression,
+	flate.BestSpeed,
+	2, 3, 4, 5, 7, 8,
+	flate.NoCompression,
+	flate.HuffmanOnly,
+}
+
+var ErrNotGzip = errors.New("File is not a gzip file")
+
+// NotReproducibleError is returned when a gzip file cannot be compressed again byte for byte
+type NotReproducibleError struct {
+	Reason string
+}
+
+func (e *NotReproducibleError) Error() string {
+	return "The gzip file cannot be recreated exactly: " + e.Reason
+}
+
+// Params are what is needed to recreate a gzip file from its decompressed content
+type Params struct {
+	// The gzip header, as it is in the file
+	Header []byte
+
+	// The compress/flate level that reproduces the deflate stream
+	Level int
+
+	// The Go version (from runtime.Version) whose compress/flate reproduced the deflate stream,
+	// empty if the index did not record it
+	GoVersion string
+
+	// The size of the decompressed content
+	Size int64
+
+	// The size and MD5 checksum of the gzip file
+	CompressedSize     int64
+	CompressedChecksum []byte
+}
+
+// IsGzip checks if the start of a file is the start of a gzip file
+func IsGzip(start []byte) bool {
+	return len(start) >= 3 && start[0] == gzipID1 && start[1] == gzipID2 && start[2] == gzipDeflate
+}
+
+// counts the bytes read, and is an io.ByteReader so that flate does not read past the end of its stream
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// reads a gzip header, returning its bytes
+func readHeader(r *countingReader) ([]byte, error) {
+	header := bytes.NewBuffer(nil)
+
+	fixed := make([]byte, 10)
+	if _, err := io.ReadFull(r, fixed); err != nil || !IsGzip(fixed) {
+		return nil, ErrNotGzip
+	}
+	header.Write(fixed)
+
+	flags := fixed[3]
+	if flags&^(flagText|flagHCRC|flagExtra|flagName|flagComment) != 0 {
+		return nil, fmt.Errorf("Gzip header has unknown flags: %x", flags)
+	}
+
+	if flags&flagExtra != 0 {
+		length := make([]byte, 2)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return nil, ErrNotGzip
+		}
+
+		extra := make([]byte, binary.LittleEndian.Uint16(length))
+		if _, err := io.ReadFull(r, extra); err != nil {
+			return nil, ErrNotGzip
+		}
+
+		header.Write(length)
+		header.Write(extra)
+	}
+
+	for _, flag := range []byte{flagName, flagComment} {
+		if flags&flag == 0 {
+			continue
+		}
+
+		s, err := r.r.ReadBytes(0)
+		r.n += int64(len(s))
+
+		if err != nil {
+			return nil, ErrNotGzip
+		}
+
+		header.Write(s)
+	}
+
+	if flags&flagHCRC != 0 {
+		crc := make([]byte, 2)
+		if _, err := io.ReadFull(r, crc); err != nil {
+			return nil, ErrNotGzip
+		}
+		header.Write(crc)
+	}
+
+	return header.Bytes(), nil
+}
+
+// fails as soon as what is written differs from expected
+type comparingWriter struct {
+	expected io.Reader
+	buffer   []byte
+}
+
+var errMismatch = errors.New("Output does not match")
+
+func (c *comparingWriter) Write(b []byte) (int, error) {
+	if cap(c.buffer) < len(b) {
+		c.buffer = make([]byte, len(b))
+	}
+
+	expected := c.buffer[:len(b)]
+	if _, err := io.ReadFull(c.expected, expected); err != nil || !bytes.Equal(expected, b) {
+		return 0, errMismatch
+	}
+
+	return len(b), nil
+}
+
+// checks if compressing content at level reproduces the deflate stream exactly
+func reproduces(content io.Reader, level int, stream io.Reader) bool {
+	compare := &comparingWriter{expected: stream}
+
+	w, err := flate.NewWriter(compare, level)
+	if err != nil {
+		return false
+	}
+
+	if _, err := io.Copy(w, content); err != nil {
+		return false
+	}
+
+	if err := w.Close(); err != nil {
+		return false
+	}
+
+	// the whole stream must have been written
+	n, _ := stream.Read(make([]byte, 1))
+	return n == 0
+}
+
+/*
+Analyze reads the gzip file in r, of size bytes, and finds how to recreate it from its content.
+It returns a *NotReproducibleError if that is not possible.
+*/
+func Analyze(r io.ReaderAt, size int64) (*Params, error) {
+	counter := &countingReader{r: bufio.NewReader(io.NewSectionReader(r, 0, size))}
+
+	header, err := readHeader(counter)
+	if err != nil {
+		return nil, err
+	}
+
+	streamStart := counter.n
+	checksum := crc32.NewIEEE()
+
+	content, err := io.Copy(checksum, flate.NewReader(counter))
+	if err != nil {
+		return nil, fmt.Errorf("Could not decompress the gzip file: %v", err)
+	}
+
+	streamEnd := counter.n
+
+	trailer := make([]byte, 8)
+	if _, err := io.ReadFull(counter, trailer); err != nil {
+		return nil, fmt.Errorf("Gzip file is truncated: %v", err)
+	}
+
+	if binary.LittleEndian.Uint32(trailer) != checksum.Sum32() || binary.LittleEndian.Uint32(trailer[4:]) != uint32(content) {
+		return nil, errors.New("Gzip file is corrupt: the content does not match the trailer")
+	}
+
+	if counter.n != size {
+		return nil, &NotReproducibleError{"it has more than one gzip member, or data after the end"}
+	}
+
+	params := &Params{
+		Header:         header,
+		GoVersion:      runtime.Version(),
+		Size:           content,
+		CompressedSize: size,
+	}
+
+	found := false
+
+	for _, level := range levels {
+		decompressed := flate.NewReader(io.NewSectionReader(r, streamStart, streamEnd-streamStart))
+		stream := io.NewSectionReader(r, streamStart, streamEnd-streamStart)
+
+		if reproduces(decompressed, level, stream) {
+			params.Level, found = level, true
+			break
+		}
+	}
+
+	if !found {
+		return nil, &NotReproducibleError{
+			"it was not made by Go's compress/flate at any level (it may have been made by another compressor, such as GNU gzip)",
+		}
+	}
+
+	hash := md5.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(r, 0, size)); err != nil {
+		return nil, err
+	}
+
+	params.CompressedChecksum = hash.Sum(nil)
+	return params, nil
+}
+
+// Decompress writes the decompressed content of a gzip file to w
+func Decompress(w io.Writer, r io.Reader) (int64, error) {
+	counter := &countingReader{r: bufio.NewReader(r)}
+
+	if _, err := readHeader(counter); err != nil {
+		return 0, err
+	}
+
+	return io.Copy(w, flate.NewReader(counter))
+}
+
+/*
+Recompress writes the gzip file that content was decompressed from to w, and checks that it
+matches the checksum in params. Since the output is only known to be correct at the end,
+w should be a temporary file.
+*/
+func Recompress(w io.Writer, content io.Reader, params *Params) error {
+	hash := md5.New()
+	counter := &countingWriter{w: io.MultiWriter(w, hash)}
+
+	if _, err := counter.Write(params.Header); err != nil {
+		return err
+	}
+
+	compressor, err := flate.NewWriter(counter, params.Level)
+	if err != nil {
+		return err
+	}
+
+	checksum := crc32.NewIEEE()
+	size, err := io.Copy(io.MultiWriter(compressor, checksum), content)
+	if err != nil {
+		return err
+	}
+
+	if err := compressor.Close(); err != nil {
+		return err
+	}
+
+	trailer := make([]byte, 8)
+	binary.LittleEndian.PutUint32(trailer, checksum.Sum32())
+	binary.LittleEndian.PutUint32(trailer[4:], uint32(size))
+
+	if _, err := counter.Write(trailer); err != nil {
+		return err
+	}
+
+	if size != params.Size {
+		return fmt.Errorf("Content is %v bytes, expected %v", size, params.Size)
+	}
+
+	if counter.n != params.CompressedSize || !bytes.Equal(hash.Sum(nil), params.CompressedChecksum) {
+		reason := "compressing the content did not give the same file (the compressor may differ from the one that made the index)"
+
+		if params.GoVersion != "" && params.GoVersion != runtime.Version() {
+			reason = fmt.Sprintf(
+				"compressing the content did not give the same file, the index was made with %v and this is %v",
+				params.GoVersion,
+				runtime.Version(),
+			)
+		}
+
+		return &NotReproducibleError{reason}
+	}
+
+	return nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
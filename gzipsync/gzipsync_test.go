@@ -0,0 +1,164 @@
+package gzipsync
+
+import (
+	"bytes"
+	"compress/gzip"
+	"math/rand"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func randomText(seed int64, size int) []byte {
+	words := []string{"gosync ", "block ", "index ", "patch ", "reference ", "\n"}
+	r := rand.New(rand.NewSource(seed))
+	b := bytes.NewBuffer(nil)
+
+	for b.Len() < size {
+		b.WriteString(words[r.Intn(len(words))])
+	}
+
+	return b.Bytes()[:size]
+}
+
+func compress(t *testing.T, content []byte, level int, flush bool) []byte {
+	b := bytes.NewBuffer(nil)
+
+	w, err := gzip.NewWriterLevel(b, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.Name = "file.txt"
+	w.Comment = "a comment"
+	w.Extra = []byte("extra")
+	w.ModTime = time.Unix(1500000000, 0)
+
+	if flush {
+		w.Write(content[:len(content)/2])
+		w.Flush()
+		w.Write(content[len(content)/2:])
+	} else {
+		w.Write(content)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return b.Bytes()
+}
+
+func TestRecompressIsExact(t *testing.T) {
+	content := randomText(1, 100000)
+
+	for _, level := range []int{gzip.DefaultCompression, gzip.BestSpeed, gzip.BestCompression, 4, gzip.NoCompression, gzip.HuffmanOnly} {
+		compressed := compress(t, content, level, false)
+
+		params, err := Analyze(bytes.NewReader(compressed), int64(len(compressed)))
+		if err != nil {
+			t.Fatalf("Level %v: %v", level, err)
+		}
+
+		if params.Size != int64(len(content)) {
+			t.Errorf("Unexpected size: %v", params.Size)
+		}
+
+		decompressed := bytes.NewBuffer(nil)
+		if _, err := Decompress(decompressed, bytes.NewReader(compressed)); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(decompressed.Bytes(), content) {
+			t.Fatal("Content was not decompressed")
+		}
+
+		output := bytes.NewBuffer(nil)
+		if err := Recompress(output, decompressed, params); err != nil {
+			t.Fatalf("Level %v: %v", level, err)
+		}
+
+		if !bytes.Equal(output.Bytes(), compressed) {
+			t.Errorf("Level %v: the recompressed file is different", level)
+		}
+	}
+}
+
+func TestNotReproducible(t *testing.T) {
+	content := randomText(2, 100000)
+
+	// a flush in the middle of the stream is not something that compressing the content again does
+	flushed := compress(t, content, gzip.DefaultCompression, true)
+
+	_, err := Analyze(bytes.NewReader(flushed), int64(len(flushed)))
+	if _, ok := err.(*NotReproducibleError); !ok {
+		t.Errorf("Expected a flushed stream not to be reproducible, got: %v", err)
+	}
+
+	whole := compress(t, content, gzip.DefaultCompression, false)
+	members := append(append([]byte{}, whole...), whole...)
+
+	_, err = Analyze(bytes.NewReader(members), int64(len(members)))
+	if _, ok := err.(*NotReproducibleError); !ok {
+		t.Errorf("Expected several members not to be reproducible, got: %v", err)
+	}
+
+	if _, err := Analyze(bytes.NewReader(content), int64(len(content))); err != ErrNotGzip {
+		t.Errorf("Expected content not to be gzip, got: %v", err)
+	}
+
+	params, err := Analyze(bytes.NewReader(whole), int64(len(whole)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed := append([]byte{}, content...)
+	changed[500] ^= 1
+
+	err = Recompress(bytes.NewBuffer(nil), bytes.NewReader(changed), params)
+	if _, ok := err.(*NotReproducibleError); !ok {
+		t.Errorf("Expected other content not to match, got: %v", err)
+	}
+
+	// an index from another Go version says so
+	params.GoVersion = "go1.0"
+
+	err = Recompress(bytes.NewBuffer(nil), bytes.NewReader(changed), params)
+	if err == nil || !strings.Contains(err.Error(), "go1.0") {
+		t.Errorf("Expected the error to name the Go version of the index, got: %v", err)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	compressed := compress(t, randomText(3, 1000), gzip.BestSpeed, false)
+
+	params, err := Analyze(bytes.NewReader(compressed), int64(len(compressed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := bytes.NewBuffer(nil)
+	if err := WriteIndex(b, params); err != nil {
+		t.Fatal(err)
+	}
+	b.WriteString("rest")
+
+	read, err := ReadIndex(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if read.Level != params.Level || read.Size != params.Size || read.CompressedSize != params.CompressedSize ||
+		!bytes.Equal(read.Header, params.Header) || !bytes.Equal(read.CompressedChecksum, params.CompressedChecksum) {
+		t.Errorf("Index was not read back: %+v", read)
+	}
+
+	if read.GoVersion != runtime.Version() {
+		t.Errorf("Unexpected Go version: %q", read.GoVersion)
+	}
+
+	if b.String() != "rest" {
+		t.Errorf("Unexpected data after the index: %q", b.String())
+	}
+}
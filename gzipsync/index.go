@@ -0,0 +1,112 @@
+package gzipsync
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+/*
+A gzip index starts with the Params of the gzip file, and is followed by the .gosync index of
+its decompressed content. The format of the start (all integers little endian) is:
+
+	magic "GSYNCGZI", uint8 version, int8 compress/flate level, int64 decompressed size,
+	int64 gzip file size, the MD5 of the gzip file, uint32 header length, the gzip header,
+	uint8 length and the Go version that reproduced the stream
+*/
+const (
+	MagicString  = "GSYNCGZI"
+	indexVersion = uint8(1)
+
+	// gzip headers are short, unless they have a large extra field
+	maxHeaderSize = 1024 * 1024
+)
+
+var ErrInvalidIndex = errors.New("Data is not a valid gzip index")
+
+// WriteIndex writes params as the start of a gzip index
+func WriteIndex(w io.Writer, params *Params) error {
+	if len(params.CompressedChecksum) != md5.Size {
+		return errors.New("Gzip parameters have no checksum")
+	}
+
+	if _, err := io.WriteString(w, MagicString); err != nil {
+		return err
+	}
+
+	for _, v := range []interface{}{
+		indexVersion,
+		int8(params.Level),
+		params.Size,
+		params.CompressedSize,
+		params.CompressedChecksum,
+		uint32(len(params.Header)),
+		params.Header,
+		uint8(len(params.GoVersion)),
+		[]byte(params.GoVersion),
+	} {
+		if err := binary.Write(w, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReadIndex reads the start of a gzip index, leaving r at the start of the .gosync index of the content
+func ReadIndex(r io.Reader) (*Params, error) {
+	magic := make([]byte, len(MagicString))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != MagicString {
+		return nil, ErrInvalidIndex
+	}
+
+	var version uint8
+	if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
+		return nil, ErrInvalidIndex
+	} else if version != indexVersion {
+		return nil, fmt.Errorf("Unsupported gzip index version: %v", version)
+	}
+
+	var level int8
+	var headerLength uint32
+
+	params := &Params{CompressedChecksum: make([]byte, md5.Size)}
+
+	for _, v := range []interface{}{
+		&level,
+		&params.Size,
+		&params.CompressedSize,
+		params.CompressedChecksum,
+		&headerLength,
+	} {
+		if err := binary.Read(r, binary.LittleEndian, v); err != nil {
+			return nil, ErrInvalidIndex
+		}
+	}
+
+	if headerLength < 10 || headerLength > maxHeaderSize || params.Size < 0 {
+		return nil, ErrInvalidIndex
+	}
+
+	params.Level = int(level)
+	params.Header = make([]byte, headerLength)
+
+	if _, err := io.ReadFull(r, params.Header); err != nil || !IsGzip(params.Header) {
+		return nil, ErrInvalidIndex
+	}
+
+	var versionLength uint8
+	if err := binary.Read(r, binary.LittleEndian, &versionLength); err != nil {
+		return nil, ErrInvalidIndex
+	}
+
+	goVersion := make([]byte, versionLength)
+	if _, err := io.ReadFull(r, goVersion); err != nil {
+		return nil, ErrInvalidIndex
+	}
+
+	params.GoVersion = string(goVersion)
+	return params, nil
+}
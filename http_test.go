@@ -27,8 +27,11 @@ const LOCAL_VERSION = "The qwik brown fox jumped 0v3r the lazy"
 
 var content = bytes.NewReader([]byte(REFERENCE))
 
+// the content does not change while the tests run
+var contentModTime = time.Now()
+
 func handler(w http.ResponseWriter, req *http.Request) {
-	http.ServeContent(w, req, "", time.Now(), content)
+	http.ServeContent(w, req, "", contentModTime, content)
 }
 
 // set up a http server locally that will respond predictably to ranged requests
@@ -0,0 +1,378 @@
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/Redundancy/go-sync/chunks"
+)
+
+/*
+CompiledIndex is a serialized form of the checksum index that can be queried in place,
+so that a large index can be memory mapped instead of rebuilt from a []ChunkChecksum.
+
+The layout (all integers little endian) is:
+
+	header:  magic "GSYNCIDX", uint32 version, uint32 weak size, uint32 strong size,
+	         uint32 block count, uint32 weak bucket count
+	fanout:  65537 uint32 - the first bucket with the given top 16 bits of weak checksum
+	buckets: per distinct weak checksum, sorted: uint32 weak checksum, uint32 first entry
+	         followed by a sentinel bucket holding the entry count
+	entries: per block, sorted by weak then strong checksum: uint32 block ID, weak checksum, strong checksum
+	blocks:  per block ID: uint32 entry index
+
+Weak checksums are ordered by their value as a little endian uint32, as in ChecksumIndex.
+*/
+type CompiledIndex struct {
+	data []byte
+
+	weakSize    int
+	strongSize  int
+	entrySize   int
+	blockCount  int
+	bucketCount int
+
+	fanout  []byte
+	buckets []byte
+	entries []byte
+	blocks  []byte
+
+	closer io.Closer
+}
+
+const (
+	compiledIndexMagic   = "GSYNCIDX"
+	compiledIndexVersion = 1
+	compiledHeaderSize   = len(compiledIndexMagic) + 5*4
+	fanoutEntries        = 1<<16 + 1
+	bucketSize           = 8
+)
+
+var ErrInvalidCompiledIndex = errors.New("Data is not a valid compiled index")
+
+// compiledBucket is the result of a weak lookup: a range of entries
+type compiledBucket struct {
+	start, end uint32
+}
+
+// WriteCompiledIndex serializes checksums to w in the CompiledIndex format
+// All weak and strong checksums must be the same length.
+func WriteCompiledIndex(w io.Writer, checksums []chunks.ChunkChecksum) error {
+	weakSize, strongSize := 4, 0
+	if len(checksums) > 0 {
+		weakSize = len(checksums[0].WeakChecksum)
+		strongSize = len(checksums[0].StrongChecksum)
+	}
+
+	if weakSize != 4 {
+		return fmt.Errorf("Compiled indexes require 4 byte weak checksums, got %v", weakSize)
+	}
+
+	sorted := make(StrongChecksumList, len(checksums))
+	copy(sorted, checksums)
+
+	for i, c := range sorted {
+		if len(c.WeakChecksum) != weakSize || len(c.StrongChecksum) != strongSize {
+			return fmt.Errorf("Checksum for block %v does not have the same size as the first", i)
+		}
+		if c.ChunkOffset >= uint(len(checksums)) {
+			return fmt.Errorf("Block %v is outside the range of blocks", c.ChunkOffset)
+		}
+	}
+
+	// stable, so that duplicate blocks stay in block order
+	sort.Stable(weakThenStrongList{sorted})
+
+	// work out the buckets, and where each block ended up
+	buckets := make([]uint32, 0, len(sorted))
+	blocks := make([]uint32, len(sorted))
+
+	for i, c := range sorted {
+		weak := binary.LittleEndian.Uint32(c.WeakChecksum)
+		if i == 0 || weak != binary.LittleEndian.Uint32(sorted[i-1].WeakChecksum) {
+			buckets = append(buckets, uint32(i))
+		}
+		blocks[c.ChunkOffset] = uint32(i)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	buf.WriteString(compiledIndexMagic)
+
+	for _, v := range []uint32{
+		compiledIndexVersion,
+		uint32(weakSize),
+		uint32(strongSize),
+		uint32(len(sorted)),
+		uint32(len(buckets)),
+	} {
+		binary.Write(buf, binary.LittleEndian, v)
+	}
+
+	// fanout table
+	b := 0
+	for prefix := 0; prefix < fanoutEntries; prefix++ {
+		for b < len(buckets) && weakPrefix(sorted[buckets[b]].WeakChecksum) < uint32(prefix) {
+			b++
+		}
+		binary.Write(buf, binary.LittleEndian, uint32(b))
+	}
+
+	for _, start := range buckets {
+		buf.Write(sorted[start].WeakChecksum)
+		binary.Write(buf, binary.LittleEndian, start)
+	}
+
+	// sentinel, so that the end of each bucket is the start of the next
+	buf.Write(make([]byte, 4))
+	binary.Write(buf, binary.LittleEndian, uint32(len(sorted)))
+
+	for _, c := range sorted {
+		binary.Write(buf, binary.LittleEndian, uint32(c.ChunkOffset))
+		buf.Write(c.WeakChecksum)
+		buf.Write(c.StrongChecksum)
+	}
+
+	for _, entry := range blocks {
+		binary.Write(buf, binary.LittleEndian, entry)
+	}
+
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// LoadCompiledIndex uses data in the CompiledIndex format without copying it
+// The offsets and block numbers in data are checked, so a corrupt index is rejected,
+// but data must not be modified while the index is in use
+func LoadCompiledIndex(data []byte) (*CompiledIndex, error) {
+	if len(data) < compiledHeaderSize || string(data[:len(compiledIndexMagic)]) != compiledIndexMagic {
+		return nil, ErrInvalidCompiledIndex
+	}
+
+	header := data[len(compiledIndexMagic):]
+	field := func(i int) int {
+		return int(binary.LittleEndian.Uint32(header[i*4:]))
+	}
+
+	if field(0) != compiledIndexVersion {
+		return nil, fmt.Errorf("Unsupported compiled index version: %v", field(0))
+	}
+
+	c := &CompiledIndex{
+		data:        data,
+		weakSize:    field(1),
+		strongSize:  field(2),
+		blockCount:  field(3),
+		bucketCount: field(4),
+	}
+
+	if c.weakSize != 4 {
+		return nil, ErrInvalidCompiledIndex
+	}
+
+	c.entrySize = 4 + c.weakSize + c.strongSize
+
+	offset := int64(compiledHeaderSize)
+	sections := []struct {
+		section *[]byte
+		size    int64
+	}{
+		{&c.fanout, fanoutEntries * 4},
+		{&c.buckets, int64(c.bucketCount+1) * bucketSize},
+		{&c.entries, int64(c.blockCount) * int64(c.entrySize)},
+		{&c.blocks, int64(c.blockCount) * 4},
+	}
+
+	for _, s := range sections {
+		if offset+s.size > int64(len(data)) {
+			return nil, ErrInvalidCompiledIndex
+		}
+		*s.section = data[offset : offset+s.size]
+		offset += s.size
+	}
+
+	if !c.valid() {
+		return nil, ErrInvalidCompiledIndex
+	}
+
+	return c, nil
+}
+
+// valid checks that every offset and block number in the index is in range,
+// so that a corrupt file cannot make lookups index outside of the data
+func (c *CompiledIndex) valid() bool {
+	previous := uint32(0)
+	for prefix := 0; prefix < fanoutEntries; prefix++ {
+		b := binary.LittleEndian.Uint32(c.fanout[prefix*4:])
+		if b < previous {
+			return false
+		}
+		previous = b
+	}
+
+	if previous != uint32(c.bucketCount) {
+		return false
+	}
+
+	previous = 0
+	for i := 0; i <= c.bucketCount; i++ {
+		start := c.bucketStart(i)
+		if start < previous {
+			return false
+		}
+		previous = start
+	}
+
+	if previous != uint32(c.blockCount) {
+		return false
+	}
+
+	for i := 0; i < c.blockCount; i++ {
+		if binary.LittleEndian.Uint32(c.entry(uint32(i))) >= uint32(c.blockCount) ||
+			binary.LittleEndian.Uint32(c.blocks[i*4:]) >= uint32(c.blockCount) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Close releases the underlying data, if it was opened from a file
+func (c *CompiledIndex) Close() error {
+	if c.closer != nil {
+		return c.closer.Close()
+	}
+	return nil
+}
+
+func (c *CompiledIndex) BlockCount() int {
+	return c.blockCount
+}
+
+func (c *CompiledIndex) WeakCount() int {
+	return c.blockCount
+}
+
+func (c *CompiledIndex) bucketWeak(i int) uint32 {
+	return binary.LittleEndian.Uint32(c.buckets[i*bucketSize:])
+}
+
+func (c *CompiledIndex) bucketStart(i int) uint32 {
+	return binary.LittleEndian.Uint32(c.buckets[i*bucketSize+4:])
+}
+
+func (c *CompiledIndex) entry(i uint32) []byte {
+	start := int(i) * c.entrySize
+	return c.entries[start : start+c.entrySize]
+}
+
+func (c *CompiledIndex) entryStrong(i uint32) []byte {
+	return c.entry(i)[4+c.weakSize:]
+}
+
+func (c *CompiledIndex) toChunkChecksum(i uint32) chunks.ChunkChecksum {
+	e := c.entry(i)
+	return chunks.ChunkChecksum{
+		ChunkOffset:    uint(binary.LittleEndian.Uint32(e)),
+		WeakChecksum:   e[4 : 4+c.weakSize],
+		StrongChecksum: e[4+c.weakSize:],
+	}
+}
+
+func (c *CompiledIndex) FindWeakChecksum2(chk []byte) interface{} {
+	weak := binary.LittleEndian.Uint32(chk)
+	prefix := weakPrefix(chk)
+
+	low := int(binary.LittleEndian.Uint32(c.fanout[prefix*4:]))
+	high := int(binary.LittleEndian.Uint32(c.fanout[(prefix+1)*4:]))
+
+	i := low + sort.Search(high-low, func(i int) bool {
+		return c.bucketWeak(low+i) >= weak
+	})
+
+	if i == high || c.bucketWeak(i) != weak {
+		return nil
+	}
+
+	return compiledBucket{
+		start: c.bucketStart(i),
+		end:   c.bucketStart(i + 1),
+	}
+}
+
+func (c *CompiledIndex) FindStrongChecksum2(chk []byte, weak interface{}) []chunks.ChunkChecksum {
+	bucket, ok := weak.(compiledBucket)
+
+	if !ok {
+		return nil
+	}
+
+	n := int(bucket.end - bucket.start)
+	first := bucket.start + uint32(sort.Search(n, func(i int) bool {
+		return bytes.Compare(c.entryStrong(bucket.start+uint32(i)), chk) >= 0
+	}))
+
+	var result []chunks.ChunkChecksum
+
+	for i := first; i < bucket.end && bytes.Equal(c.entryStrong(i), chk); i++ {
+		result = append(result, c.toChunkChecksum(i))
+	}
+
+	return result
+}
+
+// GetStrongChecksumForBlock satisfies filechecksum.ChecksumLookup
+func (c *CompiledIndex) GetStrongChecksumForBlock(blockID int) []byte {
+	if blockID < 0 || blockID >= c.blockCount {
+		return nil
+	}
+
+	return c.entryStrong(binary.LittleEndian.Uint32(c.blocks[blockID*4:]))
+}
+
+// GetChunkByOffset gets the checksums for block i, or nil if there is no such block
+func (c *CompiledIndex) GetChunkByOffset(i uint) *chunks.ChunkChecksum {
+	if i >= uint(c.blockCount) {
+		return nil
+	}
+
+	chunk := c.toChunkChecksum(binary.LittleEndian.Uint32(c.blocks[i*4:]))
+	return &chunk
+}
+
+// IsDuplicated is true if the content of block i appears more than once in the reference
+func (c *CompiledIndex) IsDuplicated(i uint) bool {
+	if i >= uint(c.blockCount) {
+		return false
+	}
+
+	e := binary.LittleEndian.Uint32(c.blocks[i*4:])
+	checksums := c.entry(e)[4:]
+
+	return (e > 0 && bytes.Equal(c.entry(e - 1)[4:], checksums)) ||
+		(e+1 < uint32(c.blockCount) && bytes.Equal(c.entry(e + 1)[4:], checksums))
+}
+
+// the top 16 bits of the weak checksum value
+func weakPrefix(weak []byte) uint32 {
+	return binary.LittleEndian.Uint32(weak) >> 16
+}
+
+// sorts checksums by weak value, then by strong checksum
+type weakThenStrongList struct {
+	StrongChecksumList
+}
+
+func (s weakThenStrongList) Less(i, j int) bool {
+	a := binary.LittleEndian.Uint32(s.StrongChecksumList[i].WeakChecksum)
+	b := binary.LittleEndian.Uint32(s.StrongChecksumList[j].WeakChecksum)
+
+	if a != b {
+		return a < b
+	}
+
+	return s.StrongChecksumList.Less(i, j)
+}
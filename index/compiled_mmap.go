@@ -0,0 +1,59 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package index
+
+import (
+	"os"
+	"syscall"
+)
+
+type mmapCloser []byte
+
+func (m mmapCloser) Close() error {
+	return syscall.Munmap(m)
+}
+
+// OpenCompiledIndex memory maps a file written by WriteCompiledIndex
+// Close the index to unmap the file.
+func OpenCompiledIndex(path string) (*CompiledIndex, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	fi, err := f.Stat()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.Size() == 0 {
+		return nil, ErrInvalidCompiledIndex
+	}
+
+	data, err := syscall.Mmap(
+		int(f.Fd()),
+		0,
+		int(fi.Size()),
+		syscall.PROT_READ,
+		syscall.MAP_SHARED,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := LoadCompiledIndex(data)
+
+	if err != nil {
+		syscall.Munmap(data)
+		return nil, err
+	}
+
+	c.closer = mmapCloser(data)
+	return c, nil
+}
@@ -0,0 +1,20 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package index
+
+import (
+	"io/ioutil"
+)
+
+// OpenCompiledIndex reads a file written by WriteCompiledIndex
+// On this platform, the file is read into memory rather than mapped.
+func OpenCompiledIndex(path string) (*CompiledIndex, error) {
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return LoadCompiledIndex(data)
+}
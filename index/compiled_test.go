@@ -0,0 +1,235 @@
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Redundancy/go-sync/chunks"
+)
+
+func compile(t testing.TB, checksums []chunks.ChunkChecksum) *CompiledIndex {
+	buf := bytes.NewBuffer(nil)
+
+	if err := WriteCompiledIndex(buf, checksums); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := LoadCompiledIndex(buf.Bytes())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func randomChecksums(count int) []chunks.ChunkChecksum {
+	checksums := make([]chunks.ChunkChecksum, count)
+
+	for i := range checksums {
+		weak := make([]byte, 4)
+		binary.LittleEndian.PutUint32(weak, rand.Uint32())
+		strong := make([]byte, 16)
+		rand.Read(strong)
+
+		checksums[i] = chunks.ChunkChecksum{
+			ChunkOffset:    uint(i),
+			WeakChecksum:   weak,
+			StrongChecksum: strong,
+		}
+	}
+
+	return checksums
+}
+
+func TestCompiledIndexFindsDuplicates(t *testing.T) {
+	i := compile(t, []chunks.ChunkChecksum{
+		{ChunkOffset: 0, WeakChecksum: WEAK_A, StrongChecksum: []byte("b")},
+		{ChunkOffset: 1, WeakChecksum: WEAK_B, StrongChecksum: []byte("c")},
+		{ChunkOffset: 2, WeakChecksum: WEAK_B, StrongChecksum: []byte("d")},
+		{ChunkOffset: 3, WeakChecksum: WEAK_B, StrongChecksum: []byte("c")},
+	})
+
+	weak := i.FindWeakChecksum2(WEAK_B)
+
+	if weak == nil {
+		t.Fatal("Did not find weak checksum")
+	}
+
+	strong := i.FindStrongChecksum2([]byte("c"), weak)
+
+	if len(strong) != 2 {
+		t.Fatalf("Wrong number of strong matches: %#v", strong)
+	}
+
+	if strong[0].ChunkOffset != 1 || strong[1].ChunkOffset != 3 {
+		t.Errorf("Wrong blocks matched: %#v", strong)
+	}
+
+	if i.FindStrongChecksum2([]byte("e"), weak) != nil {
+		t.Error("Should not have found a strong checksum")
+	}
+
+	if i.FindWeakChecksum2([]byte("afgh")) != nil {
+		t.Error("Should not have found a weak checksum")
+	}
+}
+
+func TestCompiledIndexMatchesChecksumIndex(t *testing.T) {
+	checksums := randomChecksums(10000)
+	// force some weak collisions
+	checksums[10].WeakChecksum = checksums[20].WeakChecksum
+
+	index := MakeChecksumIndex(checksums)
+	compiled := compile(t, checksums)
+
+	for _, c := range checksums {
+		weak := compiled.FindWeakChecksum2(c.WeakChecksum)
+		strong := compiled.FindStrongChecksum2(c.StrongChecksum, weak)
+		expected := index.FindStrongChecksum2(
+			c.StrongChecksum,
+			index.FindWeakChecksum2(c.WeakChecksum),
+		)
+
+		if len(strong) != 1 || len(expected) != 1 || strong[0].ChunkOffset != expected[0].ChunkOffset {
+			t.Fatalf("Lookup of block %v differed: %#v vs %#v", c.ChunkOffset, strong, expected)
+		}
+
+		if !bytes.Equal(compiled.GetStrongChecksumForBlock(int(c.ChunkOffset)), c.StrongChecksum) {
+			t.Fatalf("Wrong strong checksum for block %v", c.ChunkOffset)
+		}
+	}
+
+	for _, c := range randomChecksums(1000) {
+		if (compiled.FindWeakChecksum2(c.WeakChecksum) == nil) != (index.FindWeakChecksum2(c.WeakChecksum) == nil) {
+			t.Fatalf("Weak lookup differed for %v", c.WeakChecksum)
+		}
+	}
+}
+
+func TestEmptyCompiledIndex(t *testing.T) {
+	i := compile(t, nil)
+
+	if i.BlockCount() != 0 {
+		t.Errorf("Unexpected block count: %v", i.BlockCount())
+	}
+
+	if i.FindWeakChecksum2(WEAK_A) != nil {
+		t.Error("Should not have found a weak checksum")
+	}
+}
+
+func TestInvalidCompiledIndex(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	WriteCompiledIndex(buf, randomChecksums(10))
+
+	if _, err := LoadCompiledIndex(buf.Bytes()[:buf.Len()-1]); err != ErrInvalidCompiledIndex {
+		t.Errorf("Expected invalid index error for truncated data: %v", err)
+	}
+
+	if _, err := LoadCompiledIndex([]byte("not an index")); err != ErrInvalidCompiledIndex {
+		t.Errorf("Expected invalid index error: %v", err)
+	}
+}
+
+func TestCorruptCompiledIndex(t *testing.T) {
+	const BLOCKS = 10
+	buf := bytes.NewBuffer(nil)
+	WriteCompiledIndex(buf, randomChecksums(BLOCKS))
+	data := buf.Bytes()
+
+	loaded, err := LoadCompiledIndex(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fanout := compiledHeaderSize
+	buckets := fanout + fanoutEntries*4
+	entries := buckets + (loaded.bucketCount+1)*bucketSize
+	blocks := entries + BLOCKS*loaded.entrySize
+
+	corruptions := map[string]struct {
+		offset int
+		value  uint32
+	}{
+		"fanout out of order":        {fanout + 4*100, BLOCKS + 1},
+		"fanout past the buckets":    {buckets - 4, BLOCKS + 1},
+		"bucket start out of order":  {buckets + 4, BLOCKS},
+		"bucket sentinel":            {entries - 4, BLOCKS + 1},
+		"entry block out of range":   {entries, BLOCKS},
+		"block entry out of range":   {blocks, 1 << 31},
+		"block entry past the index": {blocks + 4*(BLOCKS-1), BLOCKS},
+	}
+
+	for name, c := range corruptions {
+		corrupt := append([]byte{}, data...)
+		binary.LittleEndian.PutUint32(corrupt[c.offset:], c.value)
+
+		if _, err := LoadCompiledIndex(corrupt); err != ErrInvalidCompiledIndex {
+			t.Errorf("Expected %v to be invalid: %v", name, err)
+		}
+	}
+}
+
+func TestOpenCompiledIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	checksums := randomChecksums(100)
+	path := filepath.Join(dir, "test.idx")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = WriteCompiledIndex(f, checksums)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := OpenCompiledIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i.Close()
+
+	c := checksums[50]
+	strong := i.FindStrongChecksum2(c.StrongChecksum, i.FindWeakChecksum2(c.WeakChecksum))
+
+	if len(strong) != 1 || strong[0].ChunkOffset != 50 {
+		t.Errorf("Did not find block 50: %#v", strong)
+	}
+}
+
+func TestCompiledGetChunkByOffset(t *testing.T) {
+	i := compile(t, []chunks.ChunkChecksum{
+		{ChunkOffset: 0, WeakChecksum: WEAK_A, StrongChecksum: []byte("b")},
+		{ChunkOffset: 1, WeakChecksum: WEAK_B, StrongChecksum: []byte("c")},
+		{ChunkOffset: 2, WeakChecksum: WEAK_B, StrongChecksum: []byte("c")},
+	})
+
+	if c := i.GetChunkByOffset(2); c == nil || c.ChunkOffset != 2 || string(c.StrongChecksum) != "c" {
+		t.Errorf("Wrong chunk for offset 2: %#v", c)
+	}
+
+	if c := i.GetChunkByOffset(3); c != nil {
+		t.Errorf("Should not have found a chunk past the end: %#v", c)
+	}
+
+	if i.IsDuplicated(0) {
+		t.Error("Block 0 is not duplicated")
+	}
+
+	if !i.IsDuplicated(1) || !i.IsDuplicated(2) {
+		t.Error("Blocks 1 and 2 are duplicated")
+	}
+}
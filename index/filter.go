@@ -0,0 +1,74 @@
+package index
+
+// the number of filter bits to use for each weak checksum
+const filterBitsPerEntry = 16
+
+/*
+WeakFilter is a blocked bloom filter over weak checksums.
+
+Each checksum maps to a single 64 bit word, in which 3 bits are set. A lookup therefore
+touches only one cache line, which makes it much cheaper than a map lookup when rejecting
+checksums that are not in the index - the common case when comparing data that has changed.
+*/
+type WeakFilter struct {
+	words []uint64
+	shift uint
+}
+
+// NewWeakFilter creates a filter sized for the given number of checksums
+func NewWeakFilter(entries int) *WeakFilter {
+	wordCount := 1
+	shift := uint(64)
+
+	for wordCount*64 < entries*filterBitsPerEntry {
+		wordCount <<= 1
+		shift--
+	}
+
+	return &WeakFilter{
+		words: make([]uint64, wordCount),
+		shift: shift,
+	}
+}
+
+/*
+spreads the weak checksum value, and uses the top bits to pick the word. The bits within it
+come from the top of a second multiply, since the low bits of a product only depend on the
+low bits of the checksum, which for a rollsum is a sum of bytes with little entropy.
+*/
+func (f *WeakFilter) locate(weak uint32) (word uint64, bits uint64) {
+	h := uint64(weak) * 0x9E3779B97F4A7C15
+	g := (h ^ h>>29) * 0xBF58476D1CE4E5B9
+
+	bits = 1<<(g>>58) | 1<<((g>>52)&63) | 1<<((g>>46)&63)
+	return h >> f.shift, bits
+}
+
+func (f *WeakFilter) Add(weak uint32) {
+	word, bits := f.locate(weak)
+	f.words[word] |= bits
+}
+
+// MayContain returns false only if the checksum was definitely not added
+func (f *WeakFilter) MayContain(weak uint32) bool {
+	word, bits := f.locate(weak)
+	return f.words[word]&bits == bits
+}
+
+// EnableWeakFilter builds a WeakFilter over the index, which is checked before
+// looking up weak checksums. This uses 2 bytes per checksum, and speeds up
+// comparisons of data which largely does not match the index.
+// It is not safe to call this while the index is in use.
+func (index *ChecksumIndex) EnableWeakFilter() {
+	filter := NewWeakFilter(index.BlockCount)
+
+	for _, m := range index.weakChecksumLookup {
+		for weak, strongList := range m {
+			if len(strongList) > 0 {
+				filter.Add(weak)
+			}
+		}
+	}
+
+	index.filter = filter
+}
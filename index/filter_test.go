@@ -0,0 +1,109 @@
+package index
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/Redundancy/go-sync/rollsum"
+)
+
+func TestWeakFilterHasNoFalseNegatives(t *testing.T) {
+	f := NewWeakFilter(1000)
+	values := make([]uint32, 1000)
+
+	for i := range values {
+		values[i] = rand.Uint32()
+		f.Add(values[i])
+	}
+
+	for _, v := range values {
+		if !f.MayContain(v) {
+			t.Fatalf("Filter rejected a value that was added: %v", v)
+		}
+	}
+}
+
+func TestWeakFilterRejectsMostMisses(t *testing.T) {
+	const ENTRIES = 10000
+	f := NewWeakFilter(ENTRIES)
+
+	for i := 0; i < ENTRIES; i++ {
+		f.Add(rand.Uint32())
+	}
+
+	falsePositives := 0
+	for i := 0; i < ENTRIES; i++ {
+		if f.MayContain(rand.Uint32()) {
+			falsePositives++
+		}
+	}
+
+	if falsePositives > ENTRIES/20 {
+		t.Errorf("False positive rate is too high: %v/%v", falsePositives, ENTRIES)
+	}
+}
+
+// the weak checksums of random blocks, whose low half is a sum of bytes with little entropy
+func rollsumChecksums(r *rand.Rand, count int) []uint32 {
+	const blockSize = 16
+
+	sums := make([]uint32, count)
+	block := make([]byte, blockSize)
+	sum := make([]byte, 4)
+
+	for i := range sums {
+		r.Read(block)
+
+		rolling := rollsum.NewRollsum32Base(blockSize)
+		rolling.SetBlock(block)
+		rolling.GetSum(sum)
+
+		sums[i] = weakValue(sum)
+	}
+
+	return sums
+}
+
+func TestWeakFilterRejectsMostMissesOfRollsums(t *testing.T) {
+	const ENTRIES = 10000
+	r := rand.New(rand.NewSource(1))
+	f := NewWeakFilter(ENTRIES)
+
+	added := make(map[uint32]bool)
+	for _, weak := range rollsumChecksums(r, ENTRIES) {
+		f.Add(weak)
+		added[weak] = true
+	}
+
+	falsePositives, misses := 0, 0
+	for _, weak := range rollsumChecksums(r, ENTRIES) {
+		if added[weak] {
+			continue
+		}
+
+		misses++
+		if f.MayContain(weak) {
+			falsePositives++
+		}
+	}
+
+	if falsePositives > misses/100 {
+		t.Errorf("False positive rate is too high: %v/%v", falsePositives, misses)
+	}
+}
+
+func TestFilteredIndexFindsChecksums(t *testing.T) {
+	checksums := randomChecksums(1000)
+	i := MakeChecksumIndex(checksums)
+	i.EnableWeakFilter()
+
+	for _, c := range checksums {
+		if i.FindWeakChecksum2(c.WeakChecksum) == nil {
+			t.Fatalf("Did not find weak checksum of block %v", c.ChunkOffset)
+		}
+	}
+
+	if i.FindWeakChecksum2([]byte("afgh")) != nil {
+		t.Error("Should not have found a weak checksum")
+	}
+}
@@ -19,6 +19,9 @@ type Index interface {
 
 This allows the implementation to rely on a previously generated value, without the users knowing what it is.
 This breaks the dependency that requires so many packages to import index.
+
+For very large files, CompiledIndex satisfies the same interface from a serialized form that can be
+memory mapped, avoiding the cost of building the lookup maps.
 */
 package index
 
@@ -42,6 +45,14 @@ type ChecksumIndex struct {
 	*/
 	weakChecksumLookup []map[uint32]StrongChecksumList
 
+	// optional prefilter, see EnableWeakFilter
+	filter *WeakFilter
+
+	// the checksums by block offset, and the offsets of blocks
+	// whose content appears more than once
+	blocks     []chunks.ChunkChecksum
+	duplicated map[uint]bool
+
 	MaxStrongLength     int
 	AverageStrongLength float32
 	Count               int
@@ -56,7 +67,12 @@ func MakeChecksumIndex(checksums []chunks.ChunkChecksum) *ChecksumIndex {
 	}
 
 	for _, chunk := range checksums {
-		weakChecksumAsInt := binary.LittleEndian.Uint32(chunk.WeakChecksum)
+		if chunk.ChunkOffset >= uint(len(n.blocks)) {
+			n.blocks = append(n.blocks, make([]chunks.ChunkChecksum, chunk.ChunkOffset+1-uint(len(n.blocks)))...)
+		}
+		n.blocks[chunk.ChunkOffset] = chunk
+
+		weakChecksumAsInt := weakValue(chunk.WeakChecksum)
 		arrayOffset := weakChecksumAsInt & 255
 
 		if n.weakChecksumLookup[arrayOffset] == nil {
@@ -76,6 +92,7 @@ func MakeChecksumIndex(checksums []chunks.ChunkChecksum) *ChecksumIndex {
 	for _, a := range n.weakChecksumLookup {
 		for _, c := range a {
 			sort.Sort(c)
+			n.markDuplicates(c)
 			if len(c) > n.MaxStrongLength {
 				n.MaxStrongLength = len(c)
 			}
@@ -90,12 +107,44 @@ func MakeChecksumIndex(checksums []chunks.ChunkChecksum) *ChecksumIndex {
 	return n
 }
 
+// records blocks in a sorted list which have the same strong checksum
+func (index *ChecksumIndex) markDuplicates(s StrongChecksumList) {
+	for i := 1; i < len(s); i++ {
+		if bytes.Equal(s[i-1].StrongChecksum, s[i].StrongChecksum) {
+			if index.duplicated == nil {
+				index.duplicated = make(map[uint]bool)
+			}
+			index.duplicated[s[i-1].ChunkOffset] = true
+			index.duplicated[s[i].ChunkOffset] = true
+		}
+	}
+}
+
+// GetChunkByOffset gets the checksums for block i, or nil if there is no such block
+// This allows a match to be followed by checking if the next block also matches.
+func (index *ChecksumIndex) GetChunkByOffset(i uint) *chunks.ChunkChecksum {
+	if i >= uint(len(index.blocks)) || index.blocks[i].WeakChecksum == nil {
+		return nil
+	}
+	return &index.blocks[i]
+}
+
+// IsDuplicated is true if the content of block i appears more than once in the reference
+func (index *ChecksumIndex) IsDuplicated(i uint) bool {
+	return index.duplicated[i]
+}
+
 func (index *ChecksumIndex) WeakCount() int {
 	return index.Count
 }
 
 func (index *ChecksumIndex) FindWeakChecksumInIndex(weak []byte) StrongChecksumList {
-	x := binary.LittleEndian.Uint32(weak)
+	x := weakValue(weak)
+
+	if index.filter != nil && !index.filter.MayContain(x) {
+		return nil
+	}
+
 	if index.weakChecksumLookup[x&255] != nil {
 		if v, ok := index.weakChecksumLookup[x&255][x]; ok {
 			return v
@@ -104,6 +153,19 @@ func (index *ChecksumIndex) FindWeakChecksumInIndex(weak []byte) StrongChecksumL
 	return nil
 }
 
+// weakValue is the value of a weak checksum as a little endian uint32.
+// Weak checksums may be shorter than 4 bytes (such as the truncated checksums of a
+// zsync file), in which case the missing high bytes are zero.
+func weakValue(weak []byte) uint32 {
+	if len(weak) >= 4 {
+		return binary.LittleEndian.Uint32(weak)
+	}
+
+	var padded [4]byte
+	copy(padded[:], weak)
+	return binary.LittleEndian.Uint32(padded[:])
+}
+
 func (index *ChecksumIndex) FindWeakChecksum2(chk []byte) interface{} {
 	w := index.FindWeakChecksumInIndex(chk)
 
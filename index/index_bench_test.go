@@ -1,6 +1,7 @@
 package index
 
 import (
+	"bytes"
 	"github.com/Redundancy/go-sync/chunks"
 	"math/rand"
 	"sort"
@@ -146,3 +147,62 @@ func Benchmark_256Split_Map(b *testing.B) {
 	}
 	b.StopTimer()
 }
+
+func BenchmarkCompiledIndex8192(b *testing.B) {
+	buf := bytes.NewBuffer(nil)
+	WriteCompiledIndex(buf, randomChecksums(8192))
+	i, _ := LoadCompiledIndex(buf.Bytes())
+
+	b.SetBytes(1)
+	b.StartTimer()
+	for x := 0; x < b.N; x++ {
+		i.FindWeakChecksum2(T)
+	}
+	b.StopTimer()
+}
+
+// Compare the startup cost of building an index with loading a compiled one
+func BenchmarkMakeChecksumIndex100000(b *testing.B) {
+	checksums := randomChecksums(100000)
+
+	b.ResetTimer()
+	for x := 0; x < b.N; x++ {
+		MakeChecksumIndex(checksums)
+	}
+}
+
+func BenchmarkLoadCompiledIndex100000(b *testing.B) {
+	buf := bytes.NewBuffer(nil)
+	WriteCompiledIndex(buf, randomChecksums(100000))
+	data := buf.Bytes()
+
+	b.ResetTimer()
+	for x := 0; x < b.N; x++ {
+		LoadCompiledIndex(data)
+	}
+}
+
+// Lookups of weak checksums that are mostly not in the index,
+// as when comparing data that differs heavily from the reference
+func benchmarkIndexMisses(b *testing.B, filtered bool) {
+	i := MakeChecksumIndex(randomChecksums(65536))
+	if filtered {
+		i.EnableWeakFilter()
+	}
+
+	lookups := randomChecksums(1024)
+
+	b.SetBytes(1)
+	b.ResetTimer()
+	for x := 0; x < b.N; x++ {
+		i.FindWeakChecksum2(lookups[x&1023].WeakChecksum)
+	}
+}
+
+func BenchmarkIndexMisses65536(b *testing.B) {
+	benchmarkIndexMisses(b, false)
+}
+
+func BenchmarkFilteredIndexMisses65536(b *testing.B) {
+	benchmarkIndexMisses(b, true)
+}
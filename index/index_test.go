@@ -6,7 +6,7 @@ import (
 	"github.com/Redundancy/go-sync/chunks"
 )
 
-// Weak checksums must be 4 bytes
+// Weak checksums are usually 4 bytes
 var WEAK_A = []byte("aaaa")
 var WEAK_B = []byte("bbbb")
 
@@ -204,3 +204,52 @@ func TestFindTwoDuplicatedBlocksInIndex(t *testing.T) {
 		t.Errorf("Wrong chunk found, had offset %v", second.ChunkOffset)
 	}
 }
+
+func TestGetChunkByOffset(t *testing.T) {
+	i := MakeChecksumIndex(
+		[]chunks.ChunkChecksum{
+			{ChunkOffset: 0, WeakChecksum: WEAK_A, StrongChecksum: []byte("b")},
+			{ChunkOffset: 1, WeakChecksum: WEAK_B, StrongChecksum: []byte("c")},
+			{ChunkOffset: 2, WeakChecksum: WEAK_B, StrongChecksum: []byte("c")},
+		},
+	)
+
+	if c := i.GetChunkByOffset(1); c == nil || c.ChunkOffset != 1 {
+		t.Errorf("Wrong chunk for offset 1: %#v", c)
+	}
+
+	if c := i.GetChunkByOffset(3); c != nil {
+		t.Errorf("Should not have found a chunk past the end: %#v", c)
+	}
+
+	if i.IsDuplicated(0) {
+		t.Error("Block 0 is not duplicated")
+	}
+
+	if !i.IsDuplicated(1) || !i.IsDuplicated(2) {
+		t.Error("Blocks 1 and 2 are duplicated")
+	}
+}
+
+func TestShortWeakChecksums(t *testing.T) {
+	i := MakeChecksumIndex(
+		[]chunks.ChunkChecksum{
+			{ChunkOffset: 0, WeakChecksum: []byte("ab"), StrongChecksum: []byte("b")},
+			{ChunkOffset: 1, WeakChecksum: []byte("ac"), StrongChecksum: []byte("c")},
+			{ChunkOffset: 2, WeakChecksum: []byte("ab"), StrongChecksum: []byte("d")},
+		},
+	)
+
+	if result := i.FindWeakChecksumInIndex([]byte("ab")); len(result) != 2 {
+		t.Errorf("Expected 2 weak matches, got %v", len(result))
+	}
+
+	if result := i.FindWeakChecksumInIndex([]byte("ba")); result != nil {
+		t.Errorf("Unexpected match: %v", result)
+	}
+
+	strong := i.FindStrongChecksum2([]byte("c"), i.FindWeakChecksum2([]byte("ac")))
+	if len(strong) != 1 || strong[0].ChunkOffset != 1 {
+		t.Errorf("Unexpected strong matches: %v", strong)
+	}
+}
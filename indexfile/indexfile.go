@@ -0,0 +1,216 @@
+/*
+Package indexfile reads and writes .gosync index files, as built by "gosync build"
+and served by server.FileServer.
+
+The format (all integers little endian) is:
+
+	header: magic "G0S9NC", uint16 major, minor and patch versions, int64 file size,
+	        uint32 block size, whole-file checksum (from version 0.3),
+	        the root of the Merkle tree of the blocks (from version 0.4, see the merkle package)
+	blocks: per block, the weak checksum followed by the strong checksum
+
+See cmd/gosync/fileformat.md for more detail.
+*/
+package indexfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/Redundancy/go-sync/chunks"
+	"github.com/Redundancy/go-sync/filechecksum"
+	"github.com/Redundancy/go-sync/merkle"
+)
+
+// The header of an index file, and the version of the format that is written
+const (
+	MagicString  = "G0S9NC"
+	MajorVersion = uint16(0)
+	MinorVersion = uint16(4)
+	PatchVersion = uint16(0)
+)
+
+// FileChecksumOffset is the offset of the whole-file checksum in the header
+const FileChecksumOffset = int64(len(MagicString)) + 3*2 + 8 + 4
+
+// MerkleRootOffset is the offset of the Merkle root, the last item in the header
+var MerkleRootOffset = FileChecksumOffset + int64(filechecksum.DefaultFileHashGenerator().Size())
+
+// Header is the start of an index file
+type Header struct {
+	Major, Minor, Patch uint16
+	FileSize            int64
+	BlockSize           uint32
+	// nil for indexes older than version 0.3
+	FileChecksum []byte
+	// nil for indexes older than version 0.4
+	MerkleRoot []byte
+}
+
+// WriteHeader writes a header for the current version of the format
+func WriteHeader(w io.Writer, fileSize int64, blockSize uint32, fileChecksum []byte, merkleRoot []byte) error {
+	if _, err := io.WriteString(w, MagicString); err != nil {
+		return err
+	}
+
+	for _, v := range []interface{}{
+		MajorVersion,
+		MinorVersion,
+		PatchVersion,
+		fileSize,
+		blockSize,
+	} {
+		if err := binary.Write(w, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+
+	if _, err := w.Write(fileChecksum); err != nil {
+		return err
+	}
+
+	_, err := w.Write(merkleRoot)
+	return err
+}
+
+// ReadHeader reads the header, and checks the magic string, then the semantic versioning
+func ReadHeader(r io.Reader) (h *Header, err error) {
+	b := make([]byte, len(MagicString))
+
+	if _, err = io.ReadFull(r, b); err != nil {
+		return nil, err
+	} else if string(b) != MagicString {
+		return nil, errors.New(
+			"file header does not match magic string. Not a valid gosync file",
+		)
+	}
+
+	h = &Header{}
+
+	for _, v := range []*uint16{&h.Major, &h.Minor, &h.Patch} {
+		if err = binary.Read(r, binary.LittleEndian, v); err != nil {
+			return nil, err
+		}
+	}
+
+	if h.Major != MajorVersion {
+		return nil, fmt.Errorf(
+			"The major version of the gosync file (%v.%v.%v) does not match the tool (%v.%v.%v).",
+			h.Major, h.Minor, h.Patch,
+			MajorVersion, MinorVersion, PatchVersion,
+		)
+	}
+
+	if err = binary.Read(r, binary.LittleEndian, &h.FileSize); err != nil {
+		return nil, err
+	}
+
+	if err = binary.Read(r, binary.LittleEndian, &h.BlockSize); err != nil {
+		return nil, err
+	}
+
+	// versions before 0.3 did not store the whole file checksum
+	if h.Minor < 3 {
+		return h, nil
+	}
+
+	h.FileChecksum = make([]byte, filechecksum.DefaultFileHashGenerator().Size())
+	if _, err = io.ReadFull(r, h.FileChecksum); err != nil {
+		return nil, err
+	}
+
+	if h.Minor < 4 {
+		return h, nil
+	}
+
+	h.MerkleRoot = make([]byte, merkle.HashSize)
+	if _, err = io.ReadFull(r, h.MerkleRoot); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// Build reads a file of the given size and returns its index
+func Build(file io.Reader, size int64, blockSize uint) ([]byte, error) {
+	index, _, err := BuildWithTree(file, size, blockSize)
+	return index, err
+}
+
+// BuildWithTree works like Build, and also returns the Merkle tree of the file
+func BuildWithTree(file io.Reader, size int64, blockSize uint) ([]byte, *merkle.Tree, error) {
+	generator := filechecksum.NewFileChecksumGenerator(blockSize)
+	builder := merkle.NewBuilder(blockSize)
+	body := bytes.NewBuffer(nil)
+
+	fileChecksum, err := generator.GenerateChecksums(io.TeeReader(file, builder), body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tree := builder.Tree()
+	index := bytes.NewBuffer(nil)
+
+	if err := WriteHeader(index, size, uint32(blockSize), fileChecksum, tree.Root()); err != nil {
+		return nil, nil, err
+	}
+
+	index.Write(body.Bytes())
+	return index.Bytes(), tree, nil
+}
+
+// Index is the content of an index file, as read by Read
+type Index struct {
+	FileSize  int64
+	BlockSize uint
+	// nil for indexes older than version 0.3
+	FileChecksum []byte
+	// nil for indexes older than version 0.4
+	MerkleRoot []byte
+	Checksums  []chunks.ChunkChecksum
+}
+
+// Read reads a whole index, such as one written by Build
+func Read(r io.Reader) (*Index, error) {
+	h, err := ReadHeader(r)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read the index header: %v", err)
+	}
+
+	if h.BlockSize == 0 {
+		return nil, errors.New("The index has a block size of 0")
+	}
+
+	generator := filechecksum.NewFileChecksumGenerator(uint(h.BlockSize))
+
+	checksums, err := chunks.LoadChecksumsFromReader(
+		r,
+		generator.WeakRollingHash.Size(),
+		generator.StrongHash.Size(),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	blockCount := (h.FileSize + int64(h.BlockSize) - 1) / int64(h.BlockSize)
+	if int64(len(checksums)) != blockCount {
+		return nil, fmt.Errorf(
+			"Index has %v blocks, expected %v for a %v byte file",
+			len(checksums),
+			blockCount,
+			h.FileSize,
+		)
+	}
+
+	return &Index{
+		FileSize:     h.FileSize,
+		BlockSize:    uint(h.BlockSize),
+		FileChecksum: h.FileChecksum,
+		MerkleRoot:   h.MerkleRoot,
+		Checksums:    checksums,
+	}, nil
+}
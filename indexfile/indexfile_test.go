@@ -0,0 +1,91 @@
+package indexfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/Redundancy/go-sync/merkle"
+)
+
+const BLOCK_SIZE = 16
+
+func randomData(seed int64, size int) []byte {
+	b := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+func TestHeaderRoundTrip(t *testing.T) {
+	checksum := randomData(1, 16)
+	root := randomData(2, merkle.HashSize)
+	buffer := bytes.NewBuffer(nil)
+
+	if err := WriteHeader(buffer, 1000, BLOCK_SIZE, checksum, root); err != nil {
+		t.Fatal(err)
+	}
+
+	if int64(buffer.Len()) != MerkleRootOffset+merkle.HashSize {
+		t.Errorf("Unexpected header size: %v", buffer.Len())
+	}
+
+	h, err := ReadHeader(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.Major != MajorVersion || h.Minor != MinorVersion || h.FileSize != 1000 ||
+		h.BlockSize != BLOCK_SIZE || !bytes.Equal(h.FileChecksum, checksum) || !bytes.Equal(h.MerkleRoot, root) {
+		t.Errorf("Unexpected header: %+v", h)
+	}
+
+	if _, err := ReadHeader(bytes.NewBufferString("not an index at all")); err == nil {
+		t.Error("Expected an error reading a header without the magic string")
+	}
+}
+
+func TestReadVersion3Header(t *testing.T) {
+	checksum := randomData(3, 16)
+	buffer := bytes.NewBufferString(MagicString)
+
+	for _, v := range []interface{}{uint16(0), uint16(3), uint16(0), int64(1000), uint32(BLOCK_SIZE)} {
+		binary.Write(buffer, binary.LittleEndian, v)
+	}
+	buffer.Write(checksum)
+
+	h, err := ReadHeader(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.FileSize != 1000 || !bytes.Equal(h.FileChecksum, checksum) || h.MerkleRoot != nil {
+		t.Errorf("Unexpected header: %+v", h)
+	}
+}
+
+func TestReadIndex(t *testing.T) {
+	content := randomData(25, 1000)
+
+	b, err := Build(bytes.NewReader(content), int64(len(content)), BLOCK_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := Read(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if idx.FileSize != 1000 || idx.BlockSize != BLOCK_SIZE || len(idx.Checksums) != 63 {
+		t.Errorf("Unexpected index: %v %v %v", idx.FileSize, idx.BlockSize, len(idx.Checksums))
+	}
+
+	if _, expected, _ := merkle.Build(bytes.NewReader(content), BLOCK_SIZE); !bytes.Equal(idx.MerkleRoot, expected.Root) {
+		t.Error("The index does not have the Merkle root of the file")
+	}
+
+	if _, err := Read(bytes.NewReader(b[:len(b)-20])); err == nil {
+		t.Error("Expected an error reading an index with a missing block")
+	}
+}
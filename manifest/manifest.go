@@ -0,0 +1,208 @@
+/*
+Package manifest describes a directory tree, so that a local directory can be made to match it
+one file at a time (see gosync.SyncTree).
+
+A manifest is stored as JSON, and lists each regular file by its slash separated path relative to
+the root of the tree, with its size, permissions, whole-file checksum and an inline index of its
+block checksums (the body of a .gosync file, base64 encoded).
+*/
+package manifest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Redundancy/go-sync/chunks"
+	"github.com/Redundancy/go-sync/filechecksum"
+	"github.com/Redundancy/go-sync/index"
+)
+
+// The current version of the manifest format
+const Version = 1
+
+// File describes a single file in the tree
+type File struct {
+	// Slash separated, relative to the root of the tree
+	Path string      `json:"path"`
+	Size int64       `json:"size"`
+	Mode os.FileMode `json:"mode"`
+
+	// The whole-file checksum, from filechecksum.DefaultFileHashGenerator
+	Checksum []byte `json:"checksum"`
+
+	// The weak and strong checksums of each block in turn
+	BlockSize uint   `json:"blocksize"`
+	Blocks    []byte `json:"blocks"`
+}
+
+type Manifest struct {
+	Version int    `json:"version"`
+	Files   []File `json:"files"`
+}
+
+/*
+Build creates a manifest of every regular file under root, with indexes using blockSize.
+Symbolic links and other special files are skipped.
+*/
+func Build(root string, blockSize uint) (*Manifest, error) {
+	m := &Manifest{Version: Version}
+
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+
+		f, err := BuildFile(p, blockSize)
+		if err != nil {
+			return err
+		}
+
+		f.Path = filepath.ToSlash(rel)
+		m.Files = append(m.Files, *f)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(m.Files, func(i, j int) bool {
+		return m.Files[i].Path < m.Files[j].Path
+	})
+
+	return m, nil
+}
+
+// BuildFile describes the file at filename. The Path is left empty.
+func BuildFile(filename string, blockSize uint) (*File, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := bytes.NewBuffer(nil)
+	generator := filechecksum.NewFileChecksumGenerator(blockSize)
+	checksum, err := generator.GenerateChecksums(file, blocks)
+
+	if err != nil {
+		return nil, fmt.Errorf("Could not generate checksums for %v: %v", filename, err)
+	}
+
+	return &File{
+		Size:      info.Size(),
+		Mode:      info.Mode().Perm(),
+		Checksum:  checksum,
+		BlockSize: blockSize,
+		Blocks:    blocks.Bytes(),
+	}, nil
+}
+
+// Read loads a manifest, and checks that it is valid
+func Read(r io.Reader) (*Manifest, error) {
+	m := &Manifest{}
+
+	if err := json.NewDecoder(r).Decode(m); err != nil {
+		return nil, fmt.Errorf("Could not read manifest: %v", err)
+	}
+
+	if m.Version != Version {
+		return nil, fmt.Errorf("Unsupported manifest version: %v", m.Version)
+	}
+
+	seen := make(map[string]bool, len(m.Files))
+
+	for _, f := range m.Files {
+		if err := checkPath(f.Path); err != nil {
+			return nil, err
+		}
+
+		if seen[f.Path] {
+			return nil, fmt.Errorf("Manifest lists %v more than once", f.Path)
+		}
+		seen[f.Path] = true
+
+		if f.BlockSize == 0 {
+			return nil, fmt.Errorf("Manifest entry for %v has no block size", f.Path)
+		}
+	}
+
+	return m, nil
+}
+
+// Write stores the manifest as JSON
+func (m *Manifest) Write(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(m)
+}
+
+// paths must stay within the tree, so that a manifest cannot write elsewhere
+func checkPath(p string) error {
+	switch {
+	case p == "" || p == ".":
+		return fmt.Errorf("Manifest contains an empty path")
+	case path.IsAbs(p) || strings.Contains(p, "\\") || filepath.IsAbs(filepath.FromSlash(p)):
+		return fmt.Errorf("Manifest path is not relative: %v", p)
+	case path.Clean(p) != p || p == ".." || strings.HasPrefix(p, "../"):
+		return fmt.Errorf("Manifest path is not clean, or leaves the tree: %v", p)
+	}
+
+	return nil
+}
+
+// BlockCount is the number of blocks in the file
+func (f *File) BlockCount() uint {
+	if f.BlockSize == 0 {
+		return 0
+	}
+
+	return uint((f.Size + int64(f.BlockSize) - 1) / int64(f.BlockSize))
+}
+
+// Index loads the inline block checksums of the file
+func (f *File) Index() (*index.ChecksumIndex, filechecksum.ChecksumLookup, error) {
+	generator := filechecksum.NewFileChecksumGenerator(f.BlockSize)
+
+	checksums, err := chunks.LoadChecksumsFromReader(
+		bytes.NewReader(f.Blocks),
+		generator.WeakRollingHash.Size(),
+		generator.GetStrongHash().Size(),
+	)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not load the index of %v: %v", f.Path, err)
+	}
+
+	if uint(len(checksums)) != f.BlockCount() {
+		return nil, nil, fmt.Errorf(
+			"Index of %v has %v blocks, expected %v",
+			f.Path,
+			len(checksums),
+			f.BlockCount(),
+		)
+	}
+
+	return index.MakeChecksumIndex(checksums), chunks.StrongChecksumGetter(checksums), nil
+}
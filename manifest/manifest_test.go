@@ -0,0 +1,85 @@
+package manifest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBuildWriteAndRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "b.txt"), []byte("The quick brown fox"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "sub", "a.txt"), []byte("jumped over the lazy dog"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "empty"), nil, 0644)
+
+	m, err := Build(dir, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	for _, f := range m.Files {
+		paths = append(paths, f.Path)
+	}
+
+	if !reflect.DeepEqual(paths, []string{"b.txt", "empty", "sub/a.txt"}) {
+		t.Errorf("Unexpected paths: %v", paths)
+	}
+
+	if m.Files[0].Mode != 0600 || m.Files[0].Size != 19 || m.Files[0].BlockCount() != 5 {
+		t.Errorf("Unexpected file entry: %#v", m.Files[0])
+	}
+
+	buffer := bytes.NewBuffer(nil)
+	if err := m.Write(buffer); err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(read, m) {
+		t.Errorf("Manifest changed after writing and reading:\n%#v\n%#v", read, m)
+	}
+
+	for _, f := range read.Files {
+		idx, _, err := f.Index()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if uint(idx.BlockCount) != f.BlockCount() {
+			t.Errorf("Wrong block count for %v: %v", f.Path, idx.BlockCount)
+		}
+	}
+}
+
+func TestReadRejectsUnsafePaths(t *testing.T) {
+	for _, p := range []string{"", ".", "..", "../a", "a/../../b", "/etc/passwd", "a//b", "a\\b"} {
+		m := `{"version": 1, "files": [{"path": "` + strings.Replace(p, "\\", "\\\\", -1) + `", "blocksize": 4}]}`
+
+		if _, err := Read(strings.NewReader(m)); err == nil {
+			t.Errorf("Expected %q to be rejected", p)
+		}
+	}
+}
+
+func TestReadRejectsDuplicatePaths(t *testing.T) {
+	m := `{"version": 1, "files": [{"path": "a", "blocksize": 4}, {"path": "a", "blocksize": 4}]}`
+
+	if _, err := Read(strings.NewReader(m)); err == nil {
+		t.Error("Expected duplicate paths to be rejected")
+	}
+}
@@ -0,0 +1,92 @@
+package merkle
+
+import (
+	"errors"
+	"io"
+)
+
+// Index is the root of the tree of a file, with the size of the file and its blocks,
+// which is all that is needed to verify blocks when the proofs are fetched on demand
+type Index struct {
+	FileSize  int64
+	BlockSize uint
+	Root      []byte
+}
+
+// BlockCount is the number of blocks in the file
+func (i *Index) BlockCount() uint {
+	if i.BlockSize == 0 {
+		return 0
+	}
+
+	return uint((i.FileSize + int64(i.BlockSize) - 1) / int64(i.BlockSize))
+}
+
+/*
+Builder builds the tree of the data written to it, in blocks of BlockSize, so that the tree
+can be built while the data is read for something else (such as with io.TeeReader).
+*/
+type Builder struct {
+	BlockSize uint
+
+	// the data of the block that has not been filled yet
+	block  []byte
+	leaves []byte
+}
+
+// NewBuilder builds a tree with blocks of blockSize
+func NewBuilder(blockSize uint) *Builder {
+	return &Builder{
+		BlockSize: blockSize,
+		block:     make([]byte, 0, blockSize),
+	}
+}
+
+func (b *Builder) Write(p []byte) (int, error) {
+	n := len(p)
+
+	for len(p) > 0 {
+		take := int(b.BlockSize) - len(b.block)
+		if take > len(p) {
+			take = len(p)
+		}
+
+		b.block = append(b.block, p[:take]...)
+		p = p[take:]
+
+		if len(b.block) == int(b.BlockSize) {
+			b.leaves = append(b.leaves, LeafHash(b.block)...)
+			b.block = b.block[:0]
+		}
+	}
+
+	return n, nil
+}
+
+// Tree finishes the tree, with a short last block if the size is not a multiple of BlockSize.
+// Nothing can be written afterwards.
+func (b *Builder) Tree() *Tree {
+	if len(b.block) > 0 {
+		b.leaves = append(b.leaves, LeafHash(b.block)...)
+		b.block = nil
+	}
+
+	return newTree(b.leaves)
+}
+
+// Build reads a file with blocks of blockSize, and creates its tree and index
+func Build(r io.Reader, blockSize uint) (*Tree, *Index, error) {
+	if blockSize == 0 {
+		return nil, nil, errors.New("The block size cannot be 0")
+	}
+
+	builder := NewBuilder(blockSize)
+
+	size, err := io.Copy(builder, r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tree := builder.Tree()
+	return tree, &Index{FileSize: size, BlockSize: blockSize, Root: tree.Root()}, nil
+}
@@ -0,0 +1,192 @@
+package merkle
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/Redundancy/go-sync/blocksources"
+)
+
+const BLOCK_SIZE = 16
+
+func randomData(seed int64, size int) []byte {
+	b := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+func makeLeaves(n int) [][]byte {
+	leaves := make([][]byte, n)
+	for i := range leaves {
+		leaves[i] = LeafHash([]byte{byte(i), byte(i >> 8)})
+	}
+	return leaves
+}
+
+// the root of RFC 6962, by splitting recursively
+func referenceRoot(leaves [][]byte) []byte {
+	if len(leaves) == 1 {
+		return leaves[0]
+	}
+
+	k := split(uint(len(leaves)))
+	return nodeHash(referenceRoot(leaves[:k]), referenceRoot(leaves[k:]))
+}
+
+func TestRootMatchesRFC6962(t *testing.T) {
+	for n := 1; n <= 33; n++ {
+		leaves := makeLeaves(n)
+
+		if root := New(leaves).Root(); !bytes.Equal(root, referenceRoot(leaves)) {
+			t.Errorf("Unexpected root for %v blocks", n)
+		}
+	}
+
+	// a single empty block is not the same as no blocks
+	if bytes.Equal(New(nil).Root(), New(makeLeaves(1)).Root()) {
+		t.Error("Expected an empty tree to have a different root")
+	}
+}
+
+func TestProofsForEveryRange(t *testing.T) {
+	for n := 1; n <= 17; n++ {
+		leaves := makeLeaves(n)
+		tree := New(leaves)
+
+		for start := 0; start < n; start++ {
+			for end := start; end < n; end++ {
+				proof, err := tree.Proof(uint(start), uint(end))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				err = Verify(tree.Root(), uint(n), uint(start), leaves[start:end+1], proof)
+				if err != nil {
+					t.Fatalf("Proof of %v-%v in %v blocks failed: %v", start, end, n, err)
+				}
+			}
+		}
+	}
+}
+
+func TestProofSize(t *testing.T) {
+	tree := New(makeLeaves(1000))
+
+	// log2(1000) rounded up, for each end of the range
+	for _, r := range [][2]uint{{0, 0}, {999, 999}, {500, 500}, {3, 997}, {0, 999}} {
+		proof, err := tree.Proof(r[0], r[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(proof) > 2*10 {
+			t.Errorf("Proof of %v has %v hashes", r, len(proof))
+		}
+	}
+}
+
+func TestInvalidProofs(t *testing.T) {
+	leaves := makeLeaves(10)
+	tree := New(leaves)
+	proof, _ := tree.Proof(3, 5)
+
+	changed := append([][]byte{}, leaves[3:6]...)
+	changed[1] = leaves[0]
+
+	if err := Verify(tree.Root(), 10, 3, changed, proof); err != ErrProofMismatch {
+		t.Errorf("Expected a changed block to fail, got: %v", err)
+	}
+
+	if err := Verify(tree.Root(), 10, 4, leaves[4:7], proof); err == nil {
+		t.Error("Expected a proof for other blocks to fail")
+	}
+
+	if err := Verify(tree.Root(), 10, 3, leaves[3:6], proof[1:]); err == nil {
+		t.Error("Expected a short proof to fail")
+	}
+
+	if err := Verify(tree.Root(), 10, 3, leaves[3:6], append(proof, proof[0])); err == nil {
+		t.Error("Expected a long proof to fail")
+	}
+
+	if _, err := tree.Proof(5, 10); err == nil {
+		t.Error("Expected a proof past the end to fail")
+	}
+}
+
+func TestBuild(t *testing.T) {
+	content := randomData(1, 1000)
+
+	tree, index, err := Build(bytes.NewReader(content), BLOCK_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if index.FileSize != 1000 || index.BlockCount() != 63 || tree.BlockCount() != 63 {
+		t.Errorf("Unexpected index: %+v", index)
+	}
+
+	// the leaves are the hashes of the data of each block
+	leaves := make([][]byte, 0, 63)
+	for offset := 0; offset < len(content); offset += BLOCK_SIZE {
+		end := offset + BLOCK_SIZE
+		if end > len(content) {
+			end = len(content)
+		}
+		leaves = append(leaves, LeafHash(content[offset:end]))
+	}
+
+	if !bytes.Equal(index.Root, New(leaves).Root()) {
+		t.Error("Unexpected root")
+	}
+
+	// writes that do not line up with blocks build the same tree
+	builder := NewBuilder(BLOCK_SIZE)
+	for offset := 0; offset < len(content); offset += 7 {
+		end := offset + 7
+		if end > len(content) {
+			end = len(content)
+		}
+		builder.Write(content[offset:end])
+	}
+
+	if !bytes.Equal(builder.Tree().Root(), index.Root) {
+		t.Error("Builder created a different root")
+	}
+}
+
+func TestVerifier(t *testing.T) {
+	content := randomData(2, 1000)
+
+	tree, index, err := Build(bytes.NewReader(content), BLOCK_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var verifier blocksources.BlockVerifier = NewVerifier(index, tree)
+
+	if !verifier.VerifyBlockRange(0, content) {
+		t.Error("Expected the whole file to verify")
+	}
+
+	// the last block is short
+	if !verifier.VerifyBlockRange(60, content[960:]) {
+		t.Error("Expected the end of the file to verify")
+	}
+
+	if !verifier.VerifyBlockRange(2, content[32:80]) {
+		t.Error("Expected blocks 2-4 to verify")
+	}
+
+	if verifier.VerifyBlockRange(2, content[32:70]) {
+		t.Error("Expected a partial block to fail")
+	}
+
+	corrupt := append([]byte{}, content[32:80]...)
+	corrupt[20] ^= 1
+
+	if verifier.VerifyBlockRange(2, corrupt) {
+		t.Error("Expected a corrupt block to fail")
+	}
+}
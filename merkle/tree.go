@@ -0,0 +1,231 @@
+/*
+Package merkle builds a Merkle tree over the blocks of a file, so that any range of blocks can be
+verified from a single root hash and a proof of O(log n) hashes, instead of the whole index.
+
+The tree is built as in RFC 6962 (Certificate Transparency), with SHA-256:
+
+	the hash of a leaf is  SHA-256(0x00 || the data of the block)
+	the hash of a node is  SHA-256(0x01 || left || right)
+
+where the left subtree of n leaves holds the largest power of two that is less than n.
+The root of an empty file is the SHA-256 of nothing.
+
+The root is stored in .gosync indexes (see the indexfile package), so a client with the index
+only has to fetch proofs to check the blocks it reads, and nothing depends on the weaker
+checksums that are used to find blocks.
+
+A proof for a range of blocks is the hash of each largest subtree that holds no block of the range,
+from left to right, so it is about two paths from the root to the ends of the range.
+*/
+package merkle
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// HashSize is the size of the hashes in the tree and in proofs
+const HashSize = sha256.Size
+
+var ErrProofMismatch = errors.New("Blocks do not match the Merkle root")
+
+// LeafHash is the hash of the leaf for a block of data
+func LeafHash(block []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(block)
+	return h.Sum(nil)
+}
+
+func nodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// the size of the left subtree of a tree of n > 1 leaves
+func split(n uint) uint {
+	k := uint(1)
+	for k*2 < n {
+		k *= 2
+	}
+	return k
+}
+
+/*
+Tree is the Merkle tree of a file, which can create proofs for ranges of its blocks.
+
+Each level of the tree is kept as the hashes of its nodes one after another, from the leaves up
+to the root. Each node hashes a pair of nodes in the level below, and the last node of a level
+without a pair is carried up unchanged, which gives the same hashes as splitting as in RFC 6962.
+*/
+type Tree struct {
+	levels [][]byte
+}
+
+// New builds the tree with the leaf hash (see LeafHash) of each block in turn
+func New(leafHashes [][]byte) *Tree {
+	leaves := make([]byte, 0, len(leafHashes)*HashSize)
+	for _, hash := range leafHashes {
+		leaves = append(leaves, hash...)
+	}
+	return newTree(leaves)
+}
+
+// builds the levels above leaves, which are the leaf hashes one after another
+func newTree(leaves []byte) *Tree {
+	t := &Tree{levels: [][]byte{leaves}}
+
+	for level := leaves; len(level) > HashSize; {
+		count := len(level) / HashSize
+		next := make([]byte, 0, (count+1)/2*HashSize)
+
+		for i := 0; i+1 < count; i += 2 {
+			next = append(next, nodeHash(
+				level[i*HashSize:(i+1)*HashSize],
+				level[(i+1)*HashSize:(i+2)*HashSize],
+			)...)
+		}
+
+		if count%2 == 1 {
+			next = append(next, level[(count-1)*HashSize:]...)
+		}
+
+		t.levels = append(t.levels, next)
+		level = next
+	}
+
+	return t
+}
+
+// the hash of the subtree of the leaves from lo up to hi, which is a subtree that split creates
+func (t *Tree) node(lo, hi uint) []byte {
+	// the subtree is the node at the lowest level that covers hi-lo leaves
+	height := uint(0)
+	for uint(1)<<height < hi-lo {
+		height++
+	}
+
+	i := lo >> height
+	return t.levels[height][i*HashSize : (i+1)*HashSize]
+}
+
+// BlockCount is the number of blocks (leaves) in the tree
+func (t *Tree) BlockCount() uint {
+	return uint(len(t.levels[0]) / HashSize)
+}
+
+// Size is the number of bytes of hashes held by the tree
+func (t *Tree) Size() int64 {
+	size := int64(0)
+	for _, level := range t.levels {
+		size += int64(len(level))
+	}
+	return size
+}
+
+// Root is the hash that the whole file is verified against
+func (t *Tree) Root() []byte {
+	if t.BlockCount() == 0 {
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	}
+
+	return t.levels[len(t.levels)-1]
+}
+
+// Proof creates the proof for the blocks from start to end (inclusive)
+func (t *Tree) Proof(start, end uint) ([][]byte, error) {
+	if end < start || end >= t.BlockCount() {
+		return nil, fmt.Errorf("Blocks %v-%v are not in the tree of %v blocks", start, end, t.BlockCount())
+	}
+
+	var proof [][]byte
+	t.proof(0, t.BlockCount(), start, end, &proof)
+
+	return proof, nil
+}
+
+func (t *Tree) proof(lo, hi, start, end uint, proof *[][]byte) {
+	switch {
+	case hi <= start || lo > end:
+		*proof = append(*proof, t.node(lo, hi))
+	case start <= lo && hi-1 <= end:
+		// computed from the blocks
+	default:
+		k := lo + split(hi-lo)
+		t.proof(lo, k, start, end, proof)
+		t.proof(k, hi, start, end, proof)
+	}
+}
+
+/*
+Verify checks the leaf hashes of consecutive blocks from start, in a file of blockCount
+blocks, against the root of its tree with a proof from Tree.Proof.
+*/
+func Verify(root []byte, blockCount uint, start uint, leafHashes [][]byte, proof [][]byte) error {
+	if len(leafHashes) == 0 {
+		return errors.New("No blocks to verify")
+	}
+
+	end := start + uint(len(leafHashes)) - 1
+	if end < start || end >= blockCount {
+		return fmt.Errorf("Blocks %v-%v are not in a tree of %v blocks", start, end, blockCount)
+	}
+
+	v := &verification{
+		start:  start,
+		end:    end,
+		leaves: leafHashes,
+		proof:  proof,
+	}
+
+	computed := v.hash(0, blockCount)
+
+	if v.err != nil {
+		return v.err
+	}
+
+	if len(v.proof) != 0 {
+		return fmt.Errorf("Proof has %v more hashes than expected", len(v.proof))
+	}
+
+	if string(computed) != string(root) {
+		return ErrProofMismatch
+	}
+
+	return nil
+}
+
+type verification struct {
+	start, end uint
+	leaves     [][]byte
+	proof      [][]byte
+	err        error
+}
+
+// computes the hash of a subtree from the blocks and the proof, mirroring Tree.proof
+func (v *verification) hash(lo, hi uint) []byte {
+	switch {
+	case v.err != nil:
+		return nil
+	case hi <= v.start || lo > v.end:
+		if len(v.proof) == 0 {
+			v.err = errors.New("Proof has too few hashes")
+			return nil
+		}
+
+		hash := v.proof[0]
+		v.proof = v.proof[1:]
+		return hash
+	case hi-lo == 1:
+		return v.leaves[lo-v.start]
+	default:
+		k := lo + split(hi-lo)
+		left := v.hash(lo, k)
+		return nodeHash(left, v.hash(k, hi))
+	}
+}
@@ -0,0 +1,148 @@
+package merkle
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/Redundancy/go-sync/blocksources"
+)
+
+// ProofSource provides proofs for ranges of blocks, such as a Tree, or a server with HTTPProofs
+type ProofSource interface {
+	Proof(start, end uint) ([][]byte, error)
+}
+
+/*
+Verifier checks blocks against the root of a tree, getting a proof for each range of blocks
+from Proofs as it is needed. It satisfies blocksources.BlockVerifier, so blocks can be
+authenticated with nothing but the Index, even if the proofs come from an untrusted source.
+*/
+type Verifier struct {
+	Index  *Index
+	Proofs ProofSource
+}
+
+// NewVerifier checks blocks against index, with proofs from proofs
+func NewVerifier(index *Index, proofs ProofSource) *Verifier {
+	return &Verifier{
+		Index:  index,
+		Proofs: proofs,
+	}
+}
+
+// VerifyBlockRange is safe to call concurrently, if the ProofSource is
+func (v *Verifier) VerifyBlockRange(startBlockID uint, data []byte) bool {
+	return v.Verify(startBlockID, data) == nil
+}
+
+// Verify checks whole blocks from startBlockID, returning an error that explains any problem
+func (v *Verifier) Verify(startBlockID uint, data []byte) error {
+	blockSize := int64(v.Index.BlockSize)
+
+	var leaves [][]byte
+	offset := int64(startBlockID) * blockSize
+
+	for len(data) > 0 {
+		expected := blockSize
+		if remaining := v.Index.FileSize - offset; remaining < expected {
+			expected = remaining
+		}
+
+		if expected <= 0 || int64(len(data)) < expected {
+			return fmt.Errorf("Data for block %v is not a whole block", startBlockID+uint(len(leaves)))
+		}
+
+		leaves = append(leaves, LeafHash(data[:expected]))
+
+		data = data[expected:]
+		offset += expected
+	}
+
+	if len(leaves) == 0 {
+		return fmt.Errorf("No data for block %v", startBlockID)
+	}
+
+	end := startBlockID + uint(len(leaves)) - 1
+	proof, err := v.Proofs.Proof(startBlockID, end)
+	if err != nil {
+		return fmt.Errorf("Could not get the proof for blocks %v-%v: %v", startBlockID, end, err)
+	}
+
+	return Verify(v.Index.Root, v.Index.BlockCount(), startBlockID, leaves, proof)
+}
+
+// ProofQuery is the query parameter that asks a server for a proof, as "?proof=<start>-<end>"
+const ProofQuery = "proof"
+
+// the longest proof that is read: two paths from the root of the largest possible tree
+const maxProofHashes = 2 * 64
+
+/*
+HTTPProofs gets proofs from a server, such as server.FileServer, by requesting
+"?proof=<first block>-<last block>" from the URL of the file. The server must use the same
+block size as the index.
+*/
+type HTTPProofs struct {
+	URL     string
+	Options blocksources.HttpOptions
+}
+
+func (p *HTTPProofs) Proof(start, end uint) ([][]byte, error) {
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	query := u.Query()
+	query.Set(ProofQuery, fmt.Sprintf("%v-%v", start, end))
+	u.RawQuery = query.Encode()
+
+	request, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := p.Options.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Request for a proof returned status: %v", response.Status)
+	}
+
+	return ReadProof(response.Body)
+}
+
+// WriteProof writes the hashes of a proof one after another
+func WriteProof(w io.Writer, proof [][]byte) error {
+	for _, hash := range proof {
+		if _, err := w.Write(hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadProof reads a proof written by WriteProof
+func ReadProof(r io.Reader) ([][]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxProofHashes*HashSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data)%HashSize != 0 || len(data) > maxProofHashes*HashSize {
+		return nil, fmt.Errorf("Proof is %v bytes, which is not a valid number of hashes", len(data))
+	}
+
+	proof := make([][]byte, len(data)/HashSize)
+	for i := range proof {
+		proof[i] = data[i*HashSize : (i+1)*HashSize]
+	}
+
+	return proof, nil
+}
@@ -39,6 +39,9 @@ type FoundBlockSpan struct {
 	EndBlock    uint
 	BlockSize   int64
 	MatchOffset int64
+
+	// Which of the local inputs the span was found in, when there are several
+	Source int
 }
 
 type MissingBlockSpan struct {
@@ -28,6 +28,33 @@ func SequentialPatcher(
 	maxBlockStorage uint64, // the amount of memory we're allowed to use for temporary data storage
 	output io.Writer,
 ) error {
+	return MultiSourcePatcher(
+		[]io.ReadSeeker{localFile},
+		reference,
+		requiredRemoteBlocks,
+		locallyAvailableBlocks,
+		maxBlockStorage,
+		output,
+	)
+}
+
+/*
+MultiSourcePatcher works like SequentialPatcher, but with several local files.
+Each FoundBlockSpan is read from localFiles[span.Source].
+*/
+func MultiSourcePatcher(
+	localFiles []io.ReadSeeker,
+	reference patcher.BlockSource,
+	requiredRemoteBlocks []patcher.MissingBlockSpan,
+	locallyAvailableBlocks []patcher.FoundBlockSpan,
+	maxBlockStorage uint64, // the amount of memory we're allowed to use for temporary data storage
+	output io.Writer,
+) error {
+
+	// an empty output has no blocks
+	if len(requiredRemoteBlocks) == 0 && len(locallyAvailableBlocks) == 0 {
+		return nil
+	}
 
 	maxBlockMissing := uint(0)
 	if len(requiredRemoteBlocks) > 0 {
@@ -56,6 +83,12 @@ func SequentialPatcher(
 		if withinFirstBlockOfLocalBlocks(currentBlock, locallyAvailableBlocks) {
 			firstMatched := locallyAvailableBlocks[0]
 
+			if firstMatched.Source < 0 || firstMatched.Source >= len(localFiles) {
+				return fmt.Errorf("No local file for the source of blocks: %v", firstMatched)
+			}
+
+			localFile := localFiles[firstMatched.Source]
+
 			// we have the current block range in the local file
 			localFile.Seek(firstMatched.MatchOffset, ABSOLUTE_POSITION)
 			blockSizeToRead := int64(firstMatched.EndBlock-firstMatched.StartBlock+1) * firstMatched.BlockSize
@@ -186,3 +186,99 @@ func TestPatchingEntirelyMissing(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestPatchingFromMultipleSources(t *testing.T) {
+	LOCAL := []io.ReadSeeker{
+		stringToReadSeeker("The quick br"),
+		stringToReadSeeker("zzown fox jumped over the lazy dog"),
+	}
+	out := bytes.NewBuffer(nil)
+
+	matched := []patcher.FoundBlockSpan{
+		{
+			BlockSize:   BLOCKSIZE,
+			StartBlock:  0,
+			EndBlock:    2,
+			MatchOffset: 0,
+			Source:      0,
+		},
+		{
+			BlockSize:   BLOCKSIZE,
+			StartBlock:  3,
+			EndBlock:    10,
+			MatchOffset: 2,
+			Source:      1,
+		},
+	}
+
+	err := MultiSourcePatcher(
+		LOCAL,
+		blocksources.NewReadSeekerBlockSource(
+			stringToReadSeeker(REFERENCE_STRING),
+			blocksources.MakeNullFixedSizeResolver(BLOCKSIZE),
+		),
+		nil,
+		matched,
+		1024,
+		out,
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result := out.String(); result != REFERENCE_STRING {
+		t.Errorf("Result does not equal reference: \"%s\" vs \"%v\"", result, REFERENCE_STRING)
+	}
+}
+
+func TestPatchingFromUnknownSourceFails(t *testing.T) {
+	matched := []patcher.FoundBlockSpan{
+		{
+			BlockSize:  BLOCKSIZE,
+			StartBlock: 0,
+			EndBlock:   10,
+			Source:     1,
+		},
+	}
+
+	err := SequentialPatcher(
+		stringToReadSeeker(REFERENCE_STRING),
+		blocksources.NewReadSeekerBlockSource(
+			stringToReadSeeker(REFERENCE_STRING),
+			blocksources.MakeNullFixedSizeResolver(BLOCKSIZE),
+		),
+		nil,
+		matched,
+		1024,
+		bytes.NewBuffer(nil),
+	)
+
+	if err == nil {
+		t.Error("Expected an error for a span from a missing source")
+	}
+}
+
+func TestPatchingEmptyOutput(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+
+	err := SequentialPatcher(
+		stringToReadSeeker(""),
+		blocksources.NewReadSeekerBlockSource(
+			stringToReadSeeker(""),
+			blocksources.MakeNullFixedSizeResolver(BLOCKSIZE),
+		),
+		nil,
+		nil,
+		1024,
+		out,
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out.Len() != 0 {
+		t.Errorf("Expected an empty output: %q", out.String())
+	}
+}
@@ -0,0 +1,200 @@
+package gosync
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/Redundancy/go-sync/blocksources"
+	"github.com/Redundancy/go-sync/chunks"
+	"github.com/Redundancy/go-sync/delta"
+	"github.com/Redundancy/go-sync/index"
+	"github.com/Redundancy/go-sync/indexfile"
+	"github.com/Redundancy/go-sync/server"
+)
+
+// PushResult describes an upload made by Push
+type PushResult struct {
+	FileSize int64
+	// The size of the delta that was uploaded
+	Sent int64
+	// True if there was no copy on the server to take blocks from
+	Created bool
+}
+
+/*
+Push uploads LocalFile to Destination, on a server that accepts uploads (such as "gosync serve --allow-upload").
+
+It works in the opposite direction to RSync: the index of the server's copy is fetched from
+Destination with "?index", and LocalFile is compared against it so that only the data that the server
+does not have is uploaded, along with instructions to copy the rest from the server's copy.
+
+The upload is conditional on the server's copy being the version that the index came from, and
+an *blocksources.ErrReferenceChanged is returned if it has changed. The server verifies the result
+against the whole-file checksum of LocalFile before replacing its copy.
+*/
+func Push(LocalFile, Destination string, Options blocksources.HttpOptions) (*PushResult, error) {
+	localFile, err := os.Open(LocalFile)
+	if err != nil {
+		return nil, err
+	}
+	defer localFile.Close()
+
+	info, err := localFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	reference, etag, err := getRemoteIndex(Destination, Options)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &PushResult{
+		FileSize: info.Size(),
+		Created:  reference == nil,
+	}
+
+	if reference == nil {
+		// every byte will be sent, so there is nothing to match against
+		reference = &BasicSummary{
+			ChecksumIndex: index.MakeChecksumIndex(nil),
+			BlockSize:     server.DefaultBlockSize,
+		}
+	}
+
+	body, pipe := io.Pipe()
+	created := make(chan error, 1)
+
+	go func() {
+		err := delta.Create(
+			&countingWriter{w: pipe, count: &result.Sent},
+			reference,
+			localFile,
+			info.Size(),
+		)
+
+		pipe.CloseWithError(err)
+		created <- err
+	}()
+
+	request, err := http.NewRequest(http.MethodPut, Destination, body)
+	if err != nil {
+		body.Close()
+		<-created
+		return nil, err
+	}
+
+	request.Header.Set("Content-Type", "application/octet-stream")
+
+	if etag == "" {
+		request.Header.Set("If-None-Match", "*")
+	} else {
+		request.Header.Set("If-Match", etag)
+	}
+
+	response, err := Options.Do(request)
+
+	// stops creating the delta if the request failed before reading it all
+	body.Close()
+	createErr := <-created
+
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+	case http.StatusPreconditionFailed:
+		return nil, &blocksources.ErrReferenceChanged{
+			URL:      Destination,
+			Expected: etag,
+			Received: response.Header.Get("ETag"),
+		}
+	default:
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		return nil, fmt.Errorf(
+			"Upload to %v failed: %v %v",
+			Destination,
+			response.Status,
+			strings.TrimSpace(string(message)),
+		)
+	}
+
+	if createErr != nil {
+		return nil, fmt.Errorf("Could not create a delta of %v: %v", LocalFile, createErr)
+	}
+
+	return result, nil
+}
+
+// gets the index of the server's copy and its ETag, or nil if there is no such file
+func getRemoteIndex(
+	destination string,
+	options blocksources.HttpOptions,
+) (summary *BasicSummary, etag string, err error) {
+	indexURL, err := url.Parse(destination)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if indexURL.RawQuery == "" {
+		indexURL.RawQuery = "index"
+	} else {
+		indexURL.RawQuery += "&index"
+	}
+
+	request, err := http.NewRequest(http.MethodGet, indexURL.String(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	response, err := options.Do(request)
+	if err != nil {
+		return nil, "", err
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, "", nil
+	default:
+		return nil, "", fmt.Errorf("Error getting the index of %v: %v", destination, response.Status)
+	}
+
+	etag = response.Header.Get("ETag")
+	if etag == "" {
+		return nil, "", fmt.Errorf("The index of %v has no ETag, so the upload cannot be made conditional", destination)
+	}
+
+	idx, err := indexfile.Read(response.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("Could not read the index of %v: %v", destination, err)
+	}
+
+	return &BasicSummary{
+		ChecksumIndex:  index.MakeChecksumIndex(idx.Checksums),
+		ChecksumLookup: chunks.StrongChecksumGetter(idx.Checksums),
+		BlockCount:     uint(len(idx.Checksums)),
+		BlockSize:      idx.BlockSize,
+		FileSize:       idx.FileSize,
+		FileChecksum:   idx.FileChecksum,
+	}, etag, nil
+}
+
+type countingWriter struct {
+	w     io.Writer
+	count *int64
+}
+
+func (c *countingWriter) Write(b []byte) (n int, err error) {
+	n, err = c.w.Write(b)
+	*c.count += int64(n)
+	return
+}
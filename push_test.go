@@ -0,0 +1,97 @@
+package gosync
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Redundancy/go-sync/blocksources"
+	"github.com/Redundancy/go-sync/server"
+)
+
+func makeUploadServer(dir string) *server.FileServer {
+	fileServer := server.NewFileServer(dir, 512)
+	fileServer.Uploads = &server.UploadHandler{Root: dir}
+	return fileServer
+}
+
+func TestPush(t *testing.T) {
+	old := randomString(3, 20000)
+	new := old[:8000] + "changed" + old[9000:] + "appended"
+
+	dir, paths := writeTestFiles(t, old, new)
+	defer os.RemoveAll(dir)
+
+	s := httptest.NewServer(makeUploadServer(dir))
+	defer s.Close()
+
+	result, err := Push(paths[1], s.URL+"/a", blocksources.HttpOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if content, _ := ioutil.ReadFile(paths[0]); string(content) != new {
+		t.Error("The remote file was not updated")
+	}
+
+	if result.Created || result.FileSize != int64(len(new)) || result.Sent > 2000 {
+		t.Errorf("Unexpected result: %#v", result)
+	}
+}
+
+func TestPushCreatesFile(t *testing.T) {
+	content := randomString(4, 5000)
+
+	dir, paths := writeTestFiles(t, content)
+	defer os.RemoveAll(dir)
+
+	s := httptest.NewServer(makeUploadServer(dir))
+	defer s.Close()
+
+	result, err := Push(paths[0], s.URL+"/created", blocksources.HttpOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c, _ := ioutil.ReadFile(filepath.Join(dir, "created")); string(c) != content {
+		t.Error("The remote file was not created")
+	}
+
+	if !result.Created || result.Sent < int64(len(content)) {
+		t.Errorf("Unexpected result: %#v", result)
+	}
+}
+
+func TestPushFailsIfRemoteChanges(t *testing.T) {
+	old := randomString(5, 5000)
+
+	dir, paths := writeTestFiles(t, old, old+"appended")
+	defer os.RemoveAll(dir)
+
+	fileServer := makeUploadServer(dir)
+
+	// another upload replaces the file after the index has been served
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fileServer.ServeHTTP(w, r)
+
+		if r.Method == http.MethodGet {
+			ioutil.WriteFile(paths[0], []byte("replaced"), 0666)
+			os.Chtimes(paths[0], time.Now(), time.Now().Add(time.Hour))
+		}
+	}))
+	defer s.Close()
+
+	_, err := Push(paths[1], s.URL+"/a", blocksources.HttpOptions{})
+
+	if _, ok := err.(*blocksources.ErrReferenceChanged); !ok {
+		t.Fatalf("Expected ErrReferenceChanged, got: %v", err)
+	}
+
+	if content, _ := ioutil.ReadFile(paths[0]); string(content) != "replaced" {
+		t.Errorf("The other upload was overwritten: %q", content)
+	}
+}
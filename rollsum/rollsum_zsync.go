@@ -0,0 +1,90 @@
+package rollsum
+
+/*
+RollsumZsync is the rolling checksum used by zsync, with 16 bit internal values.
+
+Blocks are treated as if they were padded with zeros to the block size, as zsync does with the
+last block of a file. This means that as bytes are removed from the start of the window at the
+end of a file, the sum matches that of a short final block.
+
+The sum is the big endian a then b values, truncated to the trailing Size() bytes as in a zsync
+control file. Only the number of bytes in the window is tracked, so the length arguments of
+RemoveByte, RemoveBytes and AddAndRemoveBytes are not needed.
+*/
+type RollsumZsync struct {
+	blockSize uint
+	size      int
+	length    uint
+	a, b      uint16
+}
+
+// NewRollsumZsync creates a zsync rolling checksum of size bytes, from 1 to 4
+func NewRollsumZsync(blockSize uint, size int) *RollsumZsync {
+	if size < 1 || size > 4 {
+		panic("zsync rolling checksums are between 1 and 4 bytes")
+	}
+
+	return &RollsumZsync{blockSize: blockSize, size: size}
+}
+
+// AddByte adds a byte to the end of the window
+func (r *RollsumZsync) AddByte(b byte) {
+	r.a += uint16(b)
+	r.b += uint16((r.blockSize - r.length) * uint(b))
+	r.length++
+}
+
+func (r *RollsumZsync) AddBytes(bs []byte) {
+	for _, b := range bs {
+		r.AddByte(b)
+	}
+}
+
+// RemoveByte removes a byte from the start of the window,
+// which moves every other byte one place closer to the start
+func (r *RollsumZsync) RemoveByte(b byte, length int) {
+	r.a -= uint16(b)
+	r.b -= uint16(r.blockSize * uint(b))
+	r.b += r.a
+	r.length--
+}
+
+func (r *RollsumZsync) RemoveBytes(bs []byte, length int) {
+	for _, b := range bs {
+		r.RemoveByte(b, length)
+	}
+}
+
+func (r *RollsumZsync) AddAndRemoveBytes(add []byte, remove []byte, length int) {
+	startEvicted := len(add) - len(remove)
+	r.AddBytes(add[:startEvicted])
+
+	for i := startEvicted; i < len(add); i++ {
+		r.RemoveByte(remove[i-startEvicted], 0)
+		r.AddByte(add[i])
+	}
+}
+
+// SetBlock sets the window to block, which may be shorter than the block size
+func (r *RollsumZsync) SetBlock(block []byte) {
+	r.Reset()
+	r.AddBytes(block)
+}
+
+func (r *RollsumZsync) Reset() {
+	r.a, r.b, r.length = 0, 0, 0
+}
+
+// Size of the hash in bytes
+func (r *RollsumZsync) Size() int {
+	return r.size
+}
+
+// GetSum puts the sum into b, which must have a length of at least Size()
+func (r *RollsumZsync) GetSum(b []byte) {
+	full := [4]byte{
+		byte(r.a >> 8), byte(r.a),
+		byte(r.b >> 8), byte(r.b),
+	}
+	copy(b, full[4-r.size:])
+}
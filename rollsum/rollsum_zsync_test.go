@@ -0,0 +1,101 @@
+package rollsum
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// calc_rsum_block from zsync, on a block padded with zeros to blockSize
+func zsyncBlockSum(data []byte, blockSize int) []byte {
+	padded := make([]byte, blockSize)
+	copy(padded, data)
+
+	var a, b uint16
+	for i, c := range padded {
+		a += uint16(c)
+		b += uint16(blockSize-i) * uint16(c)
+	}
+
+	return []byte{byte(a >> 8), byte(a), byte(b >> 8), byte(b)}
+}
+
+func TestZsyncRollsumOfBlock(t *testing.T) {
+	data := make([]byte, 2048)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	r := NewRollsumZsync(2048, 4)
+	r.SetBlock(data)
+
+	sum := make([]byte, 4)
+	r.GetSum(sum)
+
+	if expected := zsyncBlockSum(data, 2048); !bytes.Equal(sum, expected) {
+		t.Errorf("Sum was %x, expected %x", sum, expected)
+	}
+}
+
+func TestZsyncRollsumRolling(t *testing.T) {
+	const blockSize = 64
+	data := make([]byte, 1000)
+	rand.New(rand.NewSource(2)).Read(data)
+
+	r := NewRollsumZsync(blockSize, 4)
+	r.SetBlock(data[:blockSize])
+	sum := make([]byte, 4)
+
+	for i := 1; i+blockSize <= len(data); i++ {
+		r.AddAndRemoveBytes(data[i+blockSize-1:i+blockSize], data[i-1:i], blockSize)
+		r.GetSum(sum)
+
+		if expected := zsyncBlockSum(data[i:i+blockSize], blockSize); !bytes.Equal(sum, expected) {
+			t.Fatalf("Sum at %v was %x, expected %x", i, sum, expected)
+		}
+	}
+}
+
+func TestZsyncRollsumOfShortBlocks(t *testing.T) {
+	const blockSize = 64
+	data := make([]byte, blockSize)
+	rand.New(rand.NewSource(3)).Read(data)
+
+	r := NewRollsumZsync(blockSize, 4)
+	r.SetBlock(data)
+	sum := make([]byte, 4)
+
+	// removing bytes from the start of the window at the end of a file
+	for i := 1; i < blockSize; i++ {
+		r.RemoveBytes(data[i-1:i], blockSize-i+1)
+		r.GetSum(sum)
+
+		if expected := zsyncBlockSum(data[i:], blockSize); !bytes.Equal(sum, expected) {
+			t.Fatalf("Sum of %v bytes was %x, expected %x", blockSize-i, sum, expected)
+		}
+
+		short := NewRollsumZsync(blockSize, 4)
+		short.SetBlock(data[i:])
+		shortSum := make([]byte, 4)
+		short.GetSum(shortSum)
+
+		if !bytes.Equal(sum, shortSum) {
+			t.Fatalf("Sum of a short block of %v bytes was %x, expected %x", blockSize-i, shortSum, sum)
+		}
+	}
+}
+
+func TestZsyncRollsumIsTruncated(t *testing.T) {
+	data := []byte("abcdefgh")
+	full := zsyncBlockSum(data, 8)
+
+	for size := 1; size <= 4; size++ {
+		r := NewRollsumZsync(8, size)
+		r.SetBlock(data)
+
+		sum := make([]byte, size)
+		r.GetSum(sum)
+
+		if !bytes.Equal(sum, full[4-size:]) {
+			t.Errorf("Sum of %v bytes was %x, expected %x", size, sum, full[4-size:])
+		}
+	}
+}
@@ -2,12 +2,14 @@ package gosync
 
 import (
 	"bufio"
-	"crypto/md5"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"runtime"
+	"sort"
 
 	"github.com/Redundancy/go-sync/blocksources"
 	"github.com/Redundancy/go-sync/chunks"
@@ -41,7 +43,10 @@ To this end, it hides away many low level choices by default, and makes some
 assumptions.
 */
 type RSync struct {
-	Input  ReadSeekerAt
+	Input ReadSeekerAt
+	// Seeds are further local inputs, which are searched along with Input
+	// for blocks of the reference. The best source is chosen for each block.
+	Seeds  []ReadSeekerAt
 	Source patcher.BlockSource
 	Output io.Writer
 
@@ -54,6 +59,11 @@ type closer interface {
 	Close() error
 }
 
+// closers that should discard their work if patching fails
+type aborter interface {
+	Abort()
+}
+
 // FileSummary combines many of the interfaces that are needed
 // It is expected that you might implement it by embedding existing structs
 type FileSummary interface {
@@ -65,11 +75,56 @@ type FileSummary interface {
 	GetStrongChecksumForBlock(blockID int) []byte
 }
 
+/*
+FileChecksumSummary is implemented by a FileSummary with a whole-file checksum, which the patched
+output is verified against. Without one, only the size of the output is checked.
+*/
+type FileChecksumSummary interface {
+	// GetFileChecksum may return nil if there is no whole-file checksum
+	GetFileChecksum() []byte
+}
+
+// fileChecksum is the whole-file checksum of summary, or nil if it does not have one
+func fileChecksum(summary FileSummary) []byte {
+	if c, ok := summary.(FileChecksumSummary); ok {
+		return c.GetFileChecksum()
+	}
+
+	return nil
+}
+
+/*
+ChecksumSummary is implemented by a FileSummary whose checksums are not made by
+filechecksum.NewFileChecksumGenerator, such as one read from a zsync control file.
+*/
+type ChecksumSummary interface {
+	// Creates a generator for the block checksums and the whole file checksum
+	NewChecksumGenerator() *filechecksum.FileChecksumGenerator
+
+	// The number of consecutive blocks that must match before a match is used,
+	// when the checksums are too short to trust a single block. The last block
+	// of the file may always match alone.
+	GetSequentialMatches() int
+}
+
+// newChecksumGenerator creates a generator for the checksums of summary
+func newChecksumGenerator(summary FileSummary) *filechecksum.FileChecksumGenerator {
+	if c, ok := summary.(ChecksumSummary); ok {
+		return c.NewChecksumGenerator()
+	}
+
+	return filechecksum.NewFileChecksumGenerator(summary.GetBlockSize())
+}
+
 // BasicSummary implements a version of the FileSummary interface
 type BasicSummary struct {
 	BlockSize  uint
 	BlockCount uint
 	FileSize   int64
+	// The whole-file checksum, from filechecksum.DefaultFileHashGenerator
+	FileChecksum []byte
+	// The root of the Merkle tree of the blocks (see the merkle package), if the index has one
+	MerkleRoot []byte
 	*index.ChecksumIndex
 	filechecksum.ChecksumLookup
 }
@@ -89,6 +144,11 @@ func (fs *BasicSummary) GetFileSize() int64 {
 	return fs.FileSize
 }
 
+// GetFileChecksum gets the checksum of the whole file
+func (fs *BasicSummary) GetFileChecksum() []byte {
+	return fs.FileChecksum
+}
+
 // MakeRSync creates an RSync object using string paths,
 // inferring most of the configuration
 func MakeRSync(
@@ -97,129 +157,292 @@ func MakeRSync(
 	OutFile string,
 	Summary FileSummary,
 ) (r *RSync, err error) {
-	useTempFile := false
-	if useTempFile, err = IsSameFile(InputFile, OutFile); err != nil {
-		return nil, err
-	}
+	return MakeRSyncWithSeeds(InputFile, nil, Source, OutFile, Summary)
+}
 
-	inputFile, err := os.Open(InputFile)
+// MakeRSyncWithSeeds works like MakeRSync, but also uses blocks
+// from each of the SeedFiles
+func MakeRSyncWithSeeds(
+	InputFile string,
+	SeedFiles []string,
+	Source,
+	OutFile string,
+	Summary FileSummary,
+) (r *RSync, err error) {
+	return MakeRSyncWithOptions(
+		InputFile,
+		Source,
+		OutFile,
+		Summary,
+		RSyncOptions{SeedFiles: SeedFiles},
+	)
+}
 
-	if err != nil {
-		return
-	}
+// RSyncOptions configures MakeRSyncWithOptions
+type RSyncOptions struct {
+	// Further local files to take blocks from
+	SeedFiles []string
+
+	// Configures the requests made to Source, such as the client and headers to use
+	HTTP blocksources.HttpOptions
+
+	// If set, blocks are requested from Requester rather than from Source over HTTP,
+	// such as a file opened with the blockprotocol package
+	Requester blocksources.BlockSourceRequester
+
+	// If set, blocks from the source must also pass Verifier, such as a merkle.Verifier that
+	// authenticates them against the Merkle root of the index. It must support concurrent calls.
+	Verifier blocksources.BlockVerifier
 
-	var out io.WriteCloser
-	var outFilename = OutFile
-	var copier closer
+	// Check weak checksums against a filter before looking them up in the index of the summary
+	// (see index.ChecksumIndex.EnableWeakFilter), which speeds up comparing local files that are
+	// mostly different from the reference, for 2 bytes per block
+	WeakFilter bool
+}
+
+// weakFilterSummary is a summary that can filter weak checksums, such as a BasicSummary
+type weakFilterSummary interface {
+	EnableWeakFilter()
+}
 
-	if useTempFile {
-		out, outFilename, err = getTempFile()
+// MakeRSyncWithOptions works like MakeRSync, configured by Options
+func MakeRSyncWithOptions(
+	InputFile,
+	Source,
+	OutFile string,
+	Summary FileSummary,
+	Options RSyncOptions,
+) (r *RSync, err error) {
+	var seeds []ReadSeekerAt
+	var seedClosers []closer
 
+	defer func() {
 		if err != nil {
-			return
+			for _, c := range seedClosers {
+				c.Close()
+			}
 		}
+	}()
 
-		copier = &fileCopyCloser{
-			from: outFilename,
-			to:   OutFile,
+	for _, path := range Options.SeedFiles {
+		seed, e := os.Open(path)
+		if e != nil {
+			return nil, e
 		}
-	} else {
-		out, err = getOutFile(OutFile)
 
-		if err != nil {
-			return
-		}
+		seeds = append(seeds, seed)
+		seedClosers = append(seedClosers, &fileCloser{seed, path})
+	}
+
+	inputFile, err := os.Open(InputFile)
 
-		copier = nullCloser{}
+	if err != nil {
+		return
+	}
+
+	// Always patch into a temporary file, so that the output is
+	// only replaced once the patched result has been verified
+	out, outFilename, err := getTempFile(filepath.Dir(OutFile))
+
+	if err != nil {
+		inputFile.Close()
+		return
+	}
+
+	copier := &fileCopyCloser{
+		from: outFilename,
+		to:   OutFile,
 	}
 
-	// blocksource
 	var source *blocksources.BlockSourceBase
 
-	resolver := blocksources.MakeFileSizedBlockResolver(
-		uint64(Summary.GetBlockSize()),
-		Summary.GetFileSize(),
-	)
+	if Options.Requester != nil {
+		source = newSource(Options.Requester, Summary)
+	} else {
+		source = newHttpSource(Source, Summary, Options.HTTP)
+	}
 
-	source = blocksources.NewHttpBlockSource(
-		Source,
-		DefaultConcurrency,
-		resolver,
-		&filechecksum.HashVerifier{
-			Hash:                md5.New(),
-			BlockSize:           Summary.GetBlockSize(),
-			BlockChecksumGetter: Summary,
-		},
-	)
+	if Options.Verifier != nil {
+		source.Verifier = allVerifiers{source.Verifier, Options.Verifier}
+	}
+
+	if f, ok := Summary.(weakFilterSummary); ok && Options.WeakFilter {
+		f.EnableWeakFilter()
+	}
 
 	r = &RSync{
 		Input:   inputFile,
+		Seeds:   seeds,
 		Output:  out,
 		Source:  source,
 		Summary: Summary,
-		OnClose: []closer{
+		OnClose: append(
+			seedClosers,
 			&fileCloser{inputFile, InputFile},
 			&fileCloser{out, outFilename},
 			copier,
-		},
+		),
 	}
 
 	return
 }
 
+// newHttpSource creates a source for the blocks of the reference at url
+func newHttpSource(
+	url string,
+	summary FileSummary,
+	options blocksources.HttpOptions,
+) *blocksources.BlockSourceBase {
+	return newSource(blocksources.NewHttpRequester(url, options), summary)
+}
+
+// newSource creates a source for the blocks of the reference, verified against the summary
+func newSource(
+	requester blocksources.BlockSourceRequester,
+	summary FileSummary,
+) *blocksources.BlockSourceBase {
+	resolver := blocksources.MakeFileSizedBlockResolver(
+		uint64(summary.GetBlockSize()),
+		summary.GetFileSize(),
+	)
+
+	source := blocksources.NewBlockSourceBase(
+		requester,
+		resolver,
+		&filechecksum.HashVerifier{
+			HashGenerator: func() hash.Hash {
+				return newChecksumGenerator(summary).GetStrongHash()
+			},
+			BlockSize:           summary.GetBlockSize(),
+			BlockChecksumGetter: summary,
+		},
+		DefaultConcurrency,
+		4*blocksources.MB,
+	)
+
+	// HashVerifier is safe to use from the request goroutines
+	source.ConcurrentVerification = true
+	return source
+}
+
+// allVerifiers accepts the blocks that every one of its verifiers accepts
+type allVerifiers []blocksources.BlockVerifier
+
+func (v allVerifiers) VerifyBlockRange(startBlockID uint, data []byte) bool {
+	for _, verifier := range v {
+		if !verifier.VerifyBlockRange(startBlockID, data) {
+			return false
+		}
+	}
+	return true
+}
+
 // Patch the files
+// The output is checked against the size and checksum of the reference, and
+// an *ErrOutputMismatch is returned if it does not match.
 func (rsync *RSync) Patch() (err error) {
-	numMatchers := int64(DefaultConcurrency)
+	defer func() {
+		if err != nil {
+			rsync.abort()
+		}
+	}()
+
 	blockSize := rsync.Summary.GetBlockSize()
-	sectionSize := rsync.Summary.GetFileSize() / numMatchers
-	sectionSize += int64(blockSize) - (sectionSize % int64(blockSize))
+	inputs := append([]ReadSeekerAt{rsync.Input}, rsync.Seeds...)
+	found := make([][]patcher.FoundBlockSpan, len(inputs))
 
-	merger := &comparer.MatchMerger{}
+	for i, input := range inputs {
+		inputSize, err := input.Seek(0, io.SeekEnd)
+		if err != nil {
+			return fmt.Errorf("Could not get the size of input %v: %v", i, err)
+		}
 
-	for i := int64(0); i < numMatchers; i++ {
-		compare := &comparer.Comparer{}
-		offset := sectionSize * i
+		matcher := comparer.NewParallelMatcher(blockSize, DefaultConcurrency)
+		matcher.NewGenerator = func() *filechecksum.FileChecksumGenerator {
+			return newChecksumGenerator(rsync.Summary)
+		}
 
-		sectionReader := bufio.NewReaderSize(
-			io.NewSectionReader(rsync.Input, offset, sectionSize+int64(blockSize)),
-			megabyte, // 1 MB buffer
-		)
+		merger, err := matcher.FindMatchingBlocks(input, inputSize, rsync.Summary)
 
-		// Bakes in the assumption about how to generate checksums (extract)
-		sectionGenerator := filechecksum.NewFileChecksumGenerator(
-			uint(blockSize),
-		)
+		if err != nil {
+			return fmt.Errorf("Could not compare input %v to the reference: %v", i, err)
+		}
 
-		matchStream := compare.StartFindMatchingBlocks(
-			sectionReader, offset, sectionGenerator, rsync.Summary,
+		found[i] = toPatcherFoundSpan(
+			requireSequentialMatches(merger.GetMergedBlocks(), rsync.Summary),
+			int64(blockSize),
 		)
 
-		merger.StartMergeResultStream(matchStream, int64(blockSize))
+		for j := range found[i] {
+			found[i][j].Source = i
+		}
+	}
+
+	matched := selectFoundSpans(found)
+	missing := toBlockSpanList(matched).MissingBlocks(rsync.Summary.GetBlockCount())
+
+	localFiles := make([]io.ReadSeeker, len(inputs))
+	for i, input := range inputs {
+		localFiles[i] = input
 	}
 
-	mergedBlocks := merger.GetMergedBlocks()
-	missing := mergedBlocks.GetMissingBlocks(rsync.Summary.GetBlockCount() - 1)
+	output := newVerifyingWriter(rsync.Output, newChecksumGenerator(rsync.Summary).GetFileHash())
 
-	return sequential.SequentialPatcher(
-		rsync.Input,
+	err = sequential.MultiSourcePatcher(
+		localFiles,
 		rsync.Source,
 		toPatcherMissingSpan(missing, int64(blockSize)),
-		toPatcherFoundSpan(mergedBlocks, int64(blockSize)),
+		matched,
 		20*megabyte,
-		rsync.Output,
+		output,
 	)
+
+	if err == nil {
+		err = output.verify(
+			rsync.Summary.GetFileSize(),
+			fileChecksum(rsync.Summary),
+		)
+	}
+
+	return
 }
 
-func getOutFile(filename string) (f io.WriteCloser, err error) {
-	if _, err = os.Stat(filename); os.IsNotExist(err) {
-		return os.Create(filename)
+// requireSequentialMatches drops spans that are shorter than the summary's required
+// number of sequential matches, unless they end with the last block
+func requireSequentialMatches(spans comparer.BlockSpanList, summary FileSummary) comparer.BlockSpanList {
+	c, ok := summary.(ChecksumSummary)
+	if !ok || c.GetSequentialMatches() <= 1 {
+		return spans
 	}
 
-	return os.OpenFile(filename, os.O_WRONLY, 0)
+	lastBlock := summary.GetBlockCount() - 1
+	result := make(comparer.BlockSpanList, 0, len(spans))
+
+	for _, span := range spans {
+		if span.EndBlock-span.StartBlock+1 >= uint(c.GetSequentialMatches()) || span.EndBlock == lastBlock {
+			result = append(result, span)
+		}
+	}
+
+	return result
+}
+
+// abort tells any closers that the output should be discarded
+func (rsync *RSync) abort() {
+	for _, f := range rsync.OnClose {
+		if a, ok := f.(aborter); ok {
+			a.Abort()
+		}
+	}
 }
 
-func getTempFile() (f io.WriteCloser, filename string, err error) {
-	ft, err := ioutil.TempFile(".", "tmp_")
+func getTempFile(dir string) (f io.WriteCloser, filename string, err error) {
+	ft, err := ioutil.TempFile(dir, "tmp_")
+
+	if err != nil {
+		return
+	}
+
 	filename = ft.Name()
 	f = ft
 	return
@@ -250,14 +473,17 @@ func IsSameFile(path1, path2 string) (same bool, err error) {
 }
 
 // Close - close open files, copy to the final location from
-// a temporary one if neede
-func (rsync *RSync) Close() error {
+// a temporary one if needed.
+// Every closer is closed, and the first error is returned. If any closer fails,
+// the output is discarded rather than copied.
+func (rsync *RSync) Close() (err error) {
 	for _, f := range rsync.OnClose {
-		if err := f.Close(); err != nil {
-			return err
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+			rsync.abort()
 		}
 	}
-	return nil
+	return
 }
 
 type fileCloser struct {
@@ -278,18 +504,25 @@ func (f *fileCloser) Close() error {
 	return nil
 }
 
-type nullCloser struct{}
-
-func (n nullCloser) Close() error {
-	return nil
+// fileCopyCloser copies the temporary output over the final destination
+// and removes it. If aborted, the destination is left untouched.
+type fileCopyCloser struct {
+	from    string
+	to      string
+	aborted bool
 }
 
-type fileCopyCloser struct {
-	from string
-	to   string
+func (f *fileCopyCloser) Abort() {
+	f.aborted = true
 }
 
 func (f *fileCopyCloser) Close() (err error) {
+	defer os.Remove(f.from)
+
+	if f.aborted {
+		return nil
+	}
+
 	from, err := os.OpenFile(f.from, os.O_RDONLY, 0)
 
 	if err != nil {
@@ -298,12 +531,12 @@ func (f *fileCopyCloser) Close() (err error) {
 
 	defer func() {
 		e := from.Close()
-		if err != nil {
+		if err == nil {
 			err = e
 		}
 	}()
 
-	to, err := os.OpenFile(f.to, os.O_TRUNC|os.O_WRONLY, 0)
+	to, err := os.OpenFile(f.to, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
 
 	if err != nil {
 		return err
@@ -311,7 +544,7 @@ func (f *fileCopyCloser) Close() (err error) {
 
 	defer func() {
 		e := to.Close()
-		if err != nil {
+		if err == nil {
 			err = e
 		}
 	}()
@@ -345,3 +578,61 @@ func toPatcherMissingSpan(sl comparer.BlockSpanList, blockSize int64) []patcher.
 
 	return result
 }
+
+func toBlockSpanList(found []patcher.FoundBlockSpan) comparer.BlockSpanList {
+	result := make(comparer.BlockSpanList, len(found))
+
+	for i, v := range found {
+		result[i].StartBlock = v.StartBlock
+		result[i].EndBlock = v.EndBlock
+		result[i].ComparisonStartOffset = v.MatchOffset
+	}
+
+	return result
+}
+
+/*
+selectFoundSpans combines the spans found in several inputs into one sorted list without overlaps.
+For each block, the span that continues furthest is used, so that the result has
+as few spans (and so, seeks) as possible.
+*/
+func selectFoundSpans(found [][]patcher.FoundBlockSpan) (result []patcher.FoundBlockSpan) {
+	var all []patcher.FoundBlockSpan
+	for _, spans := range found {
+		all = append(all, spans...)
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].StartBlock < all[j].StartBlock
+	})
+
+	next := uint(0)
+
+	for i := 0; i < len(all); {
+		// skip blocks that no input has
+		if all[i].StartBlock > next {
+			next = all[i].StartBlock
+		}
+
+		// of the spans that have the next block, pick the longest
+		best := -1
+		for ; i < len(all) && all[i].StartBlock <= next; i++ {
+			if all[i].EndBlock >= next && (best == -1 || all[i].EndBlock > all[best].EndBlock) {
+				best = i
+			}
+		}
+
+		if best == -1 {
+			continue
+		}
+
+		span := all[best]
+		span.MatchOffset += int64(next-span.StartBlock) * span.BlockSize
+		span.StartBlock = next
+
+		result = append(result, span)
+		next = span.EndBlock + 1
+	}
+
+	return result
+}
@@ -0,0 +1,453 @@
+package gosync
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Redundancy/go-sync/blockprotocol"
+	"github.com/Redundancy/go-sync/blocksources"
+	"github.com/Redundancy/go-sync/filechecksum"
+	"github.com/Redundancy/go-sync/indexbuilder"
+	"github.com/Redundancy/go-sync/merkle"
+	"github.com/Redundancy/go-sync/patcher"
+)
+
+func makeTestSummary(t *testing.T, reference string, blockSize uint) *BasicSummary {
+	generator := filechecksum.NewFileChecksumGenerator(blockSize)
+	fileChecksum, referenceIndex, lookup, err := indexbuilder.BuildIndexFromString(
+		generator,
+		reference,
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &BasicSummary{
+		ChecksumIndex:  referenceIndex,
+		ChecksumLookup: lookup,
+		BlockCount:     uint(referenceIndex.BlockCount),
+		BlockSize:      blockSize,
+		FileSize:       int64(len(reference)),
+		FileChecksum:   fileChecksum,
+	}
+}
+
+func makeTestRSync(summary FileSummary, local, reference string) (*RSync, *bytes.Buffer) {
+	output := bytes.NewBuffer(nil)
+
+	return &RSync{
+		Input:  bytes.NewReader([]byte(local)),
+		Output: output,
+		Source: blocksources.NewReadSeekerBlockSource(
+			bytes.NewReader([]byte(reference)),
+			blocksources.MakeNullFixedSizeResolver(uint64(summary.GetBlockSize())),
+		),
+		Summary: summary,
+	}, output
+}
+
+func TestPatchVerifiesOutput(t *testing.T) {
+	summary := makeTestSummary(t, REFERENCE, BLOCK_SIZE)
+	rsync, output := makeTestRSync(summary, LOCAL_VERSION, REFERENCE)
+
+	if err := rsync.Patch(); err != nil {
+		t.Fatal(err)
+	}
+
+	if output.String() != REFERENCE {
+		t.Errorf("Unexpected output: %v", output.String())
+	}
+}
+
+func TestPatchDetectsChecksumMismatch(t *testing.T) {
+	summary := makeTestSummary(t, REFERENCE, BLOCK_SIZE)
+	summary.FileChecksum = md5.New().Sum(nil)
+	rsync, _ := makeTestRSync(summary, LOCAL_VERSION, REFERENCE)
+
+	err := rsync.Patch()
+
+	var mismatch *ErrOutputMismatch
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("Expected an output mismatch, got: %v", err)
+	}
+
+	if mismatch.ActualSize != mismatch.ExpectedSize {
+		t.Errorf("Size should have matched: %#v", mismatch)
+	}
+}
+
+// hides every method that is not in FileSummary, as a summary from another package might
+type minimalSummary struct {
+	FileSummary
+}
+
+func TestPatchWithoutFileChecksum(t *testing.T) {
+	summary := makeTestSummary(t, REFERENCE, BLOCK_SIZE)
+	summary.FileChecksum = md5.New().Sum(nil)
+	rsync, output := makeTestRSync(&minimalSummary{summary}, LOCAL_VERSION, REFERENCE)
+
+	// the checksum is not used without GetFileChecksum
+	if err := rsync.Patch(); err != nil {
+		t.Fatal(err)
+	}
+
+	if output.String() != REFERENCE {
+		t.Errorf("Unexpected output: %v", output.String())
+	}
+}
+
+func TestPatchDetectsTruncatedOutput(t *testing.T) {
+	summary := makeTestSummary(t, REFERENCE, BLOCK_SIZE)
+	summary.FileSize += 1
+	summary.FileChecksum = nil
+	rsync, _ := makeTestRSync(summary, LOCAL_VERSION, REFERENCE)
+
+	err := rsync.Patch()
+
+	var mismatch *ErrOutputMismatch
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("Expected an output mismatch, got: %v", err)
+	}
+
+	if mismatch.ActualSize != int64(len(REFERENCE)) {
+		t.Errorf("Unexpected actual size: %#v", mismatch)
+	}
+}
+
+func TestFailedPatchLeavesOutputUntouched(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	localPath := filepath.Join(dir, "local")
+	if err := ioutil.WriteFile(localPath, []byte(LOCAL_VERSION), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	summary := makeTestSummary(t, REFERENCE, BLOCK_SIZE)
+	summary.FileChecksum = md5.New().Sum(nil)
+
+	rsync, err := MakeRSync(localPath, "http://localhost/unused", localPath, summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsync.Source.(*blocksources.BlockSourceBase).Close()
+	rsync.Source = blocksources.NewReadSeekerBlockSource(
+		bytes.NewReader([]byte(REFERENCE)),
+		blocksources.MakeNullFixedSizeResolver(BLOCK_SIZE),
+	)
+
+	if err := rsync.Patch(); err == nil {
+		t.Fatal("Expected patching to fail")
+	}
+
+	if err := rsync.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(localPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(content) != LOCAL_VERSION {
+		t.Errorf("Local file was modified: %v", string(content))
+	}
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("Temporary output was not removed: %v", len(files))
+	}
+}
+
+type failingCloser struct {
+	closed bool
+}
+
+func (f *failingCloser) Close() error {
+	f.closed = true
+	return errors.New("close failed")
+}
+
+func TestCloseClosesEverythingAfterAnError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	outPath := filepath.Join(dir, "out")
+	tempPath := filepath.Join(dir, "tmp_out")
+
+	for _, path := range []string{outPath, tempPath} {
+		if err := ioutil.WriteFile(path, []byte(path), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first, second := &failingCloser{}, &failingCloser{}
+	rsync := &RSync{
+		OnClose: []closer{
+			first,
+			second,
+			&fileCopyCloser{from: tempPath, to: outPath},
+		},
+	}
+
+	if err := rsync.Close(); err == nil || err.Error() != "close failed" {
+		t.Errorf("Expected the first error: %v", err)
+	}
+
+	if !second.closed {
+		t.Error("Closers after the error were not closed")
+	}
+
+	if _, err := os.Stat(tempPath); !os.IsNotExist(err) {
+		t.Errorf("Temporary output was not removed: %v", err)
+	}
+
+	if content, _ := ioutil.ReadFile(outPath); string(content) != outPath {
+		t.Errorf("Output was replaced: %q", content)
+	}
+}
+
+func TestPatchFromSeeds(t *testing.T) {
+	summary := makeTestSummary(t, REFERENCE, BLOCK_SIZE)
+
+	// an empty reference source, so that every block must come from the inputs
+	rsync, output := makeTestRSync(summary, "The quick brown fox ", "")
+	rsync.Seeds = []ReadSeekerAt{
+		bytes.NewReader([]byte("nothing useful")),
+		bytes.NewReader([]byte("xxjumped over the lazy dog")),
+	}
+
+	if err := rsync.Patch(); err != nil {
+		t.Fatal(err)
+	}
+
+	if output.String() != REFERENCE {
+		t.Errorf("Unexpected output: %v", output.String())
+	}
+}
+
+func TestSelectFoundSpansPrefersLongestSpan(t *testing.T) {
+	found := [][]patcher.FoundBlockSpan{
+		{
+			{StartBlock: 0, EndBlock: 3, BlockSize: 4, MatchOffset: 0, Source: 0},
+			{StartBlock: 8, EndBlock: 8, BlockSize: 4, MatchOffset: 100, Source: 0},
+		},
+		{
+			{StartBlock: 1, EndBlock: 1, BlockSize: 4, MatchOffset: 0, Source: 1},
+			{StartBlock: 2, EndBlock: 6, BlockSize: 4, MatchOffset: 20, Source: 1},
+		},
+	}
+
+	result := selectFoundSpans(found)
+	expected := []patcher.FoundBlockSpan{
+		{StartBlock: 0, EndBlock: 3, BlockSize: 4, MatchOffset: 0, Source: 0},
+		{StartBlock: 4, EndBlock: 6, BlockSize: 4, MatchOffset: 28, Source: 1},
+		{StartBlock: 8, EndBlock: 8, BlockSize: 4, MatchOffset: 100, Source: 0},
+	}
+
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Unexpected spans:\n%v\n%v", result, expected)
+	}
+}
+
+func TestPatchWithRequester(t *testing.T) {
+	reference := randomString(6, 10000)
+	local := reference[:3000] + "changed" + reference[4000:]
+
+	dir, paths := writeTestFiles(t, reference, local)
+	defer os.RemoveAll(dir)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go (&blockprotocol.Server{Root: dir}).Serve(listener)
+
+	client, err := blockprotocol.Dial(listener.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	summary := makeTestSummary(t, reference, 512)
+
+	file, err := client.Open("a", summary.GetBlockSize())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsync, err := MakeRSyncWithOptions(
+		paths[1],
+		"unused",
+		paths[1],
+		summary,
+		RSyncOptions{Requester: file},
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rsync.Patch(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rsync.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if content, _ := ioutil.ReadFile(paths[1]); string(content) != reference {
+		t.Error("Local file was not patched")
+	}
+}
+
+func TestPatchWithWeakFilter(t *testing.T) {
+	reference := randomString(9, 10000)
+	local := reference[:3000] + "changed" + reference[4000:]
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "reference", time.Time{}, strings.NewReader(reference))
+	}))
+	defer server.Close()
+
+	dir, paths := writeTestFiles(t, local)
+	defer os.RemoveAll(dir)
+
+	rsync, err := MakeRSyncWithOptions(
+		paths[0],
+		server.URL,
+		paths[0],
+		makeTestSummary(t, reference, 512),
+		RSyncOptions{WeakFilter: true},
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = rsync.Patch()
+	if e := rsync.Close(); err == nil {
+		err = e
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if content, _ := ioutil.ReadFile(paths[0]); string(content) != reference {
+		t.Error("Local file was not patched")
+	}
+}
+
+func TestPatchWithVerifier(t *testing.T) {
+	reference := randomString(7, 10000)
+	local := reference[:3000] + "changed" + reference[4000:]
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "reference", time.Time{}, strings.NewReader(reference))
+	}))
+	defer server.Close()
+
+	summary := makeTestSummary(t, reference, 512)
+
+	for _, test := range []struct {
+		name    string
+		treeOf  string
+		success bool
+	}{
+		{"the reference", reference, true},
+		{"another file", randomString(8, 10000), false},
+	} {
+		dir, paths := writeTestFiles(t, reference, local)
+		defer os.RemoveAll(dir)
+
+		tree, index, err := merkle.Build(strings.NewReader(test.treeOf), 512)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rsync, err := MakeRSyncWithOptions(
+			paths[1],
+			server.URL,
+			paths[1],
+			summary,
+			RSyncOptions{Verifier: merkle.NewVerifier(index, tree)},
+		)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = rsync.Patch()
+		rsync.Close()
+
+		content, _ := ioutil.ReadFile(paths[1])
+
+		if test.success && (err != nil || string(content) != reference) {
+			t.Errorf("Patching with the tree of %v failed: %v", test.name, err)
+		} else if !test.success && (err == nil || string(content) != local) {
+			t.Errorf("Expected patching with the tree of %v to fail, and leave the file", test.name)
+		}
+	}
+}
+
+func TestPatchEmptyAndSmallFiles(t *testing.T) {
+	references := []string{"", "abc", "abcd", REFERENCE}
+	locals := []string{"", "ab", "abc", "xabc", LOCAL_VERSION}
+
+	for _, reference := range references {
+		for _, local := range locals {
+			summary := makeTestSummary(t, reference, BLOCK_SIZE)
+			rsync, output := makeTestRSync(summary, local, reference)
+
+			if err := rsync.Patch(); err != nil {
+				t.Errorf("Patching %q to %q: %v", local, reference, err)
+				continue
+			}
+
+			if output.String() != reference {
+				t.Errorf("Patching %q to %q: unexpected output %q", local, reference, output.String())
+			}
+		}
+	}
+}
+
+func TestPatchReusesBlockSmallerThanBlockSize(t *testing.T) {
+	const reference = "abc"
+
+	for _, local := range []string{"abc", "xabc"} {
+		summary := makeTestSummary(t, reference, BLOCK_SIZE)
+
+		// the source has nothing, so the block has to come from the local file
+		rsync, output := makeTestRSync(summary, local, "")
+
+		if err := rsync.Patch(); err != nil {
+			t.Errorf("Patching %q: %v", local, err)
+			continue
+		}
+
+		if output.String() != reference {
+			t.Errorf("Patching %q: unexpected output %q", local, output.String())
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"path"
+
+	"github.com/Redundancy/go-sync/delta"
+)
+
+// DefaultMaxSignatureSize is the largest signature that a DeltaHandler accepts when no limit is given
+const DefaultMaxSignatureSize = 64 * 1024 * 1024
+
+/*
+DeltaHandler creates deltas from the files under Root, against the signature of a client's local file.
+
+The client POSTs the signature of its local file (see delta.WriteSignature) to the path of a reference
+file, and the response is a delta (see delta.Create) that turns the local file into the reference.
+Only the signature and the data missing from the local file are transferred, so this suits clients
+with a small local file and a large reference, where downloading the whole reference index would
+cost more than the signature.
+
+The matching is done by the server, so each request reads the whole reference file and holds
+the signature in memory. Any client that can reach the handler can do this for any file under Root
+unless Token is set.
+*/
+type DeltaHandler struct {
+	Root string
+
+	// The largest signature that will be accepted, defaults to DefaultMaxSignatureSize.
+	// Larger signatures, and those with blocks over delta.MaxSignatureBlockSize, get a 400 response.
+	MaxSignatureSize int64
+
+	// If not empty, requests must have an "Authorization: Bearer <Token>" header
+	Token string
+}
+
+func (h *DeltaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if h.Token != "" && !authorized(r, h.Token) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	name := path.Clean("/" + r.URL.Path)
+
+	file, info, err := openFile(h.Root, name)
+	if err != nil {
+		fileError(w, err)
+		return
+	}
+	defer file.Close()
+
+	limit := h.MaxSignatureSize
+	if limit <= 0 {
+		limit = DefaultMaxSignatureSize
+	}
+
+	signature, err := delta.ReadSignature(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		http.Error(w, "Invalid signature: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", fileETag(info))
+
+	// delta.Create reads and matches the whole reference before writing anything,
+	// so most errors can still be reported with an error status
+	out := &startedWriter{w: w}
+
+	if err = delta.Create(out, signature, file, info.Size()); err != nil && !out.started {
+		w.Header().Del("ETag")
+		http.Error(w, "Could not create a delta: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// records if anything has been written to the response
+type startedWriter struct {
+	w       io.Writer
+	started bool
+}
+
+func (s *startedWriter) Write(b []byte) (int, error) {
+	s.started = true
+	return s.w.Write(b)
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Redundancy/go-sync/delta"
+)
+
+func postSignature(t *testing.T, url string, signature []byte) (*http.Response, []byte) {
+	response, err := http.Post(url, "application/octet-stream", bytes.NewReader(signature))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return response, body
+}
+
+func setupDeltaServer(t *testing.T, files map[string][]byte) (dir string, server *httptest.Server) {
+	dir, server = setupFileServer(t, files)
+	server.Config.Handler.(*FileServer).Deltas = &DeltaHandler{Root: dir}
+	return dir, server
+}
+
+func TestDeltaAgainstSignature(t *testing.T) {
+	reference := randomData(10, 1000)
+	local := append(append([]byte{}, reference[100:300]...), []byte("local changes")...)
+
+	dir, server := setupDeltaServer(t, map[string][]byte{"file": reference})
+	defer os.RemoveAll(dir)
+	defer server.Close()
+
+	signature := bytes.NewBuffer(nil)
+	if err := delta.WriteSignature(signature, bytes.NewReader(local), int64(len(local)), BLOCK_SIZE); err != nil {
+		t.Fatal(err)
+	}
+
+	response, body := postSignature(t, server.URL+"/file", signature.Bytes())
+
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status: %v %s", response.Status, body)
+	}
+
+	if response.Header.Get("ETag") == "" {
+		t.Error("Expected the delta to have the ETag of the file")
+	}
+
+	// the blocks found in the local file are not sent
+	if len(body) > len(reference)-100 {
+		t.Errorf("Delta was larger than expected: %v bytes", len(body))
+	}
+
+	out := bytes.NewBuffer(nil)
+	if err := delta.Apply(bytes.NewReader(local), bytes.NewReader(body), out); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(out.Bytes(), reference) {
+		t.Error("Applied delta did not recreate the reference")
+	}
+}
+
+func TestInvalidSignatureIsRejected(t *testing.T) {
+	dir, server := setupDeltaServer(t, map[string][]byte{"file": randomData(11, 100)})
+	defer os.RemoveAll(dir)
+	defer server.Close()
+
+	if response, _ := postSignature(t, server.URL+"/file", []byte("not a signature")); response.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected a bad request, got %v", response.Status)
+	}
+
+	if response, _ := postSignature(t, server.URL+"/missing", nil); response.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected not found, got %v", response.Status)
+	}
+}
+
+func TestLargeSignatureIsRejected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), randomData(12, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	local := randomData(13, 1000)
+	signature := bytes.NewBuffer(nil)
+	if err := delta.WriteSignature(signature, bytes.NewReader(local), int64(len(local)), BLOCK_SIZE); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := &DeltaHandler{Root: dir, MaxSignatureSize: 100}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("POST", "http://localhost/file", signature))
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected a bad request, got %v", recorder.Code)
+	}
+}
+
+func TestSignatureWithLargeBlocksIsRejected(t *testing.T) {
+	dir, server := setupDeltaServer(t, map[string][]byte{"file": randomData(14, 100)})
+	defer os.RemoveAll(dir)
+	defer server.Close()
+
+	signature := bytes.NewBuffer(nil)
+	if err := delta.WriteSignature(signature, bytes.NewReader(nil), 0, delta.MaxSignatureBlockSize*2); err != nil {
+		t.Fatal(err)
+	}
+
+	if response, _ := postSignature(t, server.URL+"/file", signature.Bytes()); response.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected a bad request, got %v", response.Status)
+	}
+}
+
+func TestDeltasAreDisabledByDefault(t *testing.T) {
+	dir, server := setupFileServer(t, map[string][]byte{"file": randomData(15, 100)})
+	defer os.RemoveAll(dir)
+	defer server.Close()
+
+	response, _ := postSignature(t, server.URL+"/file", nil)
+
+	if response.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected deltas to be rejected, got: %v", response.Status)
+	}
+
+	if allow := response.Header.Get("Allow"); allow != "GET, HEAD" {
+		t.Errorf("Unexpected allowed methods: %v", allow)
+	}
+}
+
+func TestDeltasRequireTheToken(t *testing.T) {
+	dir, server := setupDeltaServer(t, map[string][]byte{"file": randomData(16, 100)})
+	defer os.RemoveAll(dir)
+	defer server.Close()
+
+	server.Config.Handler.(*FileServer).Deltas.Token = "secret"
+
+	signature := bytes.NewBuffer(nil)
+	if err := delta.WriteSignature(signature, bytes.NewReader(nil), 0, BLOCK_SIZE); err != nil {
+		t.Fatal(err)
+	}
+
+	for auth, expected := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"Bearer secret": http.StatusOK,
+	} {
+		request, err := http.NewRequest("POST", server.URL+"/file", bytes.NewReader(signature.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("Authorization", auth)
+
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+
+		if response.StatusCode != expected {
+			t.Errorf("Expected %v for %q, got: %v", expected, auth, response.Status)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+/*
+Package server provides HTTP handlers for serving reference files to gosync clients.
+
+FileServer serves the files in a directory with support for range and multi-range requests,
+and generates the .gosync index of any file on demand.
+
+DeltaHandler works in the other direction, like rsync: the client posts the signature of its
+local file, and the server replies with a delta against it.
+*/
+package server
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Redundancy/go-sync/indexfile"
+	"github.com/Redundancy/go-sync/merkle"
+)
+
+// DefaultBlockSize is the block size of generated indexes when none is given
+const DefaultBlockSize = 8192
+
+// IndexSuffix is appended to the path of a file to request its index
+const IndexSuffix = ".gosync"
+
+// DefaultIndexCacheSize is the approximate memory used for cached indexes when none is given
+const DefaultIndexCacheSize = 64 * 1024 * 1024
+
+/*
+FileServer serves the files under Root, and their .gosync indexes.
+
+The index of a file is served for "/path/file?index", or for "/path/file.gosync" when no such
+file exists. Indexes are generated on first request and cached until the file's size or
+modification time changes, or until the least recently used indexes are dropped to keep the cache
+within IndexCacheSize.
+
+Indexes have the root of the Merkle tree of the file's blocks, and the proof for a range of blocks
+is served for "/path/file?proof=<first block>-<last block>".
+
+Every response has a strong ETag derived from the size and modification time of the file,
+so that clients can use If-Range and If-Match to detect a file changing between requests.
+
+POST requests are handled by Deltas and PUT requests by Uploads, if they are set,
+and get a 405 response otherwise.
+*/
+type FileServer struct {
+	Root      string
+	BlockSize uint
+
+	// Creates deltas against the signatures of clients' files. If nil, deltas are not served.
+	Deltas *DeltaHandler
+
+	// Accepts uploads of new versions of files. If nil, files cannot be uploaded.
+	Uploads *UploadHandler
+
+	// The approximate number of bytes of memory to use for cached indexes,
+	// defaults to DefaultIndexCacheSize
+	IndexCacheSize int64
+
+	// guards indexes, recent and cacheSize
+	mutex   sync.Mutex
+	indexes map[string]*cachedIndex
+	// cached indexes, most recently used first
+	recent    list.List
+	cacheSize int64
+}
+
+type cachedIndex struct {
+	sync.Mutex
+	name    string
+	size    int64
+	modTime time.Time
+	content []byte
+	tree    *merkle.Tree
+
+	// the memory used by content and tree, and the place in FileServer.recent
+	// both guarded by FileServer.mutex
+	cost    int64
+	element *list.Element
+}
+
+// NewFileServer serves the files under root, with indexes using blockSize
+func NewFileServer(root string, blockSize uint) *FileServer {
+	if blockSize == 0 {
+		blockSize = DefaultBlockSize
+	}
+
+	return &FileServer{
+		Root:      root,
+		BlockSize: blockSize,
+		indexes:   make(map[string]*cachedIndex),
+	}
+}
+
+func (s *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost && s.Deltas != nil {
+		s.Deltas.ServeHTTP(w, r)
+		return
+	}
+
+	if r.Method == http.MethodPut && s.Uploads != nil {
+		s.Uploads.ServeHTTP(w, r)
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		allow := "GET, HEAD"
+		if s.Deltas != nil {
+			allow += ", POST"
+		}
+		if s.Uploads != nil {
+			allow += ", PUT"
+		}
+
+		w.Header().Set("Allow", allow)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// cleaning a rooted path removes any ".." elements
+	name := path.Clean("/" + r.URL.Path)
+	query := r.URL.Query()
+	_, wantIndex := query["index"]
+	_, wantProof := query[merkle.ProofQuery]
+
+	file, info, err := openFile(s.Root, name)
+
+	if os.IsNotExist(err) && !wantIndex && strings.HasSuffix(name, IndexSuffix) {
+		name = strings.TrimSuffix(name, IndexSuffix)
+		wantIndex = true
+		file, info, err = openFile(s.Root, name)
+	}
+
+	if err != nil {
+		fileError(w, err)
+		return
+	}
+	defer file.Close()
+
+	etag := fileETag(info)
+
+	if wantProof {
+		s.serveProof(w, r, name, file, info, etag)
+		return
+	}
+
+	if !wantIndex {
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+		return
+	}
+
+	index, _, err := s.index(name, file, info)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", s.indexETag(etag))
+	http.ServeContent(w, r, info.Name()+IndexSuffix, info.ModTime(), bytes.NewReader(index))
+}
+
+// indexes depend on the block size as well as the file
+func (s *FileServer) indexETag(etag string) string {
+	return strings.TrimSuffix(etag, `"`) + fmt.Sprintf("-%x\"", s.BlockSize)
+}
+
+// serves the proof for a range of the blocks of a file, against the Merkle root in its index
+func (s *FileServer) serveProof(w http.ResponseWriter, r *http.Request, name string, file io.Reader, info os.FileInfo, etag string) {
+	start, end, ok := parseBlockRange(r.URL.Query().Get(merkle.ProofQuery))
+	if !ok {
+		http.Error(w, "Invalid block range", http.StatusBadRequest)
+		return
+	}
+
+	_, tree, err := s.index(name, file, info)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	proof, err := tree.Proof(start, end)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body := bytes.NewBuffer(nil)
+	merkle.WriteProof(body, proof)
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", s.indexETag(etag))
+	w.Write(body.Bytes())
+}
+
+// parses "<first>-<last>"
+func parseBlockRange(s string) (start, end uint, ok bool) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+
+	first, err1 := strconv.ParseUint(parts[0], 10, 32)
+	last, err2 := strconv.ParseUint(parts[1], 10, 32)
+
+	return uint(first), uint(last), err1 == nil && err2 == nil
+}
+
+// opens a regular file under root by its slash separated path
+func openFile(root, name string) (*os.File, os.FileInfo, error) {
+	file, err := os.Open(filepath.Join(root, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info, err := file.Stat()
+
+	if err == nil && !info.Mode().IsRegular() {
+		err = os.ErrNotExist
+	}
+
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	return file, info, nil
+}
+
+func fileError(w http.ResponseWriter, err error) {
+	switch {
+	case os.IsNotExist(err):
+		http.Error(w, "Not found", http.StatusNotFound)
+	case os.IsPermission(err):
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	default:
+		http.Error(w, "Could not open file", http.StatusInternalServerError)
+	}
+}
+
+// gets the cached index and Merkle tree of a file, regenerating them if the file has changed
+func (s *FileServer) index(name string, file io.Reader, info os.FileInfo) ([]byte, *merkle.Tree, error) {
+	s.mutex.Lock()
+	if s.indexes == nil {
+		s.indexes = make(map[string]*cachedIndex)
+	}
+
+	cached, ok := s.indexes[name]
+	if !ok {
+		cached = &cachedIndex{name: name}
+		s.indexes[name] = cached
+		cached.element = s.recent.PushFront(cached)
+	} else {
+		s.recent.MoveToFront(cached.element)
+	}
+	s.mutex.Unlock()
+
+	// only one request generates the index of a file at a time
+	cached.Lock()
+	defer cached.Unlock()
+
+	if cached.content != nil && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached.content, cached.tree, nil
+	}
+
+	content, tree, err := indexfile.BuildWithTree(file, info.Size(), s.BlockSize)
+	if err != nil {
+		s.drop(cached)
+		return nil, nil, fmt.Errorf("Could not build the index of %v: %v", name, err)
+	}
+
+	cached.content = content
+	cached.tree = tree
+	cached.size = info.Size()
+	cached.modTime = info.ModTime()
+
+	s.setCost(cached, int64(len(content))+tree.Size())
+
+	return cached.content, cached.tree, nil
+}
+
+// records the memory used by a cached index, and drops the least recently used
+// indexes until the cache is within IndexCacheSize
+func (s *FileServer) setCost(cached *cachedIndex, cost int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// the index may have been dropped while it was being built
+	if s.indexes[cached.name] != cached {
+		return
+	}
+
+	s.cacheSize += cost - cached.cost
+	cached.cost = cost
+
+	limit := s.IndexCacheSize
+	if limit <= 0 {
+		limit = DefaultIndexCacheSize
+	}
+
+	for s.cacheSize > limit && s.recent.Len() > 0 {
+		s.remove(s.recent.Back().Value.(*cachedIndex))
+	}
+}
+
+// removes an index from the cache
+func (s *FileServer) drop(cached *cachedIndex) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.indexes[cached.name] == cached {
+		s.remove(cached)
+	}
+}
+
+// the mutex must be held
+func (s *FileServer) remove(cached *cachedIndex) {
+	s.recent.Remove(cached.element)
+	delete(s.indexes, cached.name)
+	s.cacheSize -= cached.cost
+}
+
+// checks for an "Authorization: Bearer <token>" header, in constant time
+func authorized(r *http.Request, token string) bool {
+	given := []byte(r.Header.Get("Authorization"))
+	expected := []byte("Bearer " + token)
+	return subtle.ConstantTimeCompare(given, expected) == 1
+}
+
+// a strong validator that changes with the content of a file, assuming it changes with its modification time
+func fileETag(info os.FileInfo) string {
+	return fmt.Sprintf("\"%x-%x\"", info.Size(), info.ModTime().UnixNano())
+}
@@ -0,0 +1,308 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Redundancy/go-sync/indexfile"
+	"github.com/Redundancy/go-sync/merkle"
+)
+
+const BLOCK_SIZE = 16
+
+func setupFileServer(t *testing.T, files map[string][]byte) (dir string, server *httptest.Server) {
+	dir, err := ioutil.TempDir("", "gosync")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+	}
+
+	return dir, httptest.NewServer(NewFileServer(dir, BLOCK_SIZE))
+}
+
+func randomData(seed int64, size int) []byte {
+	b := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+func get(t *testing.T, url string, headers map[string]string) (*http.Response, []byte) {
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for k, v := range headers {
+		request.Header.Set(k, v)
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return response, body
+}
+
+func TestRangeRequest(t *testing.T) {
+	content := randomData(1, 1000)
+	dir, server := setupFileServer(t, map[string][]byte{"file": content})
+	defer os.RemoveAll(dir)
+	defer server.Close()
+
+	response, body := get(t, server.URL+"/file", map[string]string{"Range": "bytes=100-199"})
+
+	if response.StatusCode != http.StatusPartialContent {
+		t.Fatalf("Unexpected status: %v", response.Status)
+	}
+
+	if !bytes.Equal(body, content[100:200]) {
+		t.Error("Unexpected range content")
+	}
+
+	if response.Header.Get("ETag") == "" {
+		t.Error("Expected an ETag")
+	}
+}
+
+func TestMultiRangeRequest(t *testing.T) {
+	content := randomData(2, 1000)
+	dir, server := setupFileServer(t, map[string][]byte{"file": content})
+	defer os.RemoveAll(dir)
+	defer server.Close()
+
+	response, body := get(t, server.URL+"/file", map[string]string{"Range": "bytes=0-9,500-519"})
+
+	mediaType, params, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("Unexpected content type: %v", response.Header.Get("Content-Type"))
+	}
+
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	var parts [][]byte
+
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			break
+		}
+
+		b, _ := ioutil.ReadAll(part)
+		parts = append(parts, b)
+	}
+
+	if len(parts) != 2 || !bytes.Equal(parts[0], content[:10]) || !bytes.Equal(parts[1], content[500:520]) {
+		t.Errorf("Unexpected parts: %v", parts)
+	}
+}
+
+func TestIfRangeWithChangedFile(t *testing.T) {
+	dir, server := setupFileServer(t, map[string][]byte{"file": randomData(3, 1000)})
+	defer os.RemoveAll(dir)
+	defer server.Close()
+
+	response, _ := get(t, server.URL+"/file", nil)
+	etag := response.Header.Get("ETag")
+
+	response, _ = get(t, server.URL+"/file", map[string]string{"Range": "bytes=0-9", "If-Range": etag})
+	if response.StatusCode != http.StatusPartialContent {
+		t.Errorf("Expected a range with a matching ETag, got: %v", response.Status)
+	}
+
+	changed := randomData(4, 1000)
+	ioutil.WriteFile(filepath.Join(dir, "file"), changed, 0644)
+	os.Chtimes(filepath.Join(dir, "file"), time.Now(), time.Now().Add(time.Hour))
+
+	response, body := get(t, server.URL+"/file", map[string]string{"Range": "bytes=0-9", "If-Range": etag})
+	if response.StatusCode != http.StatusOK || !bytes.Equal(body, changed) {
+		t.Errorf("Expected the whole changed file, got: %v", response.Status)
+	}
+}
+
+func checkIndex(t *testing.T, index []byte, size int64) {
+	if !bytes.HasPrefix(index, []byte(indexfile.MagicString)) {
+		t.Fatal("Index does not start with the magic string")
+	}
+
+	var fileSize int64
+	var blockSize uint32
+	header := bytes.NewReader(index[len(indexfile.MagicString)+6:])
+	binary.Read(header, binary.LittleEndian, &fileSize)
+	binary.Read(header, binary.LittleEndian, &blockSize)
+
+	if fileSize != size || blockSize != BLOCK_SIZE {
+		t.Errorf("Unexpected file size %v or block size %v", fileSize, blockSize)
+	}
+
+	blockCount := (size + BLOCK_SIZE - 1) / BLOCK_SIZE
+	if expected := indexfile.MerkleRootOffset + merkle.HashSize + blockCount*20; int64(len(index)) != expected {
+		t.Errorf("Expected an index of %v bytes, got %v", expected, len(index))
+	}
+}
+
+func TestIndexIsGenerated(t *testing.T) {
+	content := randomData(5, 1000)
+	dir, server := setupFileServer(t, map[string][]byte{"file.bin": content})
+	defer os.RemoveAll(dir)
+	defer server.Close()
+
+	for _, url := range []string{"/file.bin?index", "/file.bin.gosync"} {
+		response, index := get(t, server.URL+url, nil)
+
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("Unexpected status for %v: %v", url, response.Status)
+		}
+
+		checkIndex(t, index, int64(len(content)))
+	}
+}
+
+func TestIndexIsRegeneratedWhenFileChanges(t *testing.T) {
+	dir, server := setupFileServer(t, map[string][]byte{"file": randomData(6, 1000)})
+	defer os.RemoveAll(dir)
+	defer server.Close()
+
+	response, first := get(t, server.URL+"/file?index", nil)
+	firstETag := response.Header.Get("ETag")
+
+	ioutil.WriteFile(filepath.Join(dir, "file"), randomData(7, 2000), 0644)
+	os.Chtimes(filepath.Join(dir, "file"), time.Now(), time.Now().Add(time.Hour))
+
+	response, second := get(t, server.URL+"/file?index", nil)
+	checkIndex(t, second, 2000)
+
+	if bytes.Equal(first, second) || response.Header.Get("ETag") == firstETag {
+		t.Error("Expected a new index and ETag after the file changed")
+	}
+}
+
+func TestExistingIndexFileIsServed(t *testing.T) {
+	dir, server := setupFileServer(t, map[string][]byte{
+		"file":        randomData(8, 100),
+		"file.gosync": []byte("prebuilt"),
+	})
+	defer os.RemoveAll(dir)
+	defer server.Close()
+
+	if _, body := get(t, server.URL+"/file.gosync", nil); string(body) != "prebuilt" {
+		t.Errorf("Expected the existing file to be served, got %q", body)
+	}
+}
+
+func TestIndexCacheIsLimited(t *testing.T) {
+	files := map[string][]byte{}
+	for i := 0; i < 10; i++ {
+		files[fmt.Sprint("file", i)] = randomData(int64(40+i), 1000)
+	}
+
+	dir, server := setupFileServer(t, files)
+	defer os.RemoveAll(dir)
+	defer server.Close()
+
+	handler := NewFileServer(dir, BLOCK_SIZE)
+
+	// room for about three indexes of 1000 bytes
+	handler.IndexCacheSize = 3 * (2000 + 63*2*merkle.HashSize)
+
+	for i := 0; i < 10; i++ {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", fmt.Sprintf("/file%v?index", i), nil))
+
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("Unexpected status: %v", recorder.Code)
+		}
+
+		checkIndex(t, recorder.Body.Bytes(), 1000)
+	}
+
+	if len(handler.indexes) > 3 || handler.recent.Len() != len(handler.indexes) || handler.cacheSize > handler.IndexCacheSize {
+		t.Errorf("Expected at most 3 cached indexes, got %v using %v bytes", len(handler.indexes), handler.cacheSize)
+	}
+
+	if _, ok := handler.indexes["/file9"]; !ok {
+		t.Error("Expected the most recently used index to be cached")
+	}
+}
+
+func TestPathsOutsideRootAreNotServed(t *testing.T) {
+	dir, server := setupFileServer(t, map[string][]byte{"file": randomData(9, 100)})
+	defer os.RemoveAll(dir)
+	defer server.Close()
+
+	handler := NewFileServer(filepath.Join(dir, "sub"), BLOCK_SIZE)
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+
+	for _, p := range []string{"/../file", "/sub/../../file", "/"} {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "http://localhost/", nil)
+		request.URL.Path = p
+		handler.ServeHTTP(recorder, request)
+
+		if recorder.Code != http.StatusNotFound {
+			t.Errorf("Expected %v to be not found, got %v", p, recorder.Code)
+		}
+	}
+}
+
+func TestMerkleProofs(t *testing.T) {
+	content := randomData(30, 1000)
+	dir, server := setupFileServer(t, map[string][]byte{"file": content})
+	defer os.RemoveAll(dir)
+	defer server.Close()
+
+	response, body := get(t, server.URL+"/file?index", nil)
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status: %v", response.Status)
+	}
+
+	idx, err := indexfile.Read(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, expected, _ := merkle.Build(bytes.NewReader(content), BLOCK_SIZE)
+	if !bytes.Equal(idx.MerkleRoot, expected.Root) {
+		t.Fatalf("Unexpected Merkle root in the index: %x", idx.MerkleRoot)
+	}
+
+	index := &merkle.Index{FileSize: idx.FileSize, BlockSize: idx.BlockSize, Root: idx.MerkleRoot}
+
+	verifier := merkle.NewVerifier(index, &merkle.HTTPProofs{URL: server.URL + "/file"})
+
+	if err := verifier.Verify(3, content[48:128]); err != nil {
+		t.Error(err)
+	}
+
+	if err := verifier.Verify(62, content[992:]); err != nil {
+		t.Error(err)
+	}
+
+	for _, r := range []string{"5-2", "0-63", "a-b", "3"} {
+		if response, _ := get(t, server.URL+"/file?proof="+r, nil); response.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected %v to be rejected, got: %v", r, response.Status)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/Redundancy/go-sync/delta"
+)
+
+// DefaultMaxDeltaSize is the largest delta that an UploadHandler accepts when no limit is given
+const DefaultMaxDeltaSize = 1024 * 1024 * 1024
+
+/*
+UploadHandler replaces the files under Root with deltas uploaded by clients, so that a new version
+of a file can be pushed by sending only the data that the server does not already have.
+
+The client creates a delta (see delta.Create) against the index of the server's copy, and PUTs it
+to the path of the file. The delta is applied to a temporary file, which only replaces the file once
+its size and whole-file checksum have been verified, so a failed upload leaves the old version.
+
+Uploads must be conditional on the version the delta was created against: "If-Match" with the ETag
+of the file or its index, or "If-None-Match: *" when there is no file yet. If the file has changed,
+including while the delta was being applied, the response is 412 Precondition Failed.
+
+Any client that can reach the handler can replace any file under Root unless Token is set,
+so it should only be used without a Token behind something that authenticates clients.
+*/
+type UploadHandler struct {
+	Root string
+
+	// The largest delta that will be accepted, defaults to DefaultMaxDeltaSize
+	MaxDeltaSize int64
+
+	// If not empty, uploads must have an "Authorization: Bearer <Token>" header
+	Token string
+
+	// held while checking that a file has not changed and replacing it, so that
+	// concurrent uploads of the same version cannot both succeed
+	mutex sync.Mutex
+}
+
+func (h *UploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		w.Header().Set("Allow", "PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if h.Token != "" && !authorized(r, h.Token) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	name := path.Clean("/" + r.URL.Path)
+	if name == "/" || strings.HasSuffix(name, IndexSuffix) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	ifMatch := r.Header.Get("If-Match")
+	ifNoneMatch := r.Header.Get("If-None-Match")
+
+	if ifMatch == "" && ifNoneMatch != "*" {
+		http.Error(w, "Uploads require If-Match or If-None-Match: *", http.StatusPreconditionRequired)
+		return
+	}
+
+	old, info, err := openFile(h.Root, name)
+
+	switch {
+	case os.IsNotExist(err) && ifMatch == "":
+		// a new file, created from nothing
+	case err != nil:
+		fileError(w, err)
+		return
+	default:
+		defer old.Close()
+	}
+
+	if !matchesPrecondition(ifMatch, ifNoneMatch, info) {
+		http.Error(w, "The file has changed", http.StatusPreconditionFailed)
+		return
+	}
+
+	filename := filepath.Join(h.Root, filepath.FromSlash(name))
+
+	// the temporary file is in the same directory, so that it can be renamed over the file
+	temp, err := ioutil.TempFile(filepath.Dir(filename), ".gosync-upload-")
+	if err != nil {
+		fileError(w, err)
+		return
+	}
+
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+
+	limit := h.MaxDeltaSize
+	if limit <= 0 {
+		limit = DefaultMaxDeltaSize
+	}
+
+	var source io.ReaderAt = emptyFile{}
+	if old != nil {
+		source = old
+	}
+
+	// the open file is read even if it is replaced meanwhile, which is caught below
+	if err = delta.Apply(source, http.MaxBytesReader(w, r.Body, limit), temp); err != nil {
+		http.Error(w, "Could not apply the delta: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err = temp.Close(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	mode := os.FileMode(0644)
+	if old != nil {
+		mode = info.Mode()
+		// some platforms cannot replace an open file
+		old.Close()
+	}
+
+	if err = os.Chmod(temp.Name(), mode); err != nil {
+		http.Error(w, fmt.Sprintf("Could not replace %v: %v", name, err), http.StatusInternalServerError)
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	// the file must still be the version that the delta was applied to
+	current, err := os.Stat(filename)
+	if err != nil && !os.IsNotExist(err) {
+		fileError(w, err)
+		return
+	}
+
+	if !sameVersion(info, current) {
+		http.Error(w, "The file has changed", http.StatusPreconditionFailed)
+		return
+	}
+
+	if err = os.Rename(temp.Name(), filename); err != nil {
+		http.Error(w, fmt.Sprintf("Could not replace %v: %v", name, err), http.StatusInternalServerError)
+		return
+	}
+
+	if newInfo, err := os.Stat(filename); err == nil {
+		w.Header().Set("ETag", fileETag(newInfo))
+	}
+
+	if old == nil {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// matchesPrecondition is true if the upload's preconditions allow replacing the file with info,
+// which is nil if there is no file
+func matchesPrecondition(ifMatch, ifNoneMatch string, info os.FileInfo) bool {
+	if info == nil {
+		return ifMatch == ""
+	}
+	return ifNoneMatch != "*" && matchesFile(ifMatch, info)
+}
+
+// sameVersion is true if both are the same version of a file, or there is no file for either
+func sameVersion(a, b os.FileInfo) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	// a replaced file is a different file, even if it has the same size and time
+	return os.SameFile(a, b) && fileETag(a) == fileETag(b)
+}
+
+// matchesFile is true if etag is the ETag of the file, or of any of its indexes
+func matchesFile(etag string, info os.FileInfo) bool {
+	tag := fileETag(info)
+	return etag == tag || strings.HasPrefix(etag, strings.TrimSuffix(tag, `"`)+"-")
+}
+
+// the old version of a file that does not exist
+type emptyFile struct{}
+
+func (emptyFile) ReadAt(b []byte, off int64) (int, error) {
+	return 0, io.EOF
+}
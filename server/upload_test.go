@@ -0,0 +1,268 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Redundancy/go-sync/delta"
+	"github.com/Redundancy/go-sync/index"
+	"github.com/Redundancy/go-sync/indexfile"
+)
+
+type testReference struct {
+	*index.ChecksumIndex
+	*indexfile.Index
+}
+
+func (r *testReference) GetBlockSize() uint {
+	return r.BlockSize
+}
+
+func (r *testReference) GetFileSize() int64 {
+	return r.FileSize
+}
+
+// gets the index of a file from the server, and creates a delta to content against it
+func makeUpload(t *testing.T, url string, content []byte) (patch []byte, etag string) {
+	response, body := get(t, url+"?index", nil)
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("Could not get the index: %v", response.Status)
+	}
+
+	idx, err := indexfile.Read(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buffer := bytes.NewBuffer(nil)
+	reference := &testReference{index.MakeChecksumIndex(idx.Checksums), idx}
+
+	if err := delta.Create(buffer, reference, bytes.NewReader(content), int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+
+	return buffer.Bytes(), response.Header.Get("ETag")
+}
+
+func put(t *testing.T, url string, body []byte, headers map[string]string) *http.Response {
+	request, err := http.NewRequest("PUT", url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for k, v := range headers {
+		request.Header.Set(k, v)
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	return response
+}
+
+func setupUploadServer(t *testing.T, files map[string][]byte) (dir string, server *httptest.Server) {
+	dir, server = setupFileServer(t, files)
+	server.Config.Handler.(*FileServer).Uploads = &UploadHandler{Root: dir}
+	return dir, server
+}
+
+func TestUploadReplacesFile(t *testing.T) {
+	old := randomData(20, 1000)
+	new := append(append([]byte{}, old[:500]...), []byte("changed")...)
+	new = append(new, old[600:]...)
+
+	dir, server := setupUploadServer(t, map[string][]byte{"file": old})
+	defer os.RemoveAll(dir)
+	defer server.Close()
+
+	patch, etag := makeUpload(t, server.URL+"/file", new)
+
+	if len(patch) > len(new)/2 {
+		t.Errorf("Upload was larger than expected: %v bytes", len(patch))
+	}
+
+	if response := put(t, server.URL+"/file", patch, map[string]string{"If-Match": etag}); response.StatusCode != http.StatusNoContent {
+		t.Fatalf("Unexpected status: %v", response.Status)
+	}
+
+	if content, _ := ioutil.ReadFile(filepath.Join(dir, "file")); !bytes.Equal(content, new) {
+		t.Error("File was not replaced")
+	}
+
+	// the same upload no longer applies to the new version
+	if response := put(t, server.URL+"/file", patch, map[string]string{"If-Match": etag}); response.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("Expected the precondition to fail, got: %v", response.Status)
+	}
+}
+
+func TestUploadCreatesFile(t *testing.T) {
+	dir, server := setupUploadServer(t, nil)
+	defer os.RemoveAll(dir)
+	defer server.Close()
+
+	content := randomData(21, 100)
+	patch := bytes.NewBuffer(nil)
+	empty := &testReference{index.MakeChecksumIndex(nil), &indexfile.Index{BlockSize: BLOCK_SIZE}}
+
+	if err := delta.Create(patch, empty, bytes.NewReader(content), int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+
+	if response := put(t, server.URL+"/new", patch.Bytes(), nil); response.StatusCode != http.StatusPreconditionRequired {
+		t.Errorf("Expected a precondition to be required, got: %v", response.Status)
+	}
+
+	if response := put(t, server.URL+"/new", patch.Bytes(), map[string]string{"If-None-Match": "*"}); response.StatusCode != http.StatusCreated {
+		t.Fatalf("Unexpected status: %v", response.Status)
+	}
+
+	if c, _ := ioutil.ReadFile(filepath.Join(dir, "new")); !bytes.Equal(c, content) {
+		t.Error("File was not created")
+	}
+
+	if response := put(t, server.URL+"/new", patch.Bytes(), map[string]string{"If-None-Match": "*"}); response.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("Expected the existing file not to be replaced, got: %v", response.Status)
+	}
+}
+
+func TestInvalidUploadLeavesFile(t *testing.T) {
+	old := randomData(22, 1000)
+	dir, server := setupUploadServer(t, map[string][]byte{"file": old})
+	defer os.RemoveAll(dir)
+	defer server.Close()
+
+	patch, etag := makeUpload(t, server.URL+"/file", randomData(23, 1000))
+
+	// corrupts the last byte of data, so that the checksum does not match
+	patch[len(patch)-2] ^= 0xFF
+
+	if response := put(t, server.URL+"/file", patch, map[string]string{"If-Match": etag}); response.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected the upload to be rejected, got: %v", response.Status)
+	}
+
+	if response := put(t, server.URL+"/file", patch[:100], map[string]string{"If-Match": etag}); response.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected the truncated upload to be rejected, got: %v", response.Status)
+	}
+
+	if content, _ := ioutil.ReadFile(filepath.Join(dir, "file")); !bytes.Equal(content, old) {
+		t.Error("File was modified")
+	}
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("Temporary files were left behind: %v", len(files))
+	}
+}
+
+func TestUploadsAreDisabledByDefault(t *testing.T) {
+	dir, server := setupFileServer(t, map[string][]byte{"file": randomData(24, 100)})
+	defer os.RemoveAll(dir)
+	defer server.Close()
+
+	if response := put(t, server.URL+"/file", nil, map[string]string{"If-None-Match": "*"}); response.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected uploads to be rejected, got: %v", response.Status)
+	}
+}
+
+func TestUploadsRequireTheToken(t *testing.T) {
+	old := randomData(25, 1000)
+	dir, server := setupUploadServer(t, map[string][]byte{"file": old})
+	defer os.RemoveAll(dir)
+	defer server.Close()
+
+	server.Config.Handler.(*FileServer).Uploads.Token = "secret"
+
+	patch, etag := makeUpload(t, server.URL+"/file", randomData(26, 1000))
+
+	for _, auth := range []string{"", "Bearer wrong"} {
+		headers := map[string]string{"If-Match": etag, "Authorization": auth}
+		if response := put(t, server.URL+"/file", patch, headers); response.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Expected %q to be unauthorized, got: %v", auth, response.Status)
+		}
+	}
+
+	headers := map[string]string{"If-Match": etag, "Authorization": "Bearer secret"}
+	if response := put(t, server.URL+"/file", patch, headers); response.StatusCode != http.StatusNoContent {
+		t.Errorf("Unexpected status: %v", response.Status)
+	}
+}
+
+// changes a file after the first read of the upload body
+type changingReader struct {
+	io.Reader
+	change func()
+}
+
+func (r *changingReader) Read(b []byte) (int, error) {
+	if r.change != nil {
+		r.change()
+		r.change = nil
+	}
+	return r.Reader.Read(b)
+}
+
+func TestFileChangedDuringUploadIsKept(t *testing.T) {
+	old := randomData(27, 1000)
+	dir, server := setupUploadServer(t, map[string][]byte{"file": old})
+	defer os.RemoveAll(dir)
+	defer server.Close()
+
+	patch, etag := makeUpload(t, server.URL+"/file", randomData(28, 1000))
+	changed := randomData(29, 1000)
+	filename := filepath.Join(dir, "file")
+
+	body := &changingReader{
+		Reader: bytes.NewReader(patch),
+		change: func() {
+			// replaces the file, as another upload would
+			temp := filename + ".tmp"
+			if err := ioutil.WriteFile(temp, changed, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Rename(temp, filename); err != nil {
+				t.Fatal(err)
+			}
+		},
+	}
+
+	request := httptest.NewRequest("PUT", "http://localhost/file", body)
+	request.Header.Set("If-Match", etag)
+	recorder := httptest.NewRecorder()
+
+	(&UploadHandler{Root: dir}).ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected the precondition to fail, got: %v", recorder.Code)
+	}
+
+	if content, _ := ioutil.ReadFile(filename); !bytes.Equal(content, changed) {
+		t.Error("The changed file was replaced")
+	}
+}
+
+func TestLargeUploadIsRejected(t *testing.T) {
+	old := randomData(30, 1000)
+	dir, server := setupUploadServer(t, map[string][]byte{"file": old})
+	defer os.RemoveAll(dir)
+	defer server.Close()
+
+	server.Config.Handler.(*FileServer).Uploads.MaxDeltaSize = 100
+
+	patch, etag := makeUpload(t, server.URL+"/file", randomData(31, 1000))
+
+	if response := put(t, server.URL+"/file", patch, map[string]string{"If-Match": etag}); response.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected the upload to be rejected, got: %v", response.Status)
+	}
+
+	if content, _ := ioutil.ReadFile(filepath.Join(dir, "file")); !bytes.Equal(content, old) {
+		t.Error("File was modified")
+	}
+}
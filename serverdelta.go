@@ -0,0 +1,110 @@
+package gosync
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/Redundancy/go-sync/blocksources"
+	"github.com/Redundancy/go-sync/delta"
+	"github.com/Redundancy/go-sync/filechecksum"
+	"github.com/Redundancy/go-sync/patcher"
+	"github.com/Redundancy/go-sync/patcher/sequential"
+)
+
+/*
+PatchFromServerDelta patches InputFile into OutFile by asking the server at Source (such as
+"gosync serve") for a delta against the signature of InputFile, with blocks of BlockSize.
+
+Unlike MakeRSync, the reference index is never downloaded, and the matching is done by the server.
+This is better when the local file is much smaller than the reference.
+The output is verified against the checksum in the delta before OutFile is replaced.
+
+The delta is returned, without its data, so that callers can report how much of the reference was reused.
+*/
+func PatchFromServerDelta(
+	InputFile,
+	Source,
+	OutFile string,
+	BlockSize uint,
+	Options blocksources.HttpOptions,
+) (patch *delta.Patch, err error) {
+	inputFile, err := os.Open(InputFile)
+	if err != nil {
+		return nil, err
+	}
+	defer inputFile.Close()
+
+	info, err := inputFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	source, requester := blocksources.NewDeltaBlockSource(
+		Source,
+		inputFile,
+		info.Size(),
+		BlockSize,
+		filepath.Dir(OutFile),
+		Options,
+	)
+	defer source.Close()
+	defer requester.Close()
+
+	if patch, err = requester.Patch(); err != nil {
+		return nil, err
+	}
+
+	out, outFilename, err := getTempFile(filepath.Dir(OutFile))
+	if err != nil {
+		return nil, err
+	}
+
+	copier := &fileCopyCloser{
+		from: outFilename,
+		to:   OutFile,
+	}
+
+	defer func() {
+		if err != nil {
+			out.Close()
+			copier.Abort()
+			copier.Close()
+		}
+	}()
+
+	output := newVerifyingWriter(out, filechecksum.DefaultFileHashGenerator())
+
+	// every block comes from the source, which reads the local file itself where it can
+	if blockCount := (patch.FileSize + int64(BlockSize) - 1) / int64(BlockSize); blockCount > 0 {
+		err = sequential.SequentialPatcher(
+			inputFile,
+			source,
+			[]patcher.MissingBlockSpan{
+				{
+					StartBlock: 0,
+					EndBlock:   uint(blockCount - 1),
+					BlockSize:  int64(BlockSize),
+				},
+			},
+			nil,
+			20*megabyte,
+			output,
+		)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err = output.verify(patch.FileSize, patch.FileChecksum); err != nil {
+		return nil, err
+	}
+
+	if err = out.Close(); err != nil {
+		return nil, err
+	}
+
+	// the input may be the output, so it is closed before being replaced
+	inputFile.Close()
+	return patch, copier.Close()
+}
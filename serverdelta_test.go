@@ -0,0 +1,68 @@
+package gosync
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/Redundancy/go-sync/blocksources"
+	"github.com/Redundancy/go-sync/server"
+)
+
+func makeDeltaServer(dir string) *server.FileServer {
+	fileServer := server.NewFileServer(dir, 0)
+	fileServer.Deltas = &server.DeltaHandler{Root: dir}
+	return fileServer
+}
+
+func TestPatchFromServerDelta(t *testing.T) {
+	reference := randomString(1, 20000)
+
+	for name, local := range map[string]string{
+		"similar":          reference[5000:15000] + "changed" + reference[:3000],
+		"smaller than one": reference[:10],
+		"empty":            "",
+		"unrelated":        randomString(2, 5000),
+	} {
+		dir, paths := writeTestFiles(t, reference, local)
+		defer os.RemoveAll(dir)
+
+		localPath := paths[1]
+
+		s := httptest.NewServer(makeDeltaServer(dir))
+		defer s.Close()
+
+		patch, err := PatchFromServerDelta(localPath, s.URL+"/a", localPath, 512, blocksources.HttpOptions{})
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+
+		if content, _ := ioutil.ReadFile(localPath); string(content) != reference {
+			t.Errorf("%v: the local file was not patched", name)
+		}
+
+		if name == "similar" && patch.CopiedBytes() < 12000 {
+			t.Errorf("%v: only %v bytes were reused", name, patch.CopiedBytes())
+		}
+	}
+}
+
+func TestPatchFromServerDeltaOfMissingFile(t *testing.T) {
+	dir, paths := writeTestFiles(t, LOCAL_VERSION)
+	defer os.RemoveAll(dir)
+
+	localPath := paths[0]
+
+	s := httptest.NewServer(makeDeltaServer(dir))
+	defer s.Close()
+
+	_, err := PatchFromServerDelta(localPath, s.URL+"/missing", localPath, BLOCK_SIZE, blocksources.HttpOptions{})
+	if _, ok := err.(blocksources.URLNotFoundError); !ok {
+		t.Errorf("Expected a not found error, got: %v", err)
+	}
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("Unexpected files left behind: %v", len(files))
+	}
+}
@@ -0,0 +1,173 @@
+/*
+Package signing signs indexes with ed25519 keys, so that an index fetched over an untrusted
+channel can be checked against keys that are trusted before it is used for patching.
+
+The data of a file can only be verified against its index, so anyone able to change the index
+can change the result of patching. A signature covers every byte of the index, including the
+file size, block size and whole-file checksum in its header, and is kept in a separate file
+(by convention the name of the index followed by ".sig"), so that any index format can be signed.
+
+A signature file (all integers little endian) is:
+
+	magic "GSYNCIXS", uint8 version, the 32 byte public key, the 64 byte signature
+
+The public key identifies the signer, but the signature is only accepted if that key is trusted.
+Keys are stored as PEM encoded PKCS #8 private keys and PKIX public keys, as written
+by "openssl genpkey -algorithm ed25519" and "openssl pkey -pubout".
+*/
+package signing
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	signatureMagic   = "GSYNCIXS"
+	signatureVersion = uint8(1)
+
+	// signatures are over this prefix and the index, so that they cannot be used for anything else
+	context = "gosync index signature\x00"
+)
+
+// SignatureSize is the size of a signature file
+const SignatureSize = len(signatureMagic) + 1 + ed25519.PublicKeySize + ed25519.SignatureSize
+
+var ErrInvalidSignature = errors.New("Data is not a valid index signature")
+var ErrBadSignature = errors.New("Index signature does not match the index")
+var ErrUntrustedKey = errors.New("Index is signed by a key that is not trusted")
+
+func message(index []byte) []byte {
+	return append([]byte(context), index...)
+}
+
+// Sign creates the signature file for index
+func Sign(key ed25519.PrivateKey, index []byte) []byte {
+	signature := bytes.NewBuffer(make([]byte, 0, SignatureSize))
+
+	signature.WriteString(signatureMagic)
+	signature.WriteByte(signatureVersion)
+	signature.Write(key.Public().(ed25519.PublicKey))
+	signature.Write(ed25519.Sign(key, message(index)))
+
+	return signature.Bytes()
+}
+
+/*
+Verify checks that signature is a valid signature of index, by one of the trusted keys.
+It returns the key that signed the index.
+*/
+func Verify(trusted []ed25519.PublicKey, index []byte, signature []byte) (ed25519.PublicKey, error) {
+	if len(signature) != SignatureSize || string(signature[:len(signatureMagic)]) != signatureMagic {
+		return nil, ErrInvalidSignature
+	}
+
+	if v := signature[len(signatureMagic)]; v != signatureVersion {
+		return nil, fmt.Errorf("Unsupported index signature version: %v", v)
+	}
+
+	keyStart := len(signatureMagic) + 1
+	key := ed25519.PublicKey(signature[keyStart : keyStart+ed25519.PublicKeySize])
+
+	isTrusted := false
+	for _, k := range trusted {
+		if bytes.Equal(k, key) {
+			isTrusted = true
+		}
+	}
+
+	if !isTrusted {
+		return nil, ErrUntrustedKey
+	}
+
+	if !ed25519.Verify(key, message(index), signature[keyStart+ed25519.PublicKeySize:]) {
+		return nil, ErrBadSignature
+	}
+
+	return key, nil
+}
+
+// GenerateKey creates a new key for signing indexes
+func GenerateKey() (ed25519.PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	return key, err
+}
+
+func readPEM(r io.Reader, blockType string) ([]byte, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != blockType {
+		return nil, fmt.Errorf("Expected a PEM encoded %v", blockType)
+	}
+
+	return block.Bytes, nil
+}
+
+// ReadPrivateKey reads a PEM encoded ed25519 private key
+func ReadPrivateKey(r io.Reader) (ed25519.PrivateKey, error) {
+	der, err := readPEM(r, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	if k, ok := key.(ed25519.PrivateKey); ok {
+		return k, nil
+	}
+
+	return nil, errors.New("Private key is not an ed25519 key")
+}
+
+// ReadPublicKey reads a PEM encoded ed25519 public key
+func ReadPublicKey(r io.Reader) (ed25519.PublicKey, error) {
+	der, err := readPEM(r, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	if k, ok := key.(ed25519.PublicKey); ok {
+		return k, nil
+	}
+
+	return nil, errors.New("Public key is not an ed25519 key")
+}
+
+// WritePrivateKey writes a private key in PEM encoding
+func WritePrivateKey(w io.Writer, key ed25519.PrivateKey) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	return pem.Encode(w, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+// WritePublicKey writes a public key in PEM encoding
+func WritePublicKey(w io.Writer, key ed25519.PublicKey) error {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return err
+	}
+
+	return pem.Encode(w, &pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
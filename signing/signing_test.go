@@ -0,0 +1,99 @@
+package signing
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+)
+
+func makeKey(t *testing.T) ed25519.PrivateKey {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestSignAndVerify(t *testing.T) {
+	key := makeKey(t)
+	public := key.Public().(ed25519.PublicKey)
+	index := []byte("G0S9NC an index")
+
+	signature := Sign(key, index)
+
+	if len(signature) != SignatureSize {
+		t.Errorf("Unexpected signature size: %v", len(signature))
+	}
+
+	signer, err := Verify([]ed25519.PublicKey{makeKey(t).Public().(ed25519.PublicKey), public}, index, signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(signer, public) {
+		t.Error("Unexpected signer")
+	}
+}
+
+func TestVerifyFailures(t *testing.T) {
+	key := makeKey(t)
+	trusted := []ed25519.PublicKey{key.Public().(ed25519.PublicKey)}
+	index := []byte("G0S9NC an index")
+	signature := Sign(key, index)
+
+	changed := append([]byte{}, index...)
+	changed[len(changed)-1] ^= 1
+
+	if _, err := Verify(trusted, changed, signature); err != ErrBadSignature {
+		t.Errorf("Expected a changed index to fail, got: %v", err)
+	}
+
+	if _, err := Verify(trusted, index, Sign(makeKey(t), index)); err != ErrUntrustedKey {
+		t.Errorf("Expected another key not to be trusted, got: %v", err)
+	}
+
+	if _, err := Verify(nil, index, signature); err != ErrUntrustedKey {
+		t.Errorf("Expected no key to be trusted, got: %v", err)
+	}
+
+	for _, s := range [][]byte{nil, signature[:len(signature)-1], append([]byte("X"), signature[1:]...)} {
+		if _, err := Verify(trusted, index, s); err != ErrInvalidSignature {
+			t.Errorf("Expected an invalid signature, got: %v", err)
+		}
+	}
+
+	// the public key in the signature is trusted, but the signature is by another key
+	forged := append([]byte{}, Sign(makeKey(t), index)...)
+	copy(forged[len(signatureMagic)+1:], trusted[0])
+
+	if _, err := Verify(trusted, index, forged); err != ErrBadSignature {
+		t.Errorf("Expected a forged signature to fail, got: %v", err)
+	}
+}
+
+func TestKeyEncoding(t *testing.T) {
+	key := makeKey(t)
+	buffer := bytes.NewBuffer(nil)
+
+	if err := WritePrivateKey(buffer, key); err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := ReadPrivateKey(buffer)
+	if err != nil || !bytes.Equal(key, read) {
+		t.Fatalf("Private key was not read back: %v", err)
+	}
+
+	if err := WritePublicKey(buffer, key.Public().(ed25519.PublicKey)); err != nil {
+		t.Fatal(err)
+	}
+
+	public, err := ReadPublicKey(bytes.NewReader(buffer.Bytes()))
+	if err != nil || !bytes.Equal(public, key.Public().(ed25519.PublicKey)) {
+		t.Fatalf("Public key was not read back: %v", err)
+	}
+
+	if _, err := ReadPrivateKey(bytes.NewReader(buffer.Bytes())); err == nil {
+		t.Error("Expected a public key not to be read as a private key")
+	}
+}
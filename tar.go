@@ -0,0 +1,109 @@
+package gosync
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+
+	"github.com/Redundancy/go-sync/blocksources"
+	"github.com/Redundancy/go-sync/filechecksum"
+	"github.com/Redundancy/go-sync/tarsync"
+)
+
+/*
+PatchTar recreates the tar file of Index in OutFile, using blocks found in InputFile and the
+SeedFiles in Options, which are compared a member at a time if they are tar files.
+Blocks that are not found locally are requested from Source.
+
+The output is verified against the checksum in the index before OutFile is replaced.
+The offsets of the blocks found in each local file are returned, so that callers can report
+how much was reused with Index.Reuse.
+*/
+func PatchTar(
+	InputFile,
+	Source,
+	OutFile string,
+	Index *tarsync.Index,
+	Options RSyncOptions,
+) (matches [][]int64, err error) {
+	matcher := tarsync.NewMatcher(Index)
+	var inputs []tarsync.Input
+	var files []*os.File
+
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	for _, path := range append([]string{InputFile}, Options.SeedFiles...) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+
+		info, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+
+		found, err := matcher.FindMatches(f, tarsync.LocalLayout(f, info.Size()))
+		if err != nil {
+			return nil, err
+		}
+
+		inputs = append(inputs, tarsync.Input{File: f, Matches: found})
+		matches = append(matches, found)
+	}
+
+	var requester blocksources.BlockSourceRequester = Options.Requester
+	if requester == nil {
+		requester = blocksources.NewHttpRequester(Source, Options.HTTP)
+	}
+
+	out, outFilename, err := getTempFile(filepath.Dir(OutFile))
+	if err != nil {
+		return nil, err
+	}
+
+	copier := &fileCopyCloser{
+		from: outFilename,
+		to:   OutFile,
+	}
+
+	defer func() {
+		if err != nil {
+			out.Close()
+			copier.Abort()
+			copier.Close()
+		}
+	}()
+
+	buffered := bufio.NewWriterSize(out, megabyte)
+	output := newVerifyingWriter(buffered, filechecksum.DefaultFileHashGenerator())
+
+	if err = tarsync.Patch(output, Index, inputs, requester); err != nil {
+		return nil, err
+	}
+
+	if err = buffered.Flush(); err != nil {
+		return nil, err
+	}
+
+	if err = output.verify(Index.FileSize, Index.FileChecksum); err != nil {
+		return nil, err
+	}
+
+	if err = out.Close(); err != nil {
+		return nil, err
+	}
+
+	// the input may be the output, so it is closed before being replaced
+	for _, f := range files {
+		f.Close()
+	}
+	files = nil
+
+	return matches, copier.Close()
+}
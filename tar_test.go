@@ -0,0 +1,81 @@
+package gosync
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/Redundancy/go-sync/server"
+	"github.com/Redundancy/go-sync/tarsync"
+)
+
+func tarString(t *testing.T, members ...string) string {
+	b := bytes.NewBuffer(nil)
+	w := tar.NewWriter(b)
+
+	for i := 0; i < len(members); i += 2 {
+		content := members[i+1]
+
+		if err := w.WriteHeader(&tar.Header{Name: members[i], Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return b.String()
+}
+
+func TestPatchTar(t *testing.T) {
+	a, b, c := randomString(9, 30000), randomString(10, 5000), randomString(11, 70000)
+	reference := tarString(t, "a", a, "b", b, "c", c)
+
+	// a new member moves the others by an amount that is not a multiple of the block size
+	local := tarString(t, "new", randomString(12, 777), "a", a, "c", c)
+
+	// the missing member is in a seed
+	seed := tarString(t, "b", b)
+
+	dir, paths := writeTestFiles(t, reference, local, seed)
+	defer os.RemoveAll(dir)
+
+	s := httptest.NewServer(server.NewFileServer(dir, 0))
+	defer s.Close()
+
+	index, err := tarsync.Build(bytes.NewReader([]byte(reference)), int64(len(reference)), 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matches, err := PatchTar(paths[1], s.URL+"/a", paths[1], index, RSyncOptions{SeedFiles: paths[2:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if content, _ := ioutil.ReadFile(paths[1]); string(content) != reference {
+		t.Error("The local file was not patched")
+	}
+
+	for _, m := range index.Reuse(matches...) {
+		if m.Reused != m.Size {
+			t.Errorf("Expected all of %v to be reused: %+v", m.Name, m)
+		}
+	}
+
+	if reuse := index.Reuse(matches[0]); reuse[1].Reused != 0 {
+		t.Errorf("Expected b not to be in the local file: %+v", reuse[1])
+	}
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 3 {
+		t.Errorf("Temporary output was not removed: %v", len(files))
+	}
+}
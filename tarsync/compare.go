@@ -0,0 +1,121 @@
+package tarsync
+
+import (
+	"bufio"
+	"io"
+	"sync/atomic"
+
+	"github.com/Redundancy/go-sync/comparer"
+	"github.com/Redundancy/go-sync/filechecksum"
+	"github.com/Redundancy/go-sync/index"
+)
+
+// NotFound is the offset of a block that was not found in a local file
+const NotFound = int64(-1)
+
+const readBufferSize = 1024 * 1024
+
+/*
+Matcher compares local files to a tar index. Each segment of a local file is compared on its own,
+as if it was a whole file, so that blocks of the index (which never cross a segment) can match the
+start and the short end of each segment.
+*/
+type Matcher struct {
+	// Statistics for all of the comparisons
+	comparer.Comparer
+
+	index     *Index
+	checksums *index.ChecksumIndex
+}
+
+// NewMatcher creates a Matcher for the blocks of an index
+func NewMatcher(i *Index) *Matcher {
+	return &Matcher{
+		index:     i,
+		checksums: i.ChecksumIndex(),
+	}
+}
+
+/*
+FindMatches compares each segment of the local file in the layout with the index, and returns the
+offset in the local file of each block of the index, or NotFound.
+*/
+func (m *Matcher) FindMatches(local io.ReaderAt, layout *Layout) ([]int64, error) {
+	matches := make([]int64, m.index.BlockCount())
+	for i := range matches {
+		matches[i] = NotFound
+	}
+
+	found := func(block uint, offset int64) {
+		if matches[block] == NotFound {
+			matches[block] = offset
+		}
+	}
+
+	for _, s := range layout.Segments {
+		if s.Size < int64(m.index.BlockSize) {
+			if err := m.findShortSegment(local, s, found); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		results := m.StartFindMatchingBlocks(
+			bufio.NewReaderSize(io.NewSectionReader(local, s.Offset, s.Size), readBufferSize),
+			s.Offset,
+			filechecksum.NewFileChecksumGenerator(m.index.BlockSize),
+			m.checksums,
+		)
+
+		var err error
+		for result := range results {
+			if result.Err != nil {
+				err = result.Err
+			} else {
+				found(result.BlockIdx, result.ComparisonOffset)
+			}
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return matches, nil
+}
+
+// a segment smaller than a block can only match a block of the same size, so it is compared once
+func (m *Matcher) findShortSegment(local io.ReaderAt, s Segment, found func(uint, int64)) error {
+	data := make([]byte, s.Size)
+	if _, err := local.ReadAt(data, s.Offset); err != nil {
+		return err
+	}
+
+	generator := filechecksum.NewFileChecksumGenerator(m.index.BlockSize)
+	weak := make([]byte, generator.WeakRollingHash.Size())
+	generator.WeakRollingHash.SetBlock(data)
+	generator.WeakRollingHash.GetSum(weak)
+
+	atomic.AddInt64(&m.Comparisons, 1)
+
+	weakMatches := m.checksums.FindWeakChecksum2(weak)
+	if weakMatches == nil {
+		return nil
+	}
+
+	atomic.AddInt64(&m.WeakHashHits, 1)
+
+	strong := generator.GetStrongHash()
+	strong.Write(data)
+
+	strongMatches := m.checksums.FindStrongChecksum2(strong.Sum(nil), weakMatches)
+	if len(strongMatches) > 0 {
+		atomic.AddInt64(&m.StrongHashHits, 1)
+	}
+
+	for _, match := range strongMatches {
+		found(match.ChunkOffset, s.Offset)
+	}
+
+	return nil
+}
@@ -0,0 +1,275 @@
+package tarsync
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/Redundancy/go-sync/chunks"
+	"github.com/Redundancy/go-sync/filechecksum"
+	"github.com/Redundancy/go-sync/index"
+)
+
+/*
+The format of a tar index (all integers little endian) is:
+
+	magic "GSYNCTAR", uint8 version, int64 file size, uint32 block size, the MD5 of the file,
+	uint32 segment count, then for each segment: uint8 kind, int64 size, uint16 name length, the name
+
+followed by the weak (4 bytes) and strong (16 bytes) checksums of each block, as in a .gosync index.
+The offsets of segments, and the blocks in them, follow from their sizes.
+*/
+const (
+	MagicString  = "GSYNCTAR"
+	indexVersion = uint8(1)
+)
+
+var ErrInvalidIndex = errors.New("Data is not a valid tar index")
+
+// Index has the checksums of the blocks of a tar file, which are aligned to its segments
+type Index struct {
+	FileSize     int64
+	BlockSize    uint
+	FileChecksum []byte
+	Segments     []Segment
+
+	// The checksums of each block in order, with the size of the block
+	Checksums []chunks.ChunkChecksum
+
+	// the offset of each block in the file
+	offsets []int64
+}
+
+// calls f with the offset and size of each block of the segments, in order
+func eachBlock(segments []Segment, blockSize uint, f func(offset, size int64) error) error {
+	for _, s := range segments {
+		for offset := s.Offset; offset < s.Offset+s.Size; offset += int64(blockSize) {
+			size := s.Offset + s.Size - offset
+			if size > int64(blockSize) {
+				size = int64(blockSize)
+			}
+
+			if err := f(offset, size); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// adds a block, with its checksums
+func (i *Index) add(offset, size int64, weak, strong []byte) {
+	i.Checksums = append(i.Checksums, chunks.ChunkChecksum{
+		ChunkOffset:    uint(len(i.Checksums)),
+		Size:           size,
+		WeakChecksum:   weak,
+		StrongChecksum: strong,
+	})
+	i.offsets = append(i.offsets, offset)
+}
+
+// BlockCount is the number of blocks in the file
+func (i *Index) BlockCount() uint {
+	return uint(len(i.Checksums))
+}
+
+// Block returns the offset and size of a block
+func (i *Index) Block(block uint) (offset int64, size int64) {
+	return i.offsets[block], i.Checksums[block].Size
+}
+
+// ChecksumIndex builds an index of the checksums of the blocks, for the comparer
+func (i *Index) ChecksumIndex() *index.ChecksumIndex {
+	return index.MakeChecksumIndex(i.Checksums)
+}
+
+/*
+Build reads the tar file in r, of size bytes, and creates its index.
+The block size must be a multiple of RecordSize, so that every block starts on a record.
+*/
+func Build(r io.ReaderAt, size int64, blockSize uint) (*Index, error) {
+	if blockSize == 0 || blockSize%RecordSize != 0 {
+		return nil, fmt.Errorf("The block size of a tar index must be a multiple of %v", RecordSize)
+	}
+
+	layout, err := ReadLayout(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, err
+	}
+
+	if layout.Size != size {
+		return nil, fmt.Errorf("Tar file is %v bytes, expected %v", layout.Size, size)
+	}
+
+	i := &Index{FileSize: size, BlockSize: blockSize, Segments: layout.Segments}
+	generator := filechecksum.NewFileChecksumGenerator(blockSize)
+	fileHash := generator.GetFileHash()
+	strongHash := generator.GetStrongHash()
+	buffer := make([]byte, blockSize)
+
+	err = eachBlock(layout.Segments, blockSize, func(offset, length int64) error {
+		data := buffer[:length]
+
+		if _, err := r.ReadAt(data, offset); err != nil {
+			return err
+		}
+
+		fileHash.Write(data)
+
+		weak := make([]byte, generator.WeakRollingHash.Size())
+		generator.WeakRollingHash.SetBlock(data)
+		generator.WeakRollingHash.GetSum(weak)
+
+		strongHash.Reset()
+		strongHash.Write(data)
+
+		i.add(offset, length, weak, strongHash.Sum(nil))
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	i.FileChecksum = fileHash.Sum(nil)
+	return i, nil
+}
+
+// Write writes the index
+func (i *Index) Write(w io.Writer) error {
+	buffered := bufio.NewWriter(w)
+
+	if _, err := buffered.WriteString(MagicString); err != nil {
+		return err
+	}
+
+	values := []interface{}{
+		indexVersion,
+		i.FileSize,
+		uint32(i.BlockSize),
+		i.FileChecksum,
+		uint32(len(i.Segments)),
+	}
+
+	for _, s := range i.Segments {
+		if len(s.Name) > math.MaxUint16 {
+			return fmt.Errorf("The name of a tar member is too long: %v bytes", len(s.Name))
+		}
+
+		values = append(values, uint8(s.Kind), s.Size, uint16(len(s.Name)), []byte(s.Name))
+	}
+
+	for _, v := range values {
+		if err := binary.Write(buffered, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+
+	for _, c := range i.Checksums {
+		buffered.Write(c.WeakChecksum)
+		buffered.Write(c.StrongChecksum)
+	}
+
+	return buffered.Flush()
+}
+
+// ReadIndex reads an index written by Index.Write
+func ReadIndex(r io.Reader) (*Index, error) {
+	reader := bufio.NewReader(r)
+
+	magic := make([]byte, len(MagicString))
+	if _, err := io.ReadFull(reader, magic); err != nil || string(magic) != MagicString {
+		return nil, ErrInvalidIndex
+	}
+
+	var version uint8
+	if err := binary.Read(reader, binary.LittleEndian, &version); err != nil {
+		return nil, ErrInvalidIndex
+	} else if version != indexVersion {
+		return nil, fmt.Errorf("Unsupported tar index version: %v", version)
+	}
+
+	generator := filechecksum.NewFileChecksumGenerator(RecordSize)
+	weakSize, strongSize := generator.GetChecksumSizes()
+
+	var size int64
+	var blockSize, segmentCount uint32
+	fileChecksum := make([]byte, generator.GetFileHash().Size())
+
+	for _, v := range []interface{}{&size, &blockSize, fileChecksum, &segmentCount} {
+		if err := binary.Read(reader, binary.LittleEndian, v); err != nil {
+			return nil, ErrInvalidIndex
+		}
+	}
+
+	if blockSize == 0 || blockSize%RecordSize != 0 {
+		return nil, ErrInvalidIndex
+	}
+
+	var segments []Segment
+	offset := int64(0)
+
+	for n := uint32(0); n < segmentCount; n++ {
+		var kind uint8
+		var nameLength uint16
+		s := Segment{Offset: offset}
+
+		for _, v := range []interface{}{&kind, &s.Size, &nameLength} {
+			if err := binary.Read(reader, binary.LittleEndian, v); err != nil {
+				return nil, ErrInvalidIndex
+			}
+		}
+
+		name := make([]byte, nameLength)
+		if _, err := io.ReadFull(reader, name); err != nil {
+			return nil, ErrInvalidIndex
+		}
+
+		if SegmentKind(kind) > Trailer || s.Size <= 0 || s.Size > size-offset {
+			return nil, ErrInvalidIndex
+		}
+
+		s.Kind = SegmentKind(kind)
+		s.Name = string(name)
+		segments = append(segments, s)
+		offset += s.Size
+	}
+
+	if offset != size {
+		return nil, ErrInvalidIndex
+	}
+
+	i := &Index{
+		FileSize:     size,
+		BlockSize:    uint(blockSize),
+		FileChecksum: fileChecksum,
+		Segments:     segments,
+	}
+
+	// the checksums are read as blocks are added, so that an index cannot claim more blocks than it has
+	err := eachBlock(segments, uint(blockSize), func(offset, length int64) error {
+		weak := make([]byte, weakSize)
+		strong := make([]byte, strongSize)
+
+		if _, err := io.ReadFull(reader, weak); err != nil {
+			return ErrInvalidIndex
+		}
+
+		if _, err := io.ReadFull(reader, strong); err != nil {
+			return ErrInvalidIndex
+		}
+
+		i.add(offset, length, weak, strong)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return i, nil
+}
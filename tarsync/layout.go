@@ -0,0 +1,133 @@
+/*
+Package tarsync indexes tar files with blocks that are aligned to the members of the archive.
+
+When a tar file is built again with members that have changed, the members that follow move by
+amounts that are not multiples of the block size, and their headers land in the middle of blocks,
+so few of the blocks of a plain index match. A tar index instead splits the archive into segments:
+the headers of each member, the data of each member, and the end of the archive. Blocks never cross
+a segment, so the data of each member starts a new block, and the last block of each segment
+may be short.
+
+The local file is compared a segment at a time in the same way, so that unchanged members match
+wherever they are in either archive.
+*/
+package tarsync
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// RecordSize is the size of the records of a tar file, which every segment starts on
+const RecordSize = 512
+
+var ErrNotTar = errors.New("File is not a tar file")
+
+// SegmentKind is the kind of content in a segment
+type SegmentKind uint8
+
+const (
+	// The header records of a member, including any PAX or GNU records for it
+	Header SegmentKind = iota
+	// The content of a member, padded to a whole record
+	Data
+	// The records that mark the end of the archive, and any padding after them
+	Trailer
+)
+
+// Segment is a range of a tar file that blocks do not cross
+type Segment struct {
+	Kind SegmentKind
+	// The name of the member that a header or data segment belongs to
+	Name   string
+	Offset int64
+	Size   int64
+}
+
+// Layout is the segments of a tar file, which cover all of it in order
+type Layout struct {
+	Size     int64
+	Segments []Segment
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+func roundUp(n int64) int64 {
+	return (n + RecordSize - 1) / RecordSize * RecordSize
+}
+
+// ReadLayout reads a tar file, and finds its segments. It returns ErrNotTar if r is not a tar file.
+func ReadLayout(r io.Reader) (*Layout, error) {
+	counter := &countingReader{r: r}
+	reader := tar.NewReader(counter)
+	layout := &Layout{}
+	end := int64(0)
+
+	for {
+		header, err := reader.Next()
+
+		if err == io.EOF {
+			break
+		} else if (err == tar.ErrHeader || err == io.ErrUnexpectedEOF) && len(layout.Segments) == 0 {
+			return nil, ErrNotTar
+		} else if err != nil {
+			return nil, err
+		}
+
+		dataStart := counter.n
+		layout.add(Segment{Kind: Header, Name: header.Name, Offset: end, Size: dataStart - end})
+
+		// the physical size of the data is only known by reading it, since sparse files have holes
+		if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+			return nil, err
+		}
+
+		end = roundUp(counter.n)
+		layout.add(Segment{Kind: Data, Name: header.Name, Offset: dataStart, Size: end - dataStart})
+	}
+
+	if _, err := io.Copy(ioutil.Discard, counter); err != nil {
+		return nil, err
+	}
+
+	if len(layout.Segments) == 0 && counter.n == 0 {
+		return nil, ErrNotTar
+	}
+
+	layout.Size = counter.n
+	layout.add(Segment{Kind: Trailer, Offset: end, Size: layout.Size - end})
+
+	return layout, nil
+}
+
+// empty segments are left out, such as the data of a directory
+func (l *Layout) add(s Segment) {
+	if s.Size > 0 {
+		l.Segments = append(l.Segments, s)
+	}
+}
+
+/*
+LocalLayout reads the layout of a local file to compare to an index.
+If it is not a tar file, or it cannot be read as one, the whole file is one segment.
+*/
+func LocalLayout(r io.ReaderAt, size int64) *Layout {
+	if layout, err := ReadLayout(io.NewSectionReader(r, 0, size)); err == nil && layout.Size == size {
+		return layout
+	}
+
+	layout := &Layout{Size: size}
+	layout.add(Segment{Kind: Data, Offset: 0, Size: size})
+	return layout
+}
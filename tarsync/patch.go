@@ -0,0 +1,135 @@
+package tarsync
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/Redundancy/go-sync/blocksources"
+	"github.com/Redundancy/go-sync/filechecksum"
+)
+
+// the most that is requested from the source at once
+const maxRequestSize = 4 * 1024 * 1024
+
+// Input is a local file to take blocks from, with the offsets of the blocks found in it by a Matcher
+type Input struct {
+	File    io.ReaderAt
+	Matches []int64
+}
+
+/*
+Patch writes the file of the index to w, copying each block from the first input that has it.
+Runs of blocks that no input has are requested from source, and checked against the index.
+*/
+func Patch(w io.Writer, i *Index, inputs []Input, source blocksources.BlockSourceRequester) error {
+	buffer := make([]byte, i.BlockSize)
+	strongHash := filechecksum.DefaultStrongHashGenerator()
+
+	for block := uint(0); block < i.BlockCount(); {
+		offset, size := i.Block(block)
+
+		if input := findInput(inputs, block); input != nil {
+			data := buffer[:size]
+			if _, err := input.File.ReadAt(data, input.Matches[block]); err != nil {
+				return err
+			}
+
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+
+			block++
+			continue
+		}
+
+		// blocks tile the file, so a run of missing blocks is one range of it
+		end := block + 1
+		for end < i.BlockCount() && findInput(inputs, end) == nil && i.offsets[end]-offset < maxRequestSize {
+			end++
+		}
+
+		lastOffset, lastSize := i.Block(end - 1)
+		data, err := source.DoRequest(offset, lastOffset+lastSize)
+		if err != nil {
+			return fmt.Errorf("Could not read blocks %v-%v of the reference: %v", block, end-1, err)
+		}
+
+		if int64(len(data)) != lastOffset+lastSize-offset {
+			return fmt.Errorf("Blocks %v-%v of the reference were %v bytes, expected %v",
+				block, end-1, len(data), lastOffset+lastSize-offset)
+		}
+
+		for ; block < end; block++ {
+			blockOffset, blockSize := i.Block(block)
+			blockData := data[blockOffset-offset : blockOffset-offset+blockSize]
+
+			strongHash.Reset()
+			strongHash.Write(blockData)
+
+			if !bytes.Equal(strongHash.Sum(nil), i.Checksums[block].StrongChecksum) {
+				return fmt.Errorf("Block %v of the reference does not match the index", block)
+			}
+		}
+
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func findInput(inputs []Input, block uint) *Input {
+	for n := range inputs {
+		if inputs[n].Matches[block] != NotFound {
+			return &inputs[n]
+		}
+	}
+	return nil
+}
+
+// MemberReuse is how much of a member of the archive was found in local files
+type MemberReuse struct {
+	Name string
+	// The size of the headers and data of the member
+	Size int64
+	// The bytes of the member found in local files
+	Reused int64
+}
+
+// Reuse adds up the blocks of each member that are in any of the matches. The end of the archive is left out.
+func (i *Index) Reuse(matches ...[]int64) []MemberReuse {
+	var members []MemberReuse
+	block := uint(0)
+
+	for _, s := range i.Segments {
+		if s.Kind == Header || len(members) == 0 {
+			members = append(members, MemberReuse{Name: s.Name})
+		}
+
+		member := &members[len(members)-1]
+
+		for end := s.Offset + s.Size; block < i.BlockCount() && i.offsets[block] < end; block++ {
+			if s.Kind == Trailer {
+				continue
+			}
+
+			size := i.Checksums[block].Size
+			member.Size += size
+
+			for _, m := range matches {
+				if m[block] != NotFound {
+					member.Reused += size
+					break
+				}
+			}
+		}
+	}
+
+	if len(members) > 0 && members[len(members)-1].Size == 0 {
+		members = members[:len(members)-1]
+	}
+
+	return members
+}
@@ -0,0 +1,253 @@
+package tarsync
+
+import (
+	"archive/tar"
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+const BLOCK_SIZE = 1024
+
+func randomData(seed int64, size int) []byte {
+	b := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+type member struct {
+	name    string
+	content []byte
+}
+
+func makeTar(t *testing.T, members ...member) []byte {
+	b := bytes.NewBuffer(nil)
+	w := tar.NewWriter(b)
+
+	for _, m := range members {
+		err := w.WriteHeader(&tar.Header{
+			Name:    m.name,
+			Mode:    0644,
+			Size:    int64(len(m.content)),
+			ModTime: time.Unix(1500000000, 0),
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := w.Write(m.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return b.Bytes()
+}
+
+// reads ranges of a file in memory
+type bytesRequester []byte
+
+func (b bytesRequester) DoRequest(startOffset int64, endOffset int64) ([]byte, error) {
+	return b[startOffset:endOffset], nil
+}
+
+func (b bytesRequester) IsFatal(err error) bool {
+	return true
+}
+
+var (
+	a = member{"a", randomData(1, 10000)}
+	b = member{"b", randomData(2, 3000)}
+	c = member{"c", randomData(3, 50000)}
+	d = member{"d", randomData(4, 700)}
+)
+
+func TestLayout(t *testing.T) {
+	archive := makeTar(t, a, member{"empty", nil}, d)
+
+	layout, err := ReadLayout(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Segment{
+		{Header, "a", 0, 512},
+		{Data, "a", 512, 10240},
+		{Header, "empty", 10752, 512},
+		{Header, "d", 11264, 512},
+		{Data, "d", 11776, 1024},
+		{Trailer, "", 12800, int64(len(archive)) - 12800},
+	}
+
+	if layout.Size != int64(len(archive)) || len(layout.Segments) != len(expected) {
+		t.Fatalf("Unexpected layout: %+v", layout)
+	}
+
+	for i, s := range expected {
+		if layout.Segments[i] != s {
+			t.Errorf("Segment %v is %+v, expected %+v", i, layout.Segments[i], s)
+		}
+	}
+
+	if _, err := ReadLayout(bytes.NewReader(randomData(5, 2000))); err != ErrNotTar {
+		t.Errorf("Expected random data not to be a tar file, got: %v", err)
+	}
+
+	if l := LocalLayout(bytes.NewReader(randomData(5, 2000)), 2000); len(l.Segments) != 1 || l.Segments[0].Size != 2000 {
+		t.Errorf("Expected a file that is not a tar file to be one segment: %+v", l)
+	}
+}
+
+func TestBlocksAreAlignedToSegments(t *testing.T) {
+	archive := makeTar(t, a, b, c, d)
+
+	i, err := Build(bytes.NewReader(archive), int64(len(archive)), BLOCK_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	total := int64(0)
+	for block := uint(0); block < i.BlockCount(); block++ {
+		offset, size := i.Block(block)
+
+		if offset != total || size <= 0 || size > BLOCK_SIZE {
+			t.Fatalf("Block %v is %v bytes at %v", block, size, offset)
+		}
+
+		total += size
+	}
+
+	if total != int64(len(archive)) {
+		t.Errorf("Blocks cover %v bytes of %v", total, len(archive))
+	}
+
+	for _, s := range i.Segments {
+		found := false
+		for block := uint(0); block < i.BlockCount(); block++ {
+			if offset, _ := i.Block(block); offset == s.Offset {
+				found = true
+			}
+		}
+
+		if !found {
+			t.Errorf("No block starts at segment %+v", s)
+		}
+	}
+
+	if _, err := Build(bytes.NewReader(archive), int64(len(archive)), 1000); err == nil {
+		t.Error("Expected a block size that is not a multiple of the record size to fail")
+	}
+}
+
+func TestMatchMovedMembers(t *testing.T) {
+	reference := makeTar(t, a, b, c, d)
+
+	// a new member moves everything after it, and b has changed
+	changedB := member{"b", append([]byte{}, b.content...)}
+	changedB.content[1500] ^= 1
+	local := makeTar(t, member{"new", randomData(6, 1234)}, a, changedB, c, d)
+
+	i, err := Build(bytes.NewReader(reference), int64(len(reference)), BLOCK_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matcher := NewMatcher(i)
+	matches, err := matcher.FindMatches(bytes.NewReader(local), LocalLayout(bytes.NewReader(local), int64(len(local))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reuse := i.Reuse(matches)
+	if len(reuse) != 4 {
+		t.Fatalf("Unexpected members: %+v", reuse)
+	}
+
+	for _, m := range reuse {
+		switch m.Name {
+		case "a", "c", "d":
+			if m.Reused != m.Size {
+				t.Errorf("Expected all of %v to be reused: %+v", m.Name, m)
+			}
+		case "b":
+			// the header and the blocks before and after the change
+			if m.Reused != m.Size-BLOCK_SIZE {
+				t.Errorf("Expected all but one block of b to be reused: %+v", m)
+			}
+		}
+	}
+
+	output := bytes.NewBuffer(nil)
+	err = Patch(output, i, []Input{{bytes.NewReader(local), matches}}, bytesRequester(reference))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(output.Bytes(), reference) {
+		t.Error("The patched file is not the reference")
+	}
+}
+
+func TestPatchVerifiesBlocks(t *testing.T) {
+	reference := makeTar(t, a, b)
+
+	i, err := Build(bytes.NewReader(reference), int64(len(reference)), BLOCK_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	corrupt := append([]byte{}, reference...)
+	corrupt[3000] ^= 1
+
+	matches := make([]int64, i.BlockCount())
+	for n := range matches {
+		matches[n] = NotFound
+	}
+
+	err = Patch(bytes.NewBuffer(nil), i, []Input{{bytes.NewReader(nil), matches}}, bytesRequester(corrupt))
+	if err == nil {
+		t.Error("Expected a corrupt block from the source to fail")
+	}
+}
+
+func TestIndex(t *testing.T) {
+	archive := makeTar(t, a, b, d)
+
+	i, err := Build(bytes.NewReader(archive), int64(len(archive)), BLOCK_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buffer := bytes.NewBuffer(nil)
+	if err := i.Write(buffer); err != nil {
+		t.Fatal(err)
+	}
+
+	written := buffer.Bytes()
+
+	read, err := ReadIndex(bytes.NewReader(written))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if read.FileSize != i.FileSize || read.BlockSize != i.BlockSize || read.BlockCount() != i.BlockCount() ||
+		!bytes.Equal(read.FileChecksum, i.FileChecksum) || len(read.Segments) != len(i.Segments) {
+		t.Fatalf("Index was not read back: %+v", read)
+	}
+
+	for block := uint(0); block < i.BlockCount(); block++ {
+		if !read.Checksums[block].Match(i.Checksums[block]) || read.Checksums[block].Size != i.Checksums[block].Size {
+			t.Errorf("Block %v was not read back", block)
+		}
+	}
+
+	if _, err := ReadIndex(bytes.NewReader(written[:len(written)-1])); err != ErrInvalidIndex {
+		t.Errorf("Expected a truncated index to fail, got: %v", err)
+	}
+}
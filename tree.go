@@ -0,0 +1,491 @@
+package gosync
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Redundancy/go-sync/blocksources"
+	"github.com/Redundancy/go-sync/filechecksum"
+	"github.com/Redundancy/go-sync/manifest"
+)
+
+// TreeSyncResult lists the manifest paths of the files that SyncTree dealt with
+type TreeSyncResult struct {
+	// Files that already matched the manifest
+	Unchanged []string
+	// Files copied from a local file with the same content, such as when a file was renamed
+	Copied []string
+	// Files patched from local files and the reference
+	Patched []string
+	// Local files removed because they were not in the manifest
+	Deleted []string
+}
+
+// a local file, and its checksum once calculated
+type localFile struct {
+	path     string
+	size     int64
+	checksum []byte
+}
+
+// a new version of a file, waiting to be moved into place
+type stagedFile struct {
+	tempPath string
+	file     manifest.File
+}
+
+/*
+SyncTree makes the directory at localDir match the manifest.
+
+Files whose content already matches are left alone. A file with the same content as another local
+file (such as one that was renamed) is copied from it, and every other file is patched, using any
+local file at the same path and a few of the local files that are not in the manifest as seeds
+(those with the same name, then those closest in size).
+Missing blocks are fetched from sourceURL followed by the path of the file in the manifest.
+
+Every new file is written to a temporary file and verified before any local file is changed,
+so an error while fetching or patching leaves the local files as they were. Local files and
+directories in the way of the new files (such as a file where the manifest has a directory) are
+then removed, and the new files are moved into place one at a time, so if that fails (for instance,
+because a file is in use), some of the files will have been updated; syncing again will finish the job.
+Directories left empty by removing files are removed too.
+*/
+func SyncTree(m *manifest.Manifest, localDir, sourceURL string) (*TreeSyncResult, error) {
+	return SyncTreeWithOptions(m, localDir, sourceURL, blocksources.HttpOptions{})
+}
+
+// SyncTreeWithOptions works like SyncTree, making requests for missing blocks with options.
+// Every file has its own ETag, so options.ExpectedETag is ignored.
+func SyncTreeWithOptions(
+	m *manifest.Manifest,
+	localDir,
+	sourceURL string,
+	options blocksources.HttpOptions,
+) (result *TreeSyncResult, err error) {
+	options.ExpectedETag = ""
+
+	local, err := scanTree(localDir)
+	if err != nil {
+		return nil, err
+	}
+
+	result = &TreeSyncResult{}
+	inManifest := make(map[string]bool, len(m.Files))
+	var staged []stagedFile
+	var unchanged []manifest.File
+
+	defer func() {
+		if err != nil {
+			for _, s := range staged {
+				os.Remove(s.tempPath)
+			}
+		}
+	}()
+
+	// new files are staged at the top of localDir, since their directories may not exist yet
+	if err := os.MkdirAll(localDir, 0755); err != nil {
+		return nil, err
+	}
+
+	// files that are not in the manifest may have been renamed,
+	// so they are good seeds
+	for _, f := range m.Files {
+		inManifest[f.Path] = true
+	}
+
+	var unlisted []*localFile
+	for p, l := range local {
+		if !inManifest[p] {
+			unlisted = append(unlisted, l)
+		}
+	}
+
+	for _, f := range m.Files {
+		if existing, ok := local[f.Path]; ok {
+			same, err := existing.matches(f)
+			if err != nil {
+				return nil, err
+			}
+
+			if same {
+				unchanged = append(unchanged, f)
+				result.Unchanged = append(result.Unchanged, f.Path)
+				continue
+			}
+		}
+
+		copyFrom, err := findLocalCopy(local, f)
+		if err != nil {
+			return nil, err
+		}
+
+		var tempPath string
+
+		switch {
+		case copyFrom != nil:
+			tempPath, err = stageCopy(copyFrom.path, localDir, f)
+			result.Copied = append(result.Copied, f.Path)
+		case f.Size == 0:
+			// there are no blocks to patch
+			tempPath, err = stageReader(bytes.NewReader(nil), localDir, f)
+			result.Patched = append(result.Patched, f.Path)
+		default:
+			seeds := pickSeeds(unlisted, f)
+			tempPath, err = stagePatch(local[f.Path], seeds, localDir, sourceURL, f, options)
+			result.Patched = append(result.Patched, f.Path)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("Could not sync %v: %v", f.Path, err)
+		}
+
+		staged = append(staged, stagedFile{tempPath, f})
+
+		if err = os.Chmod(tempPath, f.Mode); err != nil {
+			return nil, err
+		}
+	}
+
+	// apart from creating localDir and the staged files in it,
+	// nothing local has been changed before this point
+	deleted := make(map[string]bool)
+
+	if err = removeClashes(m, localDir, local, deleted); err != nil {
+		return nil, err
+	}
+
+	for _, s := range staged {
+		target := filepath.Join(localDir, filepath.FromSlash(s.file.Path))
+
+		if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return nil, err
+		}
+
+		if err = os.Rename(s.tempPath, target); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, f := range unchanged {
+		target := filepath.Join(localDir, filepath.FromSlash(f.Path))
+
+		if err = os.Chmod(target, f.Mode); err != nil {
+			return nil, err
+		}
+	}
+
+	for p, l := range local {
+		if inManifest[p] || deleted[p] {
+			continue
+		}
+
+		if err = os.Remove(l.path); err != nil {
+			return nil, err
+		}
+
+		deleted[p] = true
+	}
+
+	for p := range deleted {
+		result.Deleted = append(result.Deleted, p)
+		removeEmptyDirs(localDir, p)
+	}
+
+	return result, nil
+}
+
+/*
+removes the local files and directories that are in the way of the files in the manifest,
+which are files at the path of a directory in the manifest (such as a file "a" when the manifest
+has "a/b"), and directories at the path of a file in the manifest.
+The local files that are removed are added to deleted.
+*/
+func removeClashes(
+	m *manifest.Manifest,
+	localDir string,
+	local map[string]*localFile,
+	deleted map[string]bool,
+) error {
+	for _, f := range m.Files {
+		for dir := path.Dir(f.Path); dir != "."; dir = path.Dir(dir) {
+			if l, ok := local[dir]; ok && !deleted[dir] {
+				if err := os.Remove(l.path); err != nil {
+					return err
+				}
+
+				deleted[dir] = true
+			}
+		}
+
+		target := filepath.Join(localDir, filepath.FromSlash(f.Path))
+
+		if info, err := os.Lstat(target); err != nil || !info.IsDir() {
+			continue
+		}
+
+		for p := range local {
+			if strings.HasPrefix(p, f.Path+"/") {
+				deleted[p] = true
+			}
+		}
+
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removes the directories above the deleted file p that were left empty, up to localDir
+func removeEmptyDirs(localDir, p string) {
+	for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+		// fails if the directory is not empty
+		if os.Remove(filepath.Join(localDir, filepath.FromSlash(dir))) != nil {
+			return
+		}
+	}
+}
+
+// the most local files that are used as seeds for each patched file,
+// since each seed is read in full for every file that it is a seed of
+const maxTreeSeeds = 4
+
+/*
+picks the local files that are not in the manifest (which may have been renamed) to use as seeds
+for f: first those with the same name as f, then those closest to it in size.
+*/
+func pickSeeds(unlisted []*localFile, f manifest.File) []string {
+	name := path.Base(f.Path)
+
+	distance := func(l *localFile) int64 {
+		if l.size > f.Size {
+			return l.size - f.Size
+		}
+		return f.Size - l.size
+	}
+
+	candidates := append([]*localFile(nil), unlisted...)
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		sameA, sameB := filepath.Base(a.path) == name, filepath.Base(b.path) == name
+
+		switch {
+		case sameA != sameB:
+			return sameA
+		case distance(a) != distance(b):
+			return distance(a) < distance(b)
+		default:
+			return a.path < b.path
+		}
+	})
+
+	if len(candidates) > maxTreeSeeds {
+		candidates = candidates[:maxTreeSeeds]
+	}
+
+	seeds := make([]string, len(candidates))
+	for i, l := range candidates {
+		seeds[i] = l.path
+	}
+
+	return seeds
+}
+
+// finds the regular files under dir, by slash separated relative path
+func scanTree(dir string) (map[string]*localFile, error) {
+	files := make(map[string]*localFile)
+
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return files, nil
+	}
+
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		files[filepath.ToSlash(rel)] = &localFile{
+			path: p,
+			size: info.Size(),
+		}
+
+		return nil
+	})
+
+	return files, err
+}
+
+// checks the size, then the checksum
+func (l *localFile) matches(f manifest.File) (bool, error) {
+	if l.size != f.Size {
+		return false, nil
+	}
+
+	if l.checksum == nil {
+		file, err := os.Open(l.path)
+		if err != nil {
+			return false, err
+		}
+		defer file.Close()
+
+		hash := filechecksum.DefaultFileHashGenerator()
+		if _, err := io.Copy(hash, file); err != nil {
+			return false, err
+		}
+
+		l.checksum = hash.Sum(nil)
+	}
+
+	return bytes.Equal(l.checksum, f.Checksum), nil
+}
+
+func findLocalCopy(local map[string]*localFile, f manifest.File) (*localFile, error) {
+	for _, l := range local {
+		same, err := l.matches(f)
+
+		if err != nil {
+			return nil, err
+		} else if same {
+			return l, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// copies from a local file into a temporary file in dir
+func stageCopy(from, dir string, f manifest.File) (string, error) {
+	in, err := os.Open(from)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	return stageReader(in, dir, f)
+}
+
+// writes r into a temporary file in dir,
+// checking that the content is what the manifest expects
+func stageReader(r io.Reader, dir string, f manifest.File) (tempPath string, err error) {
+	out, tempPath, err := getTempFile(dir)
+	if err != nil {
+		return "", err
+	}
+
+	defer func() {
+		if e := out.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			os.Remove(tempPath)
+		}
+	}()
+
+	output := newVerifyingWriter(out, filechecksum.DefaultFileHashGenerator())
+
+	if _, err = io.Copy(output, r); err != nil {
+		return
+	}
+
+	err = output.verify(f.Size, f.Checksum)
+	return
+}
+
+// patches into a temporary file in dir
+func stagePatch(
+	existing *localFile,
+	seeds []string,
+	dir string,
+	sourceURL string,
+	f manifest.File,
+	options blocksources.HttpOptions,
+) (tempPath string, err error) {
+	idx, lookup, err := f.Index()
+	if err != nil {
+		return "", err
+	}
+
+	summary := &BasicSummary{
+		ChecksumIndex:  idx,
+		ChecksumLookup: lookup,
+		BlockCount:     f.BlockCount(),
+		BlockSize:      f.BlockSize,
+		FileSize:       f.Size,
+		FileChecksum:   f.Checksum,
+	}
+
+	out, tempPath, err := getTempFile(dir)
+	if err != nil {
+		return "", err
+	}
+
+	source := newHttpSource(joinURL(sourceURL, f.Path), summary, options)
+
+	rsync := &RSync{
+		// a file with no local version is patched only from seeds
+		Input:   bytes.NewReader(nil),
+		Output:  out,
+		Source:  source,
+		Summary: summary,
+		OnClose: []closer{
+			&fileCloser{out, tempPath},
+		},
+	}
+
+	defer func() {
+		source.Close()
+
+		if e := rsync.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			os.Remove(tempPath)
+		}
+	}()
+
+	inputs := seeds
+	if existing != nil {
+		inputs = append([]string{existing.path}, seeds...)
+	}
+
+	for _, p := range inputs {
+		file, err := os.Open(p)
+		if err != nil {
+			return tempPath, err
+		}
+
+		rsync.Seeds = append(rsync.Seeds, file)
+		rsync.OnClose = append(rsync.OnClose, &fileCloser{file, p})
+	}
+
+	err = rsync.Patch()
+	return
+}
+
+// joins a base URL and a slash separated relative path, escaping each element of the path
+func joinURL(base, p string) string {
+	elements := strings.Split(p, "/")
+
+	for i, e := range elements {
+		elements[i] = url.PathEscape(e)
+	}
+
+	return strings.TrimRight(base, "/") + "/" + strings.Join(elements, "/")
+}
@@ -0,0 +1,392 @@
+package gosync
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Redundancy/go-sync/blocksources"
+	"github.com/Redundancy/go-sync/manifest"
+)
+
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	for p, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(p))
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readTree(t *testing.T, dir string) map[string]string {
+	files := make(map[string]string)
+
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		content, err := ioutil.ReadFile(p)
+		rel, _ := filepath.Rel(dir, p)
+		files[filepath.ToSlash(rel)] = string(content)
+		return err
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return files
+}
+
+func randomString(seed int64, size int) string {
+	b := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return string(b)
+}
+
+// serves dir, counting the bytes served
+func serveTree(dir string, served *int64) *httptest.Server {
+	fileServer := http.FileServer(http.Dir(dir))
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fileServer.ServeHTTP(&countingResponseWriter{w, served}, r)
+	}))
+}
+
+type countingResponseWriter struct {
+	http.ResponseWriter
+	count *int64
+}
+
+func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	atomic.AddInt64(w.count, int64(len(b)))
+	return w.ResponseWriter.Write(b)
+}
+
+func makeTestTrees(t *testing.T, reference, local map[string]string) (refDir, localDir string) {
+	refDir, err := ioutil.TempDir("", "gosync")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	localDir, err = ioutil.TempDir("", "gosync")
+	if err != nil {
+		os.RemoveAll(refDir)
+		t.Fatal(err)
+	}
+
+	writeTree(t, refDir, reference)
+	writeTree(t, localDir, local)
+	return
+}
+
+func TestSyncTree(t *testing.T) {
+	large := randomString(1, 4096)
+	modified := randomString(2, 4096)
+
+	reference := map[string]string{
+		"same.txt":         "unchanged content",
+		"renamed.bin":      large,
+		"modified.bin":     modified[:2000] + "changed" + modified[2000:],
+		"dir/new file.txt": "a new file",
+		"dir/empty":        "",
+	}
+
+	local := map[string]string{
+		"same.txt":     "unchanged content",
+		"old.bin":      large,
+		"modified.bin": modified,
+		"deleted.txt":  "to be removed",
+	}
+
+	refDir, localDir := makeTestTrees(t, reference, local)
+	defer os.RemoveAll(refDir)
+	defer os.RemoveAll(localDir)
+
+	m, err := manifest.Build(refDir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var served int64
+	server := serveTree(refDir, &served)
+	defer server.Close()
+
+	result, err := SyncTree(m, localDir, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if synced := readTree(t, localDir); !reflect.DeepEqual(synced, reference) {
+		t.Errorf("Local tree does not match the reference: %v", synced)
+	}
+
+	sort.Strings(result.Patched)
+	expected := &TreeSyncResult{
+		Unchanged: []string{"same.txt"},
+		Copied:    []string{"renamed.bin"},
+		Patched:   []string{"dir/empty", "dir/new file.txt", "modified.bin"},
+		Deleted:   []string{"deleted.txt", "old.bin"},
+	}
+
+	sort.Strings(result.Deleted)
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Unexpected result: %#v", result)
+	}
+
+	// only the blocks around the change and the new file should be fetched
+	if served > 4*64+int64(len("a new file")) {
+		t.Errorf("Fetched %v bytes, expected blocks to be reused", served)
+	}
+}
+
+func TestSyncTreeReusesBlocksFromRenamedFiles(t *testing.T) {
+	content := randomString(3, 4096)
+
+	refDir, localDir := makeTestTrees(
+		t,
+		map[string]string{"moved/file.bin": "prefix" + content},
+		map[string]string{"file.bin": content},
+	)
+	defer os.RemoveAll(refDir)
+	defer os.RemoveAll(localDir)
+
+	m, err := manifest.Build(refDir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var served int64
+	server := serveTree(refDir, &served)
+	defer server.Close()
+
+	result, err := SyncTree(m, localDir, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	synced := readTree(t, localDir)
+	if len(synced) != 1 || synced["moved/file.bin"] != "prefix"+content {
+		t.Errorf("Local tree does not match the reference")
+	}
+
+	if !reflect.DeepEqual(result.Deleted, []string{"file.bin"}) {
+		t.Errorf("Unexpected deleted files: %v", result.Deleted)
+	}
+
+	if served > 2*64 {
+		t.Errorf("Fetched %v bytes, expected blocks to be reused from the renamed file", served)
+	}
+}
+
+func TestSyncTreeFailureLeavesFilesUnchanged(t *testing.T) {
+	reference := map[string]string{
+		"a.txt": "The quick brown fox jumped over the lazy dog",
+		"b.txt": "fetched content",
+	}
+
+	local := map[string]string{
+		"a.txt":     "The quick brown fox",
+		"extra.txt": "not in the manifest",
+	}
+
+	refDir, localDir := makeTestTrees(t, reference, local)
+	defer os.RemoveAll(refDir)
+	defer os.RemoveAll(localDir)
+
+	m, err := manifest.Build(refDir, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the reference changed after the manifest was made
+	writeTree(t, refDir, map[string]string{"b.txt": strings.ToUpper(reference["b.txt"])})
+
+	var served int64
+	server := serveTree(refDir, &served)
+	defer server.Close()
+
+	if _, err := SyncTree(m, localDir, server.URL); err == nil {
+		t.Fatal("Expected an error syncing from a changed reference")
+	}
+
+	if synced := readTree(t, localDir); !reflect.DeepEqual(synced, local) {
+		t.Errorf("Local tree was changed by a failed sync: %v", synced)
+	}
+}
+
+func TestSyncTreeFailureLeavesModesUnchanged(t *testing.T) {
+	reference := map[string]string{
+		"a.txt": "unchanged content",
+		"b.txt": "fetched content",
+	}
+
+	refDir, localDir := makeTestTrees(t, reference, map[string]string{"a.txt": reference["a.txt"]})
+	defer os.RemoveAll(refDir)
+	defer os.RemoveAll(localDir)
+
+	m, err := manifest.Build(refDir, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unchanged := filepath.Join(localDir, "a.txt")
+	if err := os.Chmod(unchanged, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTree(t, refDir, map[string]string{"b.txt": strings.ToUpper(reference["b.txt"])})
+
+	var served int64
+	server := serveTree(refDir, &served)
+	defer server.Close()
+
+	if _, err := SyncTree(m, localDir, server.URL); err == nil {
+		t.Fatal("Expected an error syncing from a changed reference")
+	}
+
+	if info, err := os.Stat(unchanged); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("The mode of an unchanged file was changed by a failed sync: %v %v", info.Mode(), err)
+	}
+}
+
+func TestSyncTreeWithOptionsSendsHeaders(t *testing.T) {
+	reference := map[string]string{"a.txt": "The quick brown fox jumped over the lazy dog"}
+
+	refDir, localDir := makeTestTrees(t, reference, nil)
+	defer os.RemoveAll(refDir)
+	defer os.RemoveAll(localDir)
+
+	m, err := manifest.Build(refDir, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fileServer := http.FileServer(http.Dir(refDir))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		fileServer.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	if _, err := SyncTree(m, localDir, server.URL); err == nil {
+		t.Error("Expected syncing without the header to fail")
+	}
+
+	options := blocksources.HttpOptions{
+		Header: http.Header{"Authorization": []string{"Bearer token"}},
+	}
+
+	if _, err := SyncTreeWithOptions(m, localDir, server.URL, options); err != nil {
+		t.Fatal(err)
+	}
+
+	if synced := readTree(t, localDir); !reflect.DeepEqual(synced, reference) {
+		t.Errorf("Unexpected tree: %v", synced)
+	}
+}
+
+func syncTestTrees(t *testing.T, reference, local map[string]string) (*TreeSyncResult, string) {
+	refDir, localDir := makeTestTrees(t, reference, local)
+	defer os.RemoveAll(refDir)
+
+	m, err := manifest.Build(refDir, 4)
+	if err != nil {
+		os.RemoveAll(localDir)
+		t.Fatal(err)
+	}
+
+	var served int64
+	server := serveTree(refDir, &served)
+	defer server.Close()
+
+	result, err := SyncTree(m, localDir, server.URL)
+	if err != nil {
+		os.RemoveAll(localDir)
+		t.Fatal(err)
+	}
+
+	return result, localDir
+}
+
+func TestSyncTreeReplacesFileWithDirectory(t *testing.T) {
+	reference := map[string]string{"a/b": "The quick brown fox"}
+
+	result, localDir := syncTestTrees(t, reference, map[string]string{"a": "The quick brown fox"})
+	defer os.RemoveAll(localDir)
+
+	if synced := readTree(t, localDir); !reflect.DeepEqual(synced, reference) {
+		t.Errorf("Local tree does not match the reference: %v", synced)
+	}
+
+	if !reflect.DeepEqual(result.Deleted, []string{"a"}) {
+		t.Errorf("Unexpected deleted files: %v", result.Deleted)
+	}
+}
+
+func TestSyncTreeReplacesDirectoryWithFile(t *testing.T) {
+	reference := map[string]string{"a": "The quick brown fox"}
+
+	result, localDir := syncTestTrees(t, reference, map[string]string{"a/b/c": "The quick brown fox"})
+	defer os.RemoveAll(localDir)
+
+	if synced := readTree(t, localDir); !reflect.DeepEqual(synced, reference) {
+		t.Errorf("Local tree does not match the reference: %v", synced)
+	}
+
+	if !reflect.DeepEqual(result.Deleted, []string{"a/b/c"}) {
+		t.Errorf("Unexpected deleted files: %v", result.Deleted)
+	}
+}
+
+func TestSyncTreeRemovesEmptyDirectories(t *testing.T) {
+	reference := map[string]string{"a.txt": "The quick brown fox"}
+
+	_, localDir := syncTestTrees(t, reference, map[string]string{"old/dir/b.txt": "removed"})
+	defer os.RemoveAll(localDir)
+
+	if _, err := os.Stat(filepath.Join(localDir, "old")); !os.IsNotExist(err) {
+		t.Errorf("Expected the empty directory to be removed: %v", err)
+	}
+}
+
+func TestPickSeedsPrefersSameNameThenSize(t *testing.T) {
+	unlisted := []*localFile{
+		{path: filepath.Join("x", "far.bin"), size: 1000},
+		{path: filepath.Join("x", "near.bin"), size: 110},
+		{path: filepath.Join("old", "file.bin"), size: 5000},
+		{path: filepath.Join("x", "nearer.bin"), size: 101},
+		{path: filepath.Join("x", "nearest.bin"), size: 100},
+		{path: filepath.Join("x", "farthest.bin"), size: 9000},
+	}
+
+	seeds := pickSeeds(unlisted, manifest.File{Path: "new/file.bin", Size: 100})
+
+	expected := []string{
+		filepath.Join("old", "file.bin"),
+		filepath.Join("x", "nearest.bin"),
+		filepath.Join("x", "nearer.bin"),
+		filepath.Join("x", "near.bin"),
+	}
+
+	if !reflect.DeepEqual(seeds, expected) {
+		t.Errorf("Unexpected seeds: %v", seeds)
+	}
+}
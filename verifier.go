@@ -0,0 +1,75 @@
+package gosync
+
+import (
+	"bytes"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// ErrOutputMismatch is returned by RSync.Patch when the patched output does not
+// have the size or whole-file checksum described by the reference
+type ErrOutputMismatch struct {
+	ExpectedSize int64
+	ActualSize   int64
+
+	// ExpectedChecksum is nil if the summary did not provide one
+	ExpectedChecksum []byte
+	ActualChecksum   []byte
+}
+
+func (e *ErrOutputMismatch) Error() string {
+	if e.ExpectedSize != e.ActualSize {
+		return fmt.Sprintf(
+			"Patched output was %v bytes, expected %v bytes",
+			e.ActualSize,
+			e.ExpectedSize,
+		)
+	}
+
+	return fmt.Sprintf(
+		"Patched output checksum %x did not match the reference checksum %x",
+		e.ActualChecksum,
+		e.ExpectedChecksum,
+	)
+}
+
+// verifyingWriter hashes and counts everything written through it,
+// so that the final output can be checked against the reference
+type verifyingWriter struct {
+	w       io.Writer
+	hash    hash.Hash
+	written int64
+}
+
+// newVerifyingWriter checks the output with fileHash, which is
+// filechecksum.DefaultFileHashGenerator() unless the summary says otherwise
+func newVerifyingWriter(w io.Writer, fileHash hash.Hash) *verifyingWriter {
+	return &verifyingWriter{
+		w:    w,
+		hash: fileHash,
+	}
+}
+
+func (v *verifyingWriter) Write(p []byte) (n int, err error) {
+	n, err = v.w.Write(p)
+	v.hash.Write(p[:n])
+	v.written += int64(n)
+	return
+}
+
+// verify checks the output size, and the checksum if one is given
+func (v *verifyingWriter) verify(size int64, checksum []byte) error {
+	actual := v.hash.Sum(nil)
+
+	if v.written != size || (checksum != nil && !bytes.Equal(checksum, actual)) {
+		return &ErrOutputMismatch{
+			ExpectedSize:     size,
+			ActualSize:       v.written,
+			ExpectedChecksum: checksum,
+			ActualChecksum:   actual,
+		}
+	}
+
+	return nil
+}
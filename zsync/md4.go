@@ -0,0 +1,129 @@
+package zsync
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// MD4 (RFC 1320) is only used because zsync block checksums use it.
+// It is not in the standard library, and is too small to be worth a dependency.
+const (
+	md4Size      = 16
+	md4BlockSize = 64
+)
+
+type md4Digest struct {
+	s      [4]uint32
+	buffer [md4BlockSize]byte
+	n      int
+	length uint64
+}
+
+func newMD4() hash.Hash {
+	d := &md4Digest{}
+	d.Reset()
+	return d
+}
+
+func (d *md4Digest) Reset() {
+	d.s = [4]uint32{0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476}
+	d.n = 0
+	d.length = 0
+}
+
+func (d *md4Digest) Size() int {
+	return md4Size
+}
+
+func (d *md4Digest) BlockSize() int {
+	return md4BlockSize
+}
+
+func (d *md4Digest) Write(p []byte) (int, error) {
+	n := len(p)
+	d.length += uint64(n)
+
+	if d.n > 0 {
+		copied := copy(d.buffer[d.n:], p)
+		d.n += copied
+		p = p[copied:]
+
+		if d.n < md4BlockSize {
+			return n, nil
+		}
+
+		d.block(d.buffer[:])
+		d.n = 0
+	}
+
+	for len(p) >= md4BlockSize {
+		d.block(p[:md4BlockSize])
+		p = p[md4BlockSize:]
+	}
+
+	d.n = copy(d.buffer[:], p)
+	return n, nil
+}
+
+func (d *md4Digest) Sum(in []byte) []byte {
+	// padding must not change the state of d
+	c := *d
+	length := c.length
+
+	padding := make([]byte, md4BlockSize+8)
+	padding[0] = 0x80
+
+	padLength := 56 - int(length%md4BlockSize)
+	if padLength <= 0 {
+		padLength += md4BlockSize
+	}
+
+	binary.LittleEndian.PutUint64(padding[padLength:], length<<3)
+	c.Write(padding[:padLength+8])
+
+	var sum [md4Size]byte
+	for i, v := range c.s {
+		binary.LittleEndian.PutUint32(sum[i*4:], v)
+	}
+
+	return append(in, sum[:]...)
+}
+
+func (d *md4Digest) block(p []byte) {
+	var x [16]uint32
+	for i := range x {
+		x[i] = binary.LittleEndian.Uint32(p[i*4:])
+	}
+
+	a, b, c, e := d.s[0], d.s[1], d.s[2], d.s[3]
+
+	// round 1
+	for _, i := range []int{0, 4, 8, 12} {
+		a = bits.RotateLeft32(a+((b&c)|(^b&e))+x[i], 3)
+		e = bits.RotateLeft32(e+((a&b)|(^a&c))+x[i+1], 7)
+		c = bits.RotateLeft32(c+((e&a)|(^e&b))+x[i+2], 11)
+		b = bits.RotateLeft32(b+((c&e)|(^c&a))+x[i+3], 19)
+	}
+
+	// round 2
+	for _, i := range []int{0, 1, 2, 3} {
+		a = bits.RotateLeft32(a+((b&c)|(b&e)|(c&e))+x[i]+0x5a827999, 3)
+		e = bits.RotateLeft32(e+((a&b)|(a&c)|(b&c))+x[i+4]+0x5a827999, 5)
+		c = bits.RotateLeft32(c+((e&a)|(e&b)|(a&b))+x[i+8]+0x5a827999, 9)
+		b = bits.RotateLeft32(b+((c&e)|(c&a)|(e&a))+x[i+12]+0x5a827999, 13)
+	}
+
+	// round 3
+	for _, i := range []int{0, 2, 1, 3} {
+		a = bits.RotateLeft32(a+(b^c^e)+x[i]+0x6ed9eba1, 3)
+		e = bits.RotateLeft32(e+(a^b^c)+x[i+8]+0x6ed9eba1, 9)
+		c = bits.RotateLeft32(c+(e^a^b)+x[i+4]+0x6ed9eba1, 11)
+		b = bits.RotateLeft32(b+(c^e^a)+x[i+12]+0x6ed9eba1, 15)
+	}
+
+	d.s[0] += a
+	d.s[1] += b
+	d.s[2] += c
+	d.s[3] += e
+}
@@ -0,0 +1,455 @@
+/*
+Package zsync reads and writes zsync control files (.zsync), so that files published for zsync
+can be patched by go-sync, and go-sync can publish files for zsync clients.
+
+A control file is a set of "Key: value" header lines, ended by an empty line, followed by the
+checksums of each block of the file:
+
+	zsync: 0.6.2
+	Filename: file.iso
+	MTime: Mon, 02 Jan 2006 15:04:05 +0000
+	Blocksize: 2048
+	Length: 1234567
+	Hash-Lengths: 2,3,5
+	URL: file.iso
+	SHA-1: <hex SHA-1 of the whole file>
+
+Hash-Lengths gives the number of consecutive blocks that must match before a match is used,
+and the number of bytes stored of each rolling checksum and MD4 checksum. The rolling
+checksum is stored as its trailing bytes, and the MD4 as its leading bytes. The last block
+is padded with zeros to the block size before its checksums are calculated.
+
+Files compressed for zsync (with Z-URL and Z-Map2 headers) can be read, but only the
+uncompressed URLs can be used.
+*/
+package zsync
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Redundancy/go-sync/chunks"
+	"github.com/Redundancy/go-sync/filechecksum"
+	"github.com/Redundancy/go-sync/index"
+	"github.com/Redundancy/go-sync/rollsum"
+)
+
+// Version is the zsync version written to control files
+const Version = "0.6.2"
+
+// MagicString starts every control file
+const MagicString = "zsync: "
+
+/*
+ControlFile is the content of a .zsync file.
+
+It satisfies the FileSummary interface of the gosync package through Summary.
+*/
+type ControlFile struct {
+	Filename string
+	MTime    time.Time
+	URLs     []string
+
+	BlockSize uint
+	Length    int64
+
+	// The number of consecutive blocks that must match, 1 or 2
+	SeqMatches int
+	// The number of bytes of each rolling checksum, from 1 to 4
+	RsumBytes int
+	// The number of bytes of each MD4 checksum, from 3 to 16
+	ChecksumBytes int
+
+	// The SHA-1 of the whole file, may be nil
+	SHA1 []byte
+
+	// The truncated checksums of each block
+	Checksums []chunks.ChunkChecksum
+}
+
+// BlockCount is the number of blocks in the file
+func (c *ControlFile) BlockCount() uint {
+	if c.BlockSize == 0 {
+		return 0
+	}
+
+	return uint((c.Length + int64(c.BlockSize) - 1) / int64(c.BlockSize))
+}
+
+// NewChecksumGenerator creates a generator for the checksums used by the control file
+func (c *ControlFile) NewChecksumGenerator() *filechecksum.FileChecksumGenerator {
+	return &filechecksum.FileChecksumGenerator{
+		BlockSize:        c.BlockSize,
+		WeakRollingHash:  rollsum.NewRollsumZsync(c.BlockSize, c.RsumBytes),
+		StrongHash:       NewBlockHash(c.BlockSize, c.ChecksumBytes),
+		FileChecksumHash: sha1.New(),
+	}
+}
+
+/*
+NewBlockHash creates the hash used for zsync block checksums: the first size bytes
+of the MD4 of a block, padded with zeros to blockSize if it is shorter.
+*/
+func NewBlockHash(blockSize uint, size int) hash.Hash {
+	return &blockHash{
+		md4:       newMD4(),
+		blockSize: blockSize,
+		size:      size,
+	}
+}
+
+type blockHash struct {
+	md4       hash.Hash
+	blockSize uint
+	size      int
+	written   uint
+}
+
+func (h *blockHash) Write(p []byte) (int, error) {
+	h.written += uint(len(p))
+	return h.md4.Write(p)
+}
+
+func (h *blockHash) Sum(b []byte) []byte {
+	if h.written < h.blockSize {
+		// the padding must not change the state of the hash
+		padded := newMD4().(*md4Digest)
+		*padded = *h.md4.(*md4Digest)
+		padded.Write(make([]byte, h.blockSize-h.written))
+		return append(b, padded.Sum(nil)[:h.size]...)
+	}
+
+	return append(b, h.md4.Sum(nil)[:h.size]...)
+}
+
+func (h *blockHash) Reset() {
+	h.md4.Reset()
+	h.written = 0
+}
+
+func (h *blockHash) Size() int {
+	return h.size
+}
+
+func (h *blockHash) BlockSize() int {
+	return h.md4.BlockSize()
+}
+
+// Read parses a control file
+func Read(r io.Reader) (*ControlFile, error) {
+	reader := bufio.NewReader(r)
+
+	c := &ControlFile{
+		SeqMatches:    1,
+		RsumBytes:     4,
+		ChecksumBytes: 16,
+	}
+
+	hasBlockSize, hasLength := false, false
+
+	for first := true; ; first = false {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("Could not read zsync header: %v", err)
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+
+		if line == "" {
+			break
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid zsync header line: %q", line)
+		}
+
+		key, value := parts[0], strings.TrimSpace(parts[1])
+
+		if first && key != "zsync" {
+			return nil, fmt.Errorf("Not a zsync file")
+		}
+
+		switch key {
+		case "Filename":
+			c.Filename = value
+		case "MTime":
+			if c.MTime, err = time.Parse(time.RFC1123Z, value); err != nil {
+				return nil, fmt.Errorf("Invalid zsync MTime: %v", value)
+			}
+		case "URL":
+			c.URLs = append(c.URLs, value)
+		case "Blocksize":
+			blockSize, err := strconv.ParseUint(value, 10, 32)
+			if err != nil || blockSize == 0 {
+				return nil, fmt.Errorf("Invalid zsync block size: %v", value)
+			}
+			c.BlockSize = uint(blockSize)
+			hasBlockSize = true
+		case "Length":
+			if c.Length, err = strconv.ParseInt(value, 10, 64); err != nil || c.Length < 0 {
+				return nil, fmt.Errorf("Invalid zsync length: %v", value)
+			}
+			hasLength = true
+		case "Hash-Lengths":
+			if err := c.parseHashLengths(value); err != nil {
+				return nil, err
+			}
+		case "SHA-1":
+			if c.SHA1, err = hex.DecodeString(value); err != nil || len(c.SHA1) != sha1.Size {
+				return nil, fmt.Errorf("Invalid zsync SHA-1: %v", value)
+			}
+		case "Z-Map2":
+			// the map of the compressed file follows the header line, and is not used
+			count, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid zsync Z-Map2: %v", value)
+			}
+			if _, err := io.CopyN(ioutil.Discard, reader, int64(count)*4); err != nil {
+				return nil, fmt.Errorf("Could not read zsync Z-Map2: %v", err)
+			}
+		}
+	}
+
+	if !hasBlockSize || !hasLength {
+		return nil, fmt.Errorf("zsync file does not have a Blocksize and Length")
+	}
+
+	checksums, err := chunks.LoadChecksumsFromReader(reader, c.RsumBytes, c.ChecksumBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read zsync checksums: %v", err)
+	}
+
+	if uint(len(checksums)) != c.BlockCount() {
+		return nil, fmt.Errorf(
+			"zsync file has checksums for %v blocks, expected %v",
+			len(checksums),
+			c.BlockCount(),
+		)
+	}
+
+	c.Checksums = checksums
+	return c, nil
+}
+
+func (c *ControlFile) parseHashLengths(value string) error {
+	parts := strings.Split(value, ",")
+	lengths := make([]int, len(parts))
+
+	for i, p := range parts {
+		l, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil {
+			return fmt.Errorf("Invalid zsync Hash-Lengths: %v", value)
+		}
+		lengths[i] = l
+	}
+
+	if len(lengths) != 3 ||
+		lengths[0] < 1 || lengths[0] > 2 ||
+		lengths[1] < 1 || lengths[1] > 4 ||
+		lengths[2] < 3 || lengths[2] > 16 {
+		return fmt.Errorf("Invalid zsync Hash-Lengths: %v", value)
+	}
+
+	c.SeqMatches, c.RsumBytes, c.ChecksumBytes = lengths[0], lengths[1], lengths[2]
+	return nil
+}
+
+// Write writes the control file
+func (c *ControlFile) Write(w io.Writer) error {
+	header := bytes.NewBuffer(nil)
+
+	fmt.Fprintf(header, "%v%v\n", MagicString, Version)
+
+	if c.Filename != "" {
+		fmt.Fprintf(header, "Filename: %v\n", c.Filename)
+	}
+
+	if !c.MTime.IsZero() {
+		fmt.Fprintf(header, "MTime: %v\n", c.MTime.Format(time.RFC1123Z))
+	}
+
+	fmt.Fprintf(header, "Blocksize: %v\n", c.BlockSize)
+	fmt.Fprintf(header, "Length: %v\n", c.Length)
+	fmt.Fprintf(header, "Hash-Lengths: %v,%v,%v\n", c.SeqMatches, c.RsumBytes, c.ChecksumBytes)
+
+	for _, url := range c.URLs {
+		fmt.Fprintf(header, "URL: %v\n", url)
+	}
+
+	if c.SHA1 != nil {
+		fmt.Fprintf(header, "SHA-1: %x\n", c.SHA1)
+	}
+
+	header.WriteString("\n")
+
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return err
+	}
+
+	for _, chunk := range c.Checksums {
+		if _, err := w.Write(chunk.WeakChecksum); err != nil {
+			return err
+		}
+		if _, err := w.Write(chunk.StrongChecksum); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// BuildOptions are the header values of a control file made by Build
+type BuildOptions struct {
+	Filename string
+	MTime    time.Time
+	URLs     []string
+}
+
+/*
+Build creates a control file for the content of r, using blockSize, which must
+be a power of two for zsync clients.
+
+The hash lengths are chosen as zsyncmake does, based on the size of the file.
+*/
+func Build(r io.Reader, blockSize uint, options BuildOptions) (*ControlFile, error) {
+	if blockSize == 0 || blockSize&(blockSize-1) != 0 {
+		return nil, fmt.Errorf("zsync block sizes must be a power of two, got %v", blockSize)
+	}
+
+	// generate full checksums, then truncate them once the length is known
+	full := &ControlFile{
+		BlockSize:     blockSize,
+		RsumBytes:     4,
+		ChecksumBytes: 16,
+	}
+
+	generator := full.NewChecksumGenerator()
+	checksums := make([]chunks.ChunkChecksum, 0)
+	length := int64(0)
+
+	for result := range generator.StartChecksumGeneration(&countingReader{r, &length}, 64, nil) {
+		if result.Err != nil {
+			return nil, result.Err
+		} else if result.Filechecksum != nil {
+			full.SHA1 = result.Filechecksum
+		}
+
+		checksums = append(checksums, result.Checksums...)
+	}
+
+	c := &ControlFile{
+		Filename:  options.Filename,
+		MTime:     options.MTime,
+		URLs:      options.URLs,
+		BlockSize: blockSize,
+		Length:    length,
+		SHA1:      full.SHA1,
+	}
+
+	c.SeqMatches, c.RsumBytes, c.ChecksumBytes = hashLengths(length, blockSize)
+
+	for _, chunk := range checksums {
+		chunk.WeakChecksum = chunk.WeakChecksum[4-c.RsumBytes:]
+		chunk.StrongChecksum = chunk.StrongChecksum[:c.ChecksumBytes]
+		c.Checksums = append(c.Checksums, chunk)
+	}
+
+	return c, nil
+}
+
+type countingReader struct {
+	r     io.Reader
+	count *int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	*c.count += int64(n)
+	return n, err
+}
+
+// the hash lengths chosen by zsyncmake for a file
+func hashLengths(length int64, blockSize uint) (seqMatches, rsumBytes, checksumBytes int) {
+	seqMatches = 1
+	if length > int64(blockSize) {
+		seqMatches = 2
+	}
+
+	l := math.Max(float64(length), 1)
+	b := float64(blockSize)
+	blocks := math.Floor(l / b)
+
+	rsumBytes = int(math.Ceil(((math.Log(l)+math.Log(b))/math.Log(2) - 8.6) / float64(seqMatches) / 8))
+	rsumBytes = clamp(rsumBytes, 2, 4)
+
+	checksumBytes = int(math.Ceil(
+		(20 + (math.Log(l)+math.Log(1+blocks))/math.Log(2)) / float64(seqMatches) / 8,
+	))
+
+	if minimum := int((7.9 + (20 + math.Log(1+blocks)/math.Log(2))) / 8); checksumBytes < minimum {
+		checksumBytes = minimum
+	}
+
+	checksumBytes = clamp(checksumBytes, 3, 16)
+	return
+}
+
+func clamp(v, min, max int) int {
+	if v < min {
+		return min
+	} else if v > max {
+		return max
+	}
+	return v
+}
+
+/*
+Summary describes the reference file of a control file, satisfying the FileSummary,
+FileChecksumSummary and ChecksumSummary interfaces of the gosync package.
+*/
+type Summary struct {
+	*ControlFile
+	*index.ChecksumIndex
+	filechecksum.ChecksumLookup
+}
+
+// Summary creates an index of the control file's checksums
+func (c *ControlFile) Summary() *Summary {
+	return &Summary{
+		ControlFile:    c,
+		ChecksumIndex:  index.MakeChecksumIndex(c.Checksums),
+		ChecksumLookup: chunks.StrongChecksumGetter(c.Checksums),
+	}
+}
+
+func (s *Summary) GetBlockSize() uint {
+	return s.ControlFile.BlockSize
+}
+
+func (s *Summary) GetBlockCount() uint {
+	return s.ControlFile.BlockCount()
+}
+
+func (s *Summary) GetFileSize() int64 {
+	return s.Length
+}
+
+// GetFileChecksum is the SHA-1 of the file, from the hash of NewChecksumGenerator
+func (s *Summary) GetFileChecksum() []byte {
+	return s.SHA1
+}
+
+func (s *Summary) GetSequentialMatches() int {
+	return s.SeqMatches
+}
@@ -0,0 +1,169 @@
+package zsync
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func randomData(seed int64, size int) []byte {
+	b := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+// the checksums of a block as zsyncmake calculates them, before truncation
+func zsyncmakeChecksums(block []byte, blockSize int) (rsum []byte, checksum []byte) {
+	padded := make([]byte, blockSize)
+	copy(padded, block)
+
+	var a, b uint16
+	for i, c := range padded {
+		a += uint16(c)
+		b += uint16(blockSize-i) * uint16(c)
+	}
+
+	h := newMD4()
+	h.Write(padded)
+
+	return []byte{byte(a >> 8), byte(a), byte(b >> 8), byte(b)}, h.Sum(nil)
+}
+
+func TestBuildMatchesZsyncmake(t *testing.T) {
+	const blockSize = 64
+	data := randomData(1, 10*blockSize+10)
+
+	c, err := Build(bytes.NewReader(data), blockSize, BuildOptions{Filename: "file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Length != int64(len(data)) || c.BlockCount() != 11 || len(c.Checksums) != 11 {
+		t.Fatalf("Unexpected length %v or block count %v", c.Length, len(c.Checksums))
+	}
+
+	if sum := sha1.Sum(data); !bytes.Equal(c.SHA1, sum[:]) {
+		t.Errorf("Unexpected SHA-1 %x", c.SHA1)
+	}
+
+	for i, chunk := range c.Checksums {
+		end := (i + 1) * blockSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		rsum, checksum := zsyncmakeChecksums(data[i*blockSize:end], blockSize)
+
+		if !bytes.Equal(chunk.WeakChecksum, rsum[4-c.RsumBytes:]) {
+			t.Errorf("Block %v had rsum %x, expected %x", i, chunk.WeakChecksum, rsum[4-c.RsumBytes:])
+		}
+
+		if !bytes.Equal(chunk.StrongChecksum, checksum[:c.ChecksumBytes]) {
+			t.Errorf("Block %v had checksum %x, expected %x", i, chunk.StrongChecksum, checksum[:c.ChecksumBytes])
+		}
+	}
+}
+
+func TestWriteAndRead(t *testing.T) {
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	c, err := Build(bytes.NewReader(randomData(2, 5000)), 1024, BuildOptions{
+		Filename: "file.iso",
+		MTime:    mtime,
+		URLs:     []string{"file.iso"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buffer := bytes.NewBuffer(nil)
+	if err := c.Write(buffer); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(buffer.String(), "zsync: 0.6.2\nFilename: file.iso\nMTime: Thu, 02 Jan 2020 03:04:05 +0000\n") {
+		t.Errorf("Unexpected header:\n%v", buffer.String()[:100])
+	}
+
+	read, err := Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read.MTime = read.MTime.UTC()
+	for i := range c.Checksums {
+		// not stored in the file
+		c.Checksums[i].Size = 0
+	}
+
+	if !reflect.DeepEqual(read, c) {
+		t.Errorf("Control file changed after writing and reading:\n%#v\n%#v", read, c)
+	}
+}
+
+func TestReadSkipsCompressedMap(t *testing.T) {
+	file := "zsync: 0.6.2\nBlocksize: 4\nLength: 5\nHash-Lengths: 1,2,3\nZ-Map2: 2\n" +
+		"12345678" + "URL: file\n\n" +
+		"abcde" + "fghij"
+
+	c, err := Read(strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(c.URLs, []string{"file"}) || len(c.Checksums) != 2 {
+		t.Errorf("Unexpected control file: %#v", c)
+	}
+
+	if string(c.Checksums[1].WeakChecksum) != "fg" || string(c.Checksums[1].StrongChecksum) != "hij" {
+		t.Errorf("Unexpected checksums: %#v", c.Checksums[1])
+	}
+}
+
+func TestReadInvalidFiles(t *testing.T) {
+	for _, file := range []string{
+		"G0S9NC",
+		"zsync: 0.6.2\nLength: 5\n\n",
+		"zsync: 0.6.2\nBlocksize: 4\nLength: 5\nHash-Lengths: 3,2,3\n\n",
+		"zsync: 0.6.2\nBlocksize: 4\nLength: 5\nHash-Lengths: 1,2,3\n\nabcde",
+		"zsync: 0.6.2\nBlocksize: 4\nLength: 5\nHash-Lengths: 1,2,3\n\nabcdefghijklmno",
+	} {
+		if _, err := Read(strings.NewReader(file)); err == nil {
+			t.Errorf("Expected an error reading %q", file)
+		}
+	}
+}
+
+func TestHashLengths(t *testing.T) {
+	for _, test := range []struct {
+		length    int64
+		blockSize uint
+	}{
+		{0, 2048},
+		{100, 2048},
+		{1 << 20, 2048},
+		{1 << 32, 4096},
+		{1 << 40, 4096},
+	} {
+		seq, rsum, checksum := hashLengths(test.length, test.blockSize)
+
+		if seq < 1 || seq > 2 || rsum < 2 || rsum > 4 || checksum < 3 || checksum > 16 {
+			t.Errorf("Invalid hash lengths for %v: %v,%v,%v", test.length, seq, rsum, checksum)
+		}
+	}
+
+	// a small file of one block
+	if seq, _, _ := hashLengths(100, 2048); seq != 1 {
+		t.Errorf("Expected single block matches for a small file")
+	}
+}
+
+func TestBuildRejectsBlockSizes(t *testing.T) {
+	if _, err := Build(bytes.NewReader(nil), 1000, BuildOptions{}); err == nil {
+		t.Error("Expected a block size that is not a power of two to be rejected")
+	}
+}
@@ -0,0 +1,91 @@
+package gosync
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Redundancy/go-sync/blocksources"
+	"github.com/Redundancy/go-sync/comparer"
+	"github.com/Redundancy/go-sync/zsync"
+)
+
+func makeTestZsyncSummary(t *testing.T, reference []byte, blockSize uint) *zsync.Summary {
+	c, err := zsync.Build(bytes.NewReader(reference), blockSize, zsync.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c.Summary()
+}
+
+func TestPatchFromZsync(t *testing.T) {
+	reference := []byte(randomString(10, 16*64+5))
+	local := append([]byte("inserted"), reference[:500]...)
+	local = append(local, reference[600:]...)
+
+	summary := makeTestZsyncSummary(t, reference, 64)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", contentModTime, bytes.NewReader(reference))
+	}))
+	defer server.Close()
+
+	source := newHttpSource(server.URL, summary, blocksources.HttpOptions{})
+	defer source.Close()
+
+	output := bytes.NewBuffer(nil)
+	rsync := &RSync{
+		Input:   bytes.NewReader(local),
+		Output:  output,
+		Source:  source,
+		Summary: summary,
+	}
+
+	if err := rsync.Patch(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(output.Bytes(), reference) {
+		t.Error("Patched output did not match the reference")
+	}
+
+	// the blocks that the removed bytes were in
+	if source.ReadBytes() > 3*64 {
+		t.Errorf("Read %v bytes, expected local blocks to be used", source.ReadBytes())
+	}
+}
+
+func TestPatchFromZsyncWithShortLastBlock(t *testing.T) {
+	reference := randomString(11, 3*16+3)
+	summary := makeTestZsyncSummary(t, []byte(reference), 16)
+
+	// the last block is matched from the local file, padded with zeros
+	rsync, output := makeTestRSync(summary, "not in the reference"+reference[3*16:], reference[:3*16])
+
+	if err := rsync.Patch(); err != nil {
+		t.Fatal(err)
+	}
+
+	if output.String() != reference {
+		t.Error("Patched output did not match the reference")
+	}
+}
+
+func TestSequentialMatchesAreRequired(t *testing.T) {
+	summary := makeTestZsyncSummary(t, []byte(randomString(12, 4*16)), 16)
+
+	spans := comparer.BlockSpanList{
+		{StartBlock: 0, EndBlock: 0, ComparisonStartOffset: 0},
+		{StartBlock: 1, EndBlock: 2, ComparisonStartOffset: 100},
+		{StartBlock: 3, EndBlock: 3, ComparisonStartOffset: 200},
+	}
+
+	result := requireSequentialMatches(spans, summary)
+
+	// a single block is only trusted at the end of the file
+	if len(result) != 2 || result[0].StartBlock != 1 || result[1].StartBlock != 3 {
+		t.Errorf("Unexpected spans: %v", result)
+	}
+}